@@ -0,0 +1,195 @@
+// Package client is a Go client of the peer-messenger API for bots and tests. Subscriptions survive
+// restarts of the server: they reconnect with backoff, resume where they stopped and fall back to long-polling
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"peer-messenger/internal/models"
+)
+
+// APIError is the error response of the server
+type APIError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// IsCode reports whether err is APIError with one of codes
+func IsCode(err error, codes ...string) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, code := range codes {
+		if apiErr.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Client calls the API on behalf of the user the token was issued to. It is safe for concurrent use
+type Client struct {
+	baseURL string
+	// HTTP sends requests. Streams are long-lived, so it must not have a total timeout
+	HTTP *http.Client
+
+	mux   sync.RWMutex
+	token string
+}
+
+// New creates the client, empty token is set later by Login
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTP:    &http.Client{},
+		token:   token,
+	}
+}
+
+// Register creates the user
+func (c *Client) Register(ctx context.Context, req models.RegisterRequest) error {
+	return c.call(ctx, http.MethodPost, "/register", req, nil)
+}
+
+// Login opens a new session of the user, further requests are sent with its token.
+// Sessions do not survive restarts of the server, so Rejoin of subscriptions is expected to log in again
+func (c *Client) Login(ctx context.Context, req models.LoginRequest) (models.LoginResponse, error) {
+	var resp models.LoginResponse
+	err := c.call(ctx, http.MethodPost, "/login", req, &resp)
+	if err != nil {
+		return resp, err
+	}
+
+	c.mux.Lock()
+	c.token = resp.Token
+	c.mux.Unlock()
+
+	return resp, nil
+}
+
+// Join joins the room, the returned subscription ID is what Subscribe takes
+func (c *Client) Join(ctx context.Context, req models.JoinChannelRequest) (models.JoinChannelResponse, error) {
+	var resp models.JoinChannelResponse
+	err := c.call(ctx, http.MethodPost, channelPath(req.ChannelName)+"/join", req, &resp)
+
+	return resp, err
+}
+
+// Leave leaves the room
+func (c *Client) Leave(ctx context.Context, channelName string) error {
+	return c.call(ctx, http.MethodPost, channelPath(channelName)+"/leave", nil, nil)
+}
+
+// Heartbeat keeps the member in the room once it sent the first one, the member is removed when they stop
+// for longer than the returned window
+func (c *Client) Heartbeat(ctx context.Context, channelName string) (models.LivenessResponse, error) {
+	var resp models.LivenessResponse
+	err := c.call(ctx, http.MethodPost, channelPath(channelName)+"/heartbeat", nil, &resp)
+
+	return resp, err
+}
+
+// SetTopology tells the room how the member connects to others, the hints say which peers to offer to
+func (c *Client) SetTopology(ctx context.Context, channelName string, topology models.Topology) (models.TopologyHints, error) {
+	var hints models.TopologyHints
+	err := c.call(ctx, http.MethodPut, channelPath(channelName)+"/topology", models.TopologyRequest{Topology: topology}, &hints)
+
+	return hints, err
+}
+
+// SendToPeer sends the message to another member of the room
+func (c *Client) SendToPeer(ctx context.Context, req models.SendToPeerRequest) error {
+	return c.call(ctx, http.MethodPost, "/peer/send", req, nil)
+}
+
+// SendBatch sends messages in one request, e.g. ICE candidates gathered at once. The response lists messages
+// that were not delivered
+func (c *Client) SendBatch(ctx context.Context, req models.SendBatchRequest) (models.SendBatchResponse, error) {
+	var resp models.SendBatchResponse
+	err := c.call(ctx, http.MethodPost, "/peer/send-batch", req, &resp)
+
+	return resp, err
+}
+
+func channelPath(channelName string) string {
+	return "/channels/" + url.PathEscape(channelName)
+}
+
+// call sends JSON request and decodes JSON response into out unless it is nil
+func (c *Client) call(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.send(ctx, method, path, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send returns the response of successful request, failed ones are returned as APIError
+func (c *Client) send(ctx context.Context, method, path string, body any, header http.Header) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.mux.RLock()
+	req.Header.Set("Authorization", c.token)
+	c.mux.RUnlock()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+
+		apiErr := &APIError{Status: resp.StatusCode}
+		raw, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(raw, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Message = strings.TrimSpace(string(raw))
+		}
+
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,439 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// State of the subscription reported to SubscribeOptions.OnState
+type State string
+
+const (
+	StateConnecting State = "connecting"
+	// StateStreaming is an open event stream
+	StateStreaming State = "streaming"
+	// StatePolling collects entities by long-polling after the event stream failed FallbackAfter times in a row
+	StatePolling State = "polling"
+	// StateBackoff waits before the next attempt
+	StateBackoff State = "backoff"
+	StateClosed  State = "closed"
+)
+
+// Stream end reasons after which the subscription is not resumed
+const (
+	EndRoomDeleted = "room deleted"
+	EndKicked      = "kicked"
+)
+
+// EndError is returned by Subscribe when the server ended the subscription for good
+type EndError struct {
+	Reason string
+}
+
+func (e *EndError) Error() string {
+	return "subscription ended: " + e.Reason
+}
+
+// codes of rejected resume tokens, the subscription ID is used instead of them
+var resumeTokenCodes = []string{"INVALID_RESUME_TOKEN", "RESUME_TOKEN_EXPIRED", "TOKEN_REPLAYED"}
+
+// codes telling that the server does not know the subscription anymore, e.g. after restart
+var lostSubscriptionCodes = []string{
+	"USER_NOT_IN_ROOM", "ROOM_NOT_FOUND", "INVALID_SUBSCRIPTION_ID", "LEGACY_SUBSCRIPTION_ID",
+}
+
+// recentIDsSize is the number of delivered entity IDs remembered to drop duplicates replayed on reconnect
+const recentIDsSize = 1024
+
+// SubscribeOptions tune reconnection, zero values take the defaults
+type SubscribeOptions struct {
+	// MinBackoff and MaxBackoff bound the exponentially growing wait between failed attempts, 500ms and 30s
+	// by default. Every wait is randomized between its half and full length, so clients do not reconnect in step
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is the number of failed attempts in a row Subscribe gives up after, 0 retries forever
+	MaxAttempts int
+	// FallbackAfter is the number of event stream failures in a row after which entities are long-polled,
+	// 3 by default, negative never falls back. The event stream is tried again after MaxBackoff of polling
+	FallbackAfter int
+	// PollInterval is the pause between long-poll requests, 1s by default
+	PollInterval time.Duration
+	// IdleTimeout drops the event stream that sent nothing, not even a heartbeat, for so long. 90s by default,
+	// it must be longer than the heartbeat interval of the server
+	IdleTimeout time.Duration
+	// Rejoin is called when the server no longer knows the subscription, e.g. after restart, and returns
+	// the subscription ID of the new join. Sessions are lost on restart too, so it usually calls Login
+	// before Join. Without it Subscribe returns the error
+	Rejoin func(ctx context.Context) (string, error)
+	// OnState is called on every change of the state, err is the failure that caused it if any
+	OnState func(state State, err error)
+}
+
+func (opts SubscribeOptions) withDefaults() SubscribeOptions {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.FallbackAfter == 0 {
+		opts.FallbackAfter = 3
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 90 * time.Second
+	}
+
+	return opts
+}
+
+// Subscribe passes entities of the subscription to the room to handle until ctx is cancelled or the server ends
+// the subscription with EndError. Broken streams are resumed with the resume token and the last entity ID,
+// so entities are neither lost nor handled twice. handle is called from a single goroutine
+func (c *Client) Subscribe(
+	ctx context.Context, channelName, subscriptionID string, opts SubscribeOptions, handle func(models.ChannelEntity),
+) error {
+	s := &subscriber{
+		client:         c,
+		channelName:    channelName,
+		opts:           opts.withDefaults(),
+		handle:         handle,
+		subscriptionID: subscriptionID,
+		recent:         newRecentIDs(recentIDsSize),
+	}
+
+	return s.run(ctx)
+}
+
+type subscriber struct {
+	client *Client
+	opts   SubscribeOptions
+	handle func(models.ChannelEntity)
+
+	channelName    string
+	subscriptionID string
+	// resumeToken is the fresh token sent by the last stream, empty until the first one
+	resumeToken string
+	// lastID is the greatest entity ID handled, the server replays entities after it
+	lastID uint64
+	recent *recentIDs
+	state  State
+}
+
+func (s *subscriber) run(ctx context.Context) error {
+	failures, streamFailures := 0, 0
+	for {
+		var (
+			progressed bool
+			err        error
+		)
+		if s.opts.FallbackAfter > 0 && streamFailures >= s.opts.FallbackAfter {
+			progressed, err = s.poll(ctx)
+			streamFailures = 0
+		} else {
+			progressed, err = s.stream(ctx)
+			if progressed {
+				streamFailures = 0
+			} else if err != nil {
+				streamFailures++
+			}
+		}
+
+		if ctx.Err() != nil {
+			s.setState(StateClosed, nil)
+			return ctx.Err()
+		}
+
+		retry, err := s.recover(ctx, err)
+		if !retry {
+			s.setState(StateClosed, err)
+			return err
+		}
+
+		if progressed {
+			failures = 0
+		} else if err != nil {
+			failures++
+		}
+		if s.opts.MaxAttempts > 0 && failures >= s.opts.MaxAttempts {
+			s.setState(StateClosed, err)
+			return err
+		}
+
+		if err == nil {
+			continue
+		}
+
+		s.setState(StateBackoff, err)
+		select {
+		case <-time.After(s.backoff(failures)):
+		case <-ctx.Done():
+			s.setState(StateClosed, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+// recover decides whether the failed attempt is retried. Rejected resume tokens and lost subscriptions are
+// fixed here, the returned error is nil when the next attempt may start at once
+func (s *subscriber) recover(ctx context.Context, err error) (retry bool, _ error) {
+	var (
+		apiErr *APIError
+		endErr *EndError
+	)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &endErr):
+		return false, err
+	case IsCode(err, resumeTokenCodes...) && s.resumeToken != "":
+		s.resumeToken = ""
+		return true, nil
+	case IsCode(err, lostSubscriptionCodes...):
+		if s.opts.Rejoin == nil {
+			return false, err
+		}
+
+		subscriptionID, err := s.opts.Rejoin(ctx)
+		if err != nil {
+			return true, err
+		}
+
+		// entity IDs of the new join start over
+		s.subscriptionID, s.resumeToken, s.lastID = subscriptionID, "", 0
+		s.recent = newRecentIDs(recentIDsSize)
+
+		return true, nil
+	case errors.As(err, &apiErr):
+		// throttled and unavailable servers are retried, other rejections would be rejected again
+		retry = apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= http.StatusInternalServerError
+		return retry, err
+	default:
+		return true, err
+	}
+}
+
+// backoff grows exponentially with failures up to MaxBackoff, randomized between its half and full length
+func (s *subscriber) backoff(failures int) time.Duration {
+	wait := s.opts.MinBackoff
+	for i := 1; i < failures && wait < s.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, s.opts.MaxBackoff)
+
+	half := wait / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// stream reads the event stream until it ends. progressed tells whether the stream was opened,
+// stream ended by the server is nil error unless it must not be resumed
+func (s *subscriber) stream(ctx context.Context) (progressed bool, err error) {
+	s.setState(StateConnecting, nil)
+
+	query := url.Values{}
+	if s.resumeToken != "" {
+		query.Set("resumeToken", s.resumeToken)
+	} else {
+		query.Set("subscriptionID", s.subscriptionID)
+	}
+	header := http.Header{}
+	if s.lastID > 0 {
+		header.Set("Last-Event-ID", strconv.FormatUint(s.lastID, 10))
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := s.client.send(streamCtx, http.MethodGet, channelPath(s.channelName)+"/events?"+query.Encode(), nil, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	s.setState(StateStreaming, nil)
+
+	// the stream silent for longer than IdleTimeout is dead, e.g. the server vanished without closing it
+	idle := time.AfterFunc(s.opts.IdleTimeout, cancel)
+	defer idle.Stop()
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 4<<20)
+	for scanner.Scan() {
+		idle.Reset(s.opts.IdleTimeout)
+
+		line := scanner.Text()
+		if line != "" {
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if data != "" {
+					data += "\n"
+				}
+				data += value
+			}
+			continue
+		}
+
+		err = s.dispatch(event, data)
+		if err != nil {
+			return true, err
+		}
+		event, data = "", ""
+	}
+
+	err = scanner.Err()
+	if err != nil && ctx.Err() == nil && streamCtx.Err() != nil {
+		err = errors.New("event stream is idle")
+	}
+
+	return true, err
+}
+
+// dispatch handles one server-sent event. The end event is an error only for subscriptions that are over
+func (s *subscriber) dispatch(event, data string) error {
+	switch event {
+	case "message":
+		var entity models.ChannelEntity
+		err := json.Unmarshal([]byte(data), &entity)
+		if err != nil {
+			return err
+		}
+		s.deliver(entity)
+	case "batch":
+		var entities []models.ChannelEntity
+		err := json.Unmarshal([]byte(data), &entities)
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			s.deliver(entity)
+		}
+	case "resume":
+		var resume struct {
+			ResumeToken string `json:"resumeToken"`
+		}
+		err := json.Unmarshal([]byte(data), &resume)
+		if err != nil {
+			return err
+		}
+		s.resumeToken = resume.ResumeToken
+	case "end":
+		var end struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.Unmarshal([]byte(data), &end)
+		if end.Reason == EndRoomDeleted || end.Reason == EndKicked {
+			return &EndError{Reason: end.Reason}
+		}
+	}
+
+	return nil
+}
+
+// poll collects entities for MaxBackoff before the event stream is tried again
+func (s *subscriber) poll(ctx context.Context) (progressed bool, err error) {
+	s.setState(StatePolling, nil)
+
+	path := "/channel/collect?" + url.Values{"subscriptionID": {s.subscriptionID}}.Encode()
+	rounds := max(1, int(s.opts.MaxBackoff/s.opts.PollInterval))
+	for i := 0; i < rounds; i++ {
+		var resp struct {
+			Entities []models.ChannelEntity `json:"entities"`
+		}
+		err = s.client.call(ctx, http.MethodPost, path, nil, &resp)
+		if err != nil {
+			return progressed, err
+		}
+		progressed = true
+
+		for _, entity := range resp.Entities {
+			s.deliver(entity)
+		}
+
+		select {
+		case <-time.After(s.opts.PollInterval):
+		case <-ctx.Done():
+			return progressed, ctx.Err()
+		}
+	}
+
+	return progressed, nil
+}
+
+// deliver hands the entity over unless it was handled already, e.g. replayed after reconnect
+func (s *subscriber) deliver(entity models.ChannelEntity) {
+	if !s.recent.add(entity.ID) {
+		return
+	}
+
+	s.lastID = max(s.lastID, entity.ID)
+
+	// reconnect farewell of the shutting down server carries the token resuming the stream on another instance
+	if entity.ActionType == models.Reconnect {
+		var farewell struct {
+			ResumeToken string `json:"resumeToken"`
+		}
+		if json.Unmarshal(entity.Data, &farewell) == nil && farewell.ResumeToken != "" {
+			s.resumeToken = farewell.ResumeToken
+		}
+	}
+
+	s.handle(entity)
+}
+
+func (s *subscriber) setState(state State, err error) {
+	if state == s.state && err == nil {
+		return
+	}
+
+	s.state = state
+	if s.opts.OnState != nil {
+		s.opts.OnState(state, err)
+	}
+}
+
+// recentIDs remembers the last size entity IDs. Entities of a batch are ordered by priority, not by ID,
+// so the greatest ID alone can't tell whether an entity was handled
+type recentIDs struct {
+	ring []uint64
+	next int
+	set  map[uint64]struct{}
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{
+		ring: make([]uint64, size),
+		set:  make(map[uint64]struct{}, size),
+	}
+}
+
+// add reports whether id is new, the oldest remembered ID is forgotten when the ring is full
+func (r *recentIDs) add(id uint64) bool {
+	if _, ok := r.set[id]; ok {
+		return false
+	}
+
+	delete(r.set, r.ring[r.next])
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.set[id] = struct{}{}
+
+	return true
+}
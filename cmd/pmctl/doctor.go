@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logRoomKeys are log fields the server puts room name in
+var logRoomKeys = []string{"room", "room name"}
+
+// timelineEvent is one line of the doctor report
+type timelineEvent struct {
+	Time    time.Time
+	Kind    string
+	Summary string
+	// Fields are the remaining log fields, e.g. user and peer of a failed connection
+	Fields map[string]any
+}
+
+// bundleRoom is the part of the room state in a support bundle the doctor reports on
+type bundleRoom struct {
+	Name               string         `json:"name"`
+	TotalUsers         int            `json:"totalUsers"`
+	ConnectionFailures map[string]int `json:"connectionFailures"`
+}
+
+type deadLetter struct {
+	Time        time.Time `json:"time"`
+	RecipientID string    `json:"recipientID"`
+	SenderID    string    `json:"senderID"`
+	ActionType  string    `json:"actionType"`
+	Reason      string    `json:"reason"`
+}
+
+func newDoctorCmd(client func() *adminClient) *cobra.Command {
+	var (
+		bundlePath string
+		since      time.Duration
+		from, to   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "doctor ROOM",
+		Short: "Explain why a call failed: timeline of audit, delivery, eviction and connection events of the room",
+		Long: "doctor correlates the server log ring, room state and dead letters of the room into a single timeline. " +
+			"The server keeps only recent logs, run it soon after the failure or save a support bundle and pass it with --bundle",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			end := time.Now()
+			start := end.Add(-since)
+			var err error
+			if from != "" {
+				start, err = time.Parse(time.RFC3339, from)
+				if err != nil {
+					return fmt.Errorf("--from: %w", err)
+				}
+			}
+			if to != "" {
+				end, err = time.Parse(time.RFC3339, to)
+				if err != nil {
+					return fmt.Errorf("--to: %w", err)
+				}
+			}
+
+			var bundle []byte
+			if bundlePath != "" {
+				bundle, err = os.ReadFile(bundlePath)
+			} else {
+				bundle, err = client().get("/admin/support-bundle")
+			}
+			if err != nil {
+				return err
+			}
+
+			report, err := diagnose(bundle, args[0], start, end)
+			if err != nil {
+				return err
+			}
+
+			// dead letters are not part of the bundle, they are available only from the live server
+			if bundlePath == "" {
+				letters, err := fetchDeadLetters(client(), args[0])
+				if err != nil {
+					return err
+				}
+				report.addDeadLetters(letters)
+			}
+
+			return report.write(cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringVar(&bundlePath, "bundle", "", "read support bundle zip instead of fetching it from the server")
+	cmd.Flags().DurationVar(&since, "since", time.Hour, "how far back to look, ignored with --from")
+	cmd.Flags().StringVar(&from, "from", "", "start of the time range, RFC 3339")
+	cmd.Flags().StringVar(&to, "to", "", "end of the time range, RFC 3339, now by default")
+
+	return cmd
+}
+
+type doctorReport struct {
+	room  string
+	start time.Time
+	end   time.Time
+	// state is nil when the room no longer exists
+	state  *bundleRoom
+	events []timelineEvent
+}
+
+// diagnose extracts events of the room from the support bundle archive
+func diagnose(bundle []byte, room string, start, end time.Time) (*doctorReport, error) {
+	archive, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return nil, fmt.Errorf("read support bundle: %w", err)
+	}
+
+	report := &doctorReport{room: room, start: start, end: end}
+
+	logs, err := archive.Open("logs.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+
+	err = report.addLogs(logs)
+	if err != nil {
+		return nil, fmt.Errorf("read logs: %w", err)
+	}
+
+	raw, err := readZipFile(archive, "rooms.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []bundleRoom
+	err = json.Unmarshal(raw, &rooms)
+	if err != nil {
+		return nil, fmt.Errorf("read rooms: %w", err)
+	}
+	for i := range rooms {
+		if rooms[i].Name == room {
+			report.state = &rooms[i]
+		}
+	}
+
+	return report, nil
+}
+
+func (r *doctorReport) addLogs(logs io.Reader) error {
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		var fields map[string]any
+		if json.Unmarshal(scanner.Bytes(), &fields) != nil {
+			continue
+		}
+		if !r.logOfRoom(fields) {
+			continue
+		}
+
+		ts, _ := fields["ts"].(string)
+		at, err := time.Parse("2006-01-02T15:04:05.000Z0700", ts)
+		if err != nil || !r.inRange(at) {
+			continue
+		}
+
+		msg, _ := fields["msg"].(string)
+		for _, key := range append([]string{"ts", "msg", "level", "caller", "stacktrace"}, logRoomKeys...) {
+			delete(fields, key)
+		}
+
+		r.events = append(r.events, timelineEvent{Time: at, Kind: logKind(msg), Summary: msg, Fields: fields})
+	}
+
+	return scanner.Err()
+}
+
+func (r *doctorReport) logOfRoom(fields map[string]any) bool {
+	for _, key := range logRoomKeys {
+		if fields[key] == r.room {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *doctorReport) addDeadLetters(letters []deadLetter) {
+	for _, letter := range letters {
+		if !r.inRange(letter.Time) {
+			continue
+		}
+
+		r.events = append(r.events, timelineEvent{
+			Time:    letter.Time,
+			Kind:    "delivery",
+			Summary: "entity was not delivered: " + letter.Reason,
+			Fields: map[string]any{
+				"recipient":  letter.RecipientID,
+				"sender":     letter.SenderID,
+				"actionType": letter.ActionType,
+			},
+		})
+	}
+}
+
+func (r *doctorReport) inRange(t time.Time) bool {
+	return !t.Before(r.start) && !t.After(r.end)
+}
+
+// logKind groups server log messages the way operators ask about them
+func logKind(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "audit:"):
+		return "audit"
+	case strings.Contains(msg, "evict"), strings.Contains(msg, "inactive"), strings.Contains(msg, "removed"):
+		return "eviction"
+	case strings.Contains(msg, "connection"), strings.Contains(msg, "sdp"), strings.Contains(msg, "SDP"):
+		return "connection"
+	case strings.Contains(msg, "deliver"), strings.Contains(msg, "queue"), strings.Contains(msg, "busy"):
+		return "delivery"
+	default:
+		return "log"
+	}
+}
+
+func (r *doctorReport) write(out io.Writer) error {
+	sort.SliceStable(r.events, func(i, j int) bool { return r.events[i].Time.Before(r.events[j].Time) })
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "room %s, %s .. %s\n", r.room, r.start.Format(time.RFC3339), r.end.Format(time.RFC3339))
+	if r.state == nil {
+		fmt.Fprintln(w, "room does not exist now")
+	} else {
+		fmt.Fprintf(w, "users now: %d\n", r.state.TotalUsers)
+		for stage, count := range r.state.ConnectionFailures {
+			fmt.Fprintf(w, "failed connections at %s stage: %d\n", stage, count)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, event := range r.events {
+		counts[event.Kind]++
+	}
+	fmt.Fprintf(w, "events: %d audit, %d connection, %d eviction, %d delivery, %d other\n\n",
+		counts["audit"], counts["connection"], counts["eviction"], counts["delivery"], counts["log"])
+
+	if len(r.events) == 0 {
+		fmt.Fprintln(w, "no events in the range, the server log ring may have rotated them out")
+	}
+	for _, event := range r.events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			event.Time.UTC().Format("15:04:05.000"), event.Kind, event.Summary, formatFields(event.Fields))
+	}
+
+	return w.Flush()
+}
+
+func formatFields(fields map[string]any) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, fields[key]))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func fetchDeadLetters(client *adminClient, room string) ([]deadLetter, error) {
+	raw, err := client.get("/admin/dead-letters?" + url.Values{"room": {room}}.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		DeadLetters []deadLetter `json:"deadLetters"`
+	}
+	err = json.Unmarshal(raw, &resp)
+
+	return resp.DeadLetters, err
+}
+
+func readZipFile(archive *zip.Reader, name string) ([]byte, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
@@ -0,0 +1,220 @@
+// pmctl is an operator CLI for the peer-messenger admin API
+package main
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	var (
+		addr   string
+		token  string
+		client *adminClient
+	)
+
+	root := &cobra.Command{
+		Use:          "pmctl",
+		Short:        "Operate a peer-messenger server through its admin API",
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			client = newAdminClient(addr, token)
+		},
+	}
+
+	root.PersistentFlags().StringVar(&addr, "addr", envOr("PMCTL_ADDR", "http://localhost:8080"), "server address")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("PMCTL_TOKEN"), "admin token")
+
+	getClient := func() *adminClient { return client }
+
+	root.AddCommand(
+		newRoomsCmd(getClient),
+		newUsersCmd(getClient),
+		newLogLevelCmd(getClient),
+		newEventsCmd(getClient),
+		newDeadLettersCmd(getClient),
+		newDoctorCmd(getClient),
+	)
+
+	return root
+}
+
+func newRoomsCmd(client func() *adminClient) *cobra.Command {
+	rooms := &cobra.Command{
+		Use:   "rooms",
+		Short: "Inspect and delete rooms",
+	}
+
+	rooms.AddCommand(
+		newRoomsListCmd(client),
+		&cobra.Command{
+			Use:   "inspect ROOM",
+			Short: "Show room state",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return client().do("GET", roomPath(args[0]), nil, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "delete ROOM",
+			Short: "Delete room disconnecting all its users",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return client().do("DELETE", roomPath(args[0]), nil, cmd.OutOrStdout())
+			},
+		},
+	)
+
+	return rooms
+}
+
+func newRoomsListCmd(client func() *adminClient) *cobra.Command {
+	var (
+		cursor, prefix  string
+		limit, minUsers int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List rooms with their users page by page",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{}
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+			if prefix != "" {
+				query.Set("prefix", prefix)
+			}
+			if limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			if minUsers > 0 {
+				query.Set("minUsers", strconv.Itoa(minUsers))
+			}
+
+			return client().do("GET", "/admin/rooms?"+query.Encode(), nil, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringVar(&cursor, "cursor", "", "nextCursor of the previous page")
+	cmd.Flags().StringVar(&prefix, "prefix", "", "filter by room name prefix")
+	cmd.Flags().IntVar(&limit, "limit", 0, "page size")
+	cmd.Flags().IntVar(&minUsers, "min-users", 0, "filter by minimal number of users")
+
+	return cmd
+}
+
+func newUsersCmd(client func() *adminClient) *cobra.Command {
+	users := &cobra.Command{
+		Use:   "users",
+		Short: "Moderate room users",
+	}
+
+	users.AddCommand(
+		&cobra.Command{
+			Use:   "inspect USER",
+			Short: "Show user memberships and pending entities (audited)",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return client().do("GET", "/admin/users/"+url.PathEscape(args[0]), nil, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "kick ROOM USER",
+			Short: "Remove user from room",
+			Args:  cobra.ExactArgs(2),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return client().do("DELETE", roomPath(args[0])+"/users/"+args[1], nil, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "ban ROOM USER",
+			Short: "Remove user from room and forbid joining it again",
+			Args:  cobra.ExactArgs(2),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				body := map[string]string{"userID": args[1]}
+				return client().do("POST", roomPath(args[0])+"/bans", body, cmd.OutOrStdout())
+			},
+		},
+	)
+
+	return users
+}
+
+func newLogLevelCmd(client func() *adminClient) *cobra.Command {
+	return &cobra.Command{
+		Use:   "log-level [LEVEL]",
+		Short: "Show or change server log level",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return client().do("GET", "/admin/log-level", nil, cmd.OutOrStdout())
+			}
+
+			body := map[string]string{"level": args[0]}
+			return client().do("PUT", "/admin/log-level", body, cmd.OutOrStdout())
+		},
+	}
+}
+
+func newEventsCmd(client func() *adminClient) *cobra.Command {
+	events := &cobra.Command{
+		Use:   "events",
+		Short: "Admin event stream",
+	}
+
+	events.AddCommand(&cobra.Command{
+		Use:   "tail",
+		Short: "Print admin events as they happen",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return client().stream("/admin/events", cmd.OutOrStdout())
+		},
+	})
+
+	return events
+}
+
+func newDeadLettersCmd(client func() *adminClient) *cobra.Command {
+	var room, user string
+
+	cmd := &cobra.Command{
+		Use:   "dead-letters",
+		Short: "List entities that were never delivered",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{}
+			if room != "" {
+				query.Set("room", room)
+			}
+			if user != "" {
+				query.Set("user", user)
+			}
+
+			return client().do("GET", "/admin/dead-letters?"+query.Encode(), nil, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().StringVar(&room, "room", "", "filter by room")
+	cmd.Flags().StringVar(&user, "user", "", "filter by recipient")
+
+	return cmd
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
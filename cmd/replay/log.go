@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+type opKind string
+
+const (
+	opJoin  opKind = "join"
+	opSend  opKind = "send"
+	opLeave opKind = "leave"
+)
+
+// op is a user action reconstructed from the log
+type op struct {
+	Time time.Time
+	Kind opKind
+	Room string
+	User string
+	// Dest and EntityID are set for sends
+	Dest     string
+	EntityID uint64
+}
+
+// logLine holds the fields of server log lines the replay understands
+type logLine struct {
+	Time     time.Time         `json:"ts"`
+	Msg      string            `json:"msg"`
+	Room     string            `json:"room"`
+	Rooms    []string          `json:"rooms"`
+	User     string            `json:"user"`
+	Dest     string            `json:"dest"`
+	Device   bool              `json:"another device"`
+	Action   models.ActionType `json:"action type"`
+	EntityID uint64            `json:"entity id"`
+	// Latency of delivery in seconds, the send happened that much before the line
+	Latency float64 `json:"latency"`
+}
+
+// readOps parses JSON lines of the server log. Joins and leaves come from audit lines, sends from delivery
+// lines of peer messages. Other and malformed lines are skipped and counted
+func readOps(r io.Reader) (ops []op, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var line logLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil || line.Time.IsZero() {
+			skipped++
+			continue
+		}
+
+		parsed := line.ops()
+		if parsed == nil {
+			skipped++
+		}
+		ops = append(ops, parsed...)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("read log: %w", err)
+	}
+
+	return ops, skipped, nil
+}
+
+func (line logLine) ops() []op {
+	switch line.Msg {
+	case "audit: user joined room":
+		// other devices of the member do not join again
+		if line.Device {
+			return nil
+		}
+		return []op{{Time: line.Time, Kind: opJoin, Room: line.Room, User: line.User}}
+	case "audit: user left room", "audit: disconnected user left room", "audit: lapsed user left room":
+		return []op{{Time: line.Time, Kind: opLeave, Room: line.Room, User: line.User}}
+	case "audit: user left all rooms", "audit: user logged out":
+		ops := make([]op, 0, len(line.Rooms))
+		for _, room := range line.Rooms {
+			ops = append(ops, op{Time: line.Time, Kind: opLeave, Room: room, User: line.User})
+		}
+		return ops
+	case "entity delivered":
+		// echoes are delivered to the sender too, the message was sent once
+		if line.Action != models.Message || line.User == "" || line.User == line.Dest {
+			return nil
+		}
+		sent := line.Time.Add(-time.Duration(line.Latency * float64(time.Second)))
+		return []op{{Time: sent, Kind: opSend, Room: line.Room, User: line.User, Dest: line.Dest, EntityID: line.EntityID}}
+	default:
+		return nil
+	}
+}
+
+// sortOps orders ops by time, ops logged at the same time keep the order of the log
+func sortOps(ops []op) {
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Time.Before(ops[j].Time)
+	})
+}
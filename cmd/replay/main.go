@@ -0,0 +1,93 @@
+// replay reproduces the join, send and leave sequence captured in server logs against a test server.
+// It reads JSON log lines: audit lines give joins and leaves, delivery lines give peer messages, so the server
+// must log deliveries with observability.deliveryLogSampleRate 1 for every message to be replayed
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	opts := replayOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "replay [LOG...]",
+		Short: "Replay joins, messages and leaves from server logs against a test server",
+		Long: "replay orders the ops found in the logs by time and sends them one by one with the same gaps " +
+			"scaled by --speed. Users are registered with --password and logged in on first use. " +
+			"Message payloads are not logged, replayed messages carry the ID of the original entity instead. " +
+			"Logs are read from stdin when no file is given",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.Speed < 0 {
+				return errors.New("speed must not be negative")
+			}
+
+			ops, skipped, err := readLogs(cmd.InOrStdin(), args)
+			if err != nil {
+				return err
+			}
+			sortOps(ops)
+			fmt.Fprintf(cmd.ErrOrStderr(), "replaying %d ops, %d log lines skipped\n", len(ops), skipped)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			r := newReplayer(opts, cmd.ErrOrStderr())
+			err = r.run(ctx, ops)
+			if err != nil {
+				return err
+			}
+			if r.failed > 0 {
+				return fmt.Errorf("%d of %d ops failed", r.failed, len(ops))
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Addr, "addr", "http://localhost:8080", "address of the test server")
+	cmd.Flags().StringVar(&opts.Password, "password", "replay-password", "password of replayed users")
+	cmd.Flags().Float64Var(&opts.Speed, "speed", 1, "pace relative to the log, 0 replays without waiting")
+	cmd.Flags().StringVar(&opts.RoomPrefix, "room-prefix", "", "prefix of replayed room names")
+	cmd.Flags().BoolVar(&opts.Subscribe, "subscribe", true, "keep event streams of members open")
+
+	return cmd
+}
+
+// readLogs reads ops from the files in order, or from stdin without files
+func readLogs(stdin io.Reader, paths []string) (ops []op, skipped int, err error) {
+	if len(paths) == 0 {
+		return readOps(stdin)
+	}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		fileOps, fileSkipped, err := readOps(file)
+		file.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", path, err)
+		}
+
+		ops = append(ops, fileOps...)
+		skipped += fileSkipped
+	}
+
+	return ops, skipped, nil
+}
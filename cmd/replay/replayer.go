@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"peer-messenger/client"
+	"peer-messenger/internal/models"
+)
+
+type replayOptions struct {
+	Addr     string
+	Password string
+	// Speed multiplies the pace of the log, 0 replays without waiting
+	Speed float64
+	// RoomPrefix is prepended to room names, so replays do not collide with each other
+	RoomPrefix string
+	// Subscribe keeps event streams of members open, as clients in production do
+	Subscribe bool
+}
+
+// replayer sends ops one by one, so their order on the server is the order of the log
+type replayer struct {
+	opts  replayOptions
+	out   io.Writer
+	users map[string]*client.Client
+	// members are cancel functions of the streams of joined members by room and user
+	members map[[2]string]context.CancelFunc
+	failed  int
+}
+
+func newReplayer(opts replayOptions, out io.Writer) *replayer {
+	return &replayer{
+		opts:    opts,
+		out:     out,
+		users:   make(map[string]*client.Client),
+		members: make(map[[2]string]context.CancelFunc),
+	}
+}
+
+// run replays ops keeping the gaps between them scaled by speed. Failed ops are reported and skipped,
+// the replay goes on: rejections are usually what is being reproduced
+func (r *replayer) run(ctx context.Context, ops []op) error {
+	defer r.leaveAll()
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	started, first := time.Now(), ops[0].Time
+	for _, next := range ops {
+		if r.opts.Speed > 0 {
+			due := started.Add(time.Duration(float64(next.Time.Sub(first)) / r.opts.Speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := r.apply(ctx, next)
+		if err != nil {
+			r.failed++
+			fmt.Fprintf(r.out, "%s %s %s/%s: %v\n",
+				next.Time.Format(time.RFC3339Nano), next.Kind, next.Room, next.User, err,
+			)
+		}
+	}
+
+	return nil
+}
+
+func (r *replayer) apply(ctx context.Context, next op) error {
+	room := r.opts.RoomPrefix + next.Room
+	key := [2]string{room, next.User}
+
+	switch next.Kind {
+	case opJoin:
+		if _, ok := r.members[key]; ok {
+			return nil
+		}
+
+		c, err := r.user(ctx, next.User)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.Join(ctx, models.JoinChannelRequest{ChannelName: room})
+		if err != nil {
+			return err
+		}
+		r.members[key] = r.subscribe(c, room, resp.SubscriptionID)
+
+		return nil
+	case opLeave:
+		// leaves are logged by several lines, e.g. disconnect and logout, the member leaves once
+		stop, ok := r.members[key]
+		if !ok {
+			return nil
+		}
+		delete(r.members, key)
+		stop()
+
+		return r.users[next.User].Leave(ctx, room)
+	case opSend:
+		c, err := r.user(ctx, next.User)
+		if err != nil {
+			return err
+		}
+
+		// payloads are never logged, the message names the entity it stands for instead
+		return c.SendToPeer(ctx, models.SendToPeerRequest{
+			ChannelName:       room,
+			DestinationUserID: next.Dest,
+			Message:           map[string]any{"replayedEntityID": next.EntityID},
+		})
+	default:
+		return fmt.Errorf("unknown op %q", next.Kind)
+	}
+}
+
+// user returns the client of the logged in user, registering the user on first use
+func (r *replayer) user(ctx context.Context, userID string) (*client.Client, error) {
+	if c, ok := r.users[userID]; ok {
+		return c, nil
+	}
+
+	c := client.New(r.opts.Addr, "")
+	err := c.Register(ctx, models.RegisterRequest{UserID: userID, Password: r.opts.Password})
+	if err != nil && !client.IsCode(err, "USER_ALREADY_EXISTS") {
+		return nil, fmt.Errorf("register: %w", err)
+	}
+
+	_, err = c.Login(ctx, models.LoginRequest{UserID: userID, Password: r.opts.Password, Device: "replay"})
+	if err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	r.users[userID] = c
+
+	return c, nil
+}
+
+// subscribe opens the event stream of the member when enabled and returns the function closing it
+func (r *replayer) subscribe(c *client.Client, room, subscriptionID string) context.CancelFunc {
+	if !r.opts.Subscribe {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = c.Subscribe(ctx, room, subscriptionID, client.SubscribeOptions{FallbackAfter: -1}, func(models.ChannelEntity) {})
+	}()
+
+	return cancel
+}
+
+// leaveAll makes members still in rooms at the end of the log leave, so the server is left as it was found
+func (r *replayer) leaveAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for key, stop := range r.members {
+		stop()
+		_ = r.users[key[1]].Leave(ctx, key[0])
+	}
+	r.members = make(map[[2]string]context.CancelFunc)
+}
@@ -0,0 +1,138 @@
+// Package accesslog writes one line per served request in a format standard log pipelines parse,
+// apart from the application log
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatJSON writes JSON Lines
+	FormatJSON = "json"
+	// FormatApache writes Apache combined log format followed by latency in microseconds, request ID, room
+	// and traffic class
+	FormatApache = "apache"
+)
+
+// Entry describes a served request
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"requestID"`
+	RemoteIP  string        `json:"remoteIP"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int           `json:"bytes"`
+	Latency   time.Duration `json:"-"`
+	User      string        `json:"user,omitempty"`
+	Room      string        `json:"room,omitempty"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+	// Traffic is the class of the request, e.g. public or canary
+	Traffic string `json:"traffic,omitempty"`
+}
+
+// jsonEntry adds latency in milliseconds, the unit dashboards of log pipelines expect
+type jsonEntry struct {
+	Entry
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// Logger writes entries to w, writes are serialized by w
+type Logger struct {
+	w      io.Writer
+	format string
+}
+
+func New(w io.Writer, format string) (*Logger, error) {
+	switch format {
+	case FormatJSON, FormatApache:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	return &Logger{w: w, format: format}, nil
+}
+
+// Log writes entry as one line
+func (l *Logger) Log(entry Entry) error {
+	var line []byte
+	if l.format == FormatApache {
+		line = apacheLine(entry)
+	} else {
+		var err error
+		line, err = json.Marshal(jsonEntry{Entry: entry, LatencyMs: float64(entry.Latency.Microseconds()) / 1000})
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	}
+
+	_, err := l.w.Write(line)
+
+	return err
+}
+
+// apacheLine renders %h - %u [%t] "%r" %>s %b "%{Referer}i" "%{User-Agent}i" %D "%{X-Request-ID}o" "room" "traffic"
+func apacheLine(entry Entry) []byte {
+	bytesSent := "-"
+	if entry.Bytes > 0 {
+		bytesSent = strconv.Itoa(entry.Bytes)
+	}
+
+	var b strings.Builder
+	b.WriteString(dash(entry.RemoteIP))
+	b.WriteString(" - ")
+	b.WriteString(dash(strings.ReplaceAll(entry.User, " ", "_")))
+	b.WriteString(" [")
+	b.WriteString(entry.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	b.WriteString(quote(entry.Method + " " + entry.Path + " " + entry.Proto))
+	fmt.Fprintf(&b, " %d %s ", entry.Status, bytesSent)
+	b.WriteString(quote(dash(entry.Referer)))
+	b.WriteByte(' ')
+	b.WriteString(quote(dash(entry.UserAgent)))
+	fmt.Fprintf(&b, " %d ", entry.Latency.Microseconds())
+	b.WriteString(quote(dash(entry.RequestID)))
+	b.WriteByte(' ')
+	b.WriteString(quote(dash(entry.Room)))
+	b.WriteByte(' ')
+	b.WriteString(quote(dash(entry.Traffic)))
+	b.WriteByte('\n')
+
+	return []byte(b.String())
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// quote escapes quotes, backslashes and control characters the way Apache does, so user input can't break the line
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
@@ -0,0 +1,194 @@
+// Package authlimit protects login and registration from brute force. Every client IP and every user ID
+// has a token bucket, and failed attempts lock the key out for a backoff doubling with each further failure
+package authlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"peer-messenger/internal/metrics"
+)
+
+const (
+	ScopeIP   = "ip"
+	ScopeUser = "user"
+
+	// pruneInterval is how often keys left alone are forgotten
+	pruneInterval = time.Minute
+)
+
+var ErrThrottled = errors.New("too many authentication attempts")
+
+// ThrottledError rejects attempt of the locked out or too frequent key
+type ThrottledError struct {
+	// RetryAfter is the time until the next attempt is allowed
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrThrottled, e.RetryAfter)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
+
+type Options struct {
+	// Rate is the number of attempts per second of every key, Burst is the number of attempts at once
+	Rate  float64
+	Burst int
+	// FreeFailures is the number of consecutive failures before the first lockout
+	FreeFailures int
+	// BaseBackoff is the first lockout, it doubles with every further failure up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Key is an IP or user ID attempts are limited by
+type Key struct {
+	Scope string
+	Value string
+}
+
+type keyState struct {
+	limiter *rate.Limiter
+	// failures are consecutive failed attempts, success resets them
+	failures    int
+	lockedUntil time.Time
+	// lockouts count all lockouts of the key, they are logged to spot targeted accounts
+	lockouts int
+	lastSeen time.Time
+}
+
+// Limiter keeps state of keys attempted recently
+type Limiter struct {
+	logger  *zap.Logger
+	metrics *metrics.Metrics
+	opts    Options
+
+	mux  *sync.Mutex
+	keys map[Key]*keyState
+}
+
+func New(logger *zap.Logger, metrics *metrics.Metrics, opts Options) *Limiter {
+	return &Limiter{
+		logger:  logger,
+		metrics: metrics,
+		opts:    opts,
+		mux:     &sync.Mutex{},
+		keys:    make(map[Key]*keyState),
+	}
+}
+
+// Allow takes a token of every key, an error says when to retry if any of them is locked out or out of tokens
+func (l *Limiter) Allow(now time.Time, keys ...Key) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var retryAfter time.Duration
+	var throttled string
+	for _, key := range keys {
+		state := l.state(key, now)
+
+		wait := state.lockedUntil.Sub(now)
+		if wait <= 0 {
+			reservation := state.limiter.ReserveN(now, 1)
+			wait = reservation.DelayFrom(now)
+			if wait > 0 {
+				reservation.CancelAt(now)
+			}
+		}
+		if wait > retryAfter {
+			retryAfter, throttled = wait, key.Scope
+		}
+	}
+
+	if retryAfter > 0 {
+		l.metrics.AuthThrottled.WithLabelValues(throttled).Inc()
+		return &ThrottledError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Failed counts failed attempt of every key, keys failed more than FreeFailures times in a row are locked out
+func (l *Limiter) Failed(now time.Time, keys ...Key) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for _, key := range keys {
+		state := l.state(key, now)
+		state.failures++
+		if state.failures <= l.opts.FreeFailures {
+			continue
+		}
+
+		backoff := l.opts.MaxBackoff
+		if shift := state.failures - l.opts.FreeFailures - 1; shift < 32 && l.opts.BaseBackoff<<shift < backoff {
+			backoff = l.opts.BaseBackoff << shift
+		}
+		state.lockedUntil = now.Add(backoff)
+		state.lockouts++
+
+		l.metrics.AuthLockouts.WithLabelValues(key.Scope).Inc()
+		l.logger.Warn("authentication locked out",
+			zap.String("scope", key.Scope), zap.String(key.Scope, key.Value), zap.Int("failures", state.failures),
+			zap.Int("lockouts", state.lockouts), zap.Duration("backoff", backoff),
+		)
+	}
+}
+
+// Succeeded resets consecutive failures of every key, lockouts stay counted
+func (l *Limiter) Succeeded(now time.Time, keys ...Key) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for _, key := range keys {
+		l.state(key, now).failures = 0
+	}
+}
+
+// Run forgets keys left alone for longer than MaxBackoff, so failures of a key expire with its longest lockout
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.prune(now)
+		}
+	}
+}
+
+func (l *Limiter) prune(now time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for key, state := range l.keys {
+		if now.Sub(state.lastSeen) > l.opts.MaxBackoff && now.After(state.lockedUntil) &&
+			state.limiter.TokensAt(now) >= float64(l.opts.Burst) {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// state returns state of the key creating it on the first attempt. Must be called under lock
+func (l *Limiter) state(key Key, now time.Time) *keyState {
+	state, ok := l.keys[key]
+	if !ok {
+		state = &keyState{limiter: rate.NewLimiter(rate.Limit(l.opts.Rate), l.opts.Burst)}
+		l.keys[key] = state
+	}
+	state.lastSeen = now
+
+	return state
+}
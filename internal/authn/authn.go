@@ -0,0 +1,50 @@
+// Package authn authenticates users with pluggable providers: local passwords kept in the user store,
+// and OpenID Connect identity providers like Google or Keycloak users are redirected to
+package authn
+
+import (
+	"context"
+	"errors"
+)
+
+// LocalProvider is the name of the provider checking passwords of registered users
+const LocalProvider = "local"
+
+var (
+	ErrInvalidCredentials  = errors.New("user ID or password is invalid")
+	ErrInvalidToken        = errors.New("ID token of the identity provider is invalid")
+	ErrLoginDenied         = errors.New("identity provider denied the login")
+	ErrProviderUnavailable = errors.New("identity provider is unavailable")
+	ErrMissingClaim        = errors.New("ID token lacks the claim user ID is taken from")
+)
+
+// Identity is a user authenticated by a provider
+type Identity struct {
+	Provider string
+	// Subject identifies the user at the provider and never changes, unlike email or user name
+	Subject string
+	// UserID is the ID the user has in the messenger
+	UserID string
+}
+
+// Provider authenticates users
+type Provider interface {
+	Name() string
+}
+
+// PasswordProvider checks user ID and password presented to the messenger
+type PasswordProvider interface {
+	Provider
+	// Authenticate returns ErrInvalidCredentials for unknown users and wrong passwords alike
+	Authenticate(ctx context.Context, userID, password string) (Identity, error)
+}
+
+// RedirectProvider logs users in on its own pages and redirects them back with an authorization code
+type RedirectProvider interface {
+	Provider
+	// AuthCodeURL is where the user is sent to log in. state and nonce bind the callback and the ID token
+	// to this login, codeChallenge is the S256 PKCE challenge of the verifier passed to Exchange
+	AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error)
+	// Exchange trades the code of the callback for the verified identity of the user
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (Identity, error)
+}
@@ -0,0 +1,41 @@
+package authn
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"peer-messenger/internal/users"
+)
+
+// Local checks passwords of users registered in the store. Users created by other providers have no password
+// and can't log in with one
+type Local struct {
+	users users.Store
+}
+
+func NewLocal(store users.Store) *Local {
+	return &Local{users: store}
+}
+
+func (l *Local) Name() string {
+	return LocalProvider
+}
+
+func (l *Local) Authenticate(ctx context.Context, userID, password string) (Identity, error) {
+	user, err := l.users.Get(ctx, userID)
+	if errors.Is(err, users.ErrUserNotFound) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password))
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	return Identity{Provider: LocalProvider, Subject: user.ID, UserID: user.ID}, nil
+}
@@ -0,0 +1,268 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockLeeway tolerates clock skew between the messenger and the identity provider
+	clockLeeway = time.Minute
+	// maxUserIDLength matches the limit of user IDs registered with a password
+	maxUserIDLength = 128
+)
+
+// OIDCConfig describes an OpenID Connect identity provider the messenger is registered at as a client
+type OIDCConfig struct {
+	// Name identifies the provider in URLs of login endpoints, e.g. "google"
+	Name string
+	// Issuer is the issuer URL, discovery document is fetched from Issuer + "/.well-known/openid-configuration"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback endpoint of the messenger as registered at the provider
+	RedirectURL string
+	// Scopes are requested besides "openid"
+	Scopes []string
+	// UserIDClaim is the ID token claim user ID is taken from, "sub" if empty. "email" claims are accepted
+	// only if the provider verified them
+	UserIDClaim string
+	// UserIDPrefix is prepended to the claim, so identities of different providers don't collide
+	UserIDPrefix string
+}
+
+// OIDC logs users in with the authorization code flow protected by PKCE and verifies ID tokens
+// against keys the provider publishes
+type OIDC struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mux       *sync.Mutex
+	discovery *discovery
+	keys      *jwks
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDC returns the provider, its discovery document is fetched on first login so the messenger starts
+// while the provider is down
+func NewOIDC(cfg OIDCConfig, client *http.Client) *OIDC {
+	if cfg.UserIDClaim == "" {
+		cfg.UserIDClaim = "sub"
+	}
+
+	return &OIDC{cfg: cfg, client: client, mux: &sync.Mutex{}}
+}
+
+func (o *OIDC) Name() string {
+	return o.cfg.Name
+}
+
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	d, _, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: authorization endpoint: %w", ErrProviderUnavailable, err)
+	}
+
+	query := endpoint.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", o.cfg.ClientID)
+	query.Set("redirect_uri", o.cfg.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, o.cfg.Scopes...), " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	endpoint.RawQuery = query.Encode()
+
+	return endpoint.String(), nil
+}
+
+func (o *OIDC) Exchange(ctx context.Context, code, codeVerifier, nonce string) (Identity, error) {
+	d, keys, err := o.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	rawIDToken, err := o.redeem(ctx, d.TokenEndpoint, code, codeVerifier)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claims := map[string]any{}
+	err = verifyJWT(ctx, rawIDToken, keys, &claims)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	err = o.checkClaims(claims, d.Issuer, nonce, time.Now())
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return o.identity(claims)
+}
+
+// discover fetches the discovery document once, failed attempts are retried on the next login
+func (o *OIDC) discover(ctx context.Context) (*discovery, *jwks, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, o.keys, nil
+	}
+
+	var d discovery
+	err := getJSON(ctx, o.client, strings.TrimSuffix(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.Issuer != o.cfg.Issuer {
+		return nil, nil, fmt.Errorf("%w: discovery names issuer %q", ErrProviderUnavailable, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("%w: discovery lacks endpoints", ErrProviderUnavailable)
+	}
+
+	o.discovery, o.keys = &d, newJWKS(d.JWKSURI, o.client)
+
+	return o.discovery, o.keys, nil
+}
+
+// redeem trades the code for tokens of the user and returns the ID token. A rejected code means
+// the login was forged or replayed rather than the provider being down
+func (o *OIDC) redeem(ctx context.Context, tokenEndpoint, code, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("%w: token endpoint rejected the code", ErrLoginDenied)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: token endpoint responded %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return "", fmt.Errorf("%w: decode tokens: %w", ErrProviderUnavailable, err)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: no ID token issued", ErrInvalidToken)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// checkClaims checks the token was issued by the provider to the messenger for this login and is not expired
+func (o *OIDC) checkClaims(claims map[string]any, issuer, nonce string, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return fmt.Errorf("%w: issuer %q", ErrInvalidToken, iss)
+	}
+
+	audiences := stringList(claims["aud"])
+	if !contains(audiences, o.cfg.ClientID) {
+		return fmt.Errorf("%w: not issued to the client", ErrInvalidToken)
+	}
+	if azp, ok := claims["azp"].(string); len(audiences) > 1 && (!ok || azp != o.cfg.ClientID) {
+		return fmt.Errorf("%w: authorized party %q", ErrInvalidToken, azp)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockLeeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// identity maps claims to the user of the messenger
+func (o *OIDC) identity(claims map[string]any) (Identity, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, fmt.Errorf("%w: sub", ErrMissingClaim)
+	}
+
+	value, _ := claims[o.cfg.UserIDClaim].(string)
+	if value == "" {
+		return Identity{}, fmt.Errorf("%w: %s", ErrMissingClaim, o.cfg.UserIDClaim)
+	}
+	if o.cfg.UserIDClaim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return Identity{}, fmt.Errorf("%w: email is not verified", ErrMissingClaim)
+		}
+	}
+
+	userID := o.cfg.UserIDPrefix + value
+	if len(userID) > maxUserIDLength {
+		return Identity{}, fmt.Errorf("%w: %s is too long", ErrMissingClaim, o.cfg.UserIDClaim)
+	}
+
+	return Identity{Provider: o.cfg.Name, Subject: subject, UserID: userID}, nil
+}
+
+// stringList reads the claim that may be either a string or an array of them, like "aud"
+func stringList(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []any:
+		list := make([]string, 0, len(claim))
+		for _, item := range claim {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,64 @@
+// Package bus passes peer messages between instances, so a message sent on one instance reaches the recipient
+// subscribed to another one, and hands rooms of the instance shutting down over to the others.
+// A single instance needs no bus, Redis and NATS are the shared implementations
+package bus
+
+import (
+	"context"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// Message is the entity for the user of the room connected to another instance
+type Message struct {
+	Room   string               `json:"room"`
+	UserID string               `json:"userID"`
+	Entity models.ChannelEntity `json:"entity"`
+	// MessageType of the entity, it is not part of the entity JSON
+	MessageType string `json:"messageType"`
+}
+
+// Handoff is the state of the room given up by the instance shutting down. Other instances adopt it, so members
+// resume their streams wherever they reconnect. The room password travels as its bcrypt hash
+type Handoff struct {
+	Room string `json:"room"`
+	// LastEntityID lets the adopting instance go on with entity IDs members have seen
+	LastEntityID    uint64            `json:"lastEntityID"`
+	Owner           string            `json:"owner,omitempty"`
+	PasswordHash    []byte            `json:"passwordHash,omitempty"`
+	Capacity        int               `json:"capacity,omitempty"`
+	Invited         []string          `json:"invited,omitempty"`
+	Banned          []string          `json:"banned,omitempty"`
+	Policy          models.RoomPolicy `json:"policy"`
+	Locale          models.Locale     `json:"locale"`
+	EntryForm       *models.EntryForm `json:"entryForm,omitempty"`
+	CaptionsEnabled bool              `json:"captionsEnabled,omitempty"`
+	ExpiresAt       time.Time         `json:"expiresAt"`
+	Members         []HandoffMember   `json:"members"`
+}
+
+// HandoffMember is the membership of one user in the handed off room
+type HandoffMember struct {
+	UserID       string            `json:"userID"`
+	Sessions     []string          `json:"sessions"`
+	Client       models.ClientInfo `json:"client"`
+	Moderator    bool              `json:"moderator,omitempty"`
+	Silent       bool              `json:"silent,omitempty"`
+	Captions     bool              `json:"captions,omitempty"`
+	VariantLabel string            `json:"variantLabel,omitempty"`
+	Topology     models.Topology   `json:"topology,omitempty"`
+	Answers      map[string]any    `json:"answers,omitempty"`
+	// Queued are entities the member has not taken yet, oldest first
+	Queued []models.ChannelEntity `json:"queued,omitempty"`
+}
+
+type Bus interface {
+	// Publish sends the message to other instances, it is not delivered back to this one
+	Publish(ctx context.Context, msg Message) error
+	// HandOff sends the state of the room this instance gives up to other instances
+	HandOff(ctx context.Context, handoff Handoff) error
+	// Subscribe calls handle for every message and adopt for every handoff published by other instances until Close
+	Subscribe(handle func(Message), adopt func(Handoff)) error
+	Close() error
+}
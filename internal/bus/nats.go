@@ -0,0 +1,90 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/codec"
+)
+
+// handoffSubjectSuffix names the subject of handoffs after the subject of messages
+const handoffSubjectSuffix = ".handoff"
+
+// NATS publishes messages of all instances to one subject, every instance keeps those for its own subscribers.
+// Handoffs go to a subject of their own, so instances of different versions still read each other's messages
+type NATS struct {
+	conn    *nats.Conn
+	subject string
+	log     *zap.Logger
+}
+
+// NewNATS connects to the NATS server at url. Messages published by the connection are not echoed to it
+func NewNATS(url, subject string, log *zap.Logger) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("peer-messenger"), nats.NoEcho())
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %w", err)
+	}
+
+	return &NATS{conn: conn, subject: subject, log: log}, nil
+}
+
+func (b *NATS) Publish(_ context.Context, msg Message) error {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return b.conn.Publish(b.subject, data)
+}
+
+func (b *NATS) HandOff(_ context.Context, handoff Handoff) error {
+	data, err := codec.Marshal(handoff)
+	if err != nil {
+		return err
+	}
+
+	err = b.conn.Publish(b.subject+handoffSubjectSuffix, data)
+	if err != nil {
+		return err
+	}
+
+	// handoffs are published on shutdown, the connection must not be closed with them in its buffer
+	return b.conn.Flush()
+}
+
+func (b *NATS) Subscribe(handle func(Message), adopt func(Handoff)) error {
+	_, err := b.conn.Subscribe(b.subject, func(raw *nats.Msg) {
+		var msg Message
+		err := codec.Unmarshal(raw.Data, &msg)
+		if err != nil {
+			b.log.Warn("malformed bus message is skipped", zap.Error(err))
+			return
+		}
+
+		handle(msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = b.conn.Subscribe(b.subject+handoffSubjectSuffix, func(raw *nats.Msg) {
+		var handoff Handoff
+		err := codec.Unmarshal(raw.Data, &handoff)
+		if err != nil {
+			b.log.Warn("malformed room handoff is skipped", zap.Error(err))
+			return
+		}
+
+		adopt(handoff)
+	})
+
+	return err
+}
+
+// Close delivers already received messages and closes the connection
+func (b *NATS) Close() error {
+	return b.conn.Drain()
+}
@@ -0,0 +1,330 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/codec"
+)
+
+const (
+	// redisTimeout bounds dialing and publish round trips without a context deadline
+	redisTimeout = 5 * time.Second
+	// redisRetryMin and redisRetryMax bound the pause between attempts to resubscribe after a lost connection
+	redisRetryMin = time.Second
+	redisRetryMax = 30 * time.Second
+)
+
+var ErrClosed = errors.New("bus is closed")
+
+// redisEnvelope carries the message or the handoff with the instance that published it, Redis has no NATS NoEcho
+type redisEnvelope struct {
+	Origin  string   `json:"origin"`
+	Message *Message `json:"message,omitempty"`
+	Handoff *Handoff `json:"handoff,omitempty"`
+}
+
+// redisConn is a connection speaking RESP
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func (c *redisConn) do(args ...[]byte) (any, error) {
+	err := writeCommand(c.w, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return readReply(c.r)
+}
+
+// Redis publishes messages of all instances to one pub/sub channel, every instance keeps those for its own
+// subscribers. Publishing and subscribing take separate connections, a subscribed connection takes no other commands
+type Redis struct {
+	url     *url.URL
+	channel string
+	// origin tells messages of this instance, Redis delivers them back to it
+	origin string
+	log    *zap.Logger
+
+	mux    *sync.Mutex
+	pub    *redisConn
+	sub    *redisConn
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewRedis connects to the Redis server at rawURL, redis://[[user]:password@]host:port or rediss:// for TLS
+func NewRedis(rawURL, channel string, log *zap.Logger) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis url scheme %q is unknown", u.Scheme)
+	}
+
+	raw := make([]byte, 8)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Redis{
+		url:     u,
+		channel: channel,
+		origin:  hex.EncodeToString(raw),
+		log:     log,
+		mux:     &sync.Mutex{},
+		stop:    make(chan struct{}),
+	}
+
+	b.pub, err = b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *Redis) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+
+	var conn net.Conn
+	var err error
+	if b.url.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.url.Host, &tls.Config{ServerName: b.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", b.url.Host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	password, ok := b.url.User.Password()
+	if ok {
+		_ = conn.SetDeadline(time.Now().Add(redisTimeout))
+
+		args := [][]byte{[]byte("AUTH"), []byte(password)}
+		if user := b.url.User.Username(); user != "" {
+			args = [][]byte{[]byte("AUTH"), []byte(user), []byte(password)}
+		}
+		_, err = c.do(args...)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authenticate to redis: %w", err)
+		}
+
+		_ = conn.SetDeadline(time.Time{})
+	}
+
+	return c, nil
+}
+
+// Publish sends the message over the publishing connection, it is dialed again after a failed publish
+func (b *Redis) Publish(ctx context.Context, msg Message) error {
+	return b.publish(ctx, redisEnvelope{Origin: b.origin, Message: &msg})
+}
+
+// HandOff publishes the handoff to the channel of messages, the envelope tells them apart
+func (b *Redis) HandOff(ctx context.Context, handoff Handoff) error {
+	return b.publish(ctx, redisEnvelope{Origin: b.origin, Handoff: &handoff})
+}
+
+func (b *Redis) publish(ctx context.Context, envelope redisEnvelope) error {
+	data, err := codec.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if b.pub == nil {
+		b.pub, err = b.dial()
+		if err != nil {
+			return err
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	_ = b.pub.conn.SetDeadline(deadline)
+
+	_, err = b.pub.do([]byte("PUBLISH"), []byte(b.channel), data)
+	if err != nil {
+		b.pub.conn.Close()
+		b.pub = nil
+		return fmt.Errorf("publish to redis: %w", err)
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to the channel and calls handle and adopt from a single goroutine. A lost subscription is
+// restored in the background, messages published meanwhile are lost as Redis pub/sub does not keep them
+func (b *Redis) Subscribe(handle func(Message), adopt func(Handoff)) error {
+	sub, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		sub.conn.Close()
+		return ErrClosed
+	}
+	b.sub = sub
+	b.done = make(chan struct{})
+
+	go b.receive(sub, handle, adopt)
+
+	return nil
+}
+
+func (b *Redis) subscribe() (*redisConn, error) {
+	sub, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	_ = sub.conn.SetDeadline(time.Now().Add(redisTimeout))
+	_, err = sub.do([]byte("SUBSCRIBE"), []byte(b.channel))
+	if err != nil {
+		sub.conn.Close()
+		return nil, fmt.Errorf("subscribe to redis: %w", err)
+	}
+	_ = sub.conn.SetDeadline(time.Time{})
+
+	return sub, nil
+}
+
+func (b *Redis) receive(sub *redisConn, handle func(Message), adopt func(Handoff)) {
+	defer close(b.done)
+
+	for {
+		reply, err := readReply(sub.r)
+		if err != nil {
+			sub, err = b.resubscribe(err)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// pushes are [message, channel, payload], subscription confirmations are skipped
+		push, ok := reply.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		payload, _ := push[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		var envelope redisEnvelope
+		err = codec.Unmarshal(payload, &envelope)
+		if err != nil {
+			b.log.Warn("malformed bus message is skipped", zap.Error(err))
+			continue
+		}
+		switch {
+		case envelope.Origin == b.origin:
+		case envelope.Message != nil:
+			handle(*envelope.Message)
+		case envelope.Handoff != nil:
+			adopt(*envelope.Handoff)
+		}
+	}
+}
+
+// resubscribe dials the subscription again until it succeeds or the bus is closed, then ErrClosed is returned
+func (b *Redis) resubscribe(cause error) (*redisConn, error) {
+	retry := redisRetryMin
+	for {
+		b.mux.Lock()
+		closed := b.closed
+		b.mux.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+
+		b.log.Warn("redis subscription is lost, subscribing again", zap.Error(cause), zap.Duration("retry", retry))
+		select {
+		case <-b.stop:
+			return nil, ErrClosed
+		case <-time.After(retry):
+		}
+
+		sub, err := b.subscribe()
+		if err != nil {
+			cause = err
+			retry = min(2*retry, redisRetryMax)
+			continue
+		}
+
+		b.mux.Lock()
+		if b.closed {
+			b.mux.Unlock()
+			sub.conn.Close()
+			return nil, ErrClosed
+		}
+		b.sub = sub
+		b.mux.Unlock()
+
+		b.log.Info("redis subscription is restored")
+
+		return sub, nil
+	}
+}
+
+// Close closes both connections and waits for the message being handled, messages not yet read are dropped
+func (b *Redis) Close() error {
+	b.mux.Lock()
+	if b.closed {
+		b.mux.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.stop)
+
+	var err error
+	if b.pub != nil {
+		err = b.pub.conn.Close()
+	}
+	if b.sub != nil {
+		b.sub.conn.Close()
+	}
+	done := b.done
+	b.mux.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+package bus
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulkLength bounds bulk strings read from Redis, bus messages are far smaller
+const maxBulkLength = 64 << 20
+
+var errRESP = errors.New("malformed redis reply")
+
+// writeCommand writes the command as RESP array of bulk strings
+func writeCommand(w *bufio.Writer, args ...[]byte) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(arg)))
+		w.WriteString("\r\n")
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+
+	return w.Flush()
+}
+
+// readReply reads one RESP reply: simple and bulk strings are returned as []byte, integers as int64,
+// arrays as []any and nil bulk strings and arrays as nil. Error replies are returned as error
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errRESP
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > maxBulkLength {
+			return nil, errRESP
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errRESP
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]any, 0, min(n, 16))
+		for i := 0; i < n; i++ {
+			item, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		return items, nil
+	default:
+		return nil, errRESP
+	}
+}
+
+// readLine reads the line up to CRLF, the terminator is not returned
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errRESP
+	}
+
+	return line[:len(line)-2], nil
+}
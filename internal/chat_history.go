@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/search"
+)
+
+var ErrHistoryDisabled = errors.New("chat history is disabled in room")
+
+// chatHistory indexes the latest chat messages of the room, the oldest ones are removed from the index above capacity
+type chatHistory struct {
+	index    search.Index
+	capacity int
+	// ids are indexed message IDs from oldest to newest
+	ids []uint64
+	mux *sync.Mutex
+}
+
+func newChatHistory(capacity int) *chatHistory {
+	return &chatHistory{
+		index:    search.NewMemoryIndex(),
+		capacity: max(capacity, 1),
+		mux:      &sync.Mutex{},
+	}
+}
+
+func (h *chatHistory) add(doc search.Document) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	err := h.index.Add(doc)
+	if err != nil {
+		return err
+	}
+
+	h.ids = append(h.ids, doc.ID)
+	for len(h.ids) > h.capacity {
+		err = h.index.Remove(h.ids[0])
+		if err != nil {
+			return err
+		}
+		h.ids = h.ids[1:]
+	}
+
+	return nil
+}
+
+// recordChat indexes message with text field when chat history is enabled. Must be called under read lock
+func (r *Room) recordChat(entity models.ChannelEntity, recipientID string, data map[string]any) {
+	text, _ := data["text"].(string)
+	if r.chatHistory == nil || text == "" {
+		return
+	}
+
+	err := r.chatHistory.add(search.Document{
+		ID:          entity.ID,
+		Time:        entity.Time,
+		AuthorID:    entity.UserID,
+		RecipientID: recipientID,
+		Text:        text,
+	})
+	if err != nil {
+		r.log.Error("failed to index chat message", zap.Uint64("id", entity.ID), zap.Error(err))
+	}
+}
+
+// SearchHistory finds chat messages of the room. Set query ParticipantID to limit results to one user's messages
+func (r *Room) SearchHistory(q search.Query) ([]search.Document, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.chatHistory == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	return r.chatHistory.index.Search(q)
+}
@@ -0,0 +1,3 @@
+// Package codec is the JSON implementation of messages passed between instances. encoding/json is the default,
+// -tags=jsoniter switches it the same way it switches gin
+package codec
@@ -0,0 +1,13 @@
+//go:build !jsoniter
+
+package codec
+
+import "encoding/json"
+
+// Name of the implementation, reported on startup
+const Name = "encoding/json"
+
+var (
+	Marshal   = json.Marshal
+	Unmarshal = json.Unmarshal
+)
@@ -0,0 +1,14 @@
+//go:build jsoniter
+
+package codec
+
+import jsoniter "github.com/json-iterator/go"
+
+// Name of the implementation, reported on startup
+const Name = "jsoniter"
+
+var (
+	json      = jsoniter.ConfigCompatibleWithStandardLibrary
+	Marshal   = json.Marshal
+	Unmarshal = json.Unmarshal
+)
@@ -0,0 +1,618 @@
+// Package config loads application configuration. Defaults are overridden by the YAML file,
+// which is in turn overridden by environment variables named in env tags
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// publicTokenSalt was the built-in salt, tokens made with it are forgeable by anyone who read the source
+const publicTokenSalt = "asasasas"
+
+type Config struct {
+	HTTP          HTTP          `yaml:"http" json:"http"`
+	Auth          Auth          `yaml:"auth" json:"auth"`
+	Room          Room          `yaml:"room" json:"room"`
+	Observability Observability `yaml:"observability" json:"observability"`
+	Regions       Regions       `yaml:"regions" json:"regions"`
+	Occupancy     Occupancy     `yaml:"occupancy" json:"occupancy"`
+	Quotas        Quotas        `yaml:"quotas" json:"quotas"`
+	MessageTypes  MessageTypes  `yaml:"messageTypes" json:"messageTypes"`
+	Meetings      Meetings      `yaml:"meetings" json:"meetings"`
+	Bus           Bus           `yaml:"bus" json:"bus"`
+	RoomStore     RoomStore     `yaml:"roomStore" json:"roomStore"`
+	Overload      Overload      `yaml:"overload" json:"overload"`
+}
+
+type HTTP struct {
+	// APIAddr serves the public API, empty leaves serving it to the embedder of the server package
+	APIAddr string `yaml:"apiAddr" json:"apiAddr" env:"API_ADDR"`
+	// MetricsAddr is the dedicated metrics port, empty serves /metrics on the api server behind admin token
+	MetricsAddr string `yaml:"metricsAddr" json:"metricsAddr" env:"METRICS_ADDR"`
+	// GRPCAddr serves the signaling API over gRPC, empty disables it
+	GRPCAddr string `yaml:"grpcAddr" json:"grpcAddr" env:"GRPC_ADDR"`
+	// TrustedProxies may set client IP via TrustedProxyHeaders
+	TrustedProxies      []string      `yaml:"trustedProxies" json:"trustedProxies" env:"TRUSTED_PROXIES"`
+	TrustedProxyHeaders []string      `yaml:"trustedProxyHeaders" json:"trustedProxyHeaders" env:"TRUSTED_PROXY_HEADERS"`
+	ShutdownTimeout     time.Duration `yaml:"shutdownTimeout" json:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+	// MaxRequestBytes is the largest accepted request body, larger ones get 413
+	MaxRequestBytes int `yaml:"maxRequestBytes" json:"maxRequestBytes" env:"MAX_REQUEST_BYTES"`
+	// SSEHeartbeatInterval is how often idle subscriptions receive a comment to confirm the listener is alive
+	SSEHeartbeatInterval time.Duration `yaml:"sseHeartbeatInterval" json:"sseHeartbeatInterval" env:"SSE_HEARTBEAT_INTERVAL"`
+	// TLS terminates TLS on the api server, which then serves HTTP/2 too. Without it the server speaks plain HTTP/1.1
+	TLS  TLS  `yaml:"tls" json:"tls"`
+	CORS CORS `yaml:"cors" json:"cors"`
+}
+
+// CORS is the policy for browser clients of the api server
+type CORS struct {
+	// AllowedOrigins are exact origins like "https://app.example.com" or subdomain wildcards like
+	// "https://*.example.com". The sole "*" allows every origin
+	AllowedOrigins []string `yaml:"allowedOrigins" json:"allowedOrigins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods []string `yaml:"allowedMethods" json:"allowedMethods" env:"CORS_ALLOWED_METHODS"`
+	// AllowedHeaders are request headers besides the CORS-safelisted ones
+	AllowedHeaders []string `yaml:"allowedHeaders" json:"allowedHeaders" env:"CORS_ALLOWED_HEADERS"`
+	// MaxAge is how long browsers cache preflight responses
+	MaxAge time.Duration `yaml:"maxAge" json:"maxAge" env:"CORS_MAX_AGE"`
+}
+
+// TLS takes certificate either from files or from Let's Encrypt for AutocertHosts. Both empty disable TLS
+type TLS struct {
+	CertFile string `yaml:"certFile" json:"certFile" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile" env:"TLS_KEY_FILE"`
+	// AutocertHosts are host names certificates are requested for, ACME challenges are answered on the api port
+	AutocertHosts []string `yaml:"autocertHosts" json:"autocertHosts" env:"TLS_AUTOCERT_HOSTS"`
+	// AutocertCacheDir keeps issued certificates across restarts, so they are not requested again
+	AutocertCacheDir string `yaml:"autocertCacheDir" json:"autocertCacheDir" env:"TLS_AUTOCERT_CACHE_DIR"`
+	// AutocertEmail is the optional contact for notices about the certificates
+	AutocertEmail string `yaml:"autocertEmail" json:"autocertEmail" env:"TLS_AUTOCERT_EMAIL"`
+}
+
+type Auth struct {
+	// TokenSalt is the suffix of "<userID><salt>" tokens issued before sessions, empty rejects such tokens.
+	// Anyone knowing it can build the token of any user, so it is only set while such tokens are migrated
+	TokenSalt string `yaml:"tokenSalt" json:"tokenSalt" env:"TOKEN_SALT"`
+	// AdminToken enables admin API, empty disables it
+	AdminToken string `yaml:"adminToken" json:"adminToken" env:"ADMIN_TOKEN"`
+	// SubscriptionSecret signs subscriptionIDs, random one is generated when empty
+	SubscriptionSecret string `yaml:"subscriptionSecret" json:"subscriptionSecret" env:"SUBSCRIPTION_SECRET"`
+	// CanaryToken tags requests of the synthetic canary carrying it in X-Canary-Token as internal traffic,
+	// empty disables tagging
+	CanaryToken string `yaml:"canaryToken" json:"canaryToken" env:"CANARY_TOKEN"`
+	// LegacyTokensUntil is the absolute date tokens issued before sessions are accepted until, zero rejects them
+	LegacyTokensUntil time.Time `yaml:"legacyTokensUntil" json:"legacyTokensUntil" env:"LEGACY_TOKENS_UNTIL"`
+	// SessionTTL is how long a login session is valid
+	SessionTTL time.Duration `yaml:"sessionTTL" json:"sessionTTL" env:"SESSION_TTL"`
+	// LegacySubscriptionIDsUntil is the absolute date unsigned subscriptionIDs are accepted until, zero rejects them
+	LegacySubscriptionIDsUntil time.Time `yaml:"legacySubscriptionIDsUntil" json:"legacySubscriptionIDsUntil" env:"LEGACY_SUBSCRIPTION_IDS_UNTIL"`
+	// ResumeTokenTTL is how long single-use resume tokens are valid
+	ResumeTokenTTL time.Duration `yaml:"resumeTokenTTL" json:"resumeTokenTTL" env:"RESUME_TOKEN_TTL"`
+	// ReplayCapacity is the number of used single-use tokens remembered until they expire
+	ReplayCapacity int `yaml:"replayCapacity" json:"replayCapacity" env:"REPLAY_CAPACITY"`
+	// UserStorePath is the JSON file with registered users, empty keeps them in memory
+	UserStorePath string `yaml:"userStorePath" json:"userStorePath" env:"USER_STORE_PATH"`
+	// Throttle limits login and register attempts of every client IP and user ID
+	Throttle AuthThrottle `yaml:"throttle" json:"throttle"`
+	// OIDC are OpenID Connect identity providers users may log in with besides passwords
+	OIDC []OIDCProvider `yaml:"oidc" json:"oidc"`
+	// LoginRedirectURL is the client page users logged in with an identity provider are sent to, with the session
+	// in the URL fragment. Empty responds to the callback with the session as JSON
+	LoginRedirectURL string `yaml:"loginRedirectURL" json:"loginRedirectURL" env:"AUTH_LOGIN_REDIRECT_URL"`
+}
+
+// OIDCProvider is an OpenID Connect identity provider, e.g. Google or a Keycloak realm, the messenger is
+// registered at as a client. Users log in at /auth/{name}/login
+type OIDCProvider struct {
+	// Name of lowercase letters, digits and '-', "local" is reserved for passwords
+	Name string `yaml:"name" json:"name"`
+	// Issuer is the issuer URL the discovery document is fetched from
+	Issuer       string `yaml:"issuer" json:"issuer"`
+	ClientID     string `yaml:"clientID" json:"clientID"`
+	ClientSecret string `yaml:"clientSecret" json:"clientSecret"`
+	// RedirectURL is /auth/{name}/callback of the messenger as registered at the provider
+	RedirectURL string `yaml:"redirectURL" json:"redirectURL"`
+	// Scopes are requested besides "openid", e.g. "email"
+	Scopes []string `yaml:"scopes" json:"scopes"`
+	// UserIDClaim is the ID token claim user IDs are taken from, "sub" when empty
+	UserIDClaim string `yaml:"userIDClaim" json:"userIDClaim"`
+	// UserIDPrefix keeps user IDs of the provider apart from others, e.g. "google:"
+	UserIDPrefix string `yaml:"userIDPrefix" json:"userIDPrefix"`
+}
+
+// AuthThrottle is a token bucket per key with lockouts after repeated failures: wrong passwords and taken user IDs
+type AuthThrottle struct {
+	// Rate is attempts per second of each key, Burst is attempts at once above it
+	Rate  float64 `yaml:"rate" json:"rate" env:"AUTH_THROTTLE_RATE"`
+	Burst int     `yaml:"burst" json:"burst" env:"AUTH_THROTTLE_BURST"`
+	// FreeFailures is the number of failures in a row allowed before the first lockout
+	FreeFailures int `yaml:"freeFailures" json:"freeFailures" env:"AUTH_THROTTLE_FREE_FAILURES"`
+	// BaseBackoff is the first lockout, every further failure doubles it up to MaxBackoff
+	BaseBackoff time.Duration `yaml:"baseBackoff" json:"baseBackoff" env:"AUTH_THROTTLE_BASE_BACKOFF"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff" json:"maxBackoff" env:"AUTH_THROTTLE_MAX_BACKOFF"`
+}
+
+type Room struct {
+	// UserMessageRate limits peer messages per second of each user in a room
+	UserMessageRate float64 `yaml:"userMessageRate" json:"userMessageRate" env:"ROOM_USER_MESSAGE_RATE"`
+	// UserMessageBurst is the number of messages user may send at once above the rate
+	UserMessageBurst int `yaml:"userMessageBurst" json:"userMessageBurst" env:"ROOM_USER_MESSAGE_BURST"`
+	// QueueSize is the capacity of each user's entity queue
+	QueueSize int `yaml:"queueSize" json:"queueSize" env:"ROOM_QUEUE_SIZE"`
+	// MaxQueuedEntities is the backlog after which user is considered disconnected
+	MaxQueuedEntities int `yaml:"maxQueuedEntities" json:"maxQueuedEntities" env:"ROOM_MAX_QUEUED_ENTITIES"`
+	// InactivityTimeout is how long user may stay idle before being probed
+	InactivityTimeout time.Duration `yaml:"inactivityTimeout" json:"inactivityTimeout" env:"ROOM_INACTIVITY_TIMEOUT"`
+	// PresenceTimeout is how long user may stay without heartbeats or subscription activity before being shown as away
+	PresenceTimeout time.Duration `yaml:"presenceTimeout" json:"presenceTimeout" env:"ROOM_PRESENCE_TIMEOUT"`
+	// ProbeGracePeriod is how long probed user has to show activity before eviction
+	ProbeGracePeriod time.Duration `yaml:"probeGracePeriod" json:"probeGracePeriod" env:"ROOM_PROBE_GRACE_PERIOD"`
+	// LivenessWindow is how long members sending liveness heartbeats may miss them before they are removed
+	LivenessWindow time.Duration `yaml:"livenessWindow" json:"livenessWindow" env:"ROOM_LIVENESS_WINDOW"`
+	// DeliveryTimeout bounds waiting for space in the destination queue of a peer message, used only
+	// when DispatchQueueSize is 0
+	DeliveryTimeout time.Duration `yaml:"deliveryTimeout" json:"deliveryTimeout" env:"ROOM_DELIVERY_TIMEOUT"`
+	// DispatchQueueSize is the number of peer messages each room accepts ahead of its dispatcher delivering them,
+	// so senders never wait for slow recipients. 0 delivers messages within the sender's request
+	DispatchQueueSize int `yaml:"dispatchQueueSize" json:"dispatchQueueSize" env:"ROOM_DISPATCH_QUEUE_SIZE"`
+	// OverflowPolicy handles entities published to full queues: drop-oldest, drop-newest or disconnect-slow-consumer
+	OverflowPolicy string `yaml:"overflowPolicy" json:"overflowPolicy" env:"ROOM_OVERFLOW_POLICY"`
+	// OfferPacing is the delay between consecutive offers in connection plans
+	OfferPacing time.Duration `yaml:"offerPacing" json:"offerPacing" env:"ROOM_OFFER_PACING"`
+	// RemoveOnDisconnect makes users leave the room once their last event stream is disconnected,
+	// otherwise they are only made inactive and evicted by the janitor unless they reconnect
+	RemoveOnDisconnect bool `yaml:"removeOnDisconnect" json:"removeOnDisconnect" env:"ROOM_REMOVE_ON_DISCONNECT"`
+	// PointerInterval is the period of publishing shared pointer positions, moves in between are coalesced
+	PointerInterval time.Duration `yaml:"pointerInterval" json:"pointerInterval" env:"ROOM_POINTER_INTERVAL"`
+	// CleanInterval is the base period of removing disconnected users and empty rooms, adapted to load from 1/4 to 4 times
+	CleanInterval time.Duration `yaml:"cleanInterval" json:"cleanInterval" env:"ROOM_CLEAN_INTERVAL"`
+	// ExpiryGrace is how long before closing expiring rooms members are warned, rooms are checked on every cleanup
+	ExpiryGrace time.Duration `yaml:"expiryGrace" json:"expiryGrace" env:"ROOM_EXPIRY_GRACE"`
+	// CleanJitter (0..1) spreads cleanups of instances started at the same time by up to this share of the interval
+	CleanJitter float64 `yaml:"cleanJitter" json:"cleanJitter" env:"ROOM_CLEAN_JITTER"`
+	// InboxCapacity is the number of peer messages kept per user when the queue is full or the user is evicted,
+	// they are replayed on collect or reconnect. 0 disables the inbox
+	InboxCapacity int `yaml:"inboxCapacity" json:"inboxCapacity" env:"ROOM_INBOX_CAPACITY"`
+	// EventHistoryCapacity is the number of the latest entities kept per room for GET /channel/history, 0 disables it
+	EventHistoryCapacity int `yaml:"eventHistoryCapacity" json:"eventHistoryCapacity" env:"ROOM_EVENT_HISTORY_CAPACITY"`
+	// ChatHistoryCapacity is the number of chat messages kept searchable in rooms with chat history enabled by policy
+	ChatHistoryCapacity int `yaml:"chatHistoryCapacity" json:"chatHistoryCapacity" env:"ROOM_CHAT_HISTORY_CAPACITY"`
+	// AudioOnlyPacketLoss (0..1) is the mean packet loss of the room that makes members receive audio only
+	// recommendation once it lasts AudioOnlySustain, 0 disables recommendations
+	AudioOnlyPacketLoss float64 `yaml:"audioOnlyPacketLoss" json:"audioOnlyPacketLoss" env:"ROOM_AUDIO_ONLY_PACKET_LOSS"`
+	// AudioOnlyRecoverPacketLoss is the mean packet loss at or below which video is recommended back
+	AudioOnlyRecoverPacketLoss float64       `yaml:"audioOnlyRecoverPacketLoss" json:"audioOnlyRecoverPacketLoss" env:"ROOM_AUDIO_ONLY_RECOVER_PACKET_LOSS"`
+	AudioOnlySustain           time.Duration `yaml:"audioOnlySustain" json:"audioOnlySustain" env:"ROOM_AUDIO_ONLY_SUSTAIN"`
+	// E2EERequired makes every room of the tenant reject messages that are not end-to-end encrypted,
+	// rooms may also require it by policy
+	E2EERequired bool `yaml:"e2eeRequired" json:"e2eeRequired" env:"ROOM_E2EE_REQUIRED"`
+}
+
+type Observability struct {
+	// DeadLetterCapacity is the number of undeliverable entities kept for inspection, 0 disables capture
+	DeadLetterCapacity int `yaml:"deadLetterCapacity" json:"deadLetterCapacity" env:"DEAD_LETTER_CAPACITY"`
+	// DeliveryLogSampleRate (0..1) is the share of delivered entities logged
+	DeliveryLogSampleRate float64 `yaml:"deliveryLogSampleRate" json:"deliveryLogSampleRate" env:"DELIVERY_LOG_SAMPLE_RATE"`
+	LogRoomsSummary       bool    `yaml:"logRoomsSummary" json:"logRoomsSummary" env:"ROOMS_SUMMARY_LOG"`
+	// ClientLogPath is the file client-reported logs are written to, empty mixes them into the service log
+	ClientLogPath string `yaml:"clientLogPath" json:"clientLogPath" env:"CLIENT_LOG_PATH"`
+	// ClientLogQuota is the number of client log entries a user may send per hour
+	ClientLogQuota int `yaml:"clientLogQuota" json:"clientLogQuota" env:"CLIENT_LOG_QUOTA"`
+	// LogRequestBodyBytes is how much of every request body is logged, 0 logs only its size
+	LogRequestBodyBytes int `yaml:"logRequestBodyBytes" json:"logRequestBodyBytes" env:"LOG_REQUEST_BODY_BYTES"`
+	// InternalLogSampleRate (0..1) is the share of admin, probe and canary requests written to request
+	// and access logs, public requests are always logged
+	InternalLogSampleRate float64 `yaml:"internalLogSampleRate" json:"internalLogSampleRate" env:"INTERNAL_LOG_SAMPLE_RATE"`
+	// RedactedFields are JSON keys of request bodies whose values are replaced in the log
+	RedactedFields []string `yaml:"redactedFields" json:"redactedFields" env:"LOG_REDACTED_FIELDS"`
+	// AccessLogPath is the file every served request is written to, empty disables the access log
+	AccessLogPath string `yaml:"accessLogPath" json:"accessLogPath" env:"ACCESS_LOG_PATH"`
+	// AccessLogFormat is "json" for JSON Lines or "apache" for Apache combined format with extra fields
+	AccessLogFormat string `yaml:"accessLogFormat" json:"accessLogFormat" env:"ACCESS_LOG_FORMAT"`
+	// AccessLogMaxSizeMB is the size the access log is rotated at, AccessLogMaxBackups rotated files are kept
+	AccessLogMaxSizeMB  int `yaml:"accessLogMaxSizeMB" json:"accessLogMaxSizeMB" env:"ACCESS_LOG_MAX_SIZE_MB"`
+	AccessLogMaxBackups int `yaml:"accessLogMaxBackups" json:"accessLogMaxBackups" env:"ACCESS_LOG_MAX_BACKUPS"`
+	// SDPLint parses relayed offers and answers and sends advisory warnings about misconfigured ones to their senders
+	SDPLint bool `yaml:"sdpLint" json:"sdpLint" env:"SDP_LINT"`
+	// SDPCandidateTimeout is how long to wait for trickled candidates after description without embedded ones
+	SDPCandidateTimeout time.Duration `yaml:"sdpCandidateTimeout" json:"sdpCandidateTimeout" env:"SDP_CANDIDATE_TIMEOUT"`
+	// BugReportCapacity is the number of the latest bug reports of users kept for support
+	BugReportCapacity int `yaml:"bugReportCapacity" json:"bugReportCapacity" env:"BUG_REPORT_CAPACITY"`
+	// Tracing exports spans over OTLP, the exporter is configured by standard OTEL_EXPORTER_OTLP_* variables
+	Tracing bool `yaml:"tracing" json:"tracing" env:"TRACING"`
+}
+
+type Regions struct {
+	// Region served by this instance
+	Region string `yaml:"region" json:"region" env:"REGION"`
+	// URLs maps other regions to base URLs of their instances, env format is "region=url" pairs separated by commas
+	URLs map[string]string `yaml:"urls" json:"urls" env:"REGION_URLS"`
+}
+
+type Occupancy struct {
+	// WebhookURL receives notifications when room size crosses Thresholds, empty disables them
+	WebhookURL string `yaml:"webhookURL" json:"webhookURL" env:"OCCUPANCY_WEBHOOK_URL"`
+	Thresholds []int  `yaml:"thresholds" json:"thresholds" env:"OCCUPANCY_THRESHOLDS"`
+	Hysteresis int    `yaml:"hysteresis" json:"hysteresis" env:"OCCUPANCY_HYSTERESIS"`
+}
+
+// Meetings configures rooms of meetings scheduled by admin API
+type Meetings struct {
+	// WarmUp is how long before the start the room of a meeting is created
+	WarmUp time.Duration `yaml:"warmUp" json:"warmUp" env:"MEETINGS_WARM_UP"`
+	// Grace keeps the empty room of a meeting after its start for late joiners
+	Grace time.Duration `yaml:"grace" json:"grace" env:"MEETINGS_GRACE"`
+	// WebhookURL is notified when the room is ready, e.g. to send push notifications to the roster. Empty disables it
+	WebhookURL string `yaml:"webhookURL" json:"webhookURL" env:"MEETINGS_WEBHOOK_URL"`
+}
+
+// Overload configures load shedding: while it is on, new joins are rejected with 503 pointing to other instances
+type Overload struct {
+	// MaxUsers in all rooms turns load shedding on, 0 leaves it to admins
+	MaxUsers   int           `yaml:"maxUsers" json:"maxUsers" env:"OVERLOAD_MAX_USERS"`
+	RetryAfter time.Duration `yaml:"retryAfter" json:"retryAfter" env:"OVERLOAD_RETRY_AFTER"`
+	// AlternateURLs are base URLs of other instances of the cluster
+	AlternateURLs []string `yaml:"alternateURLs" json:"alternateURLs" env:"OVERLOAD_ALTERNATE_URLS"`
+}
+
+// Bus passes peer messages between instances serving the same rooms
+type Bus struct {
+	// Kind is memory for a single instance, redis or nats
+	Kind    string `yaml:"kind" json:"kind" env:"BUS_KIND"`
+	NATSURL string `yaml:"natsURL" json:"natsURL" env:"BUS_NATS_URL"`
+	// RedisURL is redis://[[user]:password@]host:port, rediss:// for TLS
+	RedisURL string `yaml:"redisURL" json:"redisURL" env:"BUS_REDIS_URL"`
+	// Subject all instances publish to and subscribe on, it is the channel name for redis
+	Subject string `yaml:"subject" json:"subject" env:"BUS_SUBJECT"`
+}
+
+// RoomStore keeps configs of pre-created rooms, so they survive restarts
+type RoomStore struct {
+	// PostgresDSN is the database the configs are kept in, empty disables pre-created rooms.
+	// Its schema is migrated on start
+	PostgresDSN string `yaml:"postgresDSN" json:"postgresDSN" env:"ROOM_STORE_POSTGRES_DSN"`
+}
+
+// Quotas are soft limits reported by the usage endpoint, they are not enforced. 0 means unlimited
+type Quotas struct {
+	Rooms           int `yaml:"rooms" json:"rooms" env:"QUOTA_ROOMS"`
+	ConcurrentUsers int `yaml:"concurrentUsers" json:"concurrentUsers" env:"QUOTA_CONCURRENT_USERS"`
+	// MessagesPerDay counts peer messages and broadcasts since UTC midnight
+	MessagesPerDay int `yaml:"messagesPerDay" json:"messagesPerDay" env:"QUOTA_MESSAGES_PER_DAY"`
+	HistoryBytes   int `yaml:"historyBytes" json:"historyBytes" env:"QUOTA_HISTORY_BYTES"`
+}
+
+// MessageTypes extend built-in peer message types: offer, answer, candidate, bye, chat and custom/*
+type MessageTypes struct {
+	// Unknown is "reject" or "pass" for messages of types missing from the registry
+	Unknown string `yaml:"unknown" json:"unknown" env:"MESSAGE_TYPES_UNKNOWN"`
+	// Types with the name of a built-in type replace it
+	Types []MessageType `yaml:"types" json:"types"`
+}
+
+type MessageType struct {
+	// Name is the exact messageType or a pattern ending with "/*"
+	Name string `yaml:"name" json:"name"`
+	// Required fields must be present and not empty
+	Required []string `yaml:"required" json:"required"`
+	// Priority is "low", "normal" or "high", used when sender does not set one
+	Priority string `yaml:"priority" json:"priority"`
+	// RateClass is "limited" or "exempt" from the user send rate limit
+	RateClass string `yaml:"rateClass" json:"rateClass"`
+	// Plaintext types are relayed unencrypted where end-to-end encryption is required
+	Plaintext bool `yaml:"plaintext" json:"plaintext"`
+}
+
+func Default() Config {
+	return Config{
+		HTTP: HTTP{
+			APIAddr:              ":8080",
+			MetricsAddr:          ":9090",
+			ShutdownTimeout:      10 * time.Second,
+			MaxRequestBytes:      1 << 20,
+			SSEHeartbeatInterval: 30 * time.Second,
+			CORS: CORS{
+				AllowedOrigins: []string{"*"},
+				AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+				AllowedHeaders: []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Request-ID"},
+				MaxAge:         12 * time.Hour,
+			},
+		},
+		Auth: Auth{
+			SessionTTL:     30 * 24 * time.Hour,
+			ResumeTokenTTL: 10 * time.Minute,
+			ReplayCapacity: 100000,
+			Throttle: AuthThrottle{
+				Rate:         0.5,
+				Burst:        10,
+				FreeFailures: 5,
+				BaseBackoff:  2 * time.Second,
+				MaxBackoff:   15 * time.Minute,
+			},
+		},
+		Room: Room{
+			UserMessageRate:            20,
+			UserMessageBurst:           40,
+			QueueSize:                  100,
+			MaxQueuedEntities:          40,
+			InactivityTimeout:          5 * time.Minute,
+			PresenceTimeout:            45 * time.Second,
+			ProbeGracePeriod:           30 * time.Second,
+			LivenessWindow:             10 * time.Second,
+			DeliveryTimeout:            time.Second,
+			DispatchQueueSize:          1000,
+			OverflowPolicy:             "drop-newest",
+			OfferPacing:                100 * time.Millisecond,
+			PointerInterval:            50 * time.Millisecond,
+			CleanInterval:              10 * time.Second,
+			CleanJitter:                0.1,
+			ExpiryGrace:                time.Minute,
+			InboxCapacity:              50,
+			ChatHistoryCapacity:        1000,
+			EventHistoryCapacity:       500,
+			AudioOnlyRecoverPacketLoss: 0.02,
+			AudioOnlySustain:           30 * time.Second,
+		},
+		Observability: Observability{
+			ClientLogQuota:        1000,
+			LogRequestBodyBytes:   1024,
+			InternalLogSampleRate: 0.1,
+			RedactedFields: []string{
+				"password", "passHash", "token", "resumeToken", "subscriptionID", "secret",
+			},
+			AccessLogFormat:     "json",
+			AccessLogMaxSizeMB:  100,
+			AccessLogMaxBackups: 5,
+			SDPCandidateTimeout: 10 * time.Second,
+			BugReportCapacity:   200,
+		},
+		MessageTypes: MessageTypes{
+			Unknown: "reject",
+		},
+		Meetings: Meetings{
+			WarmUp: 5 * time.Minute,
+			Grace:  15 * time.Minute,
+		},
+		Overload: Overload{
+			RetryAfter: 30 * time.Second,
+		},
+		Bus: Bus{
+			Kind:    "memory",
+			Subject: "peer-messenger.messages",
+		},
+	}
+}
+
+// Load returns defaults overridden by the YAML file at path, if path is not empty, and then by environment
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+
+		err = yaml.Unmarshal(raw, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	err := applyEnv(&cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	positive := func(name string, value int64) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+
+	positive("room.userMessageBurst", int64(cfg.Room.UserMessageBurst))
+	positive("room.queueSize", int64(cfg.Room.QueueSize))
+	positive("room.maxQueuedEntities", int64(cfg.Room.MaxQueuedEntities))
+	positive("room.inactivityTimeout", int64(cfg.Room.InactivityTimeout))
+	positive("room.presenceTimeout", int64(cfg.Room.PresenceTimeout))
+	positive("room.probeGracePeriod", int64(cfg.Room.ProbeGracePeriod))
+	positive("room.livenessWindow", int64(cfg.Room.LivenessWindow))
+	positive("auth.resumeTokenTTL", int64(cfg.Auth.ResumeTokenTTL))
+	positive("auth.sessionTTL", int64(cfg.Auth.SessionTTL))
+	positive("auth.replayCapacity", int64(cfg.Auth.ReplayCapacity))
+	positive("auth.throttle.burst", int64(cfg.Auth.Throttle.Burst))
+	positive("auth.throttle.baseBackoff", int64(cfg.Auth.Throttle.BaseBackoff))
+	positive("room.pointerInterval", int64(cfg.Room.PointerInterval))
+	positive("meetings.warmUp", int64(cfg.Meetings.WarmUp))
+	positive("meetings.grace", int64(cfg.Meetings.Grace))
+	positive("room.cleanInterval", int64(cfg.Room.CleanInterval))
+	positive("room.expiryGrace", int64(cfg.Room.ExpiryGrace))
+	positive("room.chatHistoryCapacity", int64(cfg.Room.ChatHistoryCapacity))
+	positive("room.audioOnlySustain", int64(cfg.Room.AudioOnlySustain))
+	positive("observability.clientLogQuota", int64(cfg.Observability.ClientLogQuota))
+	positive("observability.accessLogMaxSizeMB", int64(cfg.Observability.AccessLogMaxSizeMB))
+	positive("observability.sdpCandidateTimeout", int64(cfg.Observability.SDPCandidateTimeout))
+	positive("overload.retryAfter", int64(cfg.Overload.RetryAfter))
+	positive("observability.bugReportCapacity", int64(cfg.Observability.BugReportCapacity))
+	positive("http.sseHeartbeatInterval", int64(cfg.HTTP.SSEHeartbeatInterval))
+	positive("http.maxRequestBytes", int64(cfg.HTTP.MaxRequestBytes))
+
+	if cfg.Room.DispatchQueueSize < 0 {
+		errs = append(errs, errors.New("room.dispatchQueueSize can't be negative"))
+	}
+
+	throttle := cfg.Auth.Throttle
+	if throttle.Rate <= 0 {
+		errs = append(errs, errors.New("auth.throttle.rate must be positive"))
+	}
+	if throttle.FreeFailures < 0 {
+		errs = append(errs, errors.New("auth.throttle.freeFailures can't be negative"))
+	}
+	if throttle.MaxBackoff < throttle.BaseBackoff {
+		errs = append(errs, errors.New("auth.throttle.maxBackoff can't be less than auth.throttle.baseBackoff"))
+	}
+
+	errs = append(errs, validateOIDC(cfg.Auth)...)
+
+	switch cfg.Room.OverflowPolicy {
+	case "drop-oldest", "drop-newest", "disconnect-slow-consumer":
+	default:
+		errs = append(errs, fmt.Errorf("room.overflowPolicy %q is unknown", cfg.Room.OverflowPolicy))
+	}
+	tls := cfg.HTTP.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		errs = append(errs, errors.New("http.tls.certFile and http.tls.keyFile must be set together"))
+	}
+	if len(tls.AutocertHosts) > 0 && tls.CertFile != "" {
+		errs = append(errs, errors.New("http.tls.autocertHosts can't be used with certificate files"))
+	}
+	if len(tls.AutocertHosts) > 0 && tls.AutocertCacheDir == "" {
+		errs = append(errs, errors.New("http.tls.autocertCacheDir must be set for autocert"))
+	}
+	errs = append(errs, validateCORS(cfg.HTTP.CORS)...)
+
+	switch cfg.Bus.Kind {
+	case "memory":
+	case "redis":
+		if cfg.Bus.RedisURL == "" || cfg.Bus.Subject == "" {
+			errs = append(errs, errors.New("bus.redisURL and bus.subject must be set for redis bus"))
+		}
+	case "nats":
+		if cfg.Bus.NATSURL == "" || cfg.Bus.Subject == "" {
+			errs = append(errs, errors.New("bus.natsURL and bus.subject must be set for nats bus"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("bus.kind %q is unknown", cfg.Bus.Kind))
+	}
+	if cfg.Overload.MaxUsers < 0 {
+		errs = append(errs, errors.New("overload.maxUsers must not be negative"))
+	}
+	if cfg.Room.EventHistoryCapacity < 0 {
+		errs = append(errs, errors.New("room.eventHistoryCapacity must not be negative"))
+	}
+	if cfg.Room.InboxCapacity < 0 {
+		errs = append(errs, errors.New("room.inboxCapacity must not be negative"))
+	}
+	if cfg.Room.UserMessageRate <= 0 {
+		errs = append(errs, errors.New("room.userMessageRate must be positive"))
+	}
+
+	if loss := cfg.Room.AudioOnlyPacketLoss; loss < 0 || loss > 1 {
+		errs = append(errs, errors.New("room.audioOnlyPacketLoss must be within [0, 1]"))
+	}
+	if loss := cfg.Room.AudioOnlyPacketLoss; loss > 0 && cfg.Room.AudioOnlyRecoverPacketLoss >= loss {
+		errs = append(errs, errors.New("room.audioOnlyRecoverPacketLoss must be below room.audioOnlyPacketLoss"))
+	}
+
+	if !cfg.Auth.LegacyTokensUntil.IsZero() && (cfg.Auth.TokenSalt == "" || cfg.Auth.TokenSalt == publicTokenSalt) {
+		errs = append(errs, errors.New("auth.legacyTokensUntil requires auth.tokenSalt other than the former default"))
+	}
+	if rate := cfg.Observability.DeliveryLogSampleRate; rate < 0 || rate > 1 {
+		errs = append(errs, errors.New("observability.deliveryLogSampleRate must be within [0, 1]"))
+	}
+	if format := cfg.Observability.AccessLogFormat; format != "json" && format != "apache" {
+		errs = append(errs, errors.New(`observability.accessLogFormat must be "json" or "apache"`))
+	}
+	if jitter := cfg.Room.CleanJitter; jitter < 0 || jitter >= 1 {
+		errs = append(errs, errors.New("room.cleanJitter must be within [0, 1)"))
+	}
+	if rate := cfg.Observability.InternalLogSampleRate; rate < 0 || rate > 1 {
+		errs = append(errs, errors.New("observability.internalLogSampleRate must be within [0, 1]"))
+	}
+	if cfg.Observability.LogRequestBodyBytes < 0 {
+		errs = append(errs, errors.New("observability.logRequestBodyBytes must not be negative"))
+	}
+	if cfg.Observability.AccessLogMaxBackups < 0 {
+		errs = append(errs, errors.New("observability.accessLogMaxBackups must not be negative"))
+	}
+	for _, threshold := range cfg.Occupancy.Thresholds {
+		positive("occupancy.thresholds item", int64(threshold))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateCORS checks origins are the sole "*", scheme://host[:port] or scheme://*.domain[:port]
+func validateCORS(cfg CORS) []error {
+	var errs []error
+	if len(cfg.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("http.cors.allowedOrigins must not be empty, list origins or use \"*\""))
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		errs = append(errs, errors.New("http.cors.allowedMethods must not be empty"))
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			if len(cfg.AllowedOrigins) > 1 {
+				errs = append(errs, errors.New(`http.cors.allowedOrigins can't mix "*" with other origins`))
+			}
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#@") {
+			errs = append(errs, fmt.Errorf("http.cors.allowedOrigins item %q must be scheme://host[:port]", origin))
+			continue
+		}
+		if domain, ok := strings.CutPrefix(host, "*."); ok && (domain == "" || strings.Contains(domain, "*")) ||
+			!ok && strings.Contains(host, "*") {
+			errs = append(errs, fmt.Errorf("http.cors.allowedOrigins item %q may only start host with \"*.\"", origin))
+		}
+	}
+
+	return errs
+}
+
+var providerNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+func validateOIDC(auth Auth) []error {
+	var errs []error
+
+	if auth.LoginRedirectURL != "" {
+		if !absoluteURL(auth.LoginRedirectURL) || strings.Contains(auth.LoginRedirectURL, "#") {
+			errs = append(errs, errors.New("auth.loginRedirectURL must be an absolute URL without fragment"))
+		}
+	}
+
+	names := make(map[string]bool, len(auth.OIDC))
+	for i, provider := range auth.OIDC {
+		prefix := fmt.Sprintf("auth.oidc[%d]", i)
+		switch {
+		case !providerNameRegexp.MatchString(provider.Name) || provider.Name == "local":
+			errs = append(errs, fmt.Errorf("%s.name %q is invalid", prefix, provider.Name))
+		case names[provider.Name]:
+			errs = append(errs, fmt.Errorf("%s.name %q is duplicated", prefix, provider.Name))
+		}
+		names[provider.Name] = true
+
+		if provider.ClientID == "" {
+			errs = append(errs, fmt.Errorf("%s.clientID is required", prefix))
+		}
+		if !absoluteURL(provider.Issuer) {
+			errs = append(errs, fmt.Errorf("%s.issuer must be an absolute URL", prefix))
+		}
+		if !absoluteURL(provider.RedirectURL) {
+			errs = append(errs, fmt.Errorf("%s.redirectURL must be an absolute URL", prefix))
+		}
+	}
+
+	return errs
+}
+
+func absoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.IsAbs() && u.Host != ""
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// applyEnv overrides fields tagged with env by the set environment variables, walking nested structs
+func applyEnv(cfg *Config) error {
+	return applyEnvToStruct(reflect.ValueOf(cfg).Elem())
+}
+
+func applyEnvToStruct(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct && field.Type() != timeType {
+			err := applyEnvToStruct(field)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		name := v.Type().Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		err := setFromString(field, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setFromString parses value into field. Lists are comma separated, maps are comma separated "key=value" pairs
+func setFromString(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(duration))
+	case field.Type() == timeType:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+
+		field.Set(reflect.ValueOf(t))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+
+		field.SetFloat(f)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(b)
+	case field.Kind() == reflect.Slice:
+		items := splitList(value)
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			err := setFromString(slice.Index(i), item)
+			if err != nil {
+				return fmt.Errorf("item %q: %w", item, err)
+			}
+		}
+
+		field.Set(slice)
+	case field.Kind() == reflect.Map && field.Type().Key().Kind() == reflect.String:
+		m := reflect.MakeMap(field.Type())
+		for _, pair := range splitList(value) {
+			key, item, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid item %q, key=value expected", pair)
+			}
+
+			elem := reflect.New(field.Type().Elem()).Elem()
+			err := setFromString(elem, item)
+			if err != nil {
+				return fmt.Errorf("item %q: %w", pair, err)
+			}
+
+			m.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+
+		field.Set(m)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// splitList parses comma separated list, empty string yields nil
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+
+	return items
+}
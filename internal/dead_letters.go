@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// DeadLetter describes an entity that was never delivered to its recipient. Entity data is not kept
+type DeadLetter struct {
+	Time        time.Time         `json:"time"`
+	Room        string            `json:"room"`
+	RecipientID string            `json:"recipientID"`
+	SenderID    string            `json:"senderID,omitempty"`
+	ActionType  models.ActionType `json:"actionType"`
+	MessageType string            `json:"messageType,omitempty"`
+	EntityTime  time.Time         `json:"entityTime"`
+	Reason      string            `json:"reason"`
+}
+
+// DeadLetters is a capped in-memory store of undeliverable entities. Nil store discards everything
+type DeadLetters struct {
+	letters []DeadLetter
+	next    int
+	full    bool
+	mux     *sync.RWMutex
+}
+
+func NewDeadLetters(capacity int) *DeadLetters {
+	return &DeadLetters{
+		letters: make([]DeadLetter, capacity),
+		mux:     &sync.RWMutex{},
+	}
+}
+
+func (d *DeadLetters) Record(room, recipientID string, entity models.ChannelEntity, reason string) {
+	if d == nil {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.letters[d.next] = DeadLetter{
+		Time:        time.Now(),
+		Room:        room,
+		RecipientID: recipientID,
+		SenderID:    entity.UserID,
+		ActionType:  entity.ActionType,
+		MessageType: entity.MessageType,
+		EntityTime:  entity.Time,
+		Reason:      reason,
+	}
+
+	d.next = (d.next + 1) % len(d.letters)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// List returns stored letters from the newest to the oldest. Empty room or recipientID matches any value
+func (d *DeadLetters) List(room, recipientID string) []DeadLetter {
+	if d == nil {
+		return nil
+	}
+
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+
+	count := d.next
+	if d.full {
+		count = len(d.letters)
+	}
+
+	out := make([]DeadLetter, 0)
+	for i := 1; i <= count; i++ {
+		letter := d.letters[(d.next-i+len(d.letters))%len(d.letters)]
+		if (room == "" || letter.Room == room) && (recipientID == "" || letter.RecipientID == recipientID) {
+			out = append(out, letter)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,26 @@
+// Package decode turns request bodies into validated DTOs
+package decode
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Request decodes JSON body into T and validates the result. It never panics on malformed input.
+// Size of the body is not limited here, the handlers.RequestBody middleware bounds it by http.maxRequestBytes
+func Request[T any](body io.Reader, validate *validator.Validate) (T, error) {
+	var dto T
+	err := json.NewDecoder(body).Decode(&dto)
+	if err != nil {
+		return dto, err
+	}
+
+	err = validate.Struct(dto)
+	if err != nil {
+		return dto, err
+	}
+
+	return dto, nil
+}
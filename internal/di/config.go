@@ -0,0 +1,277 @@
+package di
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/acme/autocert"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/accesslog"
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/bus"
+	"peer-messenger/internal/config"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/msgtype"
+	"peer-messenger/internal/roomconfig"
+	"peer-messenger/internal/services"
+	"peer-messenger/internal/support"
+	"peer-messenger/internal/users"
+)
+
+// newServiceOptions maps configuration onto service options
+func newServiceOptions(
+	cfg config.Config, logger *zap.Logger, messageTypes *msgtype.Registry,
+) (services.Options, error) {
+	opts := services.Options{
+		Room: internal.RoomOptions{
+			UserMessageRate:      cfg.Room.UserMessageRate,
+			UserMessageBurst:     cfg.Room.UserMessageBurst,
+			QueueSize:            cfg.Room.QueueSize,
+			MaxQueuedEntities:    cfg.Room.MaxQueuedEntities,
+			InactivityTimeout:    cfg.Room.InactivityTimeout,
+			PresenceTimeout:      cfg.Room.PresenceTimeout,
+			ProbeGracePeriod:     cfg.Room.ProbeGracePeriod,
+			LivenessWindow:       cfg.Room.LivenessWindow,
+			DeliveryTimeout:      cfg.Room.DeliveryTimeout,
+			DispatchQueueSize:    cfg.Room.DispatchQueueSize,
+			OverflowPolicy:       internal.OverflowPolicy(cfg.Room.OverflowPolicy),
+			ChatHistoryCapacity:  cfg.Room.ChatHistoryCapacity,
+			EventHistoryCapacity: cfg.Room.EventHistoryCapacity,
+			SDPLint:              cfg.Observability.SDPLint,
+			SDPCandidateTimeout:  cfg.Observability.SDPCandidateTimeout,
+			MessageTypes:         messageTypes,
+			E2EERequired:         cfg.Room.E2EERequired,
+		},
+		OfferPacing:                cfg.Room.OfferPacing,
+		PointerInterval:            cfg.Room.PointerInterval,
+		RemoveOnDisconnect:         cfg.Room.RemoveOnDisconnect,
+		TokenSalt:                  cfg.Auth.TokenSalt,
+		LegacyTokensUntil:          cfg.Auth.LegacyTokensUntil,
+		SessionTTL:                 cfg.Auth.SessionTTL,
+		SubscriptionSecret:         []byte(cfg.Auth.SubscriptionSecret),
+		LegacySubscriptionIDsUntil: cfg.Auth.LegacySubscriptionIDsUntil,
+		ResumeTokenTTL:             cfg.Auth.ResumeTokenTTL,
+		ReplayCapacity:             cfg.Auth.ReplayCapacity,
+		DeadLetterCapacity:         cfg.Observability.DeadLetterCapacity,
+		InboxCapacity:              cfg.Room.InboxCapacity,
+		Region:                     cfg.Regions.Region,
+		RegionURLs:                 cfg.Regions.URLs,
+		DeliveryLogSampleRate:      cfg.Observability.DeliveryLogSampleRate,
+		LogRoomsSummary:            cfg.Observability.LogRoomsSummary,
+		OccupancyWebhookURL:        cfg.Occupancy.WebhookURL,
+		MeetingWarmUp:              cfg.Meetings.WarmUp,
+		MeetingGrace:               cfg.Meetings.Grace,
+		MeetingWebhookURL:          cfg.Meetings.WebhookURL,
+		RoomExpiryGrace:            cfg.Room.ExpiryGrace,
+		OccupancyThresholds:        cfg.Occupancy.Thresholds,
+		OccupancyHysteresis:        cfg.Occupancy.Hysteresis,
+		ClientLogQuota:             cfg.Observability.ClientLogQuota,
+		BugReportCapacity:          cfg.Observability.BugReportCapacity,
+		OverloadMaxUsers:           cfg.Overload.MaxUsers,
+		OverloadRetryAfter:         cfg.Overload.RetryAfter,
+		AlternateURLs:              cfg.Overload.AlternateURLs,
+		AudioOnly: services.AudioOnlyRule{
+			DegradeAt: cfg.Room.AudioOnlyPacketLoss,
+			RecoverAt: cfg.Room.AudioOnlyRecoverPacketLoss,
+			Sustain:   cfg.Room.AudioOnlySustain,
+		},
+		Quotas: services.Quotas{
+			Rooms:           cfg.Quotas.Rooms,
+			ConcurrentUsers: cfg.Quotas.ConcurrentUsers,
+			MessagesPerDay:  cfg.Quotas.MessagesPerDay,
+			HistoryBytes:    cfg.Quotas.HistoryBytes,
+		},
+	}
+
+	if len(opts.SubscriptionSecret) == 0 {
+		logger.Warn("subscription secret is not set, subscriptionIDs will not survive restart")
+
+		opts.SubscriptionSecret = make([]byte, 32)
+		_, err := rand.Read(opts.SubscriptionSecret)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.AuthProviders = newAuthProviders(cfg.Auth.OIDC)
+
+	return opts, nil
+}
+
+// newAuthProviders creates identity providers, they share a client so slow providers don't hold logins forever
+func newAuthProviders(providers []config.OIDCProvider) []authn.RedirectProvider {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	out := make([]authn.RedirectProvider, 0, len(providers))
+	for _, provider := range providers {
+		out = append(out, authn.NewOIDC(authn.OIDCConfig{
+			Name:         provider.Name,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  provider.RedirectURL,
+			Scopes:       provider.Scopes,
+			UserIDClaim:  provider.UserIDClaim,
+			UserIDPrefix: provider.UserIDPrefix,
+		}, client))
+	}
+
+	return out
+}
+
+// newMessageTypes builds the registry of peer message types, types without rate class are rate limited
+func newMessageTypes(cfg config.MessageTypes) (*msgtype.Registry, error) {
+	types := make([]msgtype.Type, 0, len(cfg.Types))
+	for _, t := range cfg.Types {
+		rate := msgtype.RateClass(t.RateClass)
+		if rate == "" {
+			rate = msgtype.RateLimited
+		}
+
+		types = append(types, msgtype.Type{
+			Name:      t.Name,
+			Required:  t.Required,
+			Priority:  models.Priority(t.Priority),
+			Rate:      rate,
+			Plaintext: t.Plaintext,
+		})
+	}
+
+	registry, err := msgtype.New(types, msgtype.UnknownPolicy(cfg.Unknown))
+	if err != nil {
+		return nil, fmt.Errorf("messageTypes: %w", err)
+	}
+
+	return registry, nil
+}
+
+// newUserStore keeps registered users in the JSON file or in memory if the path is not configured
+func newUserStore(cfg config.Config, logger *zap.Logger) (users.Store, error) {
+	if cfg.Auth.UserStorePath == "" {
+		logger.Warn("user store path is not set, registered users will not survive restart")
+		return users.NewMemoryStore(), nil
+	}
+
+	return users.OpenFileStore(cfg.Auth.UserStorePath)
+}
+
+// newBus connects to the bus shared by instances, nil for a single instance
+func newBus(cfg config.Config, logger *zap.Logger) (bus.Bus, error) {
+	switch cfg.Bus.Kind {
+	case "redis":
+		return bus.NewRedis(cfg.Bus.RedisURL, cfg.Bus.Subject, logger)
+	case "nats":
+		return bus.NewNATS(cfg.Bus.NATSURL, cfg.Bus.Subject, logger)
+	default:
+		return nil, nil
+	}
+}
+
+// roomStoreOpenTimeout bounds connecting to the room store and migrating its schema on start
+const roomStoreOpenTimeout = 30 * time.Second
+
+// newRoomConfigs opens the store of pre-created rooms, nil when it is not configured
+func newRoomConfigs(cfg config.RoomStore) (*roomconfig.Postgres, error) {
+	if cfg.PostgresDSN == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), roomStoreOpenTimeout)
+	defer cancel()
+
+	return roomconfig.OpenPostgres(ctx, cfg.PostgresDSN)
+}
+
+// newTLSConfig builds TLS config of the api server, nil when TLS is not configured.
+// Autocert answers TLS-ALPN challenges itself, so no plain HTTP port is needed for them
+func newTLSConfig(cfg config.TLS) (*tls.Config, error) {
+	switch {
+	case len(cfg.AutocertHosts) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertHosts...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+
+		tlsConfig := manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+
+		return tlsConfig, nil
+	case cfg.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls certificate: %w", err)
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newClientLogger builds the separate sink for client-reported logs, nil if the path is not configured.
+// Caller and stacktraces are left out, they would point at the server code writing the entry
+func newClientLogger(cfg config.Config) (*zap.Logger, error) {
+	if cfg.Observability.ClientLogPath == "" {
+		return nil, nil
+	}
+
+	logConfig := zap.NewProductionConfig()
+	logConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logConfig.Level.SetLevel(zapcore.DebugLevel)
+	logConfig.DisableCaller = true
+	logConfig.DisableStacktrace = true
+	logConfig.Sampling = nil
+	logConfig.OutputPaths = []string{cfg.Observability.ClientLogPath}
+
+	return logConfig.Build()
+}
+
+// newAccessLog opens the access log sink, nil if the path is not configured. The file is closed by the returned closer
+func newAccessLog(cfg config.Observability) (*accesslog.Logger, io.Closer, error) {
+	if cfg.AccessLogPath == "" {
+		return nil, nil, nil
+	}
+
+	file, err := accesslog.OpenRotatingFile(cfg.AccessLogPath, int64(cfg.AccessLogMaxSizeMB)<<20, cfg.AccessLogMaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log, err := accesslog.New(file, cfg.AccessLogFormat)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	return log, file, nil
+}
+
+// redactedConfig is the configuration snapshot safe to share in support bundles
+func redactedConfig(cfg config.Config) config.Config {
+	cfg.Auth.TokenSalt = support.Redacted
+	cfg.Auth.AdminToken = support.Redacted
+	cfg.Auth.SubscriptionSecret = support.Redacted
+	cfg.Auth.CanaryToken = support.Redacted
+	cfg.Auth.OIDC = slices.Clone(cfg.Auth.OIDC)
+	for i := range cfg.Auth.OIDC {
+		cfg.Auth.OIDC[i].ClientSecret = support.Redacted
+	}
+	cfg.Occupancy.WebhookURL = support.Redacted
+	cfg.Meetings.WebhookURL = support.Redacted
+	cfg.Bus.NATSURL = support.Redacted
+	cfg.Bus.RedisURL = support.Redacted
+	cfg.RoomStore.PostgresDSN = support.Redacted
+
+	return cfg
+}
@@ -0,0 +1,223 @@
+// Package di is the composition root: it builds all components in dependency order
+// and registers their start and stop hooks in the lifecycle
+package di
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/authlimit"
+	"peer-messenger/internal/codec"
+	"peer-messenger/internal/config"
+	"peer-messenger/internal/grpcapi"
+	"peer-messenger/internal/handlers"
+	"peer-messenger/internal/janitor"
+	"peer-messenger/internal/lifecycle"
+	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/services"
+	"peer-messenger/internal/support"
+	"peer-messenger/internal/tracing"
+	"peer-messenger/internal/validation"
+)
+
+type Container struct {
+	Lifecycle *lifecycle.Lifecycle
+	// Engine serves the public API, it is served on http.apiAddr unless the address is empty
+	Engine  *gin.Engine
+	Service *services.PeerMessenger
+	Metrics *metrics.Metrics
+}
+
+// New wires the application. Nothing is started until Lifecycle.Start is called
+func New(cfg config.Config, logger *zap.Logger, logLevel zap.AtomicLevel, logRing *support.LogRing) (*Container, error) {
+	messageTypes, err := newMessageTypes(cfg.MessageTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	validate := validation.New(messageTypes)
+
+	prom := metrics.New(metrics.DefaultOptions())
+	logger.Info("json codec of bus messages", zap.String("codec", codec.Name))
+
+	var shutdownTracing func(context.Context) error
+	if cfg.Observability.Tracing {
+		shutdownTracing, err = tracing.Setup(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serviceOpts, err := newServiceOptions(cfg, logger, messageTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	userStore, err := newUserStore(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceOpts.ClientLogger, err = newClientLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceOpts.Bus, err = newBus(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	roomConfigs, err := newRoomConfigs(cfg.RoomStore)
+	if err != nil {
+		return nil, err
+	}
+	if roomConfigs != nil {
+		serviceOpts.RoomConfigs = roomConfigs
+	}
+
+	service := services.NewPeerMessenger(logger, prom, userStore, serviceOpts)
+	handler := handlers.NewPeerMessenger(logger, validate, service, handlers.Options{
+		SSEHeartbeatInterval: cfg.HTTP.SSEHeartbeatInterval,
+		LoginRedirectURL:     cfg.Auth.LoginRedirectURL,
+	})
+	bundle := support.NewBundle(logRing, redactedConfig(cfg), prom.Reg, func() any {
+		return service.RoomsSnapshot(context.Background())
+	})
+	roomJanitor := janitor.New(logger.Named("janitor"), prom, janitor.Options{
+		Interval: cfg.Room.CleanInterval,
+		Jitter:   cfg.Room.CleanJitter,
+	}, service.Clean)
+	adminHandler := handlers.NewAdmin(logger, validate, service, bundle, roomJanitor)
+
+	accessLog, accessLogFile, err := newAccessLog(cfg.Observability)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyOpts := handlers.RequestBodyOptions{
+		MaxBytes:       int64(cfg.HTTP.MaxRequestBytes),
+		LogBytes:       cfg.Observability.LogRequestBodyBytes,
+		RedactedFields: cfg.Observability.RedactedFields,
+	}
+	trafficOpts := handlers.TrafficOptions{
+		CanaryToken:   cfg.Auth.CanaryToken,
+		AdminPaths:    []string{"/admin", "/tenant/usage"},
+		ProbePaths:    []string{"/ping", "/metrics"},
+		LogSampleRate: cfg.Observability.InternalLogSampleRate,
+	}
+	authLimiter := authlimit.New(logger.Named("authlimit"), prom, authlimit.Options{
+		Rate:         cfg.Auth.Throttle.Rate,
+		Burst:        cfg.Auth.Throttle.Burst,
+		FreeFailures: cfg.Auth.Throttle.FreeFailures,
+		BaseBackoff:  cfg.Auth.Throttle.BaseBackoff,
+		MaxBackoff:   cfg.Auth.Throttle.MaxBackoff,
+	})
+	engine, err := newRouter(
+		cfg.HTTP, cfg.Auth.AdminToken, logger, logLevel, prom, trafficOpts, bodyOpts, accessLog, authLimiter,
+		handler, adminHandler,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	onServeError := func(err error) {
+		logger.Error("http server stopped unexpectedly", zap.Error(err))
+	}
+
+	// workers are counted in goroutines by subsystem under their names
+	worker := func(name string, run func(ctx context.Context)) lifecycle.Hook {
+		return lifecycle.Worker(name, func(ctx context.Context) {
+			defer prom.TrackGoroutine(name)()
+			run(ctx)
+		})
+	}
+
+	lc := lifecycle.New(logger)
+	if shutdownTracing != nil {
+		// stopped last to export spans of everything stopped before
+		lc.Append(lifecycle.Hook{Name: "tracing", Stop: shutdownTracing})
+	}
+	lc.Append(lifecycle.Hook{Name: "janitor", Start: roomJanitor.Start, Stop: roomJanitor.Stop})
+	lc.Append(worker("occupancy webhooks", service.RunOccupancyWebhooks))
+	lc.Append(worker("pointer flush", service.RunPointerFlush))
+	lc.Append(worker("liveness sweep", service.RunLivenessSweep))
+	lc.Append(worker("meetings", service.RunMeetings))
+	lc.Append(worker("auth limit prune", authLimiter.Run))
+	if cfg.HTTP.MetricsAddr != "" {
+		lc.Append(lifecycle.HTTPServer(
+			"metrics server", &http.Server{Addr: cfg.HTTP.MetricsAddr, Handler: newMetricsRouter(prom)}, onServeError,
+		))
+	}
+	if serviceOpts.ClientLogger != nil {
+		lc.Append(lifecycle.Hook{
+			Name: "client log",
+			Stop: func(context.Context) error {
+				return serviceOpts.ClientLogger.Sync()
+			},
+		})
+	}
+	if accessLogFile != nil {
+		// closed after api server, requests in flight are logged
+		lc.Append(lifecycle.Hook{
+			Name: "access log",
+			Stop: func(context.Context) error {
+				return accessLogFile.Close()
+			},
+		})
+	}
+	if serviceOpts.Bus != nil {
+		// closed after api server, messages sent by requests in flight still reach other instances
+		lc.Append(lifecycle.Hook{
+			Name: "message bus",
+			Start: func(context.Context) error {
+				return serviceOpts.Bus.Subscribe(service.ReceiveForwarded, service.AdoptRoom)
+			},
+			Stop: func(context.Context) error {
+				return serviceOpts.Bus.Close()
+			},
+		})
+	}
+	if roomConfigs != nil {
+		// closed after api server, requests in flight may still load rooms
+		lc.Append(lifecycle.Hook{
+			Name: "room store",
+			Stop: func(context.Context) error {
+				roomConfigs.Close()
+				return nil
+			},
+		})
+	}
+	apiTLS, err := newTLSConfig(cfg.HTTP.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HTTP.APIAddr != "" {
+		lc.Append(lifecycle.HTTPServer(
+			"api server", &http.Server{Addr: cfg.HTTP.APIAddr, Handler: engine, TLSConfig: apiTLS}, onServeError,
+		))
+	}
+	if cfg.HTTP.GRPCAddr != "" {
+		lc.Append(lifecycle.GRPCListener(
+			"grpc server", cfg.HTTP.GRPCAddr, grpcapi.NewServer(logger, validate, service), onServeError,
+		))
+	}
+	// stopped before api server: subscriptions are long-lived and must be closed before waiting for active requests
+	lc.Append(lifecycle.Hook{
+		Name: "subscriptions drain",
+		Stop: func(ctx context.Context) error {
+			service.Shutdown(ctx)
+			return nil
+		},
+	})
+
+	return &Container{
+		Lifecycle: lc,
+		Engine:    engine,
+		Service:   service,
+		Metrics:   prom,
+	}, nil
+}
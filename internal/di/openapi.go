@@ -0,0 +1,390 @@
+package di
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/handlers"
+	"peer-messenger/internal/janitor"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/openapi"
+	"peer-messenger/internal/search"
+	"peer-messenger/internal/services"
+)
+
+const apiVersion = "1"
+
+type statusResponse = map[string]any
+
+var okResponse = statusResponse{"status": ""}
+
+// publicOperations describe routes of the public API. Keep them in sync with newRouter,
+// undocumented routes are reported on start
+var publicOperations = []openapi.Operation{
+	{Method: http.MethodGet, Path: "/ping", Summary: "Liveness check", Response: statusResponse{"info": ""}},
+	{
+		Method: http.MethodGet, Path: "/time", Summary: "Server clock for client clock offset estimation",
+		Query: models.ServerTimeRequest{}, Response: models.ServerTimeResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/register", Summary: "Register user",
+		Body: models.RegisterRequest{}, Status: http.StatusCreated, Response: okResponse,
+	},
+	{
+		Method: http.MethodPost, Path: "/login", Summary: "Log in and get session token",
+		Body: models.LoginRequest{}, Response: models.LoginResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/auth/providers", Summary: "List providers users may log in with",
+		Response: models.AuthProvidersResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/auth/:provider/login", Summary: "Redirect to login page of identity provider",
+		Status: http.StatusFound,
+	},
+	{
+		Method: http.MethodGet, Path: "/auth/:provider/callback",
+		Summary: "Complete login with identity provider, redirects to loginRedirectURL when configured",
+		Query:   models.LoginCallbackQuery{}, Response: models.LoginResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/logout", Summary: "Revoke session token, its device leaves rooms", Auth: openapi.AuthSession,
+		Response: statusResponse{"rooms": []string{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/me/sessions", Summary: "List sessions of the caller on all devices",
+		Auth: openapi.AuthSession, Response: statusResponse{"sessions": []models.Session{}},
+	},
+	{
+		Method: http.MethodDelete, Path: "/me/sessions/:id", Summary: "Revoke session, its device leaves rooms",
+		Auth: openapi.AuthSession, Response: okResponse,
+	},
+	{
+		Method: http.MethodPost, Path: "/me/leave-all", Summary: "Leave all rooms", Auth: openapi.AuthSession,
+		Response: statusResponse{"rooms": []string{}},
+	},
+	{
+		Method: http.MethodPost, Path: "/channels/:name/join", Summary: "Join or create room", Auth: openapi.AuthSession,
+		Body: models.JoinChannelRequest{}, OptionalBody: true, Response: models.JoinChannelResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/join", Summary: "Join or create room, use /channels/{name}/join",
+		Auth: openapi.AuthSession, Body: models.JoinChannelRequest{}, Response: models.JoinChannelResponse{}, Deprecated: true,
+	},
+	{
+		Method: http.MethodPost, Path: "/channels/:name/leave", Summary: "Leave room", Auth: openapi.AuthSession,
+		Response: okResponse,
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/leave", Summary: "Leave room, use /channels/{name}/leave",
+		Auth: openapi.AuthSession, Body: models.ChannelRequest{}, Response: okResponse, Deprecated: true,
+	},
+	{
+		Method: http.MethodGet, Path: "/channels/:name/events", Summary: "Stream room entities as server-sent events",
+		Query: models.SubscribeRequest{}, Response: models.ChannelEntity{}, ContentType: "text/event-stream",
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/subscribe",
+		Summary: "Stream room entities as server-sent events, use /channels/{name}/events",
+		Query:   models.SubscribeRequest{}, Response: models.ChannelEntity{}, ContentType: "text/event-stream", Deprecated: true,
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/members", Summary: "List room members page by page", Auth: openapi.AuthSession,
+		Query: models.MembersRequest{}, Response: models.MembersResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channels/:name/heartbeat",
+		Summary: "Liveness heartbeat, members that stop sending them are removed within the window",
+		Auth:    openapi.AuthSession, Response: models.LivenessResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/channels/:name/topology", Summary: "Peers to offer to and to answer",
+		Auth: openapi.AuthSession, Response: models.TopologyHints{},
+	},
+	{
+		Method: http.MethodPut, Path: "/channels/:name/topology", Summary: "Set mesh or SFU topology of the member",
+		Auth: openapi.AuthSession, Body: models.TopologyRequest{}, Response: models.TopologyHints{},
+	},
+	{
+		Method: http.MethodGet, Path: "/channels/:name/members", Summary: "Presence of room members", Auth: openapi.AuthSession,
+		Response: statusResponse{"members": []models.MemberPresence{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/:name/members", Summary: "Presence of room members, use /channels/{name}/members",
+		Auth: openapi.AuthSession, Response: statusResponse{"members": []models.MemberPresence{}}, Deprecated: true,
+	},
+	{
+		Method: http.MethodGet, Path: "/channels/:name/entry-form", Summary: "Questions to answer when joining the room",
+		Auth: openapi.AuthSession, Response: models.EntryForm{},
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/:name/entry-form",
+		Summary: "Questions to answer when joining the room, use /channels/{name}/entry-form",
+		Auth:    openapi.AuthSession, Response: models.EntryForm{}, Deprecated: true,
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/presence", Summary: "Presence heartbeat", Auth: openapi.AuthSession,
+		Body: models.PresenceRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/collect", Summary: "Poll pending room entities",
+		Query: struct {
+			SubscriptionID string `form:"subscriptionID" validate:"required"`
+		}{},
+		Response: statusResponse{"entities": []models.ChannelEntity{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/history", Summary: "Page room entities visible to the member",
+		Auth: openapi.AuthSession, Query: models.HistoryRequest{}, Response: models.HistoryResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/channel/history/search", Summary: "Search chat history of the room",
+		Auth: openapi.AuthSession, Query: models.HistorySearchRequest{}, Response: statusResponse{"messages": []search.Document{}},
+	},
+	{
+		Method: http.MethodPost, Path: "/peer/send", Summary: "Send message to room member", Auth: openapi.AuthSession,
+		Body: models.SendToPeerRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/peer/send-batch", Summary: "Send several messages to room members at once",
+		Auth: openapi.AuthSession, Body: models.SendBatchRequest{}, Response: models.SendBatchResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/peer/signal", Summary: "Send offer, answer, ICE candidate or renegotiation request",
+		Auth: openapi.AuthSession, Body: models.SignalRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/peer/ack", Summary: "Acknowledge reading of message", Auth: openapi.AuthSession,
+		Body: models.AckRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/service/broadcast", Summary: "Broadcast control message, service accounts only",
+		Auth: openapi.AuthSession, Body: models.BroadcastRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/captions", Summary: "Publish caption segment, service accounts only",
+		Auth: openapi.AuthSession, Body: models.CaptionRequest{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/channels/:name", Summary: "Delete room, only its owner and moderators may", Auth: openapi.AuthSession,
+		Body: models.RemoveRoomRequest{}, OptionalBody: true,
+	},
+	{
+		Method: http.MethodDelete, Path: "/room/delete", Summary: "Delete room, use /channels/{name}", Auth: openapi.AuthSession,
+		Body: models.RemoveRoomRequest{}, Deprecated: true,
+	},
+	{
+		Method: http.MethodPost, Path: "/metrics/resolution", Summary: "Report stream resolution", Auth: openapi.AuthSession,
+		Body: models.ResolutionRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/peer/connection-state", Summary: "Report peer connection state",
+		Auth: openapi.AuthSession, Body: models.ConnectionStateRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/metrics/network", Summary: "Report packet loss", Auth: openapi.AuthSession,
+		Body: models.NetworkStatsRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/pointer", Summary: "Move shared pointer, moves are coalesced per interval",
+		Auth: openapi.AuthSession, Body: models.PointerRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/match/find", Summary: "Wait for a match and join its room", Auth: openapi.AuthSession,
+		Body: models.MatchRequest{}, Response: models.MatchResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/client-logs", Summary: "Upload batch of client logs", Auth: openapi.AuthSession,
+		Body: models.ClientLogsRequest{},
+	},
+	{
+		Method: http.MethodPost, Path: "/channel/bug-report", Summary: "Report a bug with the caller's view of the room",
+		Auth: openapi.AuthSession, Body: models.BugReportRequest{}, Response: models.BugReportResponse{},
+	},
+}
+
+var adminOperations = []openapi.Operation{
+	{
+		Method: http.MethodGet, Path: "/tenant/usage", Summary: "Usage against soft quotas", Auth: openapi.AuthAdmin,
+		Response: services.Usage{},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/rooms", Summary: "List rooms page by page", Auth: openapi.AuthAdmin,
+		Query: models.RoomsRequest{}, Response: services.RoomsPage{},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/rooms/:name", Summary: "Room state", Auth: openapi.AuthAdmin,
+		Response: internal.RoomInfo{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/admin/rooms/:name", Summary: "Delete room, after grace if given",
+		Auth: openapi.AuthAdmin, Query: models.DeleteRoomRequest{}, Response: okResponse,
+	},
+	{
+		Method: http.MethodDelete, Path: "/admin/rooms/:name/users/:id", Summary: "Kick user", Auth: openapi.AuthAdmin,
+		Query: models.KickRequest{}, Response: okResponse,
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/moderators/:id", Summary: "Make member a moderator",
+		Auth: openapi.AuthAdmin, Response: okResponse,
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/rooms/:name/bans", Summary: "Ban user", Auth: openapi.AuthAdmin,
+		Body: models.BanRequest{}, Response: okResponse,
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/captions", Summary: "Enable or disable captions",
+		Auth: openapi.AuthAdmin, Body: models.CaptionsSettingsRequest{}, Response: okResponse,
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/locale", Summary: "Set room language and time zone",
+		Auth: openapi.AuthAdmin, Body: models.Locale{}, Response: models.Locale{},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/entry-form", Summary: "Set questions asked from joining members",
+		Auth: openapi.AuthAdmin, Body: models.EntryForm{}, Response: models.EntryForm{},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/rooms/:name/config", Summary: "Config of pre-created room",
+		Auth: openapi.AuthAdmin, Response: internal.RoomConfig{},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/config", Summary: "Pre-create room kept across restarts",
+		Auth: openapi.AuthAdmin, Body: models.RoomConfigRequest{}, Response: internal.RoomConfig{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/admin/rooms/:name/config", Summary: "Forget pre-created room",
+		Auth: openapi.AuthAdmin, Response: okResponse,
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/rooms/:name/policy", Summary: "Room message policy", Auth: openapi.AuthAdmin,
+		Response: models.RoomPolicy{},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/rooms/:name/policy", Summary: "Replace room message policy",
+		Auth: openapi.AuthAdmin, Body: models.RoomPolicy{}, Response: models.RoomPolicy{},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/rooms/:name/history/search", Summary: "Search chat history (audited)",
+		Auth: openapi.AuthAdmin, Query: models.HistorySearchRequest{}, Response: statusResponse{"messages": []search.Document{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/users/:id", Summary: "User memberships and pending entities (audited)",
+		Auth: openapi.AuthAdmin, Response: statusResponse{"rooms": []internal.UserRoomState{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/events", Summary: "Stream admin events as server-sent events",
+		Auth: openapi.AuthAdmin, Response: services.AdminEvent{}, ContentType: "text/event-stream",
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/log-level", Summary: "Current log level", Auth: openapi.AuthAdmin,
+		Response: statusResponse{"level": ""},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/log-level", Summary: "Change log level", Auth: openapi.AuthAdmin,
+		Body: statusResponse{"level": ""}, Response: statusResponse{"level": ""},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/support-bundle", Summary: "Zip with logs, config, rooms, goroutines and metrics",
+		Auth: openapi.AuthAdmin, Response: "", ContentType: "application/zip",
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/dead-letters", Summary: "Entities that were never delivered",
+		Auth: openapi.AuthAdmin, Response: statusResponse{"deadLetters": []internal.DeadLetter{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/cleaner", Summary: "Janitor schedule", Auth: openapi.AuthAdmin,
+		Response: janitor.Status{},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/service-accounts", Summary: "Create service account, token is shown once",
+		Auth: openapi.AuthAdmin, Body: models.ServiceAccountRequest{}, Status: http.StatusCreated,
+		Response: models.ServiceAccountResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/experiments", Summary: "List experiments", Auth: openapi.AuthAdmin,
+		Response: statusResponse{"experiments": []models.Experiment{}},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/experiments/:name", Summary: "Create or replace experiment",
+		Auth: openapi.AuthAdmin, Body: models.Experiment{}, Response: models.Experiment{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/admin/experiments/:name", Summary: "Delete experiment", Auth: openapi.AuthAdmin,
+		Response: okResponse,
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/meetings", Summary: "List scheduled meetings", Auth: openapi.AuthAdmin,
+		Response: statusResponse{"meetings": []models.Meeting{}},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/meetings/:name", Summary: "Schedule meeting, its room is created ahead",
+		Auth: openapi.AuthAdmin, Body: models.Meeting{}, Response: models.Meeting{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/admin/meetings/:name", Summary: "Unschedule meeting", Auth: openapi.AuthAdmin,
+		Response: okResponse,
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/load-shedding", Summary: "Load shedding state", Auth: openapi.AuthAdmin,
+		Response: services.LoadShedding{},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/load-shedding", Summary: "Turn manual load shedding on or off",
+		Auth: openapi.AuthAdmin, Body: models.LoadSheddingRequest{}, Response: services.LoadShedding{},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/notices", Summary: "Publish server notice to the room or all rooms",
+		Auth: openapi.AuthAdmin, Body: models.NoticeRequest{}, Response: okResponse,
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/bug-reports/:id", Summary: "Bug report with its signature",
+		Auth: openapi.AuthAdmin, Response: services.SignedBugReport{},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/bug-reports/verify", Summary: "Check that bug report was not edited",
+		Auth: openapi.AuthAdmin, Body: services.SignedBugReport{}, Response: statusResponse{"valid": true},
+	},
+}
+
+// newAPIDocument describes the routes registered on engine. Admin routes are described only when they are enabled,
+// so the document does not advertise what the server does not serve
+func newAPIDocument(adminEnabled bool) openapi.Document {
+	ops := publicOperations
+	if adminEnabled {
+		ops = append(append([]openapi.Operation{}, publicOperations...), adminOperations...)
+	}
+
+	return openapi.Build("peer-messenger", apiVersion, handlers.ErrorResponse{}, ops)
+}
+
+// warnUndocumentedRoutes reports routes missing from the API document, documentation routes themselves excluded
+func warnUndocumentedRoutes(logger *zap.Logger, routes gin.RoutesInfo, adminEnabled bool) {
+	documented := make(map[string]struct{})
+	for _, op := range publicOperations {
+		documented[op.Method+" "+op.Path] = struct{}{}
+	}
+	if adminEnabled {
+		for _, op := range adminOperations {
+			documented[op.Method+" "+op.Path] = struct{}{}
+		}
+	}
+
+	for _, route := range routes {
+		path := route.Path
+		if path[0] != '/' {
+			path = "/" + path
+		}
+
+		switch path {
+		case "/openapi.json", "/docs", "/metrics", "/admin/log-level":
+			continue
+		}
+		if _, ok := documented[route.Method+" "+path]; !ok {
+			logger.Warn("route is missing from API document", zap.String("method", route.Method), zap.String("path", path))
+		}
+	}
+}
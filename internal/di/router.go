@@ -0,0 +1,290 @@
+package di
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/accesslog"
+	"peer-messenger/internal/authlimit"
+	"peer-messenger/internal/config"
+	"peer-messenger/internal/handlers"
+	"peer-messenger/internal/metrics"
+)
+
+// unmatchedRoute labels metrics of requests no route matched
+const unmatchedRoute = "unmatched"
+
+// newRouter builds the public API engine with its middlewares and routes. Requests are written
+// to the access log when it is set, internal traffic only sampled. Admin routes are registered only
+// when admin token is set. Without separate metrics address /metrics is served here, behind admin token
+// if there is one
+func newRouter(
+	httpCfg config.HTTP,
+	adminToken string,
+	logger *zap.Logger,
+	logLevel zap.AtomicLevel,
+	prom *metrics.Metrics,
+	trafficOpts handlers.TrafficOptions,
+	bodyOpts handlers.RequestBodyOptions,
+	accessLog *accesslog.Logger,
+	authLimiter *authlimit.Limiter,
+	handler *handlers.PeerMessenger,
+	adminHandler *handlers.Admin,
+) (*gin.Engine, error) {
+	engine := gin.New()
+
+	// client IP is taken from proxy headers only when request comes from a trusted proxy
+	err := engine.SetTrustedProxies(httpCfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if len(httpCfg.TrustedProxyHeaders) > 0 {
+		engine.RemoteIPHeaders = httpCfg.TrustedProxyHeaders
+	}
+
+	engine.Use(gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		logger.Error("recovered from panic", zap.Any("panic", recovered), zap.String("path", c.Request.URL.Path))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+
+	engine.Use(handlers.RequestID())
+	engine.Use(handlers.ClassifyTraffic(trafficOpts))
+
+	// spans of requests are no-op unless tracing is set up
+	engine.Use(otelgin.Middleware("peer-messenger"))
+
+	engine.Use(cors.New(newCORSConfig(httpCfg.CORS)))
+
+	engine.Use(func(c *gin.Context) {
+		startTime := time.Now()
+
+		c.Next()
+
+		// routes label requests rather than paths, so room names and unknown paths don't multiply the series
+		path := c.FullPath()
+		if path == "" {
+			path = unmatchedRoute
+		}
+
+		// admin, probe and canary requests are kept out of the public metrics SLOs are measured on
+		status, elapsed := strconv.Itoa(c.Writer.Status()), time.Since(startTime).Seconds()
+		if traffic := handlers.GetTrafficClass(c); traffic != handlers.TrafficPublic {
+			prom.InternalRequestsTotal.WithLabelValues(traffic, path, c.Request.Method, status).Inc()
+			prom.InternalRequestDuration.WithLabelValues(traffic, path, c.Request.Method, status).Observe(elapsed)
+			return
+		}
+
+		prom.RequestsTotal.WithLabelValues(path, c.Request.Method, status).Inc()
+		prom.RequestDuration.WithLabelValues(path, c.Request.Method, status).Observe(elapsed)
+	})
+
+	if accessLog != nil {
+		// wraps the errors middleware, so the logged status is the one sent
+		engine.Use(handlers.AccessLog(logger, accessLog))
+	}
+
+	// registered after the metrics middleware, so the error status is written before it is counted
+	engine.Use(handlers.Errors(logger))
+
+	// inside the errors middleware, so oversized bodies are answered with 413
+	engine.Use(handlers.RequestBody(logger, bodyOpts))
+
+	engine.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, map[string]string{"info": "pong"})
+	})
+
+	engine.GET("/time", handler.Time)
+	// per IP and user ID, so passwords can't be guessed and user IDs enumerated at full speed
+	authLimit := handlers.AuthLimit(authLimiter)
+	engine.POST("/register", authLimit, handler.Register)
+	engine.POST("/login", authLimit, handler.Login)
+	engine.GET("/auth/providers", handler.AuthProviders)
+	engine.GET("/auth/:provider/login", authLimit, handler.BeginLogin)
+	engine.GET("/auth/:provider/callback", authLimit, handler.CompleteLogin)
+	engine.POST("/logout", handler.Logout)
+	engine.POST("/me/leave-all", handler.LeaveAll)
+	engine.GET("/me/sessions", handler.Sessions)
+	engine.DELETE("/me/sessions/:id", handler.RevokeSession)
+	engine.GET("/channel/members", handler.Members)
+	engine.POST("/channel/presence", handler.Heartbeat)
+	engine.POST("/channel/collect", handler.CollectMessages)
+	engine.GET("/channel/history", handler.History)
+	engine.GET("/channel/history/search", handler.SearchHistory)
+	engine.POST("/peer/send", handler.SendToPeer)
+	engine.POST("/peer/send-batch", handler.SendBatch)
+	engine.POST("/peer/signal", handler.Signal)
+	engine.POST("/peer/ack", handler.AckMessage)
+	engine.POST("/service/broadcast", handler.Broadcast)
+	engine.POST("/channel/captions", handler.PublishCaption)
+	engine.POST("/metrics/resolution", handler.CollectResolution)
+	engine.POST("/peer/connection-state", handler.ReportConnectionState)
+	engine.POST("/metrics/network", handler.ReportNetworkStats)
+	engine.POST("/channel/pointer", handler.MovePointer)
+	engine.POST("/match/find", handler.FindMatch)
+	engine.POST("/client-logs", handler.CollectClientLogs)
+	engine.POST("/channel/bug-report", handler.ReportBug)
+
+	channels := engine.Group("/channels/:name")
+	channels.POST("/join", handler.JoinChannel)
+	channels.POST("/leave", handler.LeaveChannel)
+	channels.DELETE("", handler.RemoveRoom)
+	channels.GET("/events", handler.Subscribe)
+	channels.POST("/heartbeat", handler.Liveness)
+	channels.GET("/topology", handler.TopologyHints)
+	channels.PUT("/topology", handler.SetTopology)
+	channels.GET("/members", handler.Presence)
+	channels.GET("/entry-form", handler.EntryForm)
+
+	// aliases of the routes above taking the room from body or query, kept for one release
+	engine.POST("/channel/join", handlers.Deprecated("/channels/{name}/join"), handler.JoinChannel)
+	engine.POST("/channel/leave", handlers.Deprecated("/channels/{name}/leave"), handler.LeaveChannel)
+	engine.DELETE("/room/delete", handlers.Deprecated("/channels/{name}"), handler.RemoveRoom)
+	engine.GET("/channel/subscribe", handlers.Deprecated("/channels/{name}/events"), handler.Subscribe)
+	engine.GET("/channel/:name/members", handlers.Deprecated("/channels/{name}/members"), handler.Presence)
+	engine.GET("/channel/:name/entry-form", handlers.Deprecated("/channels/{name}/entry-form"), handler.EntryForm)
+
+	if httpCfg.MetricsAddr == "" {
+		metricsHandlers := []gin.HandlerFunc{gin.WrapH(newMetricsHandler(prom))}
+		if adminToken != "" {
+			metricsHandlers = append([]gin.HandlerFunc{handlers.AdminAuth(adminToken)}, metricsHandlers...)
+		} else {
+			logger.Warn("metrics address and admin token are not set, /metrics is publicly exposed on api server")
+		}
+
+		engine.GET("/metrics", metricsHandlers...)
+	}
+
+	if adminToken != "" {
+		// integrating applications poll usage with the admin token to show it to their users
+		engine.GET("/tenant/usage", handlers.AdminAuth(adminToken), adminHandler.TenantUsage)
+
+		admin := engine.Group("/admin", handlers.AdminAuth(adminToken))
+		admin.GET("/rooms", adminHandler.ListRooms)
+		admin.GET("/rooms/:name", adminHandler.GetRoom)
+		admin.DELETE("/rooms/:name", adminHandler.DeleteRoom)
+		admin.DELETE("/rooms/:name/users/:id", adminHandler.KickUser)
+		admin.PUT("/rooms/:name/moderators/:id", adminHandler.GrantModerator)
+		admin.POST("/rooms/:name/bans", adminHandler.BanUser)
+		admin.PUT("/rooms/:name/captions", adminHandler.SetCaptions)
+		admin.PUT("/rooms/:name/locale", adminHandler.SetLocale)
+		admin.PUT("/rooms/:name/entry-form", adminHandler.SetEntryForm)
+		admin.GET("/rooms/:name/config", adminHandler.GetRoomConfig)
+		admin.PUT("/rooms/:name/config", adminHandler.PutRoomConfig)
+		admin.DELETE("/rooms/:name/config", adminHandler.DeleteRoomConfig)
+		admin.GET("/rooms/:name/policy", adminHandler.GetPolicy)
+		admin.PUT("/rooms/:name/policy", adminHandler.SetPolicy)
+		admin.GET("/rooms/:name/history/search", adminHandler.SearchHistory)
+		admin.GET("/users/:id", adminHandler.InspectUser)
+		admin.GET("/events", adminHandler.Events)
+		admin.Any("/log-level", gin.WrapH(logLevel))
+		admin.GET("/support-bundle", adminHandler.SupportBundle)
+		admin.GET("/dead-letters", adminHandler.DeadLetters)
+		admin.GET("/cleaner", adminHandler.Cleaner)
+		admin.POST("/service-accounts", adminHandler.CreateServiceAccount)
+		admin.GET("/experiments", adminHandler.ListExperiments)
+		admin.PUT("/experiments/:name", adminHandler.PutExperiment)
+		admin.DELETE("/experiments/:name", adminHandler.DeleteExperiment)
+		admin.GET("/meetings", adminHandler.ListMeetings)
+		admin.PUT("/meetings/:name", adminHandler.PutMeeting)
+		admin.DELETE("/meetings/:name", adminHandler.DeleteMeeting)
+		admin.GET("/load-shedding", adminHandler.LoadShedding)
+		admin.PUT("/load-shedding", adminHandler.SetLoadShedding)
+		admin.POST("/notices", adminHandler.Notice)
+		admin.GET("/bug-reports/:id", adminHandler.BugReport)
+		admin.POST("/bug-reports/verify", adminHandler.VerifyBugReport)
+	} else {
+		logger.Warn("admin token is not set, admin API is disabled")
+	}
+
+	openAPI, err := handlers.OpenAPI(newAPIDocument(adminToken != ""))
+	if err != nil {
+		return nil, err
+	}
+	engine.GET("/openapi.json", openAPI)
+	engine.GET("/docs", handlers.SwaggerUI)
+	warnUndocumentedRoutes(logger, engine.Routes(), adminToken != "")
+
+	return engine, nil
+}
+
+// newCORSConfig translates the validated policy. Subdomain wildcards are matched here instead of by AllowWildcard,
+// which would take any origin with the same prefix and suffix, such as https://evil.com/.example.com
+func newCORSConfig(cfg config.CORS) cors.Config {
+	corsConfig := cors.Config{
+		AllowMethods:  cfg.AllowedMethods,
+		AllowHeaders:  cfg.AllowedHeaders,
+		ExposeHeaders: []string{handlers.RequestIDHeader},
+		MaxAge:        cfg.MaxAge,
+	}
+	if len(cfg.AllowedOrigins) == 1 && cfg.AllowedOrigins[0] == "*" {
+		corsConfig.AllowAllOrigins = true
+		return corsConfig
+	}
+
+	var wildcards [][2]string
+	for _, origin := range cfg.AllowedOrigins {
+		scheme, host, _ := strings.Cut(strings.ToLower(origin), "://")
+		if domain, ok := strings.CutPrefix(host, "*."); ok {
+			wildcards = append(wildcards, [2]string{scheme + "://", "." + domain})
+			continue
+		}
+		corsConfig.AllowOrigins = append(corsConfig.AllowOrigins, origin)
+	}
+
+	corsConfig.AllowOriginFunc = func(origin string) bool {
+		origin = strings.ToLower(origin)
+		for _, wildcard := range wildcards {
+			sub, ok := strings.CutPrefix(origin, wildcard[0])
+			if !ok {
+				continue
+			}
+			sub, ok = strings.CutSuffix(sub, wildcard[1])
+			if ok && isSubdomain(sub) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return corsConfig
+}
+
+// isSubdomain reports whether labels are one or more dot separated host labels
+func isSubdomain(labels string) bool {
+	for _, label := range strings.Split(labels, ".") {
+		if label == "" {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// newMetricsRouter serves the registry on a dedicated port, both at /metrics and at the root
+func newMetricsRouter(prom *metrics.Metrics) *gin.Engine {
+	metricsHandler := gin.WrapH(newMetricsHandler(prom))
+
+	metricsEngine := gin.New()
+	metricsEngine.Any("/metrics", metricsHandler)
+	metricsEngine.Any("/", metricsHandler)
+
+	return metricsEngine
+}
+
+func newMetricsHandler(prom *metrics.Metrics) http.Handler {
+	return promhttp.HandlerFor(prom.Reg, promhttp.HandlerOpts{Registry: prom.Reg})
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/tracing"
+)
+
+var ErrRoomBusy = errors.New("room dispatch queue is full")
+
+// dispatchJob is a message accepted from the sender and waiting for delivery
+type dispatchJob struct {
+	// ctx keeps values of the request, like the trace, but is not canceled when the request ends
+	ctx     context.Context
+	srcInfo *userInfo
+	msg     outgoing
+}
+
+// dispatcher is the bounded inbound queue of peer messages of the room. Its goroutine runs only while messages
+// are queued, so rooms need no shutdown, and at most one runs per room, so messages are delivered in order
+type dispatcher struct {
+	capacity int
+	deliver  func(dispatchJob)
+
+	mux     *sync.Mutex
+	jobs    []dispatchJob
+	running bool
+}
+
+func newDispatcher(capacity int, deliver func(dispatchJob)) *dispatcher {
+	return &dispatcher{capacity: capacity, deliver: deliver, mux: &sync.Mutex{}}
+}
+
+// push queues the job without waiting, false means the queue is full
+func (d *dispatcher) push(job dispatchJob) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if len(d.jobs) >= d.capacity {
+		return false
+	}
+	d.jobs = append(d.jobs, job)
+
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+
+	return true
+}
+
+func (d *dispatcher) run() {
+	for {
+		d.mux.Lock()
+		if len(d.jobs) == 0 {
+			d.running = false
+			d.jobs = nil
+			d.mux.Unlock()
+			return
+		}
+		job := d.jobs[0]
+		d.jobs[0] = dispatchJob{}
+		d.jobs = d.jobs[1:]
+		d.mux.Unlock()
+
+		d.deliver(job)
+	}
+}
+
+// dispatch hands the prepared message to the dispatcher. Must be called under lock
+func (r *Room) dispatch(ctx context.Context, srcInfo *userInfo, msg outgoing) error {
+	ok := r.dispatcher.push(dispatchJob{ctx: context.WithoutCancel(ctx), srcInfo: srcInfo, msg: msg})
+	if !ok {
+		r.deadLetters.Record(r.name, msg.destUserID, msg.entity, ErrRoomBusy.Error())
+		return ErrRoomBusy
+	}
+
+	return nil
+}
+
+// deliverDispatched delivers the message on the dispatcher goroutine. Destination queues are not waited for
+// while dispatching, so the room lock is held briefly. Failures are reported to senders who asked for receipts
+func (r *Room) deliverDispatched(job dispatchJob) {
+	var err error
+	ctx, span := tracing.Start(job.ctx, "Room.deliverDispatched",
+		tracing.Room(r.name), attribute.String("destination", job.msg.destUserID),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	err = r.deliver(ctx, job.srcInfo, job.msg)
+	if err == nil {
+		return
+	}
+
+	r.log.Warn("dispatched message is not delivered",
+		zap.String("user", job.srcInfo.id), zap.String("destination", job.msg.destUserID), zap.Error(err),
+	)
+	if job.msg.opts.MessageID != "" {
+		r.sendUndelivered(ctx, job.srcInfo, job.msg.destUserID, job.msg.opts.MessageID, err)
+	}
+}
+
+// sendUndelivered tells the sender that its message was not delivered and why. Like other receipts
+// it is best effort
+func (r *Room) sendUndelivered(ctx context.Context, senderInfo *userInfo, destUserID, messageID string, cause error) {
+	data, err := json.Marshal(map[string]string{"reason": cause.Error()})
+	if err != nil {
+		return
+	}
+
+	receipt := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
+		Time:       time.Now(),
+		ActionType: models.Undelivered,
+		UserID:     destUserID,
+		Data:       data,
+		MessageID:  messageID,
+	}
+
+	err = r.enqueue(ctx, senderInfo, receipt)
+	if err != nil {
+		r.log.Warn("receipt is not sent",
+			zap.String("user", senderInfo.id), zap.String("actionType", string(models.Undelivered)), zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"sync"
+
+	"peer-messenger/internal/models"
+)
+
+// entityHistory keeps the latest entities enqueued to a user together with their delivery state.
+// Operators use it to see what the user should have received and reconnecting subscribers to replay what they missed
+type entityHistory struct {
+	items []historyItem
+	next  int
+	full  bool
+	mux   *sync.Mutex
+}
+
+type historyItem struct {
+	entity    models.ChannelEntity
+	delivered bool
+}
+
+func newEntityHistory(capacity int) *entityHistory {
+	return &entityHistory{
+		items: make([]historyItem, max(capacity, 1)),
+		mux:   &sync.Mutex{},
+	}
+}
+
+func (h *entityHistory) record(entity models.ChannelEntity) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.items[h.next] = historyItem{entity: entity}
+	h.next = (h.next + 1) % len(h.items)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *entityHistory) markDelivered(entities []models.ChannelEntity) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, entity := range entities {
+		for i := range h.items {
+			if h.items[i].entity.ID == entity.ID {
+				h.items[i].delivered = true
+			}
+		}
+	}
+}
+
+// deliveredAfter returns delivered entities with IDs greater than afterID from oldest to newest
+func (h *entityHistory) deliveredAfter(afterID uint64) []models.ChannelEntity {
+	return h.filter(func(item historyItem) bool {
+		return item.delivered && item.entity.ID > afterID
+	})
+}
+
+// pending returns not yet delivered entities from oldest to newest
+func (h *entityHistory) pending() []models.ChannelEntity {
+	return h.filter(func(item historyItem) bool {
+		return !item.delivered
+	})
+}
+
+func (h *entityHistory) filter(accept func(historyItem) bool) []models.ChannelEntity {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.items)
+	}
+
+	out := make([]models.ChannelEntity, 0)
+	for i := 0; i < count; i++ {
+		item := h.items[(start+i)%len(h.items)]
+		if accept(item) {
+			out = append(out, item.entity)
+		}
+	}
+
+	return out
+}
+
+// bytes is the size of entity data kept in the history
+func (h *entityHistory) bytes() int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	total := 0
+	for _, item := range h.items {
+		total += len(item.entity.Data)
+	}
+
+	return total
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrQueueClosed = errors.New("user queue is closed")
+
+// EntityQueue is the bounded queue of entities of one user in one room. Entities are kept in ring buffers
+// instead of a buffered channel, so the room can drop, count and drain them without racing with close,
+// and taken slots are cleared at once instead of pinning entity data until overwritten.
+//
+// Every device of the user streaming from the room reads its own ring, so two logins of the same user
+// both receive every entity. While no device streams, entities wait in the shared ring read by polling
+type EntityQueue struct {
+	capacity int
+	mux      *sync.Mutex
+	// done is set when the queue is closed
+	done   bool
+	shared *QueueReader
+	// devices are readers of sessions with open streams by session ID, streams without session use ""
+	devices map[string]*QueueReader
+	// space holds a token after entities are taken, so producers waiting for room retry
+	space chan struct{}
+}
+
+// QueueReader is the view of EntityQueue read by one device
+type QueueReader struct {
+	queue *EntityQueue
+	ring  []models.ChannelEntity
+	head  int
+	size  int
+	// streams is the number of open streams reading it
+	streams int
+	// ready holds a token while entities are waiting or the queue is closed
+	ready chan struct{}
+}
+
+func newEntityQueue(capacity int) *EntityQueue {
+	q := &EntityQueue{
+		capacity: max(capacity, 1),
+		mux:      &sync.Mutex{},
+		devices:  make(map[string]*QueueReader),
+		space:    make(chan struct{}, 1),
+	}
+	q.shared = q.newReader()
+
+	return q
+}
+
+func (q *EntityQueue) newReader() *QueueReader {
+	return &QueueReader{
+		queue: q,
+		ring:  make([]models.ChannelEntity, q.capacity),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Ready receives when entities may be taken or the queue is closed. Wakeups may be spurious, Take tells what is there
+func (r *QueueReader) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Take removes all entities queued for the reader. Closed is set once the queue is closed,
+// entities taken with it are the last ones
+func (r *QueueReader) Take() (entities []models.ChannelEntity, closed bool) {
+	r.queue.mux.Lock()
+	defer r.queue.mux.Unlock()
+
+	entities = r.takeLocked()
+	if r.queue.done {
+		// wake the next stream of the same device, it has to see the close too
+		notify(r.ready)
+	}
+
+	return entities, r.queue.done
+}
+
+func (r *QueueReader) append(entity models.ChannelEntity) {
+	r.ring[(r.head+r.size)%len(r.ring)] = entity
+	r.size++
+	notify(r.ready)
+}
+
+// appendEvicting is append dropping the oldest entity of the full ring. Must be called under lock
+func (r *QueueReader) appendEvicting(entity models.ChannelEntity) {
+	if r.size == len(r.ring) {
+		r.popLocked()
+	}
+	r.append(entity)
+}
+
+func (r *QueueReader) popLocked() models.ChannelEntity {
+	entity := r.ring[r.head]
+	r.ring[r.head] = models.ChannelEntity{}
+	r.head = (r.head + 1) % len(r.ring)
+	r.size--
+
+	return entity
+}
+
+func (r *QueueReader) takeLocked() []models.ChannelEntity {
+	if r.size == 0 {
+		return nil
+	}
+
+	entities := make([]models.ChannelEntity, 0, r.size)
+	for r.size > 0 {
+		entities = append(entities, r.popLocked())
+	}
+	notify(r.queue.space)
+
+	return entities
+}
+
+// open returns the reader of the device, the first device takes over entities waiting in the shared ring
+func (q *EntityQueue) open(session string) *QueueReader {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	reader, ok := q.devices[session]
+	if !ok {
+		reader = q.newReader()
+		if len(q.devices) == 0 {
+			reader, q.shared = q.shared, reader
+		}
+		q.devices[session] = reader
+	}
+	reader.streams++
+
+	return reader
+}
+
+// release closes a stream of the device. Once the last device is gone, its undelivered entities wait
+// in the shared ring for the next connection
+func (q *EntityQueue) release(session string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	reader, ok := q.devices[session]
+	if !ok {
+		return
+	}
+
+	reader.streams--
+	if reader.streams > 0 {
+		return
+	}
+
+	delete(q.devices, session)
+	if len(q.devices) == 0 {
+		for _, entity := range reader.takeLocked() {
+			if q.shared.size < len(q.shared.ring) {
+				q.shared.append(entity)
+			}
+		}
+	}
+}
+
+// targets are the readers new entities go to. Must be called under lock
+func (q *EntityQueue) targets() []*QueueReader {
+	if len(q.devices) == 0 {
+		return []*QueueReader{q.shared}
+	}
+
+	targets := make([]*QueueReader, 0, len(q.devices))
+	for _, reader := range q.devices {
+		targets = append(targets, reader)
+	}
+
+	return targets
+}
+
+// Take removes all entities of the shared ring, used by polling
+func (q *EntityQueue) Take() []models.ChannelEntity {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.shared.takeLocked()
+}
+
+// Len is the number of queued entities of the most lagging device
+func (q *EntityQueue) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	size := 0
+	for _, reader := range q.targets() {
+		size = max(size, reader.size)
+	}
+
+	return size
+}
+
+// Cap is the number of entities a device holds before its queue is full
+func (q *EntityQueue) Cap() int {
+	return q.capacity
+}
+
+// push appends entity for every device without waiting, false means some queue is full or the queue is closed
+func (q *EntityQueue) push(entity models.ChannelEntity) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.done {
+		return false
+	}
+
+	targets := q.targets()
+	for _, reader := range targets {
+		if reader.size == len(reader.ring) {
+			return false
+		}
+	}
+
+	for _, reader := range targets {
+		reader.append(entity)
+	}
+
+	return true
+}
+
+// pushWait appends entity waiting for room until ctx is done
+func (q *EntityQueue) pushWait(ctx context.Context, entity models.ChannelEntity) error {
+	for !q.push(entity) {
+		if q.closed() {
+			return ErrQueueClosed
+		}
+
+		select {
+		case <-q.space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// one token may stand for several free slots, pass it on to the next waiting producer
+	if q.Len() < q.Cap() {
+		notify(q.space)
+	}
+
+	return nil
+}
+
+// popOldest makes room in every full device queue by removing its oldest entity, the first removed is returned
+func (q *EntityQueue) popOldest() (models.ChannelEntity, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	var (
+		oldest models.ChannelEntity
+		popped bool
+	)
+	for _, reader := range q.targets() {
+		if reader.size < len(reader.ring) {
+			continue
+		}
+
+		entity := reader.popLocked()
+		if !popped {
+			oldest, popped = entity, true
+		}
+	}
+	if popped {
+		notify(q.space)
+	}
+
+	return oldest, popped
+}
+
+// closeQueue stops accepting entities. Queued ones are returned when drain is set, each once however many devices
+// had it. Otherwise subscribers take them before they see the close. Closing the closed queue does nothing,
+// so entities left for subscribers stay there
+func (q *EntityQueue) closeQueue(drain bool) []models.ChannelEntity {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.done {
+		return nil
+	}
+	q.markClosed()
+
+	if !drain {
+		return nil
+	}
+
+	return q.drainLocked()
+}
+
+// closeWithFarewell drops queued entities and closes the queue leaving farewell the last entity every device
+// takes, e.g. telling the kicked user why its stream ends. Dropped entities are returned
+func (q *EntityQueue) closeWithFarewell(farewell models.ChannelEntity) []models.ChannelEntity {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.done {
+		return nil
+	}
+	q.markClosed()
+
+	dropped := q.drainLocked()
+	for _, reader := range q.targets() {
+		reader.append(farewell)
+	}
+
+	return dropped
+}
+
+// closeWithFarewells closes the queue leaving the farewell of its session the last entity every device takes,
+// the shared ring gets the farewell of pollingSession. Queued entities are kept, full readers lose the oldest
+// one to make room for the farewell
+func (q *EntityQueue) closeWithFarewells(farewell func(session string) models.ChannelEntity, pollingSession string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.done {
+		return
+	}
+
+	if len(q.devices) == 0 {
+		q.shared.appendEvicting(farewell(pollingSession))
+	}
+	for session, reader := range q.devices {
+		reader.appendEvicting(farewell(session))
+	}
+
+	q.markClosed()
+}
+
+// markClosed must be called under lock
+func (q *EntityQueue) markClosed() {
+	q.done = true
+	notify(q.space)
+	notify(q.shared.ready)
+	for _, reader := range q.devices {
+		notify(reader.ready)
+	}
+}
+
+// drainLocked takes entities of all readers, each once however many devices had it. Must be called under lock
+func (q *EntityQueue) drainLocked() []models.ChannelEntity {
+	seen := make(map[uint64]struct{})
+	entities := make([]models.ChannelEntity, 0)
+	for _, reader := range append(q.targets(), q.shared) {
+		for _, entity := range reader.takeLocked() {
+			if _, ok := seen[entity.ID]; ok {
+				continue
+			}
+
+			seen[entity.ID] = struct{}{}
+			entities = append(entities, entity)
+		}
+	}
+
+	return entities
+}
+
+// takeAll removes entities of all readers, each once however many devices had it, oldest first
+func (q *EntityQueue) takeAll() []models.ChannelEntity {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	entities := q.drainLocked()
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].ID < entities[j].ID
+	})
+
+	return entities
+}
+
+// putBack returns taken entities to every device queue that has room for them
+func (q *EntityQueue) putBack(entities []models.ChannelEntity) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for _, reader := range q.targets() {
+		for _, entity := range entities {
+			if reader.size < len(reader.ring) {
+				reader.append(entity)
+			}
+		}
+	}
+}
+
+func (q *EntityQueue) closed() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.done
+}
+
+// notify leaves a token in the channel unless one is already there
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
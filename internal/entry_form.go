@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrEntryFormInvalid = errors.New("entry form answers are invalid")
+
+// defaultEntryTextLength bounds text answers of fields without MaxLength
+const defaultEntryTextLength = 500
+
+// SetEntryForm replaces the questions asked from joining members, nil or empty form removes them.
+// Members already in the room keep their answers
+func (r *Room) SetEntryForm(form *models.EntryForm) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if form == nil || len(form.Fields) == 0 {
+		r.entryForm = nil
+		return
+	}
+
+	r.entryForm = &models.EntryForm{Fields: slices.Clone(form.Fields)}
+}
+
+// EntryForm returns the questions of the room, nil when members join without them
+func (r *Room) EntryForm() *models.EntryForm {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.entryForm
+}
+
+// checkEntryAnswers validates answers against the form and returns the ones to keep. Must be called under lock
+func (r *Room) checkEntryAnswers(answers map[string]any) (map[string]any, error) {
+	kept, err := validateEntryAnswers(r.entryForm, answers)
+
+	outcome := "accepted"
+	if err != nil {
+		outcome = "rejected"
+	}
+	r.metrics.EntryFormSubmissions.WithLabelValues(r.name, outcome).Inc()
+
+	return kept, err
+}
+
+// validateEntryAnswers checks every field of the form and reports all problems at once,
+// so the client can highlight them together
+func validateEntryAnswers(form *models.EntryForm, answers map[string]any) (map[string]any, error) {
+	var problems []string
+	kept := make(map[string]any, len(form.Fields))
+
+	known := make(map[string]struct{}, len(form.Fields))
+	for _, field := range form.Fields {
+		known[field.Name] = struct{}{}
+
+		answer, ok := answers[field.Name]
+		if !ok || answer == nil {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("%s: answer is required", field.Name))
+			}
+			continue
+		}
+
+		value, problem := entryAnswer(field, answer)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", field.Name, problem))
+			continue
+		}
+		kept[field.Name] = value
+	}
+
+	for name := range answers {
+		if _, ok := known[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: not asked by the form", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%w: %s", ErrEntryFormInvalid, strings.Join(problems, "; "))
+	}
+
+	return kept, nil
+}
+
+// entryAnswer normalizes answer to the field, problem is empty when it fits
+func entryAnswer(field models.EntryField, answer any) (value any, problem string) {
+	switch field.Kind {
+	case models.EntryFieldConsent:
+		accepted, ok := answer.(bool)
+		if !ok {
+			return nil, "must be true or false"
+		}
+		if field.Required && !accepted {
+			return nil, "consent is required"
+		}
+
+		return accepted, ""
+	case models.EntryFieldChoice:
+		choice, ok := answer.(string)
+		if !ok || !slices.Contains(field.Options, choice) {
+			return nil, "must be one of the options"
+		}
+
+		return choice, ""
+	default:
+		text, ok := answer.(string)
+		if !ok {
+			return nil, "must be text"
+		}
+
+		text = strings.TrimSpace(text)
+		if field.Required && text == "" {
+			return nil, "answer is required"
+		}
+
+		maxLength := field.MaxLength
+		if maxLength == 0 {
+			maxLength = defaultEntryTextLength
+		}
+		if utf8.RuneCountInString(text) > maxLength {
+			return nil, fmt.Sprintf("must be at most %d characters", maxLength)
+		}
+
+		return text, ""
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// eventLog keeps the latest entities of the room for late joiners and debugging. Peer messages are visible
+// to their sender and recipient only, entities published to the room are visible to every member
+type eventLog struct {
+	events []loggedEvent
+	next   int
+	full   bool
+	mux    *sync.Mutex
+}
+
+type loggedEvent struct {
+	entity models.ChannelEntity
+	// recipientID is empty for entities published to the whole room
+	recipientID string
+}
+
+func newEventLog(capacity int) *eventLog {
+	return &eventLog{
+		events: make([]loggedEvent, max(capacity, 1)),
+		mux:    &sync.Mutex{},
+	}
+}
+
+func (l *eventLog) record(entity models.ChannelEntity, recipientID string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.events[l.next] = loggedEvent{entity: entity, recipientID: recipientID}
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// page returns up to limit entities visible to viewer with IDs greater than afterID and time not before since,
+// from oldest to newest. more is set when further entities match
+func (l *eventLog) page(viewerID string, since time.Time, afterID uint64, limit int) (entities []models.ChannelEntity, more bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	start, count := 0, l.next
+	if l.full {
+		start, count = l.next, len(l.events)
+	}
+
+	entities = make([]models.ChannelEntity, 0, min(limit, count))
+	for i := 0; i < count; i++ {
+		event := l.events[(start+i)%len(l.events)]
+		entity := event.entity
+
+		visible := event.recipientID == "" || event.recipientID == viewerID || entity.UserID == viewerID
+		if !visible || entity.ID <= afterID || entity.Time.Before(since) {
+			continue
+		}
+
+		if len(entities) == limit {
+			return entities, true
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities, false
+}
+
+// History returns a page of room entities visible to the member, see eventLog
+func (r *Room) History(userID string, since time.Time, afterID uint64, limit int) ([]models.ChannelEntity, bool, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if _, ok := r.userInfos[userID]; !ok {
+		return nil, false, ErrUserNotInRoom
+	}
+	if r.events == nil {
+		return nil, false, ErrEventLogDisabled
+	}
+
+	entities, more := r.events.page(userID, since, afterID, limit)
+
+	return entities, more, nil
+}
+
+// logEvent records entity when the event log is enabled. Peer messages are logged with their recipient,
+// so the sender paging history sees whom they were sent to. Safe under read lock
+func (r *Room) logEvent(entity models.ChannelEntity, recipientID string) {
+	if r.events == nil {
+		return
+	}
+
+	if recipientID != "" {
+		entity.DestinationUserID = recipientID
+	}
+	r.events.record(entity, recipientID)
+}
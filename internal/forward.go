@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/bus"
+	"peer-messenger/internal/models"
+)
+
+// forward publishes message to the user who is not in the room on this instance. Whether the user is in the room
+// on another instance is unknown, so the message is accepted like a queued one but gets no delivered receipt
+func (r *Room) forward(
+	ctx context.Context, srcInfo *userInfo, destUserID string, entity models.ChannelEntity, opts SendOptions,
+) error {
+	err := r.bus.Publish(ctx, bus.Message{
+		Room:        r.name,
+		UserID:      destUserID,
+		Entity:      entity,
+		MessageType: entity.MessageType,
+	})
+	if err != nil {
+		r.deadLetters.Record(r.name, destUserID, entity, err.Error())
+		return err
+	}
+
+	r.logEvent(entity, destUserID)
+
+	if opts.EchoToSender && srcInfo.id != destUserID {
+		entity.DestinationUserID = destUserID
+
+		err = r.enqueue(ctx, srcInfo, entity)
+		if err != nil {
+			r.log.Warn("message is not echoed to sender", zap.String("user", srcInfo.id), zap.Error(err))
+		}
+	}
+
+	r.metrics.PeerMessages.WithLabelValues(r.name, r.opts.MessageTypes.Label(entity.MessageType)).Inc()
+
+	return nil
+}
+
+// DeliverForwarded enqueues message published by another instance if its recipient is in the room on this one.
+// The entity gets ID of this room, IDs of rooms on different instances are unrelated
+func (r *Room) DeliverForwarded(ctx context.Context, msg bus.Message) error {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	destInfo, ok := r.userInfos[msg.UserID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	entity := msg.Entity
+	entity.ID = r.lastEntityID.Add(1)
+	entity.MessageType = msg.MessageType
+
+	err := r.enqueue(ctx, destInfo, entity)
+	if errors.Is(err, ErrDestBusy) && r.storeMissed(destInfo.id, entity) {
+		err = nil
+	}
+	if err != nil {
+		r.deadLetters.Record(r.name, destInfo.id, entity, err.Error())
+		return err
+	}
+
+	r.logEvent(entity, destInfo.id)
+
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package fuzz holds fuzz tests of request decoding and of subscription ID and resume token parsing.
+// Seeds run with go test, targets are fuzzed one at a time, e.g. go test -fuzz=FuzzJSONDTOs ./internal/fuzz
+package fuzz
@@ -0,0 +1,240 @@
+package fuzz
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+
+	"peer-messenger/internal/decode"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/msgtype"
+	"peer-messenger/internal/services"
+	"peer-messenger/internal/subscription"
+	"peer-messenger/internal/validation"
+)
+
+var (
+	validate = validation.New(msgtype.Default())
+	codec    = subscription.NewCodec([]byte("fuzz secret"))
+)
+
+// decoder decodes and validates the body as one DTO, accepted DTOs are returned to check they marshal back
+type decoder func(data []byte) (any, error)
+
+func jsonDTO[T any](data []byte) (any, error) {
+	return decode.Request[T](bytes.NewReader(data), validate)
+}
+
+// jsonDTOs are DTOs of request bodies accepted by the handlers, admin ones included
+var jsonDTOs = map[string]decoder{
+	"RegisterRequest":         jsonDTO[models.RegisterRequest],
+	"LoginRequest":            jsonDTO[models.LoginRequest],
+	"ChannelRequest":          jsonDTO[models.ChannelRequest],
+	"RemoveRoomRequest":       jsonDTO[models.RemoveRoomRequest],
+	"JoinChannelRequest":      jsonDTO[models.JoinChannelRequest],
+	"SendToPeerRequest":       jsonDTO[models.SendToPeerRequest],
+	"SendBatchRequest":        jsonDTO[models.SendBatchRequest],
+	"SignalRequest":           jsonDTO[models.SignalRequest],
+	"AckRequest":              jsonDTO[models.AckRequest],
+	"ResolutionRequest":       jsonDTO[models.ResolutionRequest],
+	"PointerRequest":          jsonDTO[models.PointerRequest],
+	"NetworkStatsRequest":     jsonDTO[models.NetworkStatsRequest],
+	"ConnectionStateRequest":  jsonDTO[models.ConnectionStateRequest],
+	"PresenceRequest":         jsonDTO[models.PresenceRequest],
+	"TopologyRequest":         jsonDTO[models.TopologyRequest],
+	"MatchRequest":            jsonDTO[models.MatchRequest],
+	"BroadcastRequest":        jsonDTO[models.BroadcastRequest],
+	"CaptionRequest":          jsonDTO[models.CaptionRequest],
+	"BugReportRequest":        jsonDTO[models.BugReportRequest],
+	"ClientLogsRequest":       jsonDTO[models.ClientLogsRequest],
+	"Locale":                  jsonDTO[models.Locale],
+	"BanRequest":              jsonDTO[models.BanRequest],
+	"ServiceAccountRequest":   jsonDTO[models.ServiceAccountRequest],
+	"CaptionsSettingsRequest": jsonDTO[models.CaptionsSettingsRequest],
+	"EntryForm":               jsonDTO[models.EntryForm],
+	"RoomConfigRequest":       jsonDTO[models.RoomConfigRequest],
+	"RoomPolicy":              jsonDTO[models.RoomPolicy],
+	"NoticeRequest":           jsonDTO[models.NoticeRequest],
+	"LoadSheddingRequest":     jsonDTO[models.LoadSheddingRequest],
+	"Experiment":              jsonDTO[models.Experiment],
+	"Meeting":                 jsonDTO[models.Meeting],
+	"SignedBugReport":         jsonDTO[services.SignedBugReport],
+}
+
+func queryDTO[T any](data []byte) (any, error) {
+	var dto T
+	req := &http.Request{URL: &url.URL{RawQuery: string(data)}}
+	err := binding.Query.Bind(req, &dto)
+	if err != nil {
+		return dto, err
+	}
+
+	return dto, validate.Struct(dto)
+}
+
+// queryDTOs are DTOs bound from query strings
+var queryDTOs = map[string]decoder{
+	"LoginCallbackQuery":   queryDTO[models.LoginCallbackQuery],
+	"ServerTimeRequest":    queryDTO[models.ServerTimeRequest],
+	"SubscribeRequest":     queryDTO[models.SubscribeRequest],
+	"MembersRequest":       queryDTO[models.MembersRequest],
+	"RoomsRequest":         queryDTO[models.RoomsRequest],
+	"HistoryRequest":       queryDTO[models.HistoryRequest],
+	"HistorySearchRequest": queryDTO[models.HistorySearchRequest],
+	"DeleteRoomRequest":    queryDTO[models.DeleteRoomRequest],
+	"KickRequest":          queryDTO[models.KickRequest],
+}
+
+// checkDTOs decodes the input as every DTO, accepted ones must marshal back to JSON
+func checkDTOs(t *testing.T, decoders map[string]decoder, data []byte) {
+	for name, decode := range decoders {
+		dto, err := decode(data)
+		if err != nil {
+			continue
+		}
+
+		_, err = json.Marshal(dto)
+		if err != nil {
+			t.Errorf("accepted %s does not marshal: %v", name, err)
+		}
+	}
+}
+
+func FuzzJSONDTOs(f *testing.F) {
+	seeds := []string{
+		``,
+		`null`,
+		`[]`,
+		`{}`,
+		`{"userID":"alice","password":"password1","locale":{"language":"pt-BR"}}`,
+		`{"userID":"alice","password":"password1","device":"phone"}`,
+		`{"channelName":"room-1"}`,
+		`{"channelName":"room-1","password":"secret"}`,
+		`{"channelName":"room-1","captions":true,"connectionPlan":true,"topology":"sfu","answers":{"name":"Alice"}}`,
+		`{"channelName":"room-1","destinationUserID":"bob","message":{"messageType":"chat","text":"hi"},` +
+			`"priority":"high","messageID":"m1"}`,
+		`{"channelName":"room-1","messages":[{"destinationUserID":"bob","message":{"messageType":"candidate"}}]}`,
+		`{"channelName":"room-1","destinationUserID":"bob","type":"offer","sdp":"v=0"}`,
+		`{"channelName":"room-1","destinationUserID":"bob","type":"ice-candidate",` +
+			`"candidate":{"candidate":"candidate:1 1 udp 1 10.0.0.1 9 typ host","sdpMid":"0","sdpMLineIndex":0}}`,
+		`{"channelName":"room-1","senderUserID":"bob","messageID":"m1"}`,
+		`{"roomName":"room-1","frameRate":30,"height":720,"width":1280}`,
+		`{"channelName":"room-1","x":0.5,"y":1,"surface":"page-1","pressed":true}`,
+		`{"channelName":"room-1","packetLoss":0.02}`,
+		`{"channelName":"room-1","peerUserID":"bob","state":"failed","failureStage":"ice_checking"}`,
+		`{"channelName":"room-1","status":"away"}`,
+		`{"topology":"mesh"}`,
+		`{"tags":["go","webrtc"],"region":"eu"}`,
+		`{"channelName":"room-1","message":{"text":"maintenance"}}`,
+		`{"channelName":"room-1","speakerID":"bob","sequence":1,"text":"hello","final":true,"language":"en"}`,
+		`{"channelName":"room-1","description":"no video","pendingBuffer":3,"lastEventID":42,"members":["bob"]}`,
+		`{"sessionID":"s1","entries":[{"time":"2024-01-01T00:00:00Z","level":"error","message":"ice failed",` +
+			`"fields":{"code":1}}]}`,
+		`{"language":"pt-BR","timezone":"America/Sao_Paulo"}`,
+		`{"name":"bot1"}`,
+		`{"enabled":true}`,
+		`{"fields":[{"name":"team","label":"Team","kind":"choice","required":true,"options":["red","blue"]}]}`,
+		`{"capacity":10,"password":"secret","owner":"alice"}`,
+		`{"allowedMessageTypes":["chat"],"maxDataSize":4096,"chatHistory":true,"e2eeRequired":true}`,
+		`{"channelName":"room-1","text":"restart soon","level":"warning"}`,
+		`{"name":"codec","variants":[{"name":"vp9","percent":50}],"rooms":["room-1"]}`,
+		`{"name":"standup","startsAt":"2030-01-01T10:00:00Z","endsAt":"2030-01-01T10:15:00Z",` +
+			`"roster":["alice","bob"],"policy":{"chatHistory":true},"locale":{"language":"en"}}`,
+		`{"report":{"id":"r1","time":"2024-01-01T00:00:00Z","userID":"alice","room":"room-1"},"signature":"c2ln"}`,
+		`{"message":{"a":{"b":{"c":{"d":{"e":{"f":{"g":{"h":{"i":1}}}}}}}}}}`,
+		`{"channelName":"room-1","x":1e309}`,
+		`{"channelName":"\u0000"}`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDTOs(t, jsonDTOs, data)
+	})
+}
+
+func FuzzQueryDTOs(f *testing.F) {
+	seeds := []string{
+		``,
+		`state=s1&code=c1`,
+		`state=s1&error=access_denied`,
+		`clientTime=1700000000000`,
+		`subscriptionID=s1&batchMs=50`,
+		`resumeToken=r1.a.b.c.1.d`,
+		`channelName=room-1&cursor=c1&limit=100`,
+		`cursor=c1&limit=10&prefix=room&minUsers=2`,
+		`channelName=room-1&since=2024-01-01T00:00:00Z&limit=500`,
+		`channelName=room-1&q=hello&author=bob&from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z`,
+		`grace=30s&reason=maintenance`,
+		`reason=spam`,
+		`limit=-1&batchMs=99999999999999999999`,
+		`since=yesterday&grace=forever`,
+		`%zz=%`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDTOs(t, queryDTOs, data)
+	})
+}
+
+// FuzzSubscriptionID parses the input as subscriptionID and checks that issued IDs survive the round trip
+func FuzzSubscriptionID(f *testing.F) {
+	f.Add(codec.Encode("room-1", "alice", "session-1"))
+	f.Add(codec.Encode("room-1", "alice", ""))
+	f.Add("room-1__alice")
+	f.Add("room-1\x00alice\x00session-1")
+	f.Add("")
+	f.Add("....")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		_, _, _, _ = codec.Decode(input)
+		_, _, _ = subscription.DecodeLegacy(input)
+
+		room, rest, _ := strings.Cut(input, "\x00")
+		user, session, _ := strings.Cut(rest, "\x00")
+		decodedRoom, decodedUser, decodedSession, err := codec.Decode(codec.Encode(room, user, session))
+		if err != nil || decodedRoom != room || decodedUser != user || decodedSession != session {
+			t.Errorf("issued subscriptionID of %q, %q, %q does not survive round trip: %q, %q, %q, %v",
+				room, user, session, decodedRoom, decodedUser, decodedSession, err)
+		}
+	})
+}
+
+// FuzzResumeToken parses the input as r1 resume token and checks that issued tokens survive the round trip
+func FuzzResumeToken(f *testing.F) {
+	expires := time.Now().Add(time.Hour)
+	f.Add(codec.EncodeResume(subscription.Resume{
+		RoomKey: "room-1", UserID: "alice", Session: "session-1", ID: "aWQ", Expires: expires,
+	}))
+	f.Add(codec.EncodeResume(subscription.Resume{RoomKey: "room-1", UserID: "alice", ID: "aWQ", Expires: expires}))
+	f.Add("r1.")
+	f.Add("r1.....")
+	f.Add("r1.cm9vbQ.YWxpY2U.aWQ.-1.bWFj")
+	f.Add("r1.cm9vbQ.YWxpY2U.aWQ.99999999999999999999.c2Vzc2lvbg.bWFj")
+	f.Add("r2.cm9vbQ.YWxpY2U.aWQ.1.bWFj")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		_, _ = codec.DecodeResume(input)
+
+		room, rest, _ := strings.Cut(input, "\x00")
+		user, session, _ := strings.Cut(rest, "\x00")
+		issued := subscription.Resume{RoomKey: room, UserID: user, Session: session, ID: "aWQ", Expires: expires}
+
+		decoded, err := codec.DecodeResume(codec.EncodeResume(issued))
+		if err != nil || decoded.RoomKey != room || decoded.UserID != user || decoded.Session != session ||
+			decoded.ID != issued.ID || decoded.Expires.Unix() != expires.Unix() {
+			t.Errorf("issued resume token of %q, %q, %q does not survive round trip: %+v, %v",
+				room, user, session, decoded, err)
+		}
+	})
+}
@@ -0,0 +1,438 @@
+// Package grpcapi serves the signaling API over gRPC for native clients and bots.
+// It mirrors the REST handlers and the SSE event stream on top of the same service.
+//
+// signalingpb is generated from api/signaling.proto with protoc-gen-go v1.33.0 and protoc-gen-go-grpc v1.3.0:
+//
+//	protoc -I api --go_out=. --go_opt=module=peer-messenger \
+//		--go-grpc_out=. --go-grpc_opt=module=peer-messenger api/signaling.proto
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"peer-messenger/internal/grpcapi/signalingpb"
+	"peer-messenger/internal/handlers"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/services"
+)
+
+// errorDomain is the domain of ErrorInfo details, reasons are the codes of the REST API
+const errorDomain = "peer-messenger"
+
+// ErrorEvent is the action type of events reporting failed sends and acks of the Signal stream
+const ErrorEvent models.ActionType = "error"
+
+var (
+	errMissingToken   = errors.New("authorization metadata is empty")
+	errNoSubscribe    = errors.New("first message of the stream must be subscribe")
+	errForeignStream  = errors.New("subscription belongs to another user")
+	errUnknownRequest = errors.New("signal request is empty")
+)
+
+type Server struct {
+	signalingpb.UnimplementedSignalingServer
+
+	logger   *zap.Logger
+	validate *validator.Validate
+	service  *services.PeerMessenger
+}
+
+func NewServer(logger *zap.Logger, validate *validator.Validate, service *services.PeerMessenger) *grpc.Server {
+	server := grpc.NewServer()
+	signalingpb.RegisterSignalingServer(server, &Server{
+		logger:   logger,
+		validate: validate,
+		service:  service,
+	})
+
+	return server
+}
+
+func (s *Server) Join(ctx context.Context, req *signalingpb.JoinRequest) (*signalingpb.JoinResponse, error) {
+	userID, session, err := s.authenticateSession(ctx)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	dto := models.JoinChannelRequest{
+		ChannelName: req.GetChannelName(),
+		Captions:    req.GetCaptions(),
+		Region:      req.GetRegion(),
+		Password:    req.GetPassword(),
+		Answers:     req.GetAnswers().AsMap(),
+	}
+	err = s.validate.Struct(dto)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	client := clientInfo(ctx)
+	client.Session = session
+
+	resp, err := s.service.JoinChannel(ctx, userID, client, dto)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	return &signalingpb.JoinResponse{
+		SubscriptionId: resp.SubscriptionID,
+		MemberCount:    int32(resp.MemberCount),
+		Experiments:    resp.Experiments,
+		MissedMessages: int32(resp.MissedMessages),
+		E2EeRequired:   resp.E2EERequired,
+	}, nil
+}
+
+func (s *Server) Leave(ctx context.Context, req *signalingpb.LeaveRequest) (*signalingpb.LeaveResponse, error) {
+	userID, session, err := s.authenticateSession(ctx)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	dto := models.ChannelRequest{ChannelName: req.GetChannelName()}
+	err = s.validate.Struct(dto)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	err = s.service.LeaveChannel(ctx, userID, session, dto)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	return &signalingpb.LeaveResponse{}, nil
+}
+
+func (s *Server) Send(ctx context.Context, req *signalingpb.SendRequest) (*signalingpb.SendResponse, error) {
+	userID, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	err = s.send(ctx, userID, req)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+
+	return &signalingpb.SendResponse{}, nil
+}
+
+func (s *Server) send(ctx context.Context, userID string, req *signalingpb.SendRequest) error {
+	dto := models.SendToPeerRequest{
+		ChannelName:       req.GetChannelName(),
+		DestinationUserID: req.GetDestinationUserId(),
+		Message:           req.GetMessage().AsMap(),
+		EchoToSender:      req.GetEchoToSender(),
+		Priority:          models.Priority(req.GetPriority()),
+		MessageID:         req.GetMessageId(),
+	}
+	err := s.validate.Struct(dto)
+	if err != nil {
+		return err
+	}
+
+	return s.service.SendToPeer(ctx, userID, dto)
+}
+
+func (s *Server) ack(ctx context.Context, userID string, req *signalingpb.Ack) error {
+	dto := models.AckRequest{
+		ChannelName:  req.GetChannelName(),
+		SenderUserID: req.GetSenderUserId(),
+		MessageID:    req.GetMessageId(),
+	}
+	err := s.validate.Struct(dto)
+	if err != nil {
+		return err
+	}
+
+	return s.service.AckMessage(ctx, userID, dto)
+}
+
+// Signal streams entities like SSE subscription does. Sends and acks coming over the same stream are applied
+// as they arrive, failed ones are reported as error events instead of breaking the stream
+func (s *Server) Signal(stream signalingpb.Signaling_SignalServer) error {
+	ctx := stream.Context()
+
+	userID, err := s.authenticate(ctx)
+	if err != nil {
+		return s.statusError(err)
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	subscribe := first.GetSubscribe()
+	if subscribe == nil {
+		return s.statusError(errNoSubscribe)
+	}
+
+	sub, err := s.service.Subscribe(ctx, subscribe.GetSubscriptionId(), subscribe.GetLastEventId())
+	if err != nil {
+		return s.statusError(err)
+	}
+	if sub.UserID != userID {
+		return status.Error(codes.PermissionDenied, errForeignStream.Error())
+	}
+	defer sub.Serve("grpc")()
+
+	clientGone := true
+	defer func() {
+		if clientGone {
+			sub.Disconnected()
+		}
+	}()
+
+	failures := make(chan *signalingpb.Event)
+	received := make(chan error, 1)
+	go func() {
+		received <- s.receive(stream, userID, failures)
+	}()
+
+	if len(sub.Replay) > 0 {
+		err = s.sendEvents(stream, sub.Replay)
+		if err != nil {
+			return err
+		}
+		sub.MarkActive()
+	}
+
+	for {
+		select {
+		case <-sub.Events.Ready():
+			entities, closed := sub.Events.Take()
+			if len(entities) > 0 {
+				err = s.sendEvents(stream, entities)
+				if err != nil {
+					return err
+				}
+				sub.Delivered(entities...)
+			}
+
+			if closed {
+				clientGone = false
+				s.logger.Info("leaving from grpc subscription", zap.String("user", userID), zap.String("room", sub.Room))
+				return nil
+			}
+		case event := <-failures:
+			err = stream.Send(event)
+			if err != nil {
+				return err
+			}
+		case err = <-received:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// receive applies client messages of the stream until it ends. Failures are passed to the sending loop,
+// since stream.Send must not be called concurrently
+func (s *Server) receive(stream signalingpb.Signaling_SignalServer, userID string, failures chan<- *signalingpb.Event) error {
+	ctx := stream.Context()
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		var messageID string
+		switch kind := req.GetKind().(type) {
+		case *signalingpb.SignalRequest_Send:
+			messageID = kind.Send.GetMessageId()
+			err = s.send(ctx, userID, kind.Send)
+		case *signalingpb.SignalRequest_Ack:
+			messageID = kind.Ack.GetMessageId()
+			err = s.ack(ctx, userID, kind.Ack)
+		default:
+			err = errUnknownRequest
+		}
+		if err == nil {
+			continue
+		}
+
+		s.logger.Error(err.Error())
+		_, code, message := errorCode(err)
+		data, _ := structpb.NewValue(map[string]any{"code": code, "message": message, "messageID": messageID})
+
+		select {
+		case failures <- &signalingpb.Event{ActionType: string(ErrorEvent), UserId: userID, Data: data, MessageId: messageID}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) sendEvents(stream signalingpb.Signaling_SignalServer, entities []models.ChannelEntity) error {
+	for _, entity := range entities {
+		event, err := newEvent(entity)
+		if err != nil {
+			return err
+		}
+
+		err = stream.Send(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newEvent(entity models.ChannelEntity) (*signalingpb.Event, error) {
+	var data *structpb.Value
+	if len(entity.Data) > 0 {
+		var decoded any
+		err := json.Unmarshal(entity.Data, &decoded)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = structpb.NewValue(decoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &signalingpb.Event{
+		Id:                entity.ID,
+		Time:              timestamppb.New(entity.Time),
+		ActionType:        string(entity.ActionType),
+		UserId:            entity.UserID,
+		Data:              data,
+		DestinationUserId: entity.DestinationUserID,
+		Priority:          string(entity.Priority),
+		MessageId:         entity.MessageID,
+	}, nil
+}
+
+func (s *Server) authenticate(ctx context.Context) (string, error) {
+	userID, _, err := s.authenticateSession(ctx)
+	return userID, err
+}
+
+// authenticateSession also returns the session of the token, empty for tokens without one
+func (s *Server) authenticateSession(ctx context.Context) (userID, session string, err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("authorization")
+	if len(tokens) == 0 || tokens[0] == "" {
+		return "", "", errMissingToken
+	}
+
+	return s.service.AuthenticateSession(tokens[0])
+}
+
+func clientInfo(ctx context.Context) models.ClientInfo {
+	var client models.ClientInfo
+	if p, ok := peer.FromContext(ctx); ok {
+		client.IP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		client.UserAgent = strings.Join(md.Get("user-agent"), " ")
+	}
+
+	return client
+}
+
+// statusError converts err to gRPC status with the REST API error code in ErrorInfo details
+func (s *Server) statusError(err error) error {
+	var redirect *services.RegionRedirectError
+	if errors.As(err, &redirect) {
+		st, _ := status.New(codes.FailedPrecondition, err.Error()).WithDetails(&errdetails.ErrorInfo{
+			Reason:   "WRONG_REGION",
+			Domain:   errorDomain,
+			Metadata: map[string]string{"url": redirect.URL},
+		})
+		return st.Err()
+	}
+
+	var overloaded *services.OverloadedError
+	if errors.As(err, &overloaded) {
+		st, _ := status.New(codes.Unavailable, err.Error()).WithDetails(&errdetails.ErrorInfo{
+			Reason:   "OVERLOADED",
+			Domain:   errorDomain,
+			Metadata: map[string]string{"alternateURLs": strings.Join(overloaded.AlternateURLs, ",")},
+		})
+		return st.Err()
+	}
+
+	httpStatus, code, message := errorCode(err)
+	if httpStatus == http.StatusInternalServerError {
+		s.logger.Error("grpc call failed", zap.Error(err))
+	}
+
+	st, detailsErr := status.New(grpcCode(httpStatus, code), message).WithDetails(&errdetails.ErrorInfo{
+		Reason: code,
+		Domain: errorDomain,
+	})
+	if detailsErr != nil {
+		return status.Error(grpcCode(httpStatus, code), message)
+	}
+
+	return st.Err()
+}
+
+// errorCode classifies err like the REST API does. Messages of unexpected errors are hidden
+func errorCode(err error) (httpStatus int, code, message string) {
+	switch {
+	case errors.Is(err, errMissingToken):
+		return http.StatusUnauthorized, "UNAUTHORIZED", err.Error()
+	case errors.Is(err, errNoSubscribe), errors.Is(err, errUnknownRequest):
+		return http.StatusBadRequest, "INVALID_REQUEST", err.Error()
+	}
+
+	httpStatus, code = handlers.ErrorCode(err)
+	if httpStatus == http.StatusInternalServerError {
+		return httpStatus, code, "internal error"
+	}
+
+	return httpStatus, code, err.Error()
+}
+
+func grpcCode(httpStatus int, code string) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusConflict:
+		if strings.HasSuffix(code, "_EXISTS") {
+			return codes.AlreadyExists
+		}
+		return codes.FailedPrecondition
+	case http.StatusGone:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
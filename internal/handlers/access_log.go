@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/accesslog"
+)
+
+// RequestIDHeader carries the request ID, a valid one sent by the client or proxy is kept
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// context keys the access log reads after the request is handled
+const (
+	requestIDKey = "requestID"
+	userKey      = "accessLogUser"
+)
+
+// RequestID makes sure every request has an ID and returns it in the response, so client reports,
+// application log and access log can be correlated
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			raw := make([]byte, 8)
+			_, _ = rand.Read(raw)
+			id = hex.EncodeToString(raw)
+		}
+
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+
+		c.Next()
+	}
+}
+
+// GetRequestID returns the ID assigned by the RequestID middleware
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AccessLog writes every served public request and the sample of internal ones to the access log.
+// User is the one authenticated by the handler, room is taken from the path, query or channelName
+// of the JSON body buffered by RequestBody
+func AccessLog(logger *zap.Logger, log *accesslog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		if !requestLogged(c) {
+			return
+		}
+
+		err := log.Log(accesslog.Entry{
+			Time:      start,
+			RequestID: GetRequestID(c),
+			RemoteIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.RequestURI(),
+			Proto:     c.Request.Proto,
+			Status:    c.Writer.Status(),
+			Bytes:     max(c.Writer.Size(), 0),
+			Latency:   time.Since(start),
+			User:      c.GetString(userKey),
+			Room:      requestRoom(c),
+			Referer:   c.Request.Referer(),
+			UserAgent: c.Request.UserAgent(),
+			Traffic:   GetTrafficClass(c),
+		})
+		if err != nil {
+			logger.Error("can't write access log", zap.Error(err))
+		}
+	}
+}
+
+// setAccessLogUser records the authenticated user of the request for the access log
+func setAccessLogUser(c *gin.Context, userID string) {
+	c.Set(userKey, userID)
+}
+
+func requestRoom(c *gin.Context) string {
+	if strings.Contains(c.FullPath(), "/rooms/:name") || strings.HasPrefix(c.FullPath(), "/channel/:name") {
+		return c.Param("name")
+	}
+	if room := c.Query("channelName"); room != "" {
+		return room
+	}
+
+	// the body is buffered by RequestBody middleware
+	body, ok := c.Get(requestBodyKey)
+	if !ok {
+		return ""
+	}
+
+	var peek struct {
+		ChannelName string `json:"channelName"`
+	}
+	_ = json.Unmarshal(body.([]byte), &peek)
+
+	return peek.ChannelName
+}
@@ -0,0 +1,519 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/decode"
+	"peer-messenger/internal/janitor"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/services"
+	"peer-messenger/internal/support"
+)
+
+// Admin serves operator endpoints. All of them must be guarded by AdminAuth middleware
+type Admin struct {
+	logger   *zap.Logger
+	validate *validator.Validate
+	service  *services.PeerMessenger
+	bundle   *support.Bundle
+	janitor  *janitor.Janitor
+}
+
+func NewAdmin(
+	logger *zap.Logger,
+	validate *validator.Validate,
+	service *services.PeerMessenger,
+	bundle *support.Bundle,
+	janitor *janitor.Janitor,
+) *Admin {
+	return &Admin{
+		logger:   logger,
+		validate: validate,
+		service:  service,
+		bundle:   bundle,
+		janitor:  janitor,
+	}
+}
+
+// adminAccessLogUser names requests authenticated with the admin token in the access log
+const adminAccessLogUser = "admin"
+
+// AdminAuth checks that request carries "Authorization: Bearer <token>" header with the admin token
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			abortWithError(c, errInvalidAdminToken)
+			return
+		}
+		setAccessLogUser(c, adminAccessLogUser)
+
+		c.Next()
+	}
+}
+
+func (handler *Admin) ListRooms(c *gin.Context) {
+	var dto models.RoomsRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	page, err := handler.service.ListRooms(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	respondJSONWithETag(c, page)
+}
+
+func (handler *Admin) GetRoom(c *gin.Context) {
+	room, err := handler.service.GetRoom(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	respondJSONWithETag(c, room)
+}
+
+// DeleteRoom deletes the room at once, or after grace period members are warned about with room closing entity
+func (handler *Admin) DeleteRoom(c *gin.Context) {
+	var dto models.DeleteRoomRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	closesAt, err := handler.service.DeleteRoom(c.Request.Context(), c.Param("name"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	if dto.Grace > 0 {
+		c.JSON(http.StatusAccepted, map[string]any{"status": "closing", "closesAt": closesAt})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) KickUser(c *gin.Context) {
+	var dto models.KickRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.KickUser(c.Request.Context(), c.Param("name"), c.Param("id"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) GrantModerator(c *gin.Context) {
+	err := handler.service.GrantModerator(c.Request.Context(), c.Param("name"), c.Param("id"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// Notice publishes server notice to the room in the body, or to all rooms
+func (handler *Admin) Notice(c *gin.Context) {
+	dto, err := decode.Request[models.NoticeRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.Notice(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) BanUser(c *gin.Context) {
+	dto, err := decode.Request[models.BanRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.BanUser(c.Request.Context(), c.Param("name"), dto.UserID)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) SetCaptions(c *gin.Context) {
+	dto, err := decode.Request[models.CaptionsSettingsRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.SetCaptionsEnabled(c.Request.Context(), c.Param("name"), dto.Enabled)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) SetLocale(c *gin.Context) {
+	dto, err := decode.Request[models.Locale](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.SetRoomLocale(c.Request.Context(), c.Param("name"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dto)
+}
+
+// SetEntryForm sets the questions members answer when joining the room
+func (handler *Admin) SetEntryForm(c *gin.Context) {
+	dto, err := decode.Request[models.EntryForm](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.SetRoomEntryForm(c.Request.Context(), c.Param("name"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dto)
+}
+
+// PutRoomConfig pre-creates the room named in the path, so it survives restarts
+func (handler *Admin) PutRoomConfig(c *gin.Context) {
+	dto, err := decode.Request[models.RoomConfigRequest](c.Request.Body, handler.validate)
+	if err == nil {
+		err = handler.validate.Var(c.Param("name"), "roomname")
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	cfg, err := handler.service.PutRoomConfig(c.Request.Context(), c.Param("name"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cfg)
+}
+
+func (handler *Admin) GetRoomConfig(c *gin.Context) {
+	cfg, err := handler.service.GetRoomConfig(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cfg)
+}
+
+func (handler *Admin) DeleteRoomConfig(c *gin.Context) {
+	err := handler.service.DeleteRoomConfig(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) ListExperiments(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{"experiments": handler.service.ListExperiments(c.Request.Context())})
+}
+
+// PutExperiment creates or replaces experiment. Name in the path wins over the one in the body
+func (handler *Admin) PutExperiment(c *gin.Context) {
+	var dto models.Experiment
+	err := json.NewDecoder(c.Request.Body).Decode(&dto)
+	if err == nil {
+		dto.Name = c.Param("name")
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.PutExperiment(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dto)
+}
+
+func (handler *Admin) DeleteExperiment(c *gin.Context) {
+	err := handler.service.DeleteExperiment(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *Admin) ListMeetings(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]any{"meetings": handler.service.ListMeetings(c.Request.Context())})
+}
+
+// PutMeeting schedules meeting or replaces it. Name in the path wins over the one in the body
+func (handler *Admin) PutMeeting(c *gin.Context) {
+	var dto models.Meeting
+	err := json.NewDecoder(c.Request.Body).Decode(&dto)
+	if err == nil {
+		dto.Name = c.Param("name")
+		dto.ReadyAt = nil
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.PutMeeting(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dto)
+}
+
+func (handler *Admin) LoadShedding(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.service.LoadShedding(c.Request.Context()))
+}
+
+// SetLoadShedding turns manual load shedding on or off. Members of all rooms get migrate event when shedding starts
+func (handler *Admin) SetLoadShedding(c *gin.Context) {
+	dto, err := decode.Request[models.LoadSheddingRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, handler.service.SetLoadShedding(c.Request.Context(), dto.Enabled))
+}
+
+func (handler *Admin) BugReport(c *gin.Context) {
+	report, err := handler.service.BugReport(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// VerifyBugReport checks signature of the report, e.g. one attached to a support ticket
+func (handler *Admin) VerifyBugReport(c *gin.Context) {
+	var dto services.SignedBugReport
+	err := json.NewDecoder(c.Request.Body).Decode(&dto)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]bool{"valid": handler.service.VerifyBugReport(c.Request.Context(), dto)})
+}
+
+func (handler *Admin) DeleteMeeting(c *gin.Context) {
+	err := handler.service.DeleteMeeting(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// InspectUser shows memberships and pending entities of the user to reproduce delivery problems
+func (handler *Admin) InspectUser(c *gin.Context) {
+	states := handler.service.InspectUser(c.Request.Context(), c.ClientIP(), c.Param("id"))
+
+	c.JSON(http.StatusOK, map[string]any{"rooms": states})
+}
+
+func (handler *Admin) GetPolicy(c *gin.Context) {
+	policy, err := handler.service.GetRoomPolicy(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+func (handler *Admin) SetPolicy(c *gin.Context) {
+	dto, err := decode.Request[models.RoomPolicy](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.SetRoomPolicy(c.Request.Context(), c.Param("name"), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dto)
+}
+
+// SearchHistory searches chat history of the whole room, room name in the path wins over the query
+func (handler *Admin) SearchHistory(c *gin.Context) {
+	var dto models.HistorySearchRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		dto.ChannelName = c.Param("name")
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	messages, err := handler.service.SearchRoomHistory(c.Request.Context(), c.ClientIP(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]any{"messages": messages})
+}
+
+func (handler *Admin) CreateServiceAccount(c *gin.Context) {
+	dto, err := decode.Request[models.ServiceAccountRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	resp, err := handler.service.CreateServiceAccount(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (handler *Admin) DeadLetters(c *gin.Context) {
+	letters := handler.service.DeadLetters(c.Request.Context(), c.Query("room"), c.Query("user"))
+
+	c.JSON(http.StatusOK, map[string]any{"deadLetters": letters})
+}
+
+// TenantUsage reports consumption against soft quotas
+func (handler *Admin) TenantUsage(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.service.TenantUsage(c.Request.Context()))
+}
+
+// Cleaner shows when the janitor runs next and how long its last pass took
+func (handler *Admin) Cleaner(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.janitor.Status())
+}
+
+// SupportBundle responds with zip archive of recent logs, config, rooms state, goroutines and metrics
+func (handler *Admin) SupportBundle(c *gin.Context) {
+	fileName := fmt.Sprintf("support-bundle-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+fileName+`"`)
+
+	err := handler.bundle.WriteZip(c.Writer)
+	if err != nil {
+		handler.logger.Error("cannot write support bundle", zap.Error(err))
+		_ = c.Error(err)
+	}
+}
+
+// Events streams admin events as SSE until client disconnects
+func (handler *Admin) Events(c *gin.Context) {
+	events, unsubscribe := handler.service.SubscribeAdminEvents(c.Request.Context())
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("Content-Type", "text/event-stream")
+	c.Writer.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			c.SSEvent("admin", event)
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			handler.logger.Info("admin event stream closed")
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/models"
+)
+
+func (handler *PeerMessenger) AuthProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.service.AuthProviders())
+}
+
+// BeginLogin redirects the user to the login page of the identity provider
+func (handler *PeerMessenger) BeginLogin(c *gin.Context) {
+	location, err := handler.service.BeginLogin(c.Request.Context(), c.Param("provider"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, location)
+}
+
+// CompleteLogin is the callback the identity provider redirects the user back to. The session is passed
+// in the fragment of LoginRedirectURL, which browsers don't send to servers, or returned as LoginResponse
+func (handler *PeerMessenger) CompleteLogin(c *gin.Context) {
+	var dto models.LoginCallbackQuery
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	if dto.Error != "" {
+		abortWithServiceError(c, fmt.Errorf("%w: %s", authn.ErrLoginDenied, dto.Error))
+		return
+	}
+
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+
+	resp, err := handler.service.CompleteLogin(c.Request.Context(), client, c.Param("provider"), dto.State, dto.Code)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+
+	if handler.opts.LoginRedirectURL == "" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	fragment := url.Values{
+		"token":     {resp.Token},
+		"sessionID": {resp.SessionID},
+		"expiresAt": {resp.ExpiresAt.Format(time.RFC3339)},
+	}
+	c.Redirect(http.StatusFound, handler.opts.LoginRedirectURL+"#"+fragment.Encode())
+}
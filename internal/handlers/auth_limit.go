@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"peer-messenger/internal/authlimit"
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/services"
+)
+
+// AuthLimit throttles login and register by client IP and by the user ID in the body. Wrong passwords, taken
+// user IDs and forged callbacks of identity providers count as failures locking the keys out, other errors
+// leave the counters as they are. Success resets
+// failures of the user ID only, so an attacker can't clear failures of its IP by logging into its own account.
+// Runs after RequestBody, which buffers the body
+func AuthLimit(limiter *authlimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := []authlimit.Key{{Scope: authlimit.ScopeIP, Value: c.ClientIP()}}
+		if userID := bodyUserID(c); userID != "" {
+			keys = append(keys, authlimit.Key{Scope: authlimit.ScopeUser, Value: userID})
+		}
+
+		err := limiter.Allow(time.Now(), keys...)
+		if err != nil {
+			abortWithServiceError(c, err)
+			return
+		}
+
+		c.Next()
+
+		switch err := c.Errors.Last(); {
+		case err == nil:
+			limiter.Succeeded(time.Now(), keys[1:]...)
+		case errors.Is(err, services.ErrInvalidCredentials), errors.Is(err, services.ErrUserAlreadyExist),
+			errors.Is(err, services.ErrInvalidLoginState), errors.Is(err, authn.ErrInvalidToken):
+			limiter.Failed(time.Now(), keys...)
+		}
+	}
+}
+
+// bodyUserID returns userID field of the buffered JSON body, malformed bodies are left to the handler
+func bodyUserID(c *gin.Context) string {
+	raw, ok := c.Get(requestBodyKey)
+	if !ok {
+		return ""
+	}
+
+	var body struct {
+		UserID string `json:"userID"`
+	}
+	if json.Unmarshal(raw.([]byte), &body) != nil {
+		return ""
+	}
+
+	return body.UserID
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+
+	"peer-messenger/internal/decode"
+	"peer-messenger/internal/models"
+)
+
+// Deprecated marks responses of a route kept as alias of successor with Deprecation and Link headers,
+// so clients learn where to migrate before the alias is removed. Usage of the alias shows in request metrics
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+successor+`>; rel="successor-version"`)
+	}
+}
+
+// decodeChannelRequest decodes the body of channel routes. Routes with the room in the path take its name from there
+// with setName, their body is optional
+func decodeChannelRequest[T any](c *gin.Context, validate *validator.Validate, setName func(*T, string)) (T, error) {
+	name := c.Param("name")
+	if name == "" {
+		return decode.Request[T](c.Request.Body, validate)
+	}
+
+	var dto T
+	err := json.NewDecoder(c.Request.Body).Decode(&dto)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return dto, err
+	}
+	setName(&dto, name)
+
+	return dto, validate.Struct(dto)
+}
+
+func setChannelName(dto *models.ChannelRequest, name string) {
+	dto.ChannelName = name
+}
+
+func setRemoveRoomName(dto *models.RemoveRoomRequest, name string) {
+	dto.ChannelName = name
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+
+	"peer-messenger/internal/models"
+)
+
+// serverTimeHeader carries server wall clock in unix milliseconds on subscription responses
+const serverTimeHeader = "X-Server-Time"
+
+// processStart is the origin of monotonic time reported to clients
+var processStart = time.Now()
+
+// Time answers clock synchronization request. Server timestamps are taken when the handler starts and right before
+// the response is written, so the difference excludes only the network round trip
+func (handler *PeerMessenger) Time(c *gin.Context) {
+	receivedAt := time.Now()
+
+	var dto models.ServerTimeRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	resp := serverTime(time.Now())
+	resp.ClientTime = dto.ClientTime
+	resp.ReceivedAt = receivedAt.UnixMilli()
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func serverTime(now time.Time) models.ServerTimeResponse {
+	return models.ServerTimeResponse{
+		ReceivedAt:  now.UnixMilli(),
+		SentAt:      now.UnixMilli(),
+		ServerTime:  now.UTC(),
+		MonotonicMs: now.Sub(processStart).Milliseconds(),
+	}
+}
+
+// writeServerTime starts event stream with the server clock. The event has no ID, so it does not move Last-Event-ID
+func writeServerTime(c *gin.Context) {
+	c.Render(-1, sse.Event{Event: "time", Data: serverTime(time.Now())})
+}
+
+func setServerTimeHeader(c *gin.Context) {
+	c.Header(serverTimeHeader, strconv.FormatInt(time.Now().UnixMilli(), 10))
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/authlimit"
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/replay"
+	"peer-messenger/internal/services"
+	"peer-messenger/internal/validation"
+)
+
+const (
+	codeInvalidRequest  = "INVALID_REQUEST"
+	codeUnauthorized    = "UNAUTHORIZED"
+	codePayloadTooLarge = "PAYLOAD_TOO_LARGE"
+	codeInternal        = "INTERNAL_ERROR"
+)
+
+var (
+	errMissingToken      = errors.New("header Authorization is empty")
+	errInvalidAdminToken = errors.New("admin token is invalid")
+	errChannelMismatch   = errors.New("subscription belongs to another channel")
+)
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists failed validation rules of INVALID_REQUEST
+	Fields []validation.FieldError `json:"fields,omitempty"`
+	// AlternateURLs are base URLs of other instances to retry OVERLOADED requests on
+	AlternateURLs []string `json:"alternateURLs,omitempty"`
+}
+
+// knownError maps sentinel error to HTTP status and machine-readable code
+type knownError struct {
+	err    error
+	status int
+	code   string
+}
+
+// knownErrors are checked in order with errors.Is, so wrapped errors match too
+var knownErrors = []knownError{
+	{errMissingToken, http.StatusUnauthorized, codeUnauthorized},
+	{errInvalidAdminToken, http.StatusUnauthorized, codeUnauthorized},
+	{services.ErrInvalidToken, http.StatusUnauthorized, codeUnauthorized},
+	{services.ErrUserNotExist, http.StatusUnauthorized, codeUnauthorized},
+	{services.ErrInvalidCredentials, http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+	{authn.ErrInvalidToken, http.StatusUnauthorized, "INVALID_ID_TOKEN"},
+	{authn.ErrMissingClaim, http.StatusUnauthorized, "MISSING_CLAIM"},
+	{authn.ErrLoginDenied, http.StatusUnauthorized, "LOGIN_DENIED"},
+	{services.ErrInvalidSubscriptionID, http.StatusBadRequest, "INVALID_SUBSCRIPTION_ID"},
+	{errChannelMismatch, http.StatusBadRequest, "CHANNEL_MISMATCH"},
+	{services.ErrLegacySubscriptionID, http.StatusGone, "LEGACY_SUBSCRIPTION_ID"},
+	{services.ErrInvalidResumeToken, http.StatusBadRequest, "INVALID_RESUME_TOKEN"},
+	{services.ErrResumeTokenExpired, http.StatusUnauthorized, "RESUME_TOKEN_EXPIRED"},
+	{services.ErrTokenReplayed, http.StatusUnauthorized, "TOKEN_REPLAYED"},
+	{services.ErrInvalidCursor, http.StatusBadRequest, "INVALID_CURSOR"},
+	{services.ErrUnknownRegion, http.StatusBadRequest, "UNKNOWN_REGION"},
+	{services.ErrReservedUserID, http.StatusBadRequest, "RESERVED_USER_ID"},
+	{services.ErrInvalidLoginState, http.StatusBadRequest, "INVALID_LOGIN_STATE"},
+	{internal.ErrEntryFormInvalid, http.StatusBadRequest, "ENTRY_FORM_INVALID"},
+	{services.ErrExpiryInPast, http.StatusBadRequest, "EXPIRY_IN_PAST"},
+	{internal.ErrBatchOverBurst, http.StatusBadRequest, "BATCH_OVER_BURST"},
+	{internal.ErrRoomNotExist, http.StatusNotFound, "ROOM_NOT_FOUND"},
+	{internal.ErrRoomAlreadyExist, http.StatusConflict, "ROOM_ALREADY_EXISTS"},
+	{internal.ErrUserNotInRoom, http.StatusNotFound, "USER_NOT_IN_ROOM"},
+	{internal.ErrUserAlreadyInRoom, http.StatusConflict, "USER_ALREADY_IN_ROOM"},
+	{services.ErrExperimentNotExist, http.StatusNotFound, "EXPERIMENT_NOT_FOUND"},
+	{services.ErrMeetingNotExist, http.StatusNotFound, "MEETING_NOT_FOUND"},
+	{services.ErrBugReportNotExist, http.StatusNotFound, "BUG_REPORT_NOT_FOUND"},
+	{services.ErrSessionNotExist, http.StatusNotFound, "SESSION_NOT_FOUND"},
+	{internal.ErrRoomConfigNotFound, http.StatusNotFound, "ROOM_CONFIG_NOT_FOUND"},
+	{services.ErrUnknownProvider, http.StatusNotFound, "UNKNOWN_PROVIDER"},
+	{internal.ErrUserBanned, http.StatusForbidden, "USER_BANNED"},
+	{internal.ErrUserNotInvited, http.StatusForbidden, "USER_NOT_INVITED"},
+	{services.ErrWrongRoomPassword, http.StatusForbidden, "WRONG_ROOM_PASSWORD"},
+	{services.ErrNotServiceAccount, http.StatusForbidden, "NOT_SERVICE_ACCOUNT"},
+	{internal.ErrNotModerator, http.StatusForbidden, "NOT_MODERATOR"},
+	{internal.ErrPolicyViolation, http.StatusForbidden, "POLICY_VIOLATION"},
+	{services.ErrUserAlreadyExist, http.StatusConflict, "USER_ALREADY_EXISTS"},
+	{services.ErrIdentityConflict, http.StatusConflict, "IDENTITY_CONFLICT"},
+	{services.ErrServiceAccountName, http.StatusConflict, "SERVICE_ACCOUNT_EXISTS"},
+	{services.ErrAlreadyMatching, http.StatusConflict, "ALREADY_MATCHING"},
+	{internal.ErrCaptionsDisabled, http.StatusConflict, "CAPTIONS_DISABLED"},
+	{internal.ErrHistoryDisabled, http.StatusConflict, "HISTORY_DISABLED"},
+	{internal.ErrEventLogDisabled, http.StatusConflict, "EVENT_HISTORY_DISABLED"},
+	{internal.ErrSignalingState, http.StatusConflict, "SIGNALING_STATE"},
+	{internal.ErrRoomFull, http.StatusConflict, "ROOM_FULL"},
+	{internal.ErrRoomConfigsDisabled, http.StatusConflict, "ROOM_CONFIGS_DISABLED"},
+	{services.ErrMatchTimeout, http.StatusRequestTimeout, "MATCH_TIMEOUT"},
+	{internal.ErrRateLimited, http.StatusTooManyRequests, "RATE_LIMITED"},
+	{services.ErrClientLogsThrottled, http.StatusTooManyRequests, "RATE_LIMITED"},
+	{services.ErrStatsThrottled, http.StatusTooManyRequests, "RATE_LIMITED"},
+	{services.ErrBugReportsThrottled, http.StatusTooManyRequests, "RATE_LIMITED"},
+	{services.ErrClientLogsQuota, http.StatusTooManyRequests, "CLIENT_LOGS_QUOTA"},
+	{authlimit.ErrThrottled, http.StatusTooManyRequests, "AUTH_THROTTLED"},
+	{authn.ErrProviderUnavailable, http.StatusBadGateway, "PROVIDER_UNAVAILABLE"},
+	{internal.ErrDestBusy, http.StatusServiceUnavailable, "DEST_BUSY"},
+	{internal.ErrRoomBusy, http.StatusServiceUnavailable, "ROOM_BUSY"},
+	{replay.ErrFull, http.StatusServiceUnavailable, "REPLAY_GUARD_FULL"},
+	{services.ErrOverloaded, http.StatusServiceUnavailable, "OVERLOADED"},
+	{services.ErrTooManyLoginsBegun, http.StatusServiceUnavailable, "TOO_MANY_LOGINS"},
+}
+
+// badRequestError marks malformed requests. Known errors inside keep their own status
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *badRequestError) Unwrap() error {
+	return e.err
+}
+
+// Errors is the central error handling middleware. Handlers only abort with an error attached,
+// the middleware logs the errors and responds with ErrorResponse matching the last one
+func Errors(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		for _, err := range c.Errors {
+			logger.Error("got post process error", zap.Error(err))
+		}
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+
+		status, resp := errorResponse(c.Errors.Last().Err)
+		c.JSON(status, resp)
+	}
+}
+
+// ErrorCode returns HTTP status and machine-readable code of err, the ones the Errors middleware responds with
+func ErrorCode(err error) (int, string) {
+	status, resp := errorResponse(err)
+	return status, resp.Code
+}
+
+func errorResponse(err error) (int, ErrorResponse) {
+	for _, known := range knownErrors {
+		if errors.Is(err, known.err) {
+			resp := ErrorResponse{Code: known.code, Message: err.Error()}
+
+			var overloaded *services.OverloadedError
+			if errors.As(err, &overloaded) {
+				resp.AlternateURLs = overloaded.AlternateURLs
+			}
+
+			return known.status, resp
+		}
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, ErrorResponse{Code: codePayloadTooLarge, Message: err.Error()}
+	}
+
+	if fields := validation.Fields(err); fields != nil {
+		return http.StatusBadRequest, ErrorResponse{
+			Code:    codeInvalidRequest,
+			Message: "request validation failed",
+			Fields:  fields,
+		}
+	}
+
+	var badRequest *badRequestError
+	if errors.As(err, &badRequest) {
+		return http.StatusBadRequest, ErrorResponse{Code: codeInvalidRequest, Message: err.Error()}
+	}
+
+	// unexpected errors may carry internal details, they are only logged
+	return http.StatusInternalServerError, ErrorResponse{Code: codeInternal, Message: "internal error"}
+}
+
+// abortWithError stops the chain leaving the response to Errors middleware
+func abortWithError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// abortWithBadRequest reports malformed request, validation failures come with the list of failed fields
+func abortWithBadRequest(c *gin.Context, err error) {
+	abortWithError(c, &badRequestError{err: err})
+}
+
+// abortWithServiceError reports service error with status and code matching it, region redirects are followed
+func abortWithServiceError(c *gin.Context, err error) {
+	var redirect *services.RegionRedirectError
+	if errors.As(err, &redirect) {
+		// 307 keeps method and body, so the client repeats the same request against the owning region
+		c.Redirect(http.StatusTemporaryRedirect, strings.TrimSuffix(redirect.URL, "/")+c.Request.URL.RequestURI())
+		c.Abort()
+		return
+	}
+
+	var rateLimit *internal.RateLimitError
+	if errors.As(err, &rateLimit) {
+		// Retry-After is in whole seconds, rounding up keeps clients from retrying too early
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(rateLimit.RetryAfter.Seconds()))))
+	}
+
+	var throttled *authlimit.ThrottledError
+	if errors.As(err, &throttled) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+	}
+
+	var overloaded *services.OverloadedError
+	if errors.As(err, &overloaded) {
+		c.Header("Retry-After", strconv.Itoa(overloaded.RetryAfter))
+	}
+
+	abortWithError(c, err)
+}
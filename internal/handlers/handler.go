@@ -1,205 +1,588 @@
 package handlers
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 
 	"peer-messenger/internal"
-	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/decode"
 	"peer-messenger/internal/models"
+	"peer-messenger/internal/services"
 )
 
+// streamEndTrailer is the HTTP trailer telling why the event stream ended
+const streamEndTrailer = "X-Stream-End"
+
+// clientLogsMaxBody caps a batch of client logs well below the limit of regular requests
+const clientLogsMaxBody = 64 << 10
+
+const (
+	streamEndClosed      = "closed"
+	streamEndRoomDeleted = "room deleted"
+	streamEndReconnect   = "reconnect"
+	streamEndKicked      = "kicked"
+)
+
+// streamEndReasons maps farewell entities to the reason reported when the stream ends
+var streamEndReasons = map[models.ActionType]string{
+	models.RoomDeleted: streamEndRoomDeleted,
+	models.Reconnect:   streamEndReconnect,
+}
+
+// PeerMessenger is a thin gin adapter over services.PeerMessenger:
+// it decodes requests, calls the service and encodes responses
 type PeerMessenger struct {
-	logger            *zap.Logger
-	salt              []byte
-	validate          *validator.Validate
-	users             map[string]struct{}
-	roomRepo          *internal.RoomRepository
-	roomKeysExtractor *regexp.Regexp
-	metrics           *metrics.Metrics
+	logger   *zap.Logger
+	validate *validator.Validate
+	service  *services.PeerMessenger
+	opts     Options
 }
 
-func NewPeerMessenger(logger *zap.Logger, validate *validator.Validate, metrics *metrics.Metrics) *PeerMessenger {
-	salt := []byte("asasasas")
+// Options configures transport level behaviour
+type Options struct {
+	// SSEHeartbeatInterval is how often idle subscriptions receive an SSE comment to confirm the listener is alive
+	SSEHeartbeatInterval time.Duration
+	// LoginRedirectURL is where users logged in with an identity provider are redirected to, with the session
+	// in the URL fragment. Empty responds to the callback with LoginResponse
+	LoginRedirectURL string
+}
 
-	out := &PeerMessenger{
-		logger:            logger,
-		salt:              salt,
-		validate:          validate,
-		users:             make(map[string]struct{}),
-		roomRepo:          internal.NewRoomRepository(logger, metrics),
-		roomKeysExtractor: regexp.MustCompile(`[^_]+`),
-		metrics:           metrics,
+func NewPeerMessenger(
+	logger *zap.Logger, validate *validator.Validate, service *services.PeerMessenger, opts Options,
+) *PeerMessenger {
+	return &PeerMessenger{
+		logger:   logger,
+		validate: validate,
+		service:  service,
+		opts:     opts,
 	}
+}
 
-	g := new(errgroup.Group)
+func (handler *PeerMessenger) Register(c *gin.Context) {
+	dto, err := decode.Request[models.RegisterRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
 
-	g.Go(func() error {
-		for {
-			time.Sleep(10 * time.Second)
-			out.roomRepo.Clean()
+	err = handler.service.Register(c.Request.Context(), dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
 
-			state := out.roomRepo.GetState()
-			logger.Debug("rooms state collected", zap.Any("state", state))
-		}
-	})
+	c.JSON(http.StatusCreated, map[string]string{"status": "OK"})
+}
+
+func (handler *PeerMessenger) Login(c *gin.Context) {
+	dto, err := decode.Request[models.LoginRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
 
-	return out
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+
+	resp, err := handler.service.Login(c.Request.Context(), client, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
-func (handler *PeerMessenger) Register(c *gin.Context) {
-	c.AbortWithStatus(http.StatusNotImplemented)
+func (handler *PeerMessenger) Logout(c *gin.Context) {
+	userID, session, err := handler.extractSession(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	rooms := handler.service.Logout(c.Request.Context(), userID, session)
+
+	c.JSON(http.StatusOK, map[string]any{"rooms": rooms})
 }
 
-func (handler *PeerMessenger) Login(c *gin.Context) {
-	dto, err := getTypedRequestBody[models.LoginRequest](c.Request.Body, handler.validate)
+// Sessions lists logins of the caller on all its devices
+func (handler *PeerMessenger) Sessions(c *gin.Context) {
+	userID, session, err := handler.extractSession(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	sessions := handler.service.Sessions(c.Request.Context(), userID, session)
+
+	c.JSON(http.StatusOK, map[string]any{"sessions": sessions})
+}
+
+// RevokeSession logs the caller out on the device of the session
+func (handler *PeerMessenger) RevokeSession(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	// add temporal user for now
-	handler.users[dto.UserID] = struct{}{}
+	err = handler.service.RevokeSession(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
 
-	token := dto.UserID + string(handler.salt)
-	c.JSON(http.StatusOK, models.LoginResponse{Token: token})
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// LeaveAll removes the caller from every room it is in
+func (handler *PeerMessenger) LeaveAll(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	rooms := handler.service.LeaveAll(c.Request.Context(), userID)
+
+	c.JSON(http.StatusOK, map[string]any{"rooms": rooms})
 }
 
 func (handler *PeerMessenger) JoinChannel(c *gin.Context) {
+	userID, session, err := handler.extractSession(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decodeChannelRequest(c, handler.validate, func(dto *models.JoinChannelRequest, name string) {
+		dto.ChannelName = name
+	})
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent(), Session: session}
+
+	resp, err := handler.service.JoinChannel(c.Request.Context(), userID, client, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// FindMatch blocks until the user is paired with a random peer and joins both into a private room
+func (handler *PeerMessenger) FindMatch(c *gin.Context) {
 	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.MatchRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+
+	resp, err := handler.service.FindMatch(c.Request.Context(), userID, client, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
 		return
 	}
 
-	if _, ok := handler.users[userID]; !ok {
-		err := errors.New("user does not exist")
+	c.JSON(http.StatusOK, resp)
+}
+
+func (handler *PeerMessenger) Members(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	dto, err := getTypedRequestBody[models.ChannelRequest](c.Request.Body, handler.validate)
+	var dto models.MembersRequest
+	err = c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	var (
-		roomName = dto.ChannelName
-		room     *internal.Room
-	)
-	if !handler.roomRepo.Exist(roomName) {
-		room, err = handler.roomRepo.AddRoom(roomName)
-	} else {
-		room, err = handler.roomRepo.Get(roomName)
+	resp, err := handler.service.Members(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
 	}
+
+	respondJSONWithETag(c, resp)
+}
+
+func (handler *PeerMessenger) Heartbeat(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	err = room.AddUser(userID)
+	dto, err := decode.Request[models.PresenceRequest](c.Request.Body, handler.validate)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	subscriptionID := fmt.Sprintf("%s__%s", dto.ChannelName, userID)
+	err = handler.service.Heartbeat(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
 
-	c.JSON(http.StatusOK, map[string]string{"subscriptionID": subscriptionID})
+	c.AbortWithStatus(http.StatusOK)
 }
 
-func (handler *PeerMessenger) LeaveChannel(c *gin.Context) {
+// Liveness records liveness heartbeat of the member of the room named in the path. Members that stop sending them
+// are removed within the liveness window
+func (handler *PeerMessenger) Liveness(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	resp, err := handler.service.Beat(c.Request.Context(), userID, c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// TopologyHints tells the member of the room named in the path which peers to offer to and which to answer
+func (handler *PeerMessenger) TopologyHints(c *gin.Context) {
 	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	if _, ok := handler.users[userID]; !ok {
-		err := errors.New("user does not exist")
+	hints, err := handler.service.TopologyHints(c.Request.Context(), userID, c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, hints)
+}
+
+// SetTopology records mesh or SFU topology of the member and responds with its hints
+func (handler *PeerMessenger) SetTopology(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	dto, err := getTypedRequestBody[models.ChannelRequest](c.Request.Body, handler.validate)
+	dto, err := decode.Request[models.TopologyRequest](c.Request.Body, handler.validate)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	room, err := handler.roomRepo.Get(dto.ChannelName)
+	hints, err := handler.service.SetTopology(c.Request.Context(), userID, c.Param("name"), dto)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithServiceError(c, err)
 		return
 	}
 
-	err = room.RemoveUser(userID)
+	c.JSON(http.StatusOK, hints)
+}
+
+// Presence lists members of the room named in the path with their online or away status
+func (handler *PeerMessenger) Presence(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+	members, err := handler.service.Presence(c.Request.Context(), userID, c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]any{"members": members})
 }
 
-func (handler *PeerMessenger) Subscribe(c *gin.Context) {
-	subscriptionID, ok := c.GetQuery("subscriptionID")
-	if !ok || subscriptionID == "" {
-		err := errors.New("subscriptionID is not provided")
+// EntryForm returns the questions the caller answers when joining the room
+func (handler *PeerMessenger) EntryForm(c *gin.Context) {
+	_, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	form, err := handler.service.EntryForm(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, form)
+}
+
+func (handler *PeerMessenger) LeaveChannel(c *gin.Context) {
+	userID, session, err := handler.extractSession(c)
+	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	keys := handler.roomKeysExtractor.FindAllString(subscriptionID, 2)
-	roomKey, userID := keys[0], keys[1]
+	dto, err := decodeChannelRequest(c, handler.validate, setChannelName)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
 
-	room, err := handler.roomRepo.Get(roomKey)
+	err = handler.service.LeaveChannel(c.Request.Context(), userID, session, dto)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithServiceError(c, err)
 		return
 	}
 
-	userChan, err := room.GetUserEventsChan(userID)
+	c.JSON(http.StatusOK, map[string]string{"status": "OK"})
+}
+
+func (handler *PeerMessenger) Subscribe(c *gin.Context) {
+	var dto models.SubscribeRequest
+	err := c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
+	batchWindow := time.Duration(dto.BatchMs) * time.Millisecond
+
+	// EventSource sends Last-Event-ID on reconnect, entities the previous connection missed are replayed
+	var lastEventID uint64
+	if header := c.GetHeader("Last-Event-ID"); header != "" {
+		lastEventID, err = strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			handler.logger.Error(err.Error())
+			abortWithBadRequest(c, fmt.Errorf("invalid Last-Event-ID: %w", err))
+			return
+		}
+	}
+
+	var sub *services.Subscription
+	if dto.ResumeToken != "" {
+		sub, err = handler.service.Resume(c.Request.Context(), dto.ResumeToken, lastEventID)
+	} else {
+		sub, err = handler.service.Subscribe(c.Request.Context(), dto.SubscriptionID, lastEventID)
+	}
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+	if name := c.Param("name"); name != "" && name != sub.Room {
+		sub.Cancel()
+		abortWithBadRequest(c, errChannelMismatch)
+		return
+	}
+	defer sub.Serve("sse")()
+
+	// stream ends either with the closed queue when user leaves, or because the client went away
+	clientGone := true
+	defer func() {
+		if clientGone {
+			sub.Disconnected()
+		}
+	}()
+
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 	c.Header("Content-Type", "text/event-stream")
+	c.Header("Trailer", streamEndTrailer)
+	setServerTimeHeader(c)
+
+	// clients compute clock offset from the handshake to show entity timestamps in their local time
+	writeServerTime(c)
+	// the token used to open this stream is spent, the next connection resumes with the fresh one
+	c.Render(-1, sse.Event{Event: "resume", Data: map[string]string{"resumeToken": sub.ResumeToken}})
+	if c.IsAborted() {
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(handler.opts.SSEHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	endReason := streamEndClosed
+
+	if len(sub.Replay) > 0 {
+		writeEvents(c, sub.Replay, batchWindow > 0)
+		if c.IsAborted() {
+			return
+		}
 
-	for entity := range userChan {
-		c.SSEvent("message", entity)
 		c.Writer.Flush()
+		sub.MarkActive()
+	}
+
+	// every successful write proves that the listener is alive, so it counts as user activity
+	for {
+		select {
+		case <-sub.Events.Ready():
+			batch, closed := drainBatch(sub.Events, batchWindow)
+			for _, entity := range batch {
+				if reason, ok := streamEndReasons[entity.ActionType]; ok {
+					endReason = reason
+				}
+				// other members are told about the kick too, only the kicked user's stream ends with it
+				if entity.ActionType == models.UserKicked && entity.UserID == sub.UserID {
+					endReason = streamEndKicked
+				}
+			}
+
+			if len(batch) > 0 {
+				writeEvents(c, batch, batchWindow > 0)
+				if c.IsAborted() {
+					return
+				}
+
+				c.Writer.Flush()
+				sub.Delivered(batch...)
+			}
+
+			if closed {
+				clientGone = false
+				handler.endStream(c, sub, endReason)
+				return
+			}
+		case <-heartbeat.C:
+			_, err = io.WriteString(c.Writer, ": heartbeat\n\n")
+			if err != nil {
+				handler.logger.Info("heartbeat failed, leaving from event subscription", zap.Error(err))
+				return
+			}
+
+			c.Writer.Flush()
+			sub.MarkActive()
+		case <-c.Request.Context().Done():
+			handler.logger.Info("client disconnected from event subscription",
+				zap.String("room", sub.Room), zap.String("user", sub.UserID),
+			)
+			return
+		}
+	}
+}
+
+// writeEvents writes entities as SSE events with entity IDs as event IDs, so the client can resume with Last-Event-ID.
+// Batching clients get the whole batch as one array identified by its greatest entity ID
+func writeEvents(c *gin.Context, entities []models.ChannelEntity, batching bool) {
+	if batching {
+		var lastID uint64
+		for _, entity := range entities {
+			lastID = max(lastID, entity.ID)
+		}
+
+		renderSSE(c, lastID, "batch", entities)
+		return
 	}
 
+	for _, entity := range entities {
+		renderSSE(c, entity.ID, "message", &entity)
+		if c.IsAborted() {
+			return
+		}
+	}
+}
+
+// endStream finishes the event stream with a terminal "end" event and the trailer carrying the reason.
+// The handshake is written before any entity, so the stream always has begun by then
+func (handler *PeerMessenger) endStream(c *gin.Context, sub *services.Subscription, reason string) {
 	handler.logger.Info(
 		"leaving from event subscription",
-		zap.String("room", roomKey),
-		zap.String("user", userID),
+		zap.String("room", sub.Room),
+		zap.String("user", sub.UserID),
+		zap.String("reason", reason),
 	)
 
-	c.AbortWithStatus(http.StatusNoContent)
+	c.SSEvent("end", map[string]string{"reason": reason})
+	c.Writer.Header().Set(streamEndTrailer, reason)
+	c.Writer.Flush()
+}
+
+// drainBatch collects entities already queued into a flush batch ordered by priority.
+// Non-zero window keeps collecting entities arriving within it after the first ones
+func drainBatch(queue *internal.QueueReader, window time.Duration) (batch []models.ChannelEntity, closed bool) {
+	batch, closed = queue.Take()
+
+	if window > 0 && len(batch) > 0 && !closed {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+
+	collect:
+		for {
+			select {
+			case <-queue.Ready():
+				var more []models.ChannelEntity
+				more, closed = queue.Take()
+				batch = append(batch, more...)
+				if closed {
+					break collect
+				}
+			case <-timer.C:
+				break collect
+			}
+		}
+	}
+
+	internal.SortByPriority(batch)
+
+	return batch, closed
 }
 
 func (handler *PeerMessenger) CollectMessages(c *gin.Context) {
@@ -207,110 +590,441 @@ func (handler *PeerMessenger) CollectMessages(c *gin.Context) {
 	if !ok || subscriptionID == "" {
 		err := errors.New("subscriptionID is not provided")
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	keys := handler.roomKeysExtractor.FindAllString(subscriptionID, 2)
-	roomKey, userID := keys[0], keys[1]
+	entities, err := handler.service.CollectMessages(c.Request.Context(), subscriptionID)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
 
-	room, err := handler.roomRepo.Get(roomKey)
+	c.JSON(http.StatusOK, map[string][]models.ChannelEntity{"entities": entities})
+}
+
+// CollectClientLogs accepts a batch of client logs, so client side failures can be read next to server logs
+func (handler *PeerMessenger) CollectClientLogs(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	entities, err := room.GetUserEventsSlice(userID)
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, clientLogsMaxBody)
+
+	dto, err := decode.Request[models.ClientLogsRequest](body, handler.validate)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, map[string][]models.ChannelEntity{"entities": entities})
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+
+	err = handler.service.CollectClientLogs(c.Request.Context(), userID, client, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusAccepted)
+}
+
+// ReportBug stores the caller's view of the room with the server-side state and responds with the report ID
+func (handler *PeerMessenger) ReportBug(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.BugReportRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	client := models.ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+
+	resp, err := handler.service.ReportBug(c.Request.Context(), userID, client, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
 }
 
 func (handler *PeerMessenger) SendToPeer(c *gin.Context) {
 	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	if _, ok := handler.users[userID]; !ok {
-		err := errors.New("user does not exist")
+	dto, err := decode.Request[models.SendToPeerRequest](c.Request.Body, handler.validate)
+	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.SendToPeer(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
 		return
 	}
 
-	dto, err := getTypedRequestBody[models.SendToPeerRequest](c.Request.Body, handler.validate)
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// SendBatch sends several messages in one request. Batches rejected as a whole get the error status,
+// otherwise the response lists messages that were not delivered
+func (handler *PeerMessenger) SendBatch(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	room, err := handler.roomRepo.Get(dto.ChannelName)
+	dto, err := decode.Request[models.SendBatchRequest](c.Request.Body, handler.validate)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	errs, err := handler.service.SendBatch(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	resp := models.SendBatchResponse{Failed: []models.BatchFailure{}}
+	for i, err := range errs {
+		if err == nil {
+			resp.Sent++
+			continue
+		}
+
+		_, code := ErrorCode(err)
+		resp.Failed = append(resp.Failed, models.BatchFailure{Index: i, Code: code, Message: err.Error()})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Signal relays typed offer, answer, ICE candidate or renegotiation request to room member
+func (handler *PeerMessenger) Signal(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.SignalRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	err = room.SendToUser(c.Request.Context(), userID, dto.DestinationUserID, dto.Message)
+	err = handler.service.Signal(c.Request.Context(), userID, dto)
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithServiceError(c, err)
 		return
 	}
 
 	c.AbortWithStatus(http.StatusOK)
 }
 
+// AckMessage sends read receipt to the sender of the message
+func (handler *PeerMessenger) AckMessage(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.AckRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.AckMessage(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// Broadcast sends control message to the whole room, available to service accounts only
+func (handler *PeerMessenger) Broadcast(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.BroadcastRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.Broadcast(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// PublishCaption relays transcription segment to the room, available to service accounts only
+func (handler *PeerMessenger) PublishCaption(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.CaptionRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.PublishCaption(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// RemoveRoom deletes the room, only its owner and moderators may do it
 func (handler *PeerMessenger) RemoveRoom(c *gin.Context) {
-	dto, err := getTypedRequestBody[models.ChannelRequest](c.Request.Body, handler.validate)
+	userID, err := handler.extractUserID(c)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
 		return
 	}
 
-	handler.roomRepo.RemoveRoom(dto.ChannelName)
+	dto, err := decodeChannelRequest(c, handler.validate, setRemoveRoomName)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.RemoveRoom(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
 
 	c.AbortWithStatus(http.StatusOK)
 }
 
-func (handler *PeerMessenger) extractUserID(c *gin.Context) (string, error) {
-	token := c.GetHeader("Authorization")
-	if token == "" {
-		return "", errors.New("header Authorization is empty")
+func (handler *PeerMessenger) ReportConnectionState(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.ConnectionStateRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.ReportConnectionState(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+func (handler *PeerMessenger) ReportNetworkStats(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.NetworkStatsRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.ReportNetworkStats(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+func (handler *PeerMessenger) MovePointer(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.PointerRequest](c.Request.Body, handler.validate)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.MovePointer(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusOK)
+}
+
+func (handler *PeerMessenger) History(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	var dto models.HistoryRequest
+	err = c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	resp, err := handler.service.History(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
+		return
 	}
 
-	lastIndex := len(token) - len(handler.salt)
-	return token[:lastIndex], nil
+	c.JSON(http.StatusOK, resp)
 }
 
-func getTypedRequestBody[T any](body io.Reader, validate *validator.Validate) (T, error) {
-	var dto T
-	err := json.NewDecoder(body).Decode(&dto)
+func (handler *PeerMessenger) SearchHistory(c *gin.Context) {
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	var dto models.HistorySearchRequest
+	err = c.ShouldBindQuery(&dto)
+	if err == nil {
+		err = handler.validate.Struct(dto)
+	}
 	if err != nil {
-		return dto, err
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
 	}
 
-	err = validate.Struct(dto)
+	messages, err := handler.service.SearchHistory(c.Request.Context(), userID, dto)
 	if err != nil {
-		return dto, err
+		abortWithServiceError(c, err)
+		return
 	}
 
-	return dto, nil
+	c.JSON(http.StatusOK, map[string]any{"messages": messages})
 }
 
 func (handler *PeerMessenger) CollectResolution(c *gin.Context) {
-	dto, err := getTypedRequestBody[models.ResolutionRequest](c.Request.Body, handler.validate)
+	userID, err := handler.extractUserID(c)
+	if err != nil {
+		handler.logger.Error(err.Error())
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	dto, err := decode.Request[models.ResolutionRequest](c.Request.Body, handler.validate)
 	if err != nil {
 		handler.logger.Error(err.Error())
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortWithBadRequest(c, err)
+		return
+	}
+
+	err = handler.service.CollectResolution(c.Request.Context(), userID, dto)
+	if err != nil {
+		abortWithServiceError(c, err)
 		return
 	}
 
-	handler.metrics.StreamResolution.WithLabelValues(dto.RoomName).Set(float64(dto.Height))
+	c.AbortWithStatus(http.StatusOK)
+}
+
+func (handler *PeerMessenger) extractUserID(c *gin.Context) (string, error) {
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		return "", errMissingToken
+	}
+
+	userID, err := handler.service.Authenticate(token)
+	if err != nil {
+		return "", err
+	}
+	setAccessLogUser(c, userID)
+
+	return userID, nil
+}
+
+// extractSession authenticates the request like extractUserID and also returns its session,
+// empty for tokens without one
+func (handler *PeerMessenger) extractSession(c *gin.Context) (userID, session string, err error) {
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		return "", "", errMissingToken
+	}
+
+	userID, session, err = handler.service.AuthenticateSession(token)
+	if err != nil {
+		return "", "", err
+	}
+	setAccessLogUser(c, userID)
+
+	return userID, session, nil
 }
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/support"
+)
+
+// requestBodyKey keeps the buffered body in the context for middlewares running after the handler
+const requestBodyKey = "requestBody"
+
+// RequestBodyOptions configures RequestBody middleware
+type RequestBodyOptions struct {
+	// MaxBytes is the largest accepted body, larger requests get 413
+	MaxBytes int64
+	// LogBytes is the number of body bytes written to the request log, 0 logs only the size
+	LogBytes int
+	// RedactedFields are JSON keys, matched at any depth and in any case, whose values are never logged
+	RedactedFields []string
+}
+
+// RequestBody rejects bodies over the limit and buffers the rest, so it is logged without passwords and tokens
+// and handlers still read it in full
+func RequestBody(logger *zap.Logger, opts RequestBodyOptions) gin.HandlerFunc {
+	redacted := make(map[string]struct{}, len(opts.RedactedFields))
+	for _, field := range opts.RedactedFields {
+		redacted[strings.ToLower(field)] = struct{}{}
+	}
+
+	return func(c *gin.Context) {
+		requestID := zap.String("requestID", GetRequestID(c))
+
+		if c.Request.ContentLength > opts.MaxBytes {
+			abortWithError(c, &http.MaxBytesError{Limit: opts.MaxBytes})
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, opts.MaxBytes))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				abortWithError(c, err)
+				return
+			}
+			if err != nil {
+				logger.Error("can't read request body", zap.Error(err), requestID)
+				abortWithBadRequest(c, err)
+				return
+			}
+
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Set(requestBodyKey, body)
+		}
+
+		if !requestLogged(c) {
+			c.Next()
+			return
+		}
+
+		traffic := zap.String("traffic", GetTrafficClass(c))
+		logger.Info("Request received",
+			zap.String("path", c.Request.URL.Path), zap.Int("size", len(body)),
+			zap.String("body", loggedBody(body, opts.LogBytes, redacted)), requestID, traffic,
+		)
+
+		c.Next()
+		logger.Info("Request processed", zap.String("path", c.Request.URL.Path), requestID, traffic)
+	}
+}
+
+// loggedBody redacts JSON body and cuts it to limit bytes. Bodies that are not JSON can't be redacted
+// and are left out
+func loggedBody(body []byte, limit int, redacted map[string]struct{}) string {
+	if limit == 0 || len(body) == 0 {
+		return ""
+	}
+
+	var parsed any
+	err := json.Unmarshal(body, &parsed)
+	if err != nil {
+		return "<not JSON>"
+	}
+
+	out, err := json.Marshal(redact(parsed, redacted))
+	if err != nil {
+		return "<not JSON>"
+	}
+	if len(out) > limit {
+		return string(out[:limit]) + "...<truncated>"
+	}
+
+	return string(out)
+}
+
+func redact(value any, redacted map[string]struct{}) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if _, ok := redacted[strings.ToLower(key)]; ok {
+				v[key] = support.Redacted
+				continue
+			}
+			v[key] = redact(item, redacted)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redact(item, redacted)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"peer-messenger/internal/models"
+)
+
+// sseBuffers hold events while they are built, so every event is a single write without allocations
+var sseBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
+}
+
+// sseBufferLimit is the capacity of buffers worth pooling, buffers grown by huge batches are left to GC
+const sseBufferLimit = 64 << 10
+
+// writeSSE writes event with data as one write, the same bytes as sse.Encode. Entities and batches of them
+// are appended by hand, it is what streams send all the time, anything else is marshaled by encoding/json.
+// It is not switched by codec: jsoniter passes raw data on as is, newlines in it would end the event.
+// Event names are written as is, they must not contain newlines
+func writeSSE(w io.Writer, id uint64, event string, data any) error {
+	bufPtr := sseBuffers.Get().(*[]byte)
+	defer func() {
+		if cap(*bufPtr) <= sseBufferLimit {
+			sseBuffers.Put(bufPtr)
+		}
+	}()
+
+	buf := append((*bufPtr)[:0], "id:"...)
+	buf = strconv.AppendUint(buf, id, 10)
+	buf = append(buf, "\nevent:"...)
+	buf = append(buf, event...)
+	buf = append(buf, "\ndata:"...)
+
+	head := len(buf)
+	ok := false
+	switch data := data.(type) {
+	case *models.ChannelEntity:
+		buf, ok = appendEntity(buf, data)
+	case []models.ChannelEntity:
+		buf, ok = appendEntities(buf, data)
+	}
+	if !ok {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		buf = append(buf[:head], encoded...)
+	}
+
+	// data ends with a newline like json.Encoder writes it, one more ends the event
+	buf = append(buf, "\n\n"...)
+	*bufPtr = buf
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendEntities appends the batch as a JSON array, false means some entity has to be marshaled by encoding/json
+func appendEntities(buf []byte, entities []models.ChannelEntity) ([]byte, bool) {
+	if entities == nil {
+		return append(buf, "null"...), true
+	}
+
+	buf = append(buf, '[')
+	for i := range entities {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		var ok bool
+		buf, ok = appendEntity(buf, &entities[i])
+		if !ok {
+			return buf, false
+		}
+	}
+
+	return append(buf, ']'), true
+}
+
+// appendEntity appends the entity the way encoding/json marshals it. Anything that would need escaping
+// or validation is reported with false instead, encoding/json marshals it then
+func appendEntity(buf []byte, entity *models.ChannelEntity) ([]byte, bool) {
+	if entity == nil {
+		return append(buf, "null"...), true
+	}
+
+	var ok bool
+	buf = append(buf, `{"id":`...)
+	buf = strconv.AppendUint(buf, entity.ID, 10)
+	buf = append(buf, `,"time":`...)
+	if buf, ok = appendTime(buf, entity.Time); !ok {
+		return buf, false
+	}
+	buf = append(buf, `,"actionType":`...)
+	if buf, ok = appendString(buf, string(entity.ActionType)); !ok {
+		return buf, false
+	}
+	buf = append(buf, `,"userID":`...)
+	if buf, ok = appendString(buf, entity.UserID); !ok {
+		return buf, false
+	}
+	buf = append(buf, `,"data":`...)
+	if buf, ok = appendRaw(buf, entity.Data); !ok {
+		return buf, false
+	}
+	if entity.DestinationUserID != "" {
+		buf = append(buf, `,"destinationUserID":`...)
+		if buf, ok = appendString(buf, entity.DestinationUserID); !ok {
+			return buf, false
+		}
+	}
+	if entity.Priority != "" {
+		buf = append(buf, `,"priority":`...)
+		if buf, ok = appendString(buf, string(entity.Priority)); !ok {
+			return buf, false
+		}
+	}
+	if entity.MessageID != "" {
+		buf = append(buf, `,"messageID":`...)
+		if buf, ok = appendString(buf, entity.MessageID); !ok {
+			return buf, false
+		}
+	}
+
+	return append(buf, '}'), true
+}
+
+// appendTime appends the time as time.Time.MarshalJSON does, times it rejects are reported with false
+func appendTime(buf []byte, t time.Time) ([]byte, bool) {
+	start := len(buf) + 1
+	buf = append(buf, '"')
+	buf = t.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, '"')
+
+	// time.Time.MarshalJSON rejects years other than 4 digits and zone offsets of 24 hours and more
+	if buf[start+len("2006")] != '-' {
+		return buf, false
+	}
+	if buf[len(buf)-2] != 'Z' {
+		hour := buf[len(buf)-len(`07:00"`):]
+		if c := buf[len(buf)-len(`Z07:00"`)]; '0' <= c && c <= '9' || (hour[0]-'0')*10+hour[1]-'0' >= 24 {
+			return buf, false
+		}
+	}
+
+	return buf, true
+}
+
+// appendString appends the string quoted, strings encoding/json would escape are reported with false
+func appendString(buf []byte, s string) ([]byte, bool) {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < 0x20, c == '"', c == '\\', c == '<', c == '>', c == '&':
+			return buf, false
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	if !ascii && (!utf8.ValidString(s) || strings.ContainsAny(s, "\u2028\u2029")) {
+		return buf, false
+	}
+
+	buf = append(buf, '"')
+	buf = append(buf, s...)
+	return append(buf, '"'), true
+}
+
+// appendRaw appends data already encoded as JSON. Data comes from json.Marshal or a decoded bus message,
+// so it is valid, only whitespace and characters encoding/json would escape are reported with false
+func appendRaw(buf []byte, data []byte) ([]byte, bool) {
+	if data == nil {
+		return append(buf, "null"...), true
+	}
+	if len(data) == 0 {
+		return buf, false
+	}
+
+	inString, escaped := false, false
+	for i, c := range data {
+		switch {
+		case c == '<' || c == '>' || c == '&':
+			return buf, false
+		case c == 0xE2 && i+2 < len(data) && data[i+1] == 0x80 && (data[i+2] == 0xA8 || data[i+2] == 0xA9):
+			return buf, false
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			return buf, false
+		}
+	}
+
+	return append(buf, data...), true
+}
+
+// renderSSE is writeSSE for handlers, failed write aborts the request like failed c.Render
+func renderSSE(c *gin.Context, id uint64, event string, data any) {
+	err := writeSSE(c.Writer, id, event, data)
+	if err != nil {
+		_ = c.Error(err)
+		c.Abort()
+	}
+}
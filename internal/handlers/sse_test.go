@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sse"
+
+	"peer-messenger/internal/models"
+)
+
+// writeSSE does not depend on the codec, its benchmarks are compared with sse.Encode, e.g.
+// go test -run='^$' -bench=SSE -benchmem ./internal/handlers
+
+func sseEntity() models.ChannelEntity {
+	return models.ChannelEntity{
+		ID:         42,
+		Time:       time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		ActionType: models.Message,
+		UserID:     "alice",
+		Data: json.RawMessage(`{"messageType":"candidate","candidate":"candidate:1 1 udp 2122260223 ` +
+			`192.168.1.2 54321 typ host generation 0","sdpMid":"0","sdpMLineIndex":0}`),
+		Priority:  models.PriorityHigh,
+		MessageID: "m-42",
+	}
+}
+
+func sseBatch(size int) []models.ChannelEntity {
+	batch := make([]models.ChannelEntity, size)
+	for i := range batch {
+		batch[i] = sseEntity()
+		batch[i].ID = uint64(i + 1)
+	}
+
+	return batch
+}
+
+func TestWriteSSEMatchesEncode(t *testing.T) {
+	entity := sseEntity()
+
+	// entities written by hand must match encoding/json whatever their strings and data hold
+	tricky := func(change func(*models.ChannelEntity)) *models.ChannelEntity {
+		entity := sseEntity()
+		change(&entity)
+		return &entity
+	}
+
+	tests := []struct {
+		name  string
+		event string
+		data  any
+	}{
+		{name: "message", event: "message", data: &entity},
+		{name: "batch", event: "batch", data: sseBatch(3)},
+		{name: "empty batch", event: "batch", data: []models.ChannelEntity{}},
+		{name: "echo", event: "message", data: tricky(func(e *models.ChannelEntity) {
+			e.DestinationUserID, e.Priority, e.MessageID = "bob", "", ""
+		})},
+		{name: "no data", event: "message", data: tricky(func(e *models.ChannelEntity) { e.Data = nil })},
+		{name: "zone", event: "message", data: tricky(func(e *models.ChannelEntity) {
+			e.Time = time.Date(2024, 1, 1, 12, 0, 0, 123456789, time.FixedZone("", -(3*3600+30*60)))
+		})},
+		{name: "html in user", event: "message", data: tricky(func(e *models.ChannelEntity) { e.UserID = "<b>&" })},
+		{name: "quote in user", event: "message", data: tricky(func(e *models.ChannelEntity) { e.UserID = "a\"b\\" })},
+		{name: "control in user", event: "message", data: tricky(func(e *models.ChannelEntity) { e.UserID = "a\tb\x01" })},
+		{name: "unicode user", event: "message", data: tricky(func(e *models.ChannelEntity) { e.UserID = "jos\u00e9 \u2028" })},
+		{name: "invalid utf8 user", event: "message", data: tricky(func(e *models.ChannelEntity) { e.UserID = "a\xffb" })},
+		{name: "html in data", event: "message", data: tricky(func(e *models.ChannelEntity) {
+			e.Data = json.RawMessage(`{"text":"<script>&"}`)
+		})},
+		{name: "separator in data", event: "message", data: tricky(func(e *models.ChannelEntity) {
+			e.Data = json.RawMessage(`{"text":"a\u2028b"}`)
+		})},
+		{name: "spaced data", event: "message", data: tricky(func(e *models.ChannelEntity) {
+			e.Data = json.RawMessage("{ \"text\" : \"a \\\" b\",\n\"n\": [1, 2] }")
+		})},
+		{name: "other data", event: "state", data: map[string]any{"queued": 3, "note": "<ok>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got, want bytes.Buffer
+			err := writeSSE(&got, 42, tt.event, tt.data)
+			if err != nil {
+				t.Fatalf("writeSSE: %v", err)
+			}
+			err = sse.Encode(&want, sse.Event{Id: "42", Event: tt.event, Data: tt.data})
+			if err != nil {
+				t.Fatalf("sse.Encode: %v", err)
+			}
+
+			if got.String() != want.String() {
+				t.Errorf("writeSSE writes\n%q\nsse.Encode writes\n%q", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func BenchmarkWriteSSE(b *testing.B) {
+	entity := sseEntity()
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := writeSSE(&buf, entity.ID, "message", &entity)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeSSE(b *testing.B) {
+	entity := sseEntity()
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := sse.Encode(&buf, sse.Event{Id: strconv.FormatUint(entity.ID, 10), Event: "message", Data: &entity})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteSSEBatch(b *testing.B) {
+	batch := sseBatch(32)
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := writeSSE(&buf, batch[len(batch)-1].ID, "batch", batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeSSEBatch(b *testing.B) {
+	batch := sseBatch(32)
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := sse.Encode(&buf, sse.Event{Id: strconv.FormatUint(batch[len(batch)-1].ID, 10), Event: "batch", Data: batch})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"math/rand"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CanaryHeader carries the canary token, requests with the right one are tagged as canary traffic
+const CanaryHeader = "X-Canary-Token"
+
+// Traffic classes. Everything but public traffic is internal: it is counted apart from the public metrics
+// SLO dashboards are built on and only a sample of it is logged
+const (
+	TrafficPublic = "public"
+	TrafficAdmin  = "admin"
+	TrafficProbe  = "probe"
+	TrafficCanary = "canary"
+)
+
+// context keys of the traffic class and the log sampling decision
+const (
+	trafficKey   = "trafficClass"
+	logSampleKey = "logSampled"
+)
+
+// TrafficOptions configures ClassifyTraffic middleware
+type TrafficOptions struct {
+	// CanaryToken is expected in CanaryHeader of canary requests, empty disables canary tagging
+	CanaryToken string
+	// AdminPaths and ProbePaths are path prefixes of admin API and health probes, matched on whole segments
+	AdminPaths []string
+	ProbePaths []string
+	// LogSampleRate (0..1) is the share of internal requests written to the request and access logs
+	LogSampleRate float64
+}
+
+// ClassifyTraffic tags the request with its traffic class and decides once whether it is logged,
+// so the request log and the access log keep or skip the same requests
+func ClassifyTraffic(opts TrafficOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		class := classifyTraffic(c, opts)
+		c.Set(trafficKey, class)
+		c.Set(logSampleKey, class == TrafficPublic || rand.Float64() < opts.LogSampleRate)
+
+		c.Next()
+	}
+}
+
+func classifyTraffic(c *gin.Context, opts TrafficOptions) string {
+	token := c.GetHeader(CanaryHeader)
+	if opts.CanaryToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(opts.CanaryToken)) == 1 {
+		return TrafficCanary
+	}
+
+	path := c.Request.URL.Path
+	switch {
+	case matchPath(path, opts.ProbePaths):
+		return TrafficProbe
+	case matchPath(path, opts.AdminPaths):
+		return TrafficAdmin
+	default:
+		return TrafficPublic
+	}
+}
+
+// matchPath reports whether path is one of prefixes or lies under one of them
+func matchPath(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if ok && (rest == "" || rest[0] == '/') {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetTrafficClass returns the class assigned by ClassifyTraffic, requests it has not seen are public
+func GetTrafficClass(c *gin.Context) string {
+	class := c.GetString(trafficKey)
+	if class == "" {
+		return TrafficPublic
+	}
+
+	return class
+}
+
+// requestLogged tells whether the request was sampled for the request and access logs
+func requestLogged(c *gin.Context) bool {
+	sampled, ok := c.Get(logSampleKey)
+	return !ok || sampled.(bool)
+}
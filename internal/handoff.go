@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"peer-messenger/internal/bus"
+	"peer-messenger/internal/models"
+)
+
+// HandOffEach is DisposeEach for the room handed over to other instances: its state with the entities queued
+// for members is passed to publish first. Published entities leave the queues, members take them from the instance
+// they reconnect to. If publishing fails, they stay for members to take before the farewell as with DisposeEach
+func (r *Room) HandOffEach(
+	actionType models.ActionType, data func(userID, session string) map[string]any, publish func(bus.Handoff) error,
+) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	handoff := r.handoff()
+	err := publish(handoff)
+	if err != nil {
+		for _, member := range handoff.Members {
+			r.userInfos[member.UserID].entities.putBack(member.Queued)
+		}
+	}
+
+	r.disposeEach(actionType, data)
+
+	return err
+}
+
+// handoff captures the state of the room taking the entities queued for members. Must be called under write lock
+func (r *Room) handoff() bus.Handoff {
+	handoff := bus.Handoff{
+		Room:            r.name,
+		LastEntityID:    r.lastEntityID.Load(),
+		Owner:           r.owner,
+		PasswordHash:    r.passwordHash,
+		Capacity:        r.capacity,
+		Policy:          r.policy,
+		Locale:          r.locale,
+		EntryForm:       r.entryForm,
+		CaptionsEnabled: r.captionsEnabled,
+		ExpiresAt:       r.expiresAt,
+		Members:         make([]bus.HandoffMember, 0, len(r.userInfos)),
+	}
+	if r.invited != nil {
+		handoff.Invited = make([]string, 0, len(r.invited))
+		for userID := range r.invited {
+			handoff.Invited = append(handoff.Invited, userID)
+		}
+	}
+	for userID := range r.banned {
+		handoff.Banned = append(handoff.Banned, userID)
+	}
+
+	for userID, info := range r.userInfos {
+		sessions := make([]string, 0, len(info.sessions))
+		for session := range info.sessions {
+			sessions = append(sessions, session)
+		}
+
+		handoff.Members = append(handoff.Members, bus.HandoffMember{
+			UserID:       userID,
+			Sessions:     sessions,
+			Client:       info.client,
+			Moderator:    info.moderator,
+			Silent:       info.silent,
+			Captions:     info.captions,
+			VariantLabel: info.variantLabel,
+			Topology:     info.topology,
+			Answers:      info.answers,
+			Queued:       info.entities.takeAll(),
+		})
+	}
+
+	return handoff
+}
+
+// adopt takes over members of the room handed over by another instance, they join silently as they never left.
+// The room created for the handoff takes its settings and goes on with its entity IDs, so lastEventID of members
+// stays meaningful. The room that is here already keeps its own settings and members, adopted entities get its IDs
+func (r *Room) adopt(handoff bus.Handoff, created bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if created {
+		r.lastEntityID.Store(handoff.LastEntityID)
+		r.owner = handoff.Owner
+		r.passwordHash = handoff.PasswordHash
+		r.capacity = handoff.Capacity
+		r.locale = handoff.Locale
+		r.entryForm = handoff.EntryForm
+		r.captionsEnabled = handoff.CaptionsEnabled
+		r.expiresAt = handoff.ExpiresAt
+		if handoff.Invited != nil {
+			r.invited = make(map[string]struct{}, len(handoff.Invited))
+			for _, userID := range handoff.Invited {
+				r.invited[userID] = struct{}{}
+			}
+		}
+		for _, userID := range handoff.Banned {
+			r.banned[userID] = struct{}{}
+		}
+
+		r.policy = handoff.Policy
+		if r.policy.ChatHistory {
+			r.chatHistory = newChatHistory(r.opts.ChatHistoryCapacity)
+		}
+	}
+
+	now := time.Now()
+	for _, member := range handoff.Members {
+		if _, ok := r.userInfos[member.UserID]; ok {
+			continue
+		}
+		if _, ok := r.banned[member.UserID]; ok {
+			continue
+		}
+
+		info := &userInfo{
+			id:             member.UserID,
+			entities:       newEntityQueue(r.opts.QueueSize),
+			history:        newEntityHistory(r.opts.QueueSize),
+			lastActionTime: now,
+			joinTime:       now,
+			client:         member.Client,
+			silent:         member.Silent,
+			captions:       member.Captions,
+			variantLabel:   member.VariantLabel,
+			presence:       models.PresenceOnline,
+			sendLimiter:    rate.NewLimiter(rate.Limit(r.opts.UserMessageRate), r.opts.UserMessageBurst),
+			limiterStats:   &limiterStats{},
+			sessions:       make(map[string]struct{}, len(member.Sessions)),
+			answers:        member.Answers,
+			moderator:      member.Moderator || member.UserID == r.owner,
+			topology:       member.Topology,
+		}
+		info.adopted.Store(true)
+		for _, session := range member.Sessions {
+			info.sessions[session] = struct{}{}
+		}
+
+		for _, entity := range member.Queued {
+			if !created {
+				entity.ID = r.lastEntityID.Add(1)
+			}
+			if !info.entities.push(entity) {
+				r.deadLetters.Record(r.name, member.UserID, entity, ErrDestBusy.Error())
+				continue
+			}
+			info.history.record(entity)
+		}
+
+		r.userInfos[member.UserID] = info
+	}
+
+	r.metrics.RoomMembers.WithLabelValues(r.name).Set(float64(r.members()))
+}
+
+// forwardCopy publishes the message to the adopted member too, the instance it reconnected to delivers it there.
+// It is already accounted as delivered here, so failures are only logged
+func (r *Room) forwardCopy(ctx context.Context, destUserID string, entity models.ChannelEntity) {
+	err := r.bus.Publish(ctx, bus.Message{
+		Room:        r.name,
+		UserID:      destUserID,
+		Entity:      entity,
+		MessageType: entity.MessageType,
+	})
+	if err != nil {
+		r.log.Warn("message is not forwarded to adopted member", zap.String("user", destUserID), zap.Error(err))
+	}
+}
+
+// Adopt takes over the room handed over by another instance, creating it unless it is here already
+func (repo *RoomRepository) Adopt(handoff bus.Handoff) {
+	repo.mut.Lock()
+	defer repo.mut.Unlock()
+
+	room, ok := repo.rooms[handoff.Room]
+	if !ok {
+		room = repo.newRoom(handoff.Room)
+		repo.rooms[handoff.Room] = room
+	}
+
+	room.adopt(handoff, !ok)
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/bus"
+	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/msgtype"
+)
+
+// loopbackBus hands rooms over to another repository through JSON, like the shared buses do,
+// and keeps published messages
+type loopbackBus struct {
+	adopt     func(bus.Handoff)
+	published []bus.Message
+}
+
+func (b *loopbackBus) Publish(_ context.Context, msg bus.Message) error {
+	b.published = append(b.published, msg)
+	return nil
+}
+
+func (b *loopbackBus) HandOff(_ context.Context, handoff bus.Handoff) error {
+	data, err := json.Marshal(handoff)
+	if err != nil {
+		return err
+	}
+
+	var received bus.Handoff
+	err = json.Unmarshal(data, &received)
+	if err != nil {
+		return err
+	}
+	b.adopt(received)
+
+	return nil
+}
+
+func (b *loopbackBus) Subscribe(func(bus.Message), func(bus.Handoff)) error { return nil }
+
+func (b *loopbackBus) Close() error { return nil }
+
+func newHandoffRepository(b bus.Bus) *RoomRepository {
+	opts := RoomOptions{
+		UserMessageRate:  100,
+		UserMessageBurst: 100,
+		QueueSize:        16,
+		MessageTypes:     msgtype.Default(),
+	}
+
+	return NewRoomRepository(zap.NewNop(), metrics.New(metrics.DefaultOptions()), opts, nil, nil, b, nil)
+}
+
+func TestDrainHandsRoomOver(t *testing.T) {
+	ctx := context.Background()
+
+	adopting := newHandoffRepository(&loopbackBus{})
+	draining := newHandoffRepository(&loopbackBus{adopt: adopting.Adopt})
+
+	room, err := draining.AddRoom(ctx, "room-1")
+	if err != nil {
+		t.Fatalf("add room: %v", err)
+	}
+	room.ClaimOwner("alice")
+	for _, member := range []struct{ userID, session string }{{"alice", "a1"}, {"bob", "b1"}} {
+		err = room.AddUser(member.userID, JoinOptions{Client: models.ClientInfo{Session: member.session}})
+		if err != nil {
+			t.Fatalf("add %s: %v", member.userID, err)
+		}
+	}
+
+	bobStream, err := room.OpenStream("bob", "b1")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	bobStream.Take()
+
+	err = room.SendToUser(ctx, "alice", "bob", map[string]any{"messageType": "chat", "text": "hi"}, SendOptions{})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	sentID := room.LastEntityID()
+
+	draining.Drain(ctx, "shutdown", func(_, _, _ string) map[string]any {
+		return map[string]any{"reason": "shutdown"}
+	})
+
+	// the queued message went with the room, the old stream ends with the farewell alone
+	left, closed := bobStream.Take()
+	if !closed || len(left) != 1 || left[0].ActionType != models.Reconnect {
+		t.Fatalf("old stream takes %+v, closed %v, want the reconnect farewell only", left, closed)
+	}
+
+	adopted, err := adopting.Get("room-1")
+	if err != nil {
+		t.Fatalf("room is not adopted: %v", err)
+	}
+	if !adopted.HasUser("alice") || !adopted.HasUser("bob") || !adopted.CanManage("alice") {
+		t.Fatalf("adopted room lost members or owner: %+v", adopted.GetState())
+	}
+
+	resumed, err := adopted.OpenStream("bob", "b1")
+	if err != nil {
+		t.Fatalf("resume stream: %v", err)
+	}
+	entities, _ := resumed.Take()
+	if len(entities) != 1 || entities[0].ID != sentID || entities[0].UserID != "alice" {
+		t.Fatalf("resumed stream takes %+v, want the message %d from alice", entities, sentID)
+	}
+
+	// alice has not reconnected here, she may be on another instance, so her messages go there too
+	err = adopted.SendToUser(ctx, "bob", "alice", map[string]any{"messageType": "chat", "text": "hey"}, SendOptions{})
+	if err != nil {
+		t.Fatalf("send to adopted member: %v", err)
+	}
+	published := adopted.bus.(*loopbackBus).published
+	if len(published) != 1 || published[0].UserID != "alice" {
+		t.Fatalf("published %+v, want the copy for alice", published)
+	}
+}
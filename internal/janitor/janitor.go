@@ -0,0 +1,173 @@
+// Package janitor runs the periodic cleanup of disconnected users and empty rooms. Its interval adapts to load:
+// busy instances with many rooms clean less often, while evictions suggest more stale users to come
+// and make the next pass sooner
+package janitor
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/metrics"
+)
+
+const (
+	// roomsScale is the number of rooms that doubles the interval, every pass walks all users
+	roomsScale = 1000
+	// churnScale is the number of evicted users and removed rooms that halves the interval
+	churnScale = 10
+	// minScale and maxScale bound the interval relative to the configured one
+	minScale = 0.25
+	maxScale = 4
+)
+
+var ErrAlreadyStarted = errors.New("janitor is already started")
+
+// Pass cleans once and reports what was cleaned
+type Pass func(ctx context.Context) internal.CleanResult
+
+type Options struct {
+	// Interval is the base period between passes
+	Interval time.Duration
+	// Jitter (0..1) spreads passes of instances started at the same time by up to ±Jitter of the interval
+	Jitter float64
+}
+
+// Status is the schedule of the janitor
+type Status struct {
+	IntervalSeconds float64   `json:"intervalSeconds"`
+	NextRun         time.Time `json:"nextRun"`
+	// LastRun is zero until the first pass
+	LastRun        time.Time            `json:"lastRun"`
+	LastRunSeconds float64              `json:"lastRunSeconds"`
+	LastRunResult  internal.CleanResult `json:"lastRunResult"`
+}
+
+// Janitor runs pass from Start until Stop
+type Janitor struct {
+	logger  *zap.Logger
+	metrics *metrics.Metrics
+	opts    Options
+	pass    Pass
+
+	mux    *sync.Mutex
+	status Status
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func New(logger *zap.Logger, metrics *metrics.Metrics, opts Options, pass Pass) *Janitor {
+	return &Janitor{
+		logger:  logger,
+		metrics: metrics,
+		opts:    opts,
+		pass:    pass,
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Start schedules the first pass after the jittered interval and returns, passes run in background until Stop
+func (j *Janitor) Start(ctx context.Context) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.cancel != nil {
+		return ErrAlreadyStarted
+	}
+
+	ctx, j.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	j.done = make(chan struct{})
+
+	go j.run(ctx, j.done)
+
+	return nil
+}
+
+// Stop cancels the pass in progress and waits for it to return or ctx to expire. Stopped janitor can be started again
+func (j *Janitor) Stop(ctx context.Context) error {
+	j.mux.Lock()
+	cancel, done := j.cancel, j.done
+	j.cancel, j.done = nil, nil
+	j.mux.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns when the janitor runs next and how the last pass went
+func (j *Janitor) Status() Status {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	return j.status
+}
+
+func (j *Janitor) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	defer j.metrics.TrackGoroutine("janitor")()
+
+	timer := time.NewTimer(j.schedule(time.Now(), j.jitter(j.opts.Interval)))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			started := time.Now()
+			result := j.pass(ctx)
+			took := time.Since(started)
+
+			j.metrics.JanitorEvictedUsers.Add(float64(result.EvictedUsers))
+			j.metrics.JanitorRemovedRooms.Add(float64(result.RemovedRooms))
+			j.logger.Debug("cleanup pass finished", zap.Duration("took", took),
+				zap.Int("evicted users", result.EvictedUsers), zap.Int("removed rooms", result.RemovedRooms),
+			)
+
+			timer.Reset(j.finished(started, took, result))
+		}
+	}
+}
+
+// finished records the pass and returns the delay until the next one
+func (j *Janitor) finished(started time.Time, took time.Duration, result internal.CleanResult) time.Duration {
+	j.mux.Lock()
+	j.status.LastRun = started
+	j.status.LastRunSeconds = took.Seconds()
+	j.status.LastRunResult = result
+	j.mux.Unlock()
+
+	churn := result.EvictedUsers + result.RemovedRooms
+	scale := (1 + float64(result.Rooms)/roomsScale) / (1 + float64(churn)/churnScale)
+	scale = min(max(scale, minScale), maxScale)
+
+	return j.schedule(started.Add(took), j.jitter(time.Duration(float64(j.opts.Interval)*scale)))
+}
+
+func (j *Janitor) schedule(now time.Time, interval time.Duration) time.Duration {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	j.status.IntervalSeconds = interval.Seconds()
+	j.status.NextRun = now.Add(interval)
+
+	return interval
+}
+
+func (j *Janitor) jitter(interval time.Duration) time.Duration {
+	return time.Duration(float64(interval) * (1 + j.opts.Jitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,189 @@
+// Package lifecycle starts and stops application components in a defined order
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Hook is a named pair of start and stop functions. Both are optional
+type Hook struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Lifecycle starts hooks in the order they were appended and stops them in reverse order
+type Lifecycle struct {
+	hooks   []Hook
+	started int
+	log     *zap.Logger
+}
+
+func New(log *zap.Logger) *Lifecycle {
+	return &Lifecycle{log: log}
+}
+
+func (l *Lifecycle) Append(hook Hook) {
+	l.hooks = append(l.hooks, hook)
+}
+
+// Start runs start functions one by one. If one fails, already started hooks are stopped
+func (l *Lifecycle) Start(ctx context.Context) error {
+	for _, hook := range l.hooks {
+		if hook.Start != nil {
+			err := hook.Start(ctx)
+			if err != nil {
+				return errors.Join(fmt.Errorf("start %s: %w", hook.Name, err), l.Stop(ctx))
+			}
+		}
+
+		l.started++
+		l.log.Debug("component started", zap.String("component", hook.Name))
+	}
+
+	return nil
+}
+
+// Stop runs stop functions of started hooks in reverse order, all of them are called even if some fail
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	var errs []error
+	for ; l.started > 0; l.started-- {
+		hook := l.hooks[l.started-1]
+		if hook.Stop == nil {
+			continue
+		}
+
+		err := hook.Stop(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", hook.Name, err))
+		}
+
+		l.log.Debug("component stopped", zap.String("component", hook.Name))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Worker makes hook running background function until stop. run must return once its context is cancelled
+func Worker(name string, run func(ctx context.Context)) Hook {
+	var (
+		cancel context.CancelFunc
+		done   = &sync.WaitGroup{}
+	)
+
+	return Hook{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var workerCtx context.Context
+			workerCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				run(workerCtx)
+			}()
+
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+
+			stopped := make(chan struct{})
+			go func() {
+				done.Wait()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// HTTPServer makes hook serving requests until stop. Address is bound on start, so busy port fails the start.
+// Server with TLSConfig serves TLS and HTTP/2 with certificates of the config.
+// Serve errors happening later are reported to onError
+func HTTPServer(name string, server *http.Server, onError func(error)) Hook {
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			listener, err := net.Listen("tcp", server.Addr)
+			if err != nil {
+				return err
+			}
+
+			go func() {
+				var err error
+				if server.TLSConfig != nil {
+					err = server.ServeTLS(listener, "", "")
+				} else {
+					err = server.Serve(listener)
+				}
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					onError(err)
+				}
+			}()
+
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return server.Shutdown(ctx)
+		},
+	}
+}
+
+// GRPCServer is the part of *grpc.Server the hook needs, so lifecycle does not depend on grpc
+type GRPCServer interface {
+	Serve(net.Listener) error
+	GracefulStop()
+	Stop()
+}
+
+// GRPCListener makes hook serving gRPC on addr until stop. Like HTTPServer it binds the address on start.
+// Stop waits for active calls and cuts them off when ctx is done
+func GRPCListener(name, addr string, server GRPCServer, onError func(error)) Hook {
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+
+			go func() {
+				err := server.Serve(listener)
+				if err != nil {
+					onError(err)
+				}
+			}()
+
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				server.Stop()
+				return ctx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// saturationWarnAfter is how long the user has to keep hitting the send limit before it is logged
+	saturationWarnAfter = 5 * time.Second
+	// saturationGap is the pause between rejected messages that ends the saturation
+	saturationGap = time.Second
+	// saturationWarnInterval limits saturation warnings to one per user per interval
+	saturationWarnInterval = time.Minute
+)
+
+const (
+	limiterOutcomeAllowed  = "allowed"
+	limiterOutcomeRejected = "rejected"
+)
+
+// LimiterStats describes how the send rate limit affected messages of the user
+type LimiterStats struct {
+	Allowed  uint64 `json:"allowed"`
+	Rejected uint64 `json:"rejected"`
+	// Tokens is the number of messages user may send at once right now
+	Tokens float64 `json:"tokens"`
+}
+
+// limiterStats accumulates limiter outcomes of a single sender. Senders are limited under the room read lock,
+// so stats have their own mutex
+type limiterStats struct {
+	mux   sync.Mutex
+	stats LimiterStats
+	// saturatedSince is the start of the current run of rejected messages, zero when there is none
+	saturatedSince time.Time
+	lastRejected   time.Time
+	lastWarn       time.Time
+}
+
+// observe records the outcome and reports for how long the user is saturated if it is time to warn about it
+func (s *limiterStats) observe(outcome string, now time.Time) (time.Duration, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if outcome == limiterOutcomeAllowed {
+		s.stats.Allowed++
+		return 0, false
+	}
+
+	s.stats.Rejected++
+
+	if s.saturatedSince.IsZero() || now.Sub(s.lastRejected) > saturationGap {
+		s.saturatedSince = now
+	}
+	s.lastRejected = now
+
+	saturatedFor := now.Sub(s.saturatedSince)
+	if saturatedFor < saturationWarnAfter || now.Sub(s.lastWarn) < saturationWarnInterval {
+		return saturatedFor, false
+	}
+
+	s.lastWarn = now
+
+	return saturatedFor, true
+}
+
+func (s *limiterStats) snapshot() LimiterStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.stats
+}
+
+func (info *userInfo) rateLimitStats() LimiterStats {
+	stats := info.limiterStats.snapshot()
+	stats.Tokens = info.sendLimiter.Tokens()
+
+	return stats
+}
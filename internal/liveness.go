@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const reasonHeartbeatTimeout = "heartbeat timeout"
+
+// LapsedUser is a member removed for missing liveness heartbeats
+type LapsedUser struct {
+	Room   string
+	UserID string
+}
+
+// Beat records liveness heartbeat of the user. From the first beat the user has to beat within LivenessWindow
+// and is removed as soon as it misses it, so other members tear down their peer connections without waiting
+// for inactivity eviction
+func (r *Room) Beat(userID string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	now := time.Now()
+	info.beatTime = now
+	info.lastActionTime = now
+	r.updatePresence(info, now)
+
+	return nil
+}
+
+// RemoveLapsed removes users whose liveness heartbeats stopped for longer than LivenessWindow, others are told
+// they left. Users that never sent one are left to inactivity eviction
+func (r *Room) RemoveLapsed(now time.Time) []string {
+	// the room is checked several times per window, write lock is taken only when someone lapsed
+	r.mux.RLock()
+	lapsed := r.lapsed(now)
+	r.mux.RUnlock()
+	if len(lapsed) == 0 {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// users may have beaten or left in between
+	lapsed = r.lapsed(now)
+	for _, userID := range lapsed {
+		r.removeUser(userID, reasonHeartbeatTimeout)
+	}
+	r.log.Info("users missed liveness heartbeats", zap.Strings("users", lapsed))
+
+	return lapsed
+}
+
+// lapsed returns users with liveness heartbeats older than LivenessWindow. Must be called under lock
+func (r *Room) lapsed(now time.Time) []string {
+	var lapsed []string
+	for userID, info := range r.userInfos {
+		if !info.beatTime.IsZero() && now.Sub(info.beatTime) > r.opts.LivenessWindow {
+			lapsed = append(lapsed, userID)
+		}
+	}
+
+	return lapsed
+}
+
+// RemoveLapsed removes users who missed liveness heartbeats from all rooms
+func (repo *RoomRepository) RemoveLapsed(now time.Time) []LapsedUser {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	var lapsed []LapsedUser
+	for roomName, room := range repo.rooms {
+		for _, userID := range room.RemoveLapsed(now) {
+			lapsed = append(lapsed, LapsedUser{Room: roomName, UserID: userID})
+		}
+	}
+
+	return lapsed
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+)
+
+// MessageStore is the per-user inbox of peer messages that did not fit into the recipient's queue,
+// so they are replayed when the recipient collects messages or reconnects instead of being lost.
+// In-memory store is the default, the interface allows shared ones like Redis or Postgres
+type MessageStore interface {
+	// Put stores entity for the user of the room. Bounded stores evict the oldest entities of the user
+	Put(room, userID string, entity models.ChannelEntity) error
+	// Take removes and returns stored entities of the user from oldest to newest
+	Take(room, userID string) ([]models.ChannelEntity, error)
+	// Len is the number of stored entities of the user
+	Len(room, userID string) (int, error)
+	// Drop removes stored entities of the user, empty userID drops the whole room
+	Drop(room, userID string) error
+}
+
+type inboxKey struct {
+	room, userID string
+}
+
+// MemoryMessageStore keeps a ring buffer of the latest entities per user
+type MemoryMessageStore struct {
+	capacity int
+	inboxes  map[inboxKey]*inbox
+	mux      *sync.Mutex
+}
+
+type inbox struct {
+	entities []models.ChannelEntity
+	next     int
+	full     bool
+}
+
+func NewMemoryMessageStore(capacity int) *MemoryMessageStore {
+	return &MemoryMessageStore{
+		capacity: max(capacity, 1),
+		inboxes:  make(map[inboxKey]*inbox),
+		mux:      &sync.Mutex{},
+	}
+}
+
+func (s *MemoryMessageStore) Put(room, userID string, entity models.ChannelEntity) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	key := inboxKey{room: room, userID: userID}
+	box, ok := s.inboxes[key]
+	if !ok {
+		box = &inbox{entities: make([]models.ChannelEntity, s.capacity)}
+		s.inboxes[key] = box
+	}
+
+	box.entities[box.next] = entity
+	box.next = (box.next + 1) % len(box.entities)
+	if box.next == 0 {
+		box.full = true
+	}
+
+	return nil
+}
+
+func (s *MemoryMessageStore) Take(room, userID string) ([]models.ChannelEntity, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	key := inboxKey{room: room, userID: userID}
+	box, ok := s.inboxes[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.inboxes, key)
+
+	start, count := 0, box.next
+	if box.full {
+		start, count = box.next, len(box.entities)
+	}
+
+	out := make([]models.ChannelEntity, 0, count)
+	for i := 0; i < count; i++ {
+		out = append(out, box.entities[(start+i)%len(box.entities)])
+	}
+
+	return out, nil
+}
+
+func (s *MemoryMessageStore) Len(room, userID string) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	box, ok := s.inboxes[inboxKey{room: room, userID: userID}]
+	if !ok {
+		return 0, nil
+	}
+	if box.full {
+		return len(box.entities), nil
+	}
+
+	return box.next, nil
+}
+
+func (s *MemoryMessageStore) Drop(room, userID string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if userID != "" {
+		delete(s.inboxes, inboxKey{room: room, userID: userID})
+		return nil
+	}
+
+	for key := range s.inboxes {
+		if key.room == room {
+			delete(s.inboxes, key)
+		}
+	}
+
+	return nil
+}
+
+// storeMissed puts peer message the user could not receive into the inbox and reports whether it was stored.
+// Other entities are not worth replaying: presence changes are visible in the member list
+func (r *Room) storeMissed(userID string, entity models.ChannelEntity) bool {
+	if r.inbox == nil || entity.ActionType != models.Message {
+		return false
+	}
+
+	err := r.inbox.Put(r.name, userID, entity)
+	if err != nil {
+		r.log.Error("failed to store missed message", zap.String("user", userID), zap.Error(err))
+		return false
+	}
+
+	return true
+}
+
+// takeMissed returns stored entities of the user merged with the given ones in entity ID order
+func (r *Room) takeMissed(userID string, entities []models.ChannelEntity) []models.ChannelEntity {
+	if r.inbox == nil {
+		return entities
+	}
+
+	missed, err := r.inbox.Take(r.name, userID)
+	if err != nil {
+		r.log.Error("failed to take missed messages", zap.String("user", userID), zap.Error(err))
+		return entities
+	}
+	if len(missed) == 0 {
+		return entities
+	}
+
+	entities = append(missed, entities...)
+	slices.SortStableFunc(entities, func(a, b models.ChannelEntity) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return entities
+}
+
+// dropMissed forgets stored entities of the user who is not coming back
+func (r *Room) dropMissed(userID string) {
+	if r.inbox == nil {
+		return
+	}
+
+	err := r.inbox.Drop(r.name, userID)
+	if err != nil {
+		r.log.Error("failed to drop missed messages", zap.String("user", userID), zap.Error(err))
+	}
+}
+
+// MissedCount is the number of messages waiting in the user's inbox
+func (r *Room) MissedCount(userID string) int {
+	if r.inbox == nil {
+		return 0
+	}
+
+	count, err := r.inbox.Len(r.name, userID)
+	if err != nil {
+		r.log.Error("failed to count missed messages", zap.String("user", userID), zap.Error(err))
+	}
+
+	return count
+}
+
+// TakeMissed returns messages that did not fit into the user's queue, they are removed from the inbox
+func (r *Room) TakeMissed(userID string) ([]models.ChannelEntity, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if _, ok := r.userInfos[userID]; !ok {
+		return nil, ErrUserNotInRoom
+	}
+
+	return r.takeMissed(userID, nil), nil
+}
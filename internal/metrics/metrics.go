@@ -2,24 +2,73 @@ package metrics
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 const (
 	namespace = "webrtc"
 
-	roomNameLabel = "room_name"
-	endpointLabel = "endpoint"
+	roomNameLabel  = "room_name"
+	endpointLabel  = "endpoint"
+	methodLabel    = "method"
+	statusLabel    = "status"
+	outcomeLabel   = "outcome"
+	variantLabel   = "variant"
+	stageLabel     = "stage"
+	checkLabel     = "check"
+	typeLabel      = "message_type"
+	policyLabel    = "policy"
+	kindLabel      = "kind"
+	transportLabel = "transport"
+	subsystemLabel = "subsystem"
+	trafficLabel   = "traffic"
+	actionLabel    = "action_type"
+	scopeLabel     = "scope"
 )
 
+// Options holds tunable parameters of the collectors
+type Options struct {
+	RequestDurationBuckets []float64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		RequestDurationBuckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}
+}
+
 type Metrics struct {
 	Reg                          *prometheus.Registry
 	WebRTCConnectionCreationTime *prometheus.HistogramVec
-	StreamResolution             *prometheus.GaugeVec
-	RPS                          *prometheus.CounterVec
+	StreamResolution             *prometheus.HistogramVec
+	RequestsTotal                *prometheus.CounterVec
 	RequestDuration              *prometheus.HistogramVec
+	InternalRequestsTotal        *prometheus.CounterVec
+	InternalRequestDuration      *prometheus.HistogramVec
+	LegacySubscriptionIDs        *prometheus.CounterVec
+	WebRTCConnectionFailures     *prometheus.CounterVec
+	RateLimiterRequests          *prometheus.CounterVec
+	SDPLintWarnings              *prometheus.CounterVec
+	PacketLoss                   *prometheus.HistogramVec
+	PeerMessages                 *prometheus.CounterVec
+	DroppedEntities              *prometheus.CounterVec
+	ReplayedTokens               *prometheus.CounterVec
+	PointerEvents                *prometheus.CounterVec
+	SignalingMessages            *prometheus.CounterVec
+	EntryFormSubmissions         *prometheus.CounterVec
+	ActiveStreams                *prometheus.GaugeVec
+	Goroutines                   *prometheus.GaugeVec
+	EventsPublished              *prometheus.CounterVec
+	RoomMembers                  *prometheus.GaugeVec
+	QueueOccupancy               *prometheus.HistogramVec
+	SendToPeerDuration           *prometheus.HistogramVec
+	JanitorEvictedUsers          prometheus.Counter
+	JanitorRemovedRooms          prometheus.Counter
+	AuthThrottled                *prometheus.CounterVec
+	AuthLockouts                 *prometheus.CounterVec
 }
 
-func New() *Metrics {
+func New(opts Options) *Metrics {
 	reg := prometheus.NewRegistry()
 
 	m := &Metrics{
@@ -28,26 +77,229 @@ func New() *Metrics {
 			Namespace: namespace,
 			Name:      "webrtc_connection_creation_time",
 			Buckets:   []float64{0.1, 0.5, 1.0, 2.0, 5.0, 10.0},
-		}, []string{roomNameLabel}),
-		StreamResolution: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		}, []string{roomNameLabel, variantLabel}),
+		StreamResolution: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: namespace,
 			Name:      "stream_resolution",
+			Help:      "Stream heights reported by room members",
+			Buckets:   []float64{144, 240, 360, 480, 720, 1080, 1440, 2160},
 		}, []string{roomNameLabel}),
-		RPS: prometheus.NewCounterVec(prometheus.CounterOpts{
+		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
-			Name:      "requests_per_second",
-		}, []string{endpointLabel}),
+			Name:      "http_requests_total",
+			Help:      "Total number of processed HTTP requests",
+		}, []string{endpointLabel, methodLabel, statusLabel}),
 		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: namespace,
 			Name:      "request_duration",
-			Buckets:   []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.8, 1, 2},
-		}, []string{endpointLabel}),
+			Buckets:   opts.RequestDurationBuckets,
+		}, []string{endpointLabel, methodLabel, statusLabel}),
+		InternalRequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "internal_http_requests_total",
+			Help:      "Processed admin, probe and canary HTTP requests by traffic class",
+		}, []string{trafficLabel, endpointLabel, methodLabel, statusLabel}),
+		InternalRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "internal_request_duration",
+			Help:      "Duration of admin, probe and canary HTTP requests by traffic class",
+			Buckets:   opts.RequestDurationBuckets,
+		}, []string{trafficLabel, endpointLabel, methodLabel, statusLabel}),
+		LegacySubscriptionIDs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "legacy_subscription_ids_total",
+			Help:      "Usage of unsigned room__user subscriptionIDs by outcome",
+		}, []string{outcomeLabel}),
+		WebRTCConnectionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connection_failures_total",
+			Help:      "Peer connections reported as failed by clients, by failure stage",
+		}, []string{roomNameLabel, stageLabel}),
+		RateLimiterRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limiter_requests_total",
+			Help:      "Peer messages checked against the per-user send rate limit by outcome: allowed or rejected",
+		}, []string{roomNameLabel, outcomeLabel}),
+		SDPLintWarnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sdp_lint_warnings_total",
+			Help:      "Advisory warnings about relayed offers and answers by failed check",
+		}, []string{roomNameLabel, checkLabel}),
+		PacketLoss: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "packet_loss_ratio",
+			Help:      "Inbound packet loss reported by room members",
+			Buckets:   []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5},
+		}, []string{roomNameLabel}),
+		PeerMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "peer_messages_total",
+			Help:      "Peer messages sent by message type, unknown types are counted as other",
+		}, []string{roomNameLabel, typeLabel}),
+		DroppedEntities: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dropped_entities_total",
+			Help:      "Entities not published to full user queues by the overflow policy applied",
+		}, []string{roomNameLabel, policyLabel}),
+		ReplayedTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "token_replays_rejected_total",
+			Help:      "Single-use tokens rejected because they were already used, by token kind",
+		}, []string{kindLabel}),
+		PointerEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pointer_events_total",
+			Help:      "Pointer positions by outcome: published to a member, coalesced with a newer move or dropped on full queue",
+		}, []string{roomNameLabel, outcomeLabel}),
+		SignalingMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signaling_messages_total",
+			Help:      "Typed signals by type and outcome: relayed or rejected, e.g. by the negotiation state of the pair",
+		}, []string{roomNameLabel, typeLabel, outcomeLabel}),
+		EntryFormSubmissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "entry_form_submissions_total",
+			Help:      "Joins to rooms with entry form by outcome: accepted or rejected for invalid answers",
+		}, []string{roomNameLabel, outcomeLabel}),
+		ActiveStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_streams",
+			Help:      "Open event streams by transport",
+		}, []string{transportLabel}),
+		Goroutines: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "subsystem_goroutines",
+			Help:      "Long-lived goroutines by subsystem: background workers and event streams",
+		}, []string{subsystemLabel}),
+		EventsPublished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "events_published_total",
+			Help:      "Room events fanned out to members by action type, drops are counted in dropped_entities_total",
+		}, []string{roomNameLabel, actionLabel}),
+		RoomMembers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "room_members",
+			Help:      "Members of each room, silent service accounts are not counted",
+		}, []string{roomNameLabel}),
+		QueueOccupancy: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "queue_occupancy_ratio",
+			Help:      "Fill ratio of member queues right after an entity is put into them",
+			Buckets:   []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1},
+		}, []string{roomNameLabel}),
+		SendToPeerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "send_to_peer_duration",
+			Help:      "Duration of peer message delivery to the destination queue by outcome: sent or rejected",
+			Buckets:   opts.RequestDurationBuckets,
+		}, []string{outcomeLabel}),
+		JanitorEvictedUsers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "janitor_evicted_users_total",
+			Help:      "Disconnected users removed from rooms by the janitor",
+		}),
+		JanitorRemovedRooms: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "janitor_removed_rooms_total",
+			Help:      "Empty rooms removed by the janitor",
+		}),
+		AuthThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_throttled_total",
+			Help:      "Login and register attempts rejected with 429 by the scope that throttled them: ip or user",
+		}, []string{scopeLabel}),
+		AuthLockouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_lockouts_total",
+			Help:      "Lockouts after repeated failed login and register attempts by scope: ip or user",
+		}, []string{scopeLabel}),
 	}
 
+	// runtime and process metrics, the default registry has them but the custom one does not
+	reg.MustRegister(collectors.NewGoCollector())
+	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
 	reg.MustRegister(m.WebRTCConnectionCreationTime)
 	reg.MustRegister(m.StreamResolution)
-	reg.MustRegister(m.RPS)
+	reg.MustRegister(m.RequestsTotal)
 	reg.MustRegister(m.RequestDuration)
+	reg.MustRegister(m.InternalRequestsTotal)
+	reg.MustRegister(m.InternalRequestDuration)
+	reg.MustRegister(m.LegacySubscriptionIDs)
+	reg.MustRegister(m.WebRTCConnectionFailures)
+	reg.MustRegister(m.RateLimiterRequests)
+	reg.MustRegister(m.SDPLintWarnings)
+	reg.MustRegister(m.PacketLoss)
+	reg.MustRegister(m.PeerMessages)
+	reg.MustRegister(m.DroppedEntities)
+	reg.MustRegister(m.ReplayedTokens)
+	reg.MustRegister(m.PointerEvents)
+	reg.MustRegister(m.SignalingMessages)
+	reg.MustRegister(m.EntryFormSubmissions)
+	reg.MustRegister(m.ActiveStreams)
+	reg.MustRegister(m.Goroutines)
+	reg.MustRegister(m.EventsPublished)
+	reg.MustRegister(m.RoomMembers)
+	reg.MustRegister(m.QueueOccupancy)
+	reg.MustRegister(m.SendToPeerDuration)
+	reg.MustRegister(m.JanitorEvictedUsers)
+	reg.MustRegister(m.JanitorRemovedRooms)
+	reg.MustRegister(m.AuthThrottled)
+	reg.MustRegister(m.AuthLockouts)
 
 	return m
 }
+
+// TrackGoroutine counts the calling goroutine in the subsystem until the returned function is called
+func (m *Metrics) TrackGoroutine(subsystem string) (done func()) {
+	gauge := m.Goroutines.WithLabelValues(subsystem)
+	gauge.Inc()
+
+	return gauge.Dec
+}
+
+// DeleteRoom drops all series labeled with the room, so metrics of dead rooms do not pile up in the registry
+func (m *Metrics) DeleteRoom(roomName string) {
+	labels := prometheus.Labels{roomNameLabel: roomName}
+
+	m.WebRTCConnectionCreationTime.DeletePartialMatch(labels)
+	m.StreamResolution.DeletePartialMatch(labels)
+	m.WebRTCConnectionFailures.DeletePartialMatch(labels)
+	m.RateLimiterRequests.DeletePartialMatch(labels)
+	m.SDPLintWarnings.DeletePartialMatch(labels)
+	m.PacketLoss.DeletePartialMatch(labels)
+	m.PeerMessages.DeletePartialMatch(labels)
+	m.DroppedEntities.DeletePartialMatch(labels)
+	m.PointerEvents.DeletePartialMatch(labels)
+	m.SignalingMessages.DeletePartialMatch(labels)
+	m.EntryFormSubmissions.DeletePartialMatch(labels)
+	m.EventsPublished.DeletePartialMatch(labels)
+	m.RoomMembers.DeletePartialMatch(labels)
+	m.QueueOccupancy.DeletePartialMatch(labels)
+}
+
+// SweepRooms drops series of rooms for which alive returns false and returns the number of swept rooms.
+// It catches series that outlived their rooms, e.g. resolution reported for a room that never existed
+func (m *Metrics) SweepRooms(alive func(roomName string) bool) (int, error) {
+	families, err := m.Reg.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	dead := make(map[string]struct{})
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == roomNameLabel && !alive(label.GetValue()) {
+					dead[label.GetValue()] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for roomName := range dead {
+		m.DeleteRoom(roomName)
+	}
+
+	return len(dead), nil
+}
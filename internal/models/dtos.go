@@ -1,27 +1,133 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
+type RegisterRequest struct {
+	UserID string `json:"userID" validate:"required"`
+	// Password is limited to 72 bytes by bcrypt
+	Password string `json:"password" validate:"min=8,max=72"`
+	Locale   Locale `json:"locale"`
+}
+
 type LoginRequest struct {
 	UserID   string `json:"userID" validate:"required"`
-	PassHash string `json:"passHash"`
+	Password string `json:"password" validate:"required"`
+	// Device names the session in the list of the user's sessions, user agent is used when empty
+	Device string `json:"device" validate:"max=128"`
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token     string    `json:"token"`
+	SessionID string    `json:"sessionID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AuthProvidersResponse names providers accepted by /auth/{provider}/login, "local" is the password login
+type AuthProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+// LoginCallbackQuery is the redirect of the identity provider back to the messenger, Error is set
+// when the user denied the login
+type LoginCallbackQuery struct {
+	State string `form:"state" validate:"required"`
+	Code  string `form:"code" validate:"required_without=Error"`
+	Error string `form:"error"`
+}
+
+// Session is a login of the user on one device. Each session joins rooms and streams events on its own
+type Session struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Current marks the session of the request
+	Current bool `json:"current"`
 }
 
 type ChannelRequest struct {
-	ChannelName string `json:"channelName" validate:"required"`
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+}
+
+// RemoveRoomRequest deletes the room. Password of the protected room is required from callers who are not
+// its members, members presented it on join
+type RemoveRoomRequest struct {
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+	Password    string `json:"password" validate:"max=72"`
+}
+
+type JoinChannelRequest struct {
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+	// Captions opts the user in to caption events of the room
+	Captions bool `json:"captions"`
+	// Region pins the room to a region, clients are redirected if it is served by another instance
+	Region string `json:"region"`
+	// ConnectionPlan asks the server to tell the joiner which peers to offer to and when
+	ConnectionPlan bool `json:"connectionPlan"`
+	// Password protects the room when this join creates it, joining a protected room requires it
+	Password string `json:"password" validate:"max=72"`
+	// Answers to the entry form of the room by field name, see GET /channel/:name/entry-form
+	Answers map[string]any `json:"answers" validate:"max=32"`
+	// Topology is how the joiner connects to others, mesh when empty. Connection plans skip SFU members
+	Topology Topology `json:"topology" validate:"omitempty,oneof=mesh sfu"`
+	// TTLSeconds or ExpiresAt close the room when this join creates it, even if members are still there.
+	// They are warned with room closing entity ahead of it. Rooms without them stay until abandoned
+	TTLSeconds int64      `json:"ttlSeconds" validate:"min=0,max=604800"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" validate:"excluded_with=TTLSeconds"`
+}
+
+// ConnectionPlan lists peers the joiner should send offers to, in order, with pacing to avoid connect storms
+type ConnectionPlan struct {
+	Peers []PlannedPeer `json:"peers"`
+}
+
+type PlannedPeer struct {
+	UserID string `json:"userID"`
+	// OfferDelayMs is the delay after join before the offer to this peer should be sent
+	OfferDelayMs int64 `json:"offerDelayMs"`
 }
 
 type ChannelEntity struct {
-	Time       time.Time      `json:"time"`
-	ActionType ActionType     `json:"actionType"`
-	UserID     string         `json:"userID"`
-	Data       map[string]any `json:"data"`
+	// ID is unique within the room. Entity published to several users keeps the same ID
+	ID         uint64     `json:"id"`
+	Time       time.Time  `json:"time"`
+	ActionType ActionType `json:"actionType"`
+	UserID     string     `json:"userID"`
+	// Data is serialized once when the entity is created, so the same bytes are shared by every recipient
+	Data json.RawMessage `json:"data"`
+	// MessageType is "messageType" field of Data kept for server-side bookkeeping
+	MessageType string `json:"-"`
+	// DestinationUserID is set only for messages echoed back to their sender
+	DestinationUserID string   `json:"destinationUserID,omitempty"`
+	Priority          Priority `json:"priority,omitempty"`
+	// MessageID is the sender-chosen ID of a message, delivered and read receipts refer to it
+	MessageID string `json:"messageID,omitempty"`
+}
+
+// Priority is a delivery hint: higher priority entities are written first within a batch,
+// low priority ones are dropped first when recipient queue overflows
+type Priority string
+
+const (
+	PriorityLow    Priority = "low"
+	PriorityNormal Priority = "normal"
+	PriorityHigh   Priority = "high"
+)
+
+// Rank orders priorities, empty priority is treated as normal
+func (p Priority) Rank() int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityHigh:
+		return 2
+	default:
+		return 1
+	}
 }
 
 type ActionType string
@@ -30,17 +136,526 @@ const (
 	UserJoined ActionType = "user joined"
 	UserLeft   ActionType = "user left"
 	Message    ActionType = "message"
+	// Control is a message from a service account broadcast to the whole room
+	Control ActionType = "control"
+	// Caption is a live transcription segment pushed by a service account
+	Caption ActionType = "caption"
+	// Probe is sent to inactive users. Any client activity in response prevents eviction
+	Probe ActionType = "probe"
+	// Reconnect asks clients to re-establish their subscription, e.g. because the instance is shutting down
+	Reconnect ActionType = "reconnect"
+	// RoomDeleted is the last entity of the stream when the room is deleted
+	RoomDeleted ActionType = "room deleted"
+	// RoomCreated tells the creator that its join has created the room
+	RoomCreated ActionType = "room created"
+	// RoomClosing warns members that the room is deleted at closesAt in data
+	RoomClosing ActionType = "room closing"
+	// UserKicked tells members that the user was removed by admin. For the kicked user it is the last entity
+	// of the stream
+	UserKicked ActionType = "user kicked"
+	// ModeratorGranted tells members that the user named by userID in data became a moderator of the room
+	ModeratorGranted ActionType = "moderator granted"
+	// ServerNotice is a text of the operator with its level in data, e.g. about upcoming maintenance
+	ServerNotice ActionType = "server notice"
+	// Delivered tells the sender that the message with MessageID was queued to its recipient
+	Delivered ActionType = "delivered"
+	// Read tells the sender that the recipient acknowledged the message with MessageID
+	Read ActionType = "read"
+	// Undelivered tells the sender that the message with MessageID accepted for delivery was dropped, data has the reason
+	Undelivered ActionType = "undelivered"
+	// SDPWarning is an advisory about misconfigured offer or answer of the member sent only to that member
+	SDPWarning ActionType = "sdp warning"
+	// DegradeToAudio recommends members to drop video while the room has sustained packet loss, or to restore it
+	// when audioOnly in data is false
+	DegradeToAudio ActionType = "degrade to audio"
+	// PresenceChanged tells members that status of the user in data has changed
+	PresenceChanged ActionType = "presence changed"
+	// ExpectOffer tells member that the joiner named in data is going to send an offer, so member must not offer itself
+	ExpectOffer ActionType = "expect offer"
+	// Migrate tells members that the instance is overloaded, they may reconnect to one of alternateURLs in data
+	Migrate ActionType = "migrate"
+	// Pointer carries the latest shared pointer position of the user, moves between flushes are coalesced
+	Pointer ActionType = "pointer"
+	// TopologyChanged tells members that the user switched topology in data, mesh peers drop or open connections
+	// to it as its hints say
+	TopologyChanged ActionType = "topology changed"
+	// Offer, Answer, ICECandidate and Renegotiate are typed signals relayed by /peer/signal. The server checks
+	// them against the negotiation state of the pair, see SignalRequest
+	Offer        ActionType = "offer"
+	Answer       ActionType = "answer"
+	ICECandidate ActionType = "ice-candidate"
+	// Renegotiate asks the peer to send a new offer, with ICE restart when iceRestart in data is true
+	Renegotiate ActionType = "renegotiate"
 )
 
+// IsSignal tells whether the action is a typed signal driving the negotiation state of the pair
+func (a ActionType) IsSignal() bool {
+	switch a {
+	case Offer, Answer, ICECandidate, Renegotiate:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendToPeerRequest is additionally validated against its message type, see validation package
 type SendToPeerRequest struct {
-	ChannelName       string         `json:"channelName"`
-	DestinationUserID string         `json:"destinationUserID"`
-	Message           map[string]any `json:"message"`
+	ChannelName       string         `json:"channelName" validate:"required,roomname"`
+	DestinationUserID string         `json:"destinationUserID" validate:"required,max=128"`
+	Message           map[string]any `json:"message" validate:"required,mapdepth=8,mapsize=256"`
+	EchoToSender      bool           `json:"echoToSender"`
+	Priority          Priority       `json:"priority" validate:"omitempty,oneof=low normal high"`
+	// MessageID requests delivered receipt for the message, recipient may also acknowledge it as read
+	MessageID string `json:"messageID" validate:"max=128"`
+}
+
+// SendBatchRequest sends several messages in one request, e.g. a burst of ICE candidates. Messages are delivered
+// in order, the batch is rejected as a whole when any of them violates room policy or exceeds the rate limit
+type SendBatchRequest struct {
+	ChannelName string         `json:"channelName" validate:"required,roomname"`
+	Messages    []BatchMessage `json:"messages" validate:"required,min=1,max=100,dive"`
+}
+
+// BatchMessage is SendToPeerRequest without the room, validated against its message type the same way
+type BatchMessage struct {
+	DestinationUserID string         `json:"destinationUserID" validate:"required,max=128"`
+	Message           map[string]any `json:"message" validate:"required,mapdepth=8,mapsize=256"`
+	EchoToSender      bool           `json:"echoToSender"`
+	Priority          Priority       `json:"priority" validate:"omitempty,oneof=low normal high"`
+	MessageID         string         `json:"messageID" validate:"max=128"`
+}
+
+// SendBatchResponse tells how many messages of the batch were delivered and why the others were not
+type SendBatchResponse struct {
+	Sent   int            `json:"sent"`
+	Failed []BatchFailure `json:"failed"`
+}
+
+// BatchFailure is a message of the batch that was not delivered
+type BatchFailure struct {
+	// Index of the message in the batch
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// SignalRequest is the typed alternative to signaling through SendToPeerRequest. Offer from a member whose peer
+// has a pending offer (glare), answer without a pending offer and candidates before the first offer are rejected
+type SignalRequest struct {
+	ChannelName       string     `json:"channelName" validate:"required,roomname"`
+	DestinationUserID string     `json:"destinationUserID" validate:"required,max=128"`
+	Type              ActionType `json:"type" validate:"required,oneof=offer answer ice-candidate renegotiate"`
+	// SDP is the session description of offer and answer
+	SDP       string           `json:"sdp" validate:"required_if=Type offer,required_if=Type answer,max=65536"`
+	Candidate *SignalCandidate `json:"candidate" validate:"required_if=Type ice-candidate"`
+	// ICERestart marks offer restarting ICE, in renegotiate it asks the peer for such an offer
+	ICERestart bool   `json:"iceRestart"`
+	Reason     string `json:"reason" validate:"max=256"`
+	// MessageID requests delivered receipt for the signal
+	MessageID string `json:"messageID" validate:"max=128"`
+}
+
+// SignalCandidate mirrors RTCIceCandidateInit of the browser API
+type SignalCandidate struct {
+	Candidate     string  `json:"candidate" validate:"required,max=2048"`
+	SDPMid        *string `json:"sdpMid" validate:"omitempty,max=64"`
+	SDPMLineIndex *int    `json:"sdpMLineIndex" validate:"omitempty,min=0"`
+}
+
+// AckRequest marks the message received from the sender as read
+type AckRequest struct {
+	ChannelName  string `json:"channelName" validate:"required,roomname"`
+	SenderUserID string `json:"senderUserID" validate:"required"`
+	MessageID    string `json:"messageID" validate:"required,max=128"`
 }
 
+// Built-in peer message types carried in "messageType" field of the message, see package msgtype
+const (
+	MessageTypeOffer     = "offer"
+	MessageTypeAnswer    = "answer"
+	MessageTypeCandidate = "candidate"
+	MessageTypeBye       = "bye"
+	MessageTypeChat      = "chat"
+	// MessageTypeRenegotiate is the message type of typed renegotiate signals
+	MessageTypeRenegotiate = "renegotiate"
+)
+
+// EncryptedField is the message data field clients set to true on end-to-end encrypted payloads
+const EncryptedField = "encrypted"
+
 type ResolutionRequest struct {
-	RoomName  string  `json:"roomName" validate:"required"`
+	RoomName  string  `json:"roomName" validate:"required,roomname"`
 	FrameRate float64 `json:"frameRate" validate:"required"`
 	Height    int     `json:"height" validate:"required"`
 	Width     int     `json:"width" validate:"required"`
 }
+
+// PointerRequest moves the shared pointer of the user, e.g. cursor in co-browsing or pen on a whiteboard.
+// Coordinates are relative to the shared surface
+type PointerRequest struct {
+	ChannelName string  `json:"channelName" validate:"required,roomname"`
+	X           float64 `json:"x" validate:"min=0,max=1"`
+	Y           float64 `json:"y" validate:"min=0,max=1"`
+	// Surface tells apart pages or documents when the app shares several
+	Surface string `json:"surface,omitempty" validate:"max=64"`
+	// Pressed is set while the pointer draws or drags
+	Pressed bool `json:"pressed,omitempty"`
+}
+
+// NetworkStatsRequest is sent periodically by client with packet loss (0..1) of its inbound streams
+type NetworkStatsRequest struct {
+	ChannelName string  `json:"channelName" validate:"required,roomname"`
+	PacketLoss  float64 `json:"packetLoss" validate:"min=0,max=1"`
+}
+
+// ConnectionStateRequest is sent by client when its peer connection to another room member changes state
+type ConnectionStateRequest struct {
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+	PeerUserID  string `json:"peerUserID" validate:"required"`
+	// State mirrors RTCPeerConnection.connectionState
+	State ConnectionState `json:"state" validate:"required,oneof=new connecting connected disconnected failed closed"`
+	// FailureStage is where failed connection got stuck, required when State is failed
+	FailureStage FailureStage `json:"failureStage" validate:"required_if=State failed,omitempty,oneof=ice_gathering ice_checking dtls"`
+}
+
+type PresenceStatus string
+
+const (
+	PresenceOnline PresenceStatus = "online"
+	PresenceAway   PresenceStatus = "away"
+)
+
+// PresenceRequest is the heartbeat of a room member, empty status means online
+type PresenceRequest struct {
+	ChannelName string         `json:"channelName" validate:"required,roomname"`
+	Status      PresenceStatus `json:"status" validate:"omitempty,oneof=online away"`
+}
+
+// Topology is how the member exchanges media: mesh members connect to each other, SFU members only to the SFU
+type Topology string
+
+const (
+	TopologyMesh Topology = "mesh"
+	TopologySFU  Topology = "sfu"
+)
+
+type TopologyRequest struct {
+	Topology Topology `json:"topology" validate:"required,oneof=mesh sfu"`
+}
+
+// TopologyHints tells the member which peer connections to open. Of each pair of mesh members the later joiner
+// offers, so both never offer at once. SFU members get no peers
+type TopologyHints struct {
+	Topology Topology `json:"topology"`
+	// OfferTo are mesh peers the member sends offers to, in join order
+	OfferTo []string `json:"offerTo"`
+	// AnswerFrom are mesh peers the member waits for offers from, in join order
+	AnswerFrom []string `json:"answerFrom"`
+}
+
+// LivenessResponse tells when the next liveness heartbeat is due
+type LivenessResponse struct {
+	// WindowMs is how long the member may go without heartbeats before it is removed, send a few per window
+	WindowMs int64 `json:"windowMs"`
+}
+
+type MemberPresence struct {
+	UserID         string         `json:"userID"`
+	Status         PresenceStatus `json:"status"`
+	LastActionTime time.Time      `json:"lastActionTime"`
+	Moderator      bool           `json:"moderator,omitempty"`
+}
+
+type ConnectionState string
+
+const (
+	ConnectionFailed ConnectionState = "failed"
+)
+
+type FailureStage string
+
+const (
+	FailureStageICEGathering FailureStage = "ice_gathering"
+	FailureStageICEChecking  FailureStage = "ice_checking"
+	FailureStageDTLS         FailureStage = "dtls"
+)
+
+type JoinChannelResponse struct {
+	SubscriptionID string `json:"subscriptionID"`
+	// ResumeToken is a single-use alternative to SubscriptionID for subscribing, every stream sends a fresh one
+	ResumeToken string `json:"resumeToken"`
+	// MemberCount is the room size after join. Member list itself is available via paginated members endpoint
+	MemberCount int `json:"memberCount"`
+	// Experiments maps experiment name to the variant assigned to the user
+	Experiments map[string]string `json:"experiments,omitempty"`
+	// ConnectionPlan is present when requested on join
+	ConnectionPlan *ConnectionPlan `json:"connectionPlan,omitempty"`
+	// MissedMessages is the number of messages kept since the user was evicted, they come with the first collect
+	// or subscription
+	MissedMessages int `json:"missedMessages,omitempty"`
+	// E2EERequired tells the client to encrypt message payloads and mark them with "encrypted": true
+	E2EERequired bool `json:"e2eeRequired,omitempty"`
+	// RoomExpiresAt is when the room is closed even if members are still there, absent for rooms without expiry
+	RoomExpiresAt *time.Time `json:"roomExpiresAt,omitempty"`
+}
+
+type MatchRequest struct {
+	// Tags narrow down the match to users sharing at least one tag, no tags match anyone
+	Tags   []string `json:"tags" validate:"max=10,dive,required,max=64"`
+	Region string   `json:"region"`
+}
+
+type MatchResponse struct {
+	ChannelName string `json:"channelName"`
+	JoinChannelResponse
+}
+
+type ServerTimeRequest struct {
+	// ClientTime is the client clock in unix milliseconds when the request was sent, it is echoed back
+	ClientTime int64 `form:"clientTime" validate:"min=0"`
+}
+
+// ServerTimeResponse times are unix milliseconds. With t3 being the client clock on receiving the response,
+// clock offset is ((ReceivedAt - ClientTime) + (SentAt - t3)) / 2
+// and round trip is (t3 - ClientTime) - (SentAt - ReceivedAt)
+type ServerTimeResponse struct {
+	ClientTime int64 `json:"clientTime,omitempty"`
+	ReceivedAt int64 `json:"receivedAt"`
+	SentAt     int64 `json:"sentAt"`
+	// ServerTime is SentAt in RFC 3339
+	ServerTime time.Time `json:"serverTime"`
+	// MonotonicMs is time since server start, unaffected by wall clock adjustments
+	MonotonicMs int64 `json:"monotonicMs"`
+}
+
+type SubscribeRequest struct {
+	SubscriptionID string `form:"subscriptionID" validate:"required_without=ResumeToken"`
+	// ResumeToken is used instead of SubscriptionID by clients that do not want reusable IDs in URLs
+	ResumeToken string `form:"resumeToken" validate:"required_without=SubscriptionID"`
+	// BatchMs is the window in milliseconds to collect entities into one "batch" event, 0 sends every entity separately
+	BatchMs int `form:"batchMs" validate:"min=0,max=1000"`
+}
+
+type MembersRequest struct {
+	ChannelName string `form:"channelName" validate:"required,roomname"`
+	Cursor      string `form:"cursor"`
+	Limit       int    `form:"limit" validate:"omitempty,min=1,max=1000"`
+}
+
+type RoomsRequest struct {
+	Cursor   string `form:"cursor"`
+	Limit    int    `form:"limit" validate:"omitempty,min=1,max=1000"`
+	Prefix   string `form:"prefix"`
+	MinUsers int    `form:"minUsers" validate:"min=0"`
+}
+
+type MembersResponse struct {
+	Members    []string `json:"members"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+type BanRequest struct {
+	UserID string `json:"userID" validate:"required"`
+}
+
+// ClientInfo describes the client connection a user acts from
+type ClientInfo struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	// Session is the ID of the login, empty for tokens issued before sessions
+	Session string `json:"session,omitempty"`
+}
+
+type ServiceAccountRequest struct {
+	Name string `json:"name" validate:"required,alphanum"`
+}
+
+type ServiceAccountResponse struct {
+	UserID string `json:"userID"`
+	Token  string `json:"token"`
+}
+
+type BroadcastRequest struct {
+	ChannelName string         `json:"channelName" validate:"required,roomname"`
+	Message     map[string]any `json:"message" validate:"mapdepth=8,mapsize=256"`
+}
+
+type CaptionRequest struct {
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+	SpeakerID   string `json:"speakerID" validate:"required"`
+	Sequence    uint64 `json:"sequence"`
+	Text        string `json:"text" validate:"required"`
+	// Final is false for interim segments that may be replaced by the next one with the same sequence
+	Final    bool   `json:"final"`
+	Language string `json:"language"`
+}
+
+type CaptionsSettingsRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Locale tells how texts and times are presented to a room or a user, empty fields fall back to English and UTC
+type Locale struct {
+	// Language is a BCP 47 tag, e.g. "pt-BR"
+	Language string `json:"language,omitempty" validate:"omitempty,bcp47_language_tag"`
+	// Timezone is an IANA time zone name, e.g. "Europe/Berlin"
+	Timezone string `json:"timezone,omitempty" validate:"omitempty,timezone"`
+}
+
+// Experiment is a percentage rollout of variants. Users not falling into any variant are not enrolled
+type Experiment struct {
+	Name     string              `json:"name" validate:"required"`
+	Variants []ExperimentVariant `json:"variants" validate:"required,min=1,dive"`
+	// Rooms limits experiment to listed rooms, empty list means all rooms
+	Rooms []string `json:"rooms"`
+}
+
+type ExperimentVariant struct {
+	Name    string `json:"name" validate:"required"`
+	Percent int    `json:"percent" validate:"min=0,max=100"`
+}
+
+// Meeting is a room scheduled ahead. The room is created with the policy and locale shortly before StartsAt,
+// only the roster and service accounts may join it
+type Meeting struct {
+	Name     string     `json:"name" validate:"required,roomname"`
+	StartsAt time.Time  `json:"startsAt" validate:"required"`
+	Roster   []string   `json:"roster" validate:"required,min=1,max=1000,dive,required,max=128"`
+	Policy   RoomPolicy `json:"policy"`
+	Locale   Locale     `json:"locale"`
+	// EntryForm is asked from members joining the room, nil admits them without questions
+	EntryForm *EntryForm `json:"entryForm,omitempty"`
+	// EndsAt closes the room of the meeting, nil leaves it until abandoned
+	EndsAt *time.Time `json:"endsAt,omitempty" validate:"omitempty,gtfield=StartsAt"`
+	// ReadyAt is set by the server once the room is created
+	ReadyAt *time.Time `json:"readyAt,omitempty"`
+}
+
+// Kinds of entry form fields
+const (
+	// EntryFieldText is answered with a string
+	EntryFieldText = "text"
+	// EntryFieldConsent is a checkbox answered with a bool, required consent must be true
+	EntryFieldConsent = "consent"
+	// EntryFieldChoice is answered with one of the options
+	EntryFieldChoice = "choice"
+)
+
+// EntryForm lists the questions members answer when joining the room. Service accounts join without answers
+type EntryForm struct {
+	Fields []EntryField `json:"fields" validate:"max=32,unique=Name,dive"`
+}
+
+type EntryField struct {
+	// Name is the key of the answer
+	Name string `json:"name" validate:"required,max=64"`
+	// Label is the question shown to the user
+	Label    string `json:"label" validate:"max=256"`
+	Kind     string `json:"kind" validate:"oneof=text consent choice"`
+	Required bool   `json:"required"`
+	// MaxLength bounds text answers, 0 means the default of 500 characters
+	MaxLength int      `json:"maxLength,omitempty" validate:"min=0,max=4096"`
+	Options   []string `json:"options,omitempty" validate:"required_if=Kind choice,max=64,dive,required,max=128"`
+}
+
+// RoomPolicy restricts messages users may send to each other in the room. Zero value allows everything
+type RoomPolicy struct {
+	// AllowedMessageTypes lists accepted values of message "messageType" field, empty list allows any type
+	AllowedMessageTypes []string `json:"allowedMessageTypes" validate:"dive,messagetype"`
+	// MaxDataSize limits JSON encoded message size in bytes, 0 means no limit
+	MaxDataSize int `json:"maxDataSize" validate:"min=0"`
+	// ChatHistory keeps messages with "text" field searchable by their participants and support staff
+	ChatHistory bool `json:"chatHistory"`
+	// E2EERequired rejects messages not marked with "encrypted": true, except plaintext types such as signaling
+	E2EERequired bool `json:"e2eeRequired"`
+}
+
+// HistoryRequest pages room entities from oldest to newest. Since is RFC 3339, Cursor is NextCursor of the previous page
+type HistoryRequest struct {
+	ChannelName string    `form:"channelName" validate:"required,roomname"`
+	Since       time.Time `form:"since"`
+	Cursor      string    `form:"cursor"`
+	Limit       int       `form:"limit" validate:"omitempty,min=1,max=500"`
+}
+
+type HistoryResponse struct {
+	Entities   []ChannelEntity `json:"entities"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// HistorySearchRequest filters chat history, time bounds are RFC 3339
+type HistorySearchRequest struct {
+	ChannelName string    `form:"channelName" validate:"required,roomname"`
+	Query       string    `form:"q" validate:"max=256"`
+	AuthorID    string    `form:"author" validate:"max=128"`
+	From        time.Time `form:"from"`
+	To          time.Time `form:"to"`
+	Limit       int       `form:"limit" validate:"min=0,max=100"`
+}
+
+// RoomConfigRequest pre-creates the room, empty Password leaves it unprotected
+type RoomConfigRequest struct {
+	// Capacity limits the number of members, 0 means no limit
+	Capacity int    `json:"capacity" validate:"min=0,max=100000"`
+	Password string `json:"password" validate:"max=128"`
+	// Owner becomes a moderator of the room on join
+	Owner string `json:"owner" validate:"max=128"`
+}
+
+// DeleteRoomRequest deletes the room at once, or warns members and deletes it after Grace
+type DeleteRoomRequest struct {
+	Grace  time.Duration `form:"grace" validate:"min=0,max=1h"`
+	Reason string        `form:"reason" validate:"max=256"`
+}
+
+// KickRequest tells the kicked user and other members why the user was removed
+type KickRequest struct {
+	Reason string `form:"reason" validate:"max=256"`
+}
+
+// NoticeRequest is published as server notice to the room, or to every room when ChannelName is empty
+type NoticeRequest struct {
+	ChannelName string `json:"channelName" validate:"omitempty,roomname"`
+	Text        string `json:"text" validate:"required,max=1000"`
+	Level       string `json:"level" validate:"omitempty,oneof=info warning critical"`
+}
+
+// LoadSheddingRequest turns manual load shedding of the instance on or off
+type LoadSheddingRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// BugReportRequest is the room as the reporting client sees it, stored next to the server-side state
+type BugReportRequest struct {
+	ChannelName string `json:"channelName" validate:"required,roomname"`
+	Description string `json:"description" validate:"max=2000"`
+	// PendingBuffer is the number of received entities the client has not processed yet
+	PendingBuffer int `json:"pendingBuffer" validate:"min=0"`
+	// LastEventID is the ID of the last entity the client processed
+	LastEventID uint64 `json:"lastEventID"`
+	// Members are users the client shows as present in the room
+	Members []string `json:"members" validate:"max=500,dive,max=128"`
+}
+
+type BugReportResponse struct {
+	// ReportID is what the user gives support to find the report
+	ReportID string `json:"reportID"`
+}
+
+// ClientLogsRequest is a batch of client logs. ChannelName and SessionID correlate entries with server logs
+type ClientLogsRequest struct {
+	// SessionID identifies the client session, e.g. a page load, across batches
+	SessionID   string           `json:"sessionID" validate:"max=128"`
+	ChannelName string           `json:"channelName" validate:"omitempty,roomname"`
+	Entries     []ClientLogEntry `json:"entries" validate:"required,min=1,max=50,dive"`
+}
+
+type ClientLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level" validate:"required,oneof=debug info warn error"`
+	Message string    `json:"message" validate:"required,max=2048"`
+	// ChannelName overrides the room of the batch for this entry
+	ChannelName string         `json:"channelName" validate:"omitempty,roomname"`
+	Fields      map[string]any `json:"fields" validate:"mapdepth=4,mapsize=64"`
+}
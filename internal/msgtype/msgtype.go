@@ -0,0 +1,190 @@
+// Package msgtype is the registry of peer message types carried in "messageType" field of the message.
+// Each type declares the fields it must carry, the priority it is buffered with and whether it counts
+// against the sender's rate limit
+package msgtype
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"peer-messenger/internal/models"
+)
+
+// RateClass tells whether messages of the type count against the sender's send rate limit
+type RateClass string
+
+const (
+	RateLimited RateClass = "limited"
+	// RateExempt messages are never rejected by the rate limit, e.g. hang-ups that must get through
+	RateExempt RateClass = "exempt"
+)
+
+// UnknownPolicy is what happens to messages of types missing from the registry
+type UnknownPolicy string
+
+const (
+	UnknownReject UnknownPolicy = "reject"
+	UnknownPass   UnknownPolicy = "pass"
+)
+
+// patternSuffix marks type name matching every type with the prefix, e.g. "custom/*"
+const patternSuffix = "/*"
+
+// OtherLabel is the metrics label of messages without type and of passed unknown ones,
+// so clients can't blow up label cardinality
+const OtherLabel = "other"
+
+var ErrInvalidType = errors.New("invalid message type")
+
+type Type struct {
+	// Name is the exact messageType or a pattern ending with "/*"
+	Name string
+	// Required fields must be present and not empty
+	Required []string
+	// Priority is used when sender does not set one, empty is normal priority
+	Priority models.Priority
+	Rate     RateClass
+	// Plaintext types are relayed unencrypted in rooms requiring end-to-end encryption,
+	// signaling has to be readable for peers to set up the encrypted session
+	Plaintext bool
+}
+
+// Builtin returns the types known without configuration
+func Builtin() []Type {
+	return []Type{
+		{Name: models.MessageTypeOffer, Required: []string{"sdp"}, Rate: RateLimited, Plaintext: true},
+		{Name: models.MessageTypeAnswer, Required: []string{"sdp"}, Rate: RateLimited, Plaintext: true},
+		{Name: models.MessageTypeCandidate, Required: []string{"candidate"}, Rate: RateLimited, Plaintext: true},
+		{Name: models.MessageTypeBye, Rate: RateLimited, Plaintext: true},
+		{Name: models.MessageTypeChat, Required: []string{"text"}, Rate: RateLimited},
+		{Name: models.MessageTypeRenegotiate, Rate: RateLimited, Plaintext: true},
+		{Name: "custom" + patternSuffix, Rate: RateLimited},
+	}
+}
+
+// Registry is immutable after creation and safe for concurrent use
+type Registry struct {
+	exact map[string]Type
+	// patterns are matched in the order they were given
+	patterns []Type
+	unknown  UnknownPolicy
+}
+
+// New builds registry of built-in types extended by types. Type with the name of a built-in one replaces it
+func New(types []Type, unknown UnknownPolicy) (*Registry, error) {
+	if unknown != UnknownReject && unknown != UnknownPass {
+		return nil, fmt.Errorf("%w: unknown types policy %q, want %q or %q", ErrInvalidType, unknown, UnknownReject, UnknownPass)
+	}
+
+	r := &Registry{exact: make(map[string]Type), unknown: unknown}
+	for _, t := range append(Builtin(), types...) {
+		err := r.add(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Default is the registry of built-in types rejecting unknown ones
+func Default() *Registry {
+	r, err := New(nil, UnknownReject)
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+func (r *Registry) add(t Type) error {
+	switch {
+	case t.Name == "" || t.Name == patternSuffix:
+		return fmt.Errorf("%w: empty name", ErrInvalidType)
+	case t.Rate != RateLimited && t.Rate != RateExempt:
+		return fmt.Errorf("%w: %s has rate class %q", ErrInvalidType, t.Name, t.Rate)
+	case !slices.Contains([]models.Priority{"", models.PriorityLow, models.PriorityNormal, models.PriorityHigh}, t.Priority):
+		return fmt.Errorf("%w: %s has priority %q", ErrInvalidType, t.Name, t.Priority)
+	}
+
+	if !strings.HasSuffix(t.Name, patternSuffix) {
+		r.exact[t.Name] = t
+		return nil
+	}
+
+	for i, pattern := range r.patterns {
+		if pattern.Name == t.Name {
+			r.patterns[i] = t
+			return nil
+		}
+	}
+	r.patterns = append(r.patterns, t)
+
+	return nil
+}
+
+// Lookup finds the type by exact name first and then by pattern
+func (r *Registry) Lookup(name string) (Type, bool) {
+	if t, ok := r.exact[name]; ok {
+		return t, true
+	}
+
+	for _, pattern := range r.patterns {
+		if strings.HasPrefix(name, strings.TrimSuffix(pattern.Name, "*")) {
+			return pattern, true
+		}
+	}
+
+	return Type{}, false
+}
+
+// Resolve returns the type messages of name are handled as. Unknown names get rate limited type of normal priority
+func (r *Registry) Resolve(name string) Type {
+	t, ok := r.Lookup(name)
+	if !ok {
+		return Type{Name: name, Rate: RateLimited}
+	}
+
+	return t
+}
+
+// Allowed reports whether messages of the type are accepted
+func (r *Registry) Allowed(name string) bool {
+	_, ok := r.Lookup(name)
+	return ok || r.unknown == UnknownPass
+}
+
+// Intern returns name of the known exact type, so buffered entities do not keep a copy
+// of the same few strings each. Other names are returned as is
+func (r *Registry) Intern(name string) string {
+	if t, ok := r.exact[name]; ok {
+		return t.Name
+	}
+
+	return name
+}
+
+// Label is the metrics label of the type: its name or pattern, OtherLabel for unknown types
+func (r *Registry) Label(name string) string {
+	t, ok := r.Lookup(name)
+	if !ok {
+		return OtherLabel
+	}
+
+	return t.Name
+}
+
+// MissingFields returns required fields of the type that message lacks. Empty strings count as missing
+func (t Type) MissingFields(message map[string]any) []string {
+	var missing []string
+	for _, field := range t.Required {
+		value, ok := message[field]
+		if s, isString := value.(string); !ok || value == nil || (isString && s == "") {
+			missing = append(missing, field)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,331 @@
+// Package openapi builds OpenAPI 3 document from route descriptions and request/response Go types.
+// Schemas follow json and form tags, constraints are taken from validate tags
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Auth is the security scheme of an operation
+type Auth int
+
+const (
+	AuthNone Auth = iota
+	// AuthSession is the session token returned by login or service account token, sent as raw Authorization header
+	AuthSession
+	// AuthAdmin is the admin token sent as "Authorization: Bearer <token>"
+	AuthAdmin
+)
+
+// Operation describes one route
+type Operation struct {
+	Method  string
+	Path    string
+	Summary string
+	Auth    Auth
+	// Body is a zero value of the JSON request body type, nil when there is no body
+	Body any
+	// Query is a zero value of the struct bound from query by form tags, nil when there are no parameters
+	Query any
+	// Status is the success status code, 200 when zero
+	Status int
+	// Response is a zero value of the success response body. map[string]any describes an ad hoc object
+	// by its keys and zero values, nil means empty body
+	Response any
+	// ContentType of the response, application/json when empty
+	ContentType string
+	// OptionalBody lets the request omit Body
+	OptionalBody bool
+	// Deprecated routes are kept for compatibility, Summary tells what replaces them
+	Deprecated bool
+}
+
+// Document is the OpenAPI 3 document, ready to be encoded as JSON
+type Document map[string]any
+
+type builder struct {
+	schemas map[string]any
+}
+
+// Build describes operations. errorResponse is a zero value of the body every failed request responds with
+func Build(title, version string, errorResponse any, ops []Operation) Document {
+	b := &builder{schemas: make(map[string]any)}
+
+	errorSchema := b.schema(reflect.TypeOf(errorResponse))
+
+	paths := make(map[string]map[string]any)
+	for _, op := range ops {
+		path, pathParams := convertPath(op.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+
+		paths[path][strings.ToLower(op.Method)] = b.operation(op, pathParams, errorSchema)
+	}
+
+	return Document{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": title, "version": version},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "header", "name": "Authorization"},
+				"admin":   map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (b *builder) operation(op Operation, pathParams []string, errorSchema any) map[string]any {
+	out := map[string]any{"summary": op.Summary}
+	if op.Deprecated {
+		out["deprecated"] = true
+	}
+
+	var params []any
+	for _, name := range pathParams {
+		params = append(params, map[string]any{
+			"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	if op.Query != nil {
+		params = append(params, b.queryParams(reflect.TypeOf(op.Query))...)
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+
+	if op.Body != nil {
+		out["requestBody"] = map[string]any{
+			"required": !op.OptionalBody,
+			"content":  map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.Body))}},
+		}
+	}
+
+	switch op.Auth {
+	case AuthSession:
+		out["security"] = []any{map[string]any{"session": []string{}}}
+	case AuthAdmin:
+		out["security"] = []any{map[string]any{"admin": []string{}}}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := op.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	success := map[string]any{"description": http.StatusText(status)}
+	if op.Response != nil {
+		success["content"] = map[string]any{contentType: map[string]any{"schema": b.response(op.Response)}}
+	}
+
+	out["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error with machine-readable code",
+			"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+		},
+	}
+
+	return out
+}
+
+func (b *builder) response(v any) any {
+	object, ok := v.(map[string]any)
+	if !ok {
+		return b.schema(reflect.TypeOf(v))
+	}
+
+	properties := make(map[string]any, len(object))
+	for key, value := range object {
+		properties[key] = b.schema(reflect.TypeOf(value))
+	}
+
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func (b *builder) queryParams(t reflect.Type) []any {
+	var params []any
+	for _, field := range reflect.VisibleFields(t) {
+		name, _, _ := strings.Cut(field.Tag.Get("form"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		schema := b.schema(field.Type)
+		rules := validateRules(field)
+		constrain(schema, field.Type, rules)
+
+		params = append(params, map[string]any{
+			"name": name, "in": "query", "required": rules.has("required"), "schema": schema,
+		})
+	}
+
+	return params
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns inline schema of basic types and reference to components for named structs
+func (b *builder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawJSONType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// placeholder stops recursion on self-referencing types
+			b.schemas[t.Name()] = map[string]any{}
+			b.schemas[t.Name()] = b.object(t)
+		}
+
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (b *builder) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := b.schema(field.Type)
+		rules := validateRules(field)
+		if _, ref := schema["$ref"]; !ref {
+			constrain(schema, field.Type, rules)
+		}
+		if rules.has("required") {
+			required = append(required, name)
+		}
+
+		properties[name] = schema
+	}
+
+	out := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+
+	return out
+}
+
+// rules are validate tag rules of a field before "dive", the ones after it apply to elements
+type rules map[string]string
+
+func validateRules(field reflect.StructField) rules {
+	out := make(rules)
+	for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+		if rule == "dive" {
+			break
+		}
+
+		name, param, _ := strings.Cut(rule, "=")
+		out[name] = param
+	}
+
+	return out
+}
+
+func (r rules) has(name string) bool {
+	_, ok := r[name]
+	return ok
+}
+
+// constrain adds validation constraints to the inline schema of the field
+func constrain(schema map[string]any, t reflect.Type, r rules) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	minKey, maxKey := "minimum", "maximum"
+	switch t.Kind() {
+	case reflect.String:
+		minKey, maxKey = "minLength", "maxLength"
+	case reflect.Slice, reflect.Array:
+		minKey, maxKey = "minItems", "maxItems"
+	case reflect.Map:
+		minKey, maxKey = "minProperties", "maxProperties"
+	}
+
+	for name, key := range map[string]string{"min": minKey, "max": maxKey} {
+		param, ok := r[name]
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseFloat(param, 64); err == nil {
+			schema[key] = n
+		}
+	}
+
+	if param, ok := r["oneof"]; ok {
+		schema["enum"] = strings.Fields(param)
+	}
+}
+
+// convertPath turns gin path parameters ":name" into OpenAPI "{name}"
+func convertPath(path string) (string, []string) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	segments := strings.Split(path, "/")
+	var params []string
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, name)
+		}
+	}
+
+	return strings.Join(segments, "/"), params
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// compactData serializes entity data once when the entity is created. Queued entities then hold a single byte slice
+// instead of a tree of maps and interfaces, which is roughly 3 times smaller for typical signaling messages
+func compactData(data map[string]any) (json.RawMessage, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("encode entity data: %w", err)
+	}
+
+	return encoded, nil
+}
+
+// messageType returns messageType of data interned by the registry
+func (r *Room) messageType(data map[string]any) string {
+	messageType, _ := data["messageType"].(string)
+	return r.opts.MessageTypes.Intern(messageType)
+}
+
+// compact serializes data of entities built by the server or decoded from JSON, which always succeeds.
+// Failure would be a bug, so it is logged and the entity goes out without data
+func (r *Room) compact(data map[string]any) json.RawMessage {
+	encoded, err := compactData(data)
+	if err != nil {
+		r.log.Error("failed to compact entity data", zap.Error(err))
+	}
+
+	return encoded
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+const (
+	pointerOutcomePublished = "published"
+	pointerOutcomeCoalesced = "coalesced"
+	pointerOutcomeDropped   = "dropped"
+)
+
+// MovePointer stores the latest pointer position of the user. Positions are published by FlushPointers,
+// a move replacing one not flushed yet is coalesced, so pointer streams never reach the peer message path
+func (r *Room) MovePointer(userID string, req models.PointerRequest) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	info.lastActionTime = time.Now()
+
+	if r.pointers == nil {
+		r.pointers = make(map[string]models.PointerRequest)
+	}
+	if _, ok := r.pointers[info.id]; ok {
+		r.metrics.PointerEvents.WithLabelValues(r.name, pointerOutcomeCoalesced).Inc()
+	}
+	r.pointers[info.id] = req
+
+	return nil
+}
+
+// FlushPointers publishes the latest position of every user who moved the pointer since the previous flush.
+// Pointer entities are low priority and skip full queues: the next position supersedes the lost one,
+// so the overflow policy and dead letters are not involved
+func (r *Room) FlushPointers() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if len(r.pointers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for userID, req := range r.pointers {
+		if _, ok := r.userInfos[userID]; !ok {
+			continue
+		}
+
+		data := map[string]any{"x": req.X, "y": req.Y, "pressed": req.Pressed}
+		if req.Surface != "" {
+			data["surface"] = req.Surface
+		}
+
+		entity := models.ChannelEntity{
+			ID:         r.lastEntityID.Add(1),
+			Time:       now,
+			ActionType: models.Pointer,
+			UserID:     userID,
+			Data:       r.compact(data),
+			Priority:   models.PriorityLow,
+		}
+
+		for recipientID, info := range r.userInfos {
+			if recipientID == userID {
+				continue
+			}
+
+			if info.entities.push(entity) {
+				info.history.record(entity)
+				r.metrics.PointerEvents.WithLabelValues(r.name, pointerOutcomePublished).Inc()
+			} else {
+				r.metrics.PointerEvents.WithLabelValues(r.name, pointerOutcomeDropped).Inc()
+			}
+		}
+	}
+
+	clear(r.pointers)
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// Heartbeat records explicit presence of the user. Heartbeats are expected more often than PresenceTimeout
+func (r *Room) Heartbeat(userID string, status models.PresenceStatus) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	info.lastActionTime = time.Now()
+	info.away = status == models.PresenceAway
+	r.updatePresence(info, info.lastActionTime)
+
+	return nil
+}
+
+// Presence returns status of every member sorted by user ID
+func (r *Room) Presence() []models.MemberPresence {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	now := time.Now()
+	members := make([]models.MemberPresence, 0, len(r.userInfos))
+	for _, info := range r.userInfos {
+		members = append(members, models.MemberPresence{
+			UserID:         info.id,
+			Status:         r.presenceOf(info, now),
+			LastActionTime: info.lastActionTime,
+			Moderator:      info.moderator,
+		})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+
+	return members
+}
+
+// presenceOf treats users not heard of for PresenceTimeout as away, long before they are evicted as inactive
+func (r *Room) presenceOf(info *userInfo, now time.Time) models.PresenceStatus {
+	if info.away || now.Sub(info.lastActionTime) > r.opts.PresenceTimeout {
+		return models.PresenceAway
+	}
+
+	return models.PresenceOnline
+}
+
+// updatePresence notifies other members when status of the user has changed. Must be called under write lock
+func (r *Room) updatePresence(info *userInfo, now time.Time) {
+	status := r.presenceOf(info, now)
+	if status == info.presence {
+		return
+	}
+
+	info.presence = status
+	if info.silent {
+		return
+	}
+
+	r.publish(models.ChannelEntity{
+		Time:       now,
+		ActionType: models.PresenceChanged,
+		UserID:     info.id,
+		Data:       r.compact(map[string]any{"status": status}),
+	})
+}
@@ -0,0 +1,67 @@
+// Package replay remembers IDs (jti) of single-use tokens until the tokens expire, so a captured token
+// can't be used a second time. In-memory guard is the default, the interface allows shared ones like Redis
+// when several instances accept the same tokens
+package replay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplayed = errors.New("token was already used")
+	// ErrFull rejects claims while the guard can't remember more tokens. Accepting them would allow replays
+	ErrFull = errors.New("replay guard is full")
+)
+
+type Guard interface {
+	// Claim marks jti used until expires. Claiming the same jti again before it expires fails with ErrReplayed
+	Claim(ctx context.Context, jti string, expires time.Time) error
+}
+
+// Memory keeps up to capacity unexpired token IDs of this instance
+type Memory struct {
+	used     map[string]time.Time
+	capacity int
+	mux      *sync.Mutex
+}
+
+func NewMemory(capacity int) *Memory {
+	return &Memory{
+		used:     make(map[string]time.Time),
+		capacity: capacity,
+		mux:      &sync.Mutex{},
+	}
+}
+
+func (m *Memory) Claim(_ context.Context, jti string, expires time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now()
+	if until, ok := m.used[jti]; ok && now.Before(until) {
+		return ErrReplayed
+	}
+
+	// expired IDs are swept lazily, only when they take the space of new ones
+	if len(m.used) >= m.capacity {
+		m.sweep(now)
+	}
+	if len(m.used) >= m.capacity {
+		return ErrFull
+	}
+
+	m.used[jti] = expires
+
+	return nil
+}
+
+func (m *Memory) sweep(now time.Time) {
+	for jti, until := range m.used {
+		if !now.Before(until) {
+			delete(m.used, jti)
+		}
+	}
+}
@@ -2,65 +2,353 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 
+	"peer-messenger/internal/bus"
 	"peer-messenger/internal/metrics"
 	"peer-messenger/internal/models"
+	"peer-messenger/internal/msgtype"
+	"peer-messenger/internal/tracing"
 )
 
 var (
 	ErrUserAlreadyInRoom = errors.New("user is already in room")
 	ErrUserNotInRoom     = errors.New("user is not in room")
+	ErrRateLimited       = errors.New("send rate limit exceeded")
+	ErrDestBusy          = errors.New("destination user queue is full")
+	ErrBatchOverBurst    = errors.New("batch has more rate limited messages than the send burst, split it")
+	ErrUserBanned        = errors.New("user is banned in room")
+	ErrCaptionsDisabled  = errors.New("captions are disabled in room")
+	ErrPolicyViolation   = errors.New("message violates room policy")
+	ErrUserNotInvited    = errors.New("room is private and user is not invited")
+	ErrEventLogDisabled  = errors.New("room event history is disabled")
 )
 
+// OverflowPolicy tells what publishing does when user queue is full. Publishing never waits for the queue,
+// so one slow consumer can't stall the whole room
+type OverflowPolicy string
+
 const (
-	msgCountThreshold     = 40
-	maxMsgRPS             = 100
-	maxInactivityDuration = 5 * time.Minute
+	// OverflowDropOldest makes room for the entity by moving the oldest queued one to dead letters
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDropNewest moves the published entity to dead letters
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDisconnect removes the user from the room, the entities queued so far go to dead letters
+	OverflowDisconnect OverflowPolicy = "disconnect-slow-consumer"
 )
 
+// reasonSlowConsumer is the removal reason of users disconnected by OverflowDisconnect
+const reasonSlowConsumer = "slow consumer"
+
+// RoomOptions configures limits and blocking behaviour of room operations. Zero timeout means waiting without a deadline
+type RoomOptions struct {
+	// UserMessageRate limits peer messages per second of each user in the room
+	UserMessageRate float64
+	// UserMessageBurst is the number of messages user may send at once above the rate
+	UserMessageBurst int
+	// QueueSize is the capacity of each user's entity queue
+	QueueSize int
+	// MaxQueuedEntities is the backlog after which user is considered disconnected
+	MaxQueuedEntities int
+	// InactivityTimeout is how long user may stay idle before being probed
+	InactivityTimeout time.Duration
+	// PresenceTimeout is how long user may stay idle before being shown as away
+	PresenceTimeout time.Duration
+	// ProbeGracePeriod is how long probed user has to show activity before eviction
+	ProbeGracePeriod time.Duration
+	// LivenessWindow is how long user sending liveness heartbeats may miss them before being removed
+	LivenessWindow time.Duration
+	// DeliveryTimeout bounds the time spent enqueuing a peer message into the destination user's queue,
+	// rooms with a dispatcher don't wait at all
+	DeliveryTimeout time.Duration
+	// DispatchQueueSize is the capacity of the room queue of peer messages accepted from senders and delivered
+	// by the room dispatcher, 0 delivers them within the sender's request
+	DispatchQueueSize int
+	// OverflowPolicy applies to entities published to full queues, empty means OverflowDropNewest
+	OverflowPolicy OverflowPolicy
+	// SDPLint enables advisory warnings about relayed offers and answers
+	SDPLint bool
+	// ChatHistoryCapacity is the number of chat messages kept searchable in rooms with chat history enabled
+	ChatHistoryCapacity int
+	// SDPCandidateTimeout is how long to wait for trickled candidates after description without embedded ones
+	SDPCandidateTimeout time.Duration
+	// MessageTypes tells how peer messages of each type are limited and prioritized
+	MessageTypes *msgtype.Registry
+	// EventHistoryCapacity is the number of the latest entities kept per room for history requests, 0 disables it
+	EventHistoryCapacity int
+	// E2EERequired requires end-to-end encrypted messages in every room of the tenant, whatever the room policy
+	E2EERequired bool
+}
+
 type Room struct {
 	name        string
 	userInfos   map[string]*userInfo
+	banned      map[string]struct{}
 	mux         *sync.RWMutex
 	log         *zap.Logger
-	sendLimiter *rate.Limiter
 	metrics     *metrics.Metrics
+	opts        RoomOptions
+	deadLetters *DeadLetters
+	// inbox is nil when missed messages are not kept
+	inbox MessageStore
+	// bus is nil on a single instance, otherwise messages to users not in the room are passed to other instances
+	bus bus.Bus
+
+	captionsEnabled bool
+	policy          models.RoomPolicy
+	// entryForm is nil unless joining members have to answer questions
+	entryForm *models.EntryForm
+	locale    models.Locale
+	// invited is the set of users allowed to join private room, nil for public rooms
+	invited map[string]struct{}
+	// passwordHash is the bcrypt hash of the room password, nil for rooms without password
+	passwordHash []byte
+	// capacity limits members of the room, 0 means no limit
+	capacity int
+	// owner becomes a moderator on join, empty for rooms without owner
+	owner string
+	// connectionFailures counts client-reported failed peer connections by failure stage
+	connectionFailures map[models.FailureStage]int
+	lastEntityID       *atomic.Uint64
+	// sdpLinter is nil unless SDP linting is enabled
+	sdpLinter *sdpLinter
+	// negotiations is the offer/answer state of member pairs exchanging typed signals
+	negotiations *negotiations
+	// chatHistory is nil unless enabled by room policy
+	chatHistory *chatHistory
+	// reservedUntil keeps the empty room from being cleaned, e.g. until a scheduled meeting starts
+	reservedUntil time.Time
+	// expiresAt closes the room even if it is not empty, zero for rooms without expiry.
+	// closingAnnounced is set once members are warned about it
+	expiresAt        time.Time
+	closingAnnounced bool
+	// events is nil when room event history is disabled
+	events *eventLog
+	// pointers are the latest pointer positions not flushed yet by sender, nil until the first move
+	pointers map[string]models.PointerRequest
+	// dispatcher is nil when peer messages are delivered within the sender's request
+	dispatcher *dispatcher
 }
 
 type userInfo struct {
-	entities       chan models.ChannelEntity
+	// id is the same string as the key in userInfos, entities of the user reference it instead of a per-request copy
+	id       string
+	entities *EntityQueue
+	// history mirrors recent entities of the queue for inspection
+	history        *entityHistory
 	lastActionTime time.Time
 	joinTime       time.Time
+	// probeTime is set when inactive user was probed, zero otherwise
+	probeTime time.Time
+	// beatTime is the last liveness heartbeat, zero until the user sends one
+	beatTime time.Time
+	// away is set by the user's heartbeat, presence is the status other members were last told about
+	away     bool
+	presence models.PresenceStatus
+	client   models.ClientInfo
+	// silent users join and leave without notifying others
+	silent       bool
+	captions     bool
+	variantLabel string
+	// sendLimiter is the user's own token bucket, so one chatty user does not starve the others
+	sendLimiter  *rate.Limiter
+	limiterStats *limiterStats
+	// streams is the number of open event streams of the user
+	streams int
+	// sessions are logins of the user that joined the room, "" stands for tokens without session
+	sessions map[string]struct{}
+	// answers to the entry form given on join, nil when the room had no form
+	answers   map[string]any
+	moderator bool
+	topology  models.Topology
+	// adopted is set for members handed over by another instance until they reconnect to this one,
+	// they may have reconnected elsewhere
+	adopted atomic.Bool
+}
+
+// JoinOptions describes how user joins the room
+type JoinOptions struct {
+	Client models.ClientInfo
+	// Silent users join and leave without notifying others
+	Silent bool
+	// Captions opts user in to caption events
+	Captions bool
+	// VariantLabel identifies experiment variants of the user in metrics
+	VariantLabel string
+	// Answers to the entry form of the room, silent users skip the form
+	Answers map[string]any
+	// Topology of the user, mesh when empty
+	Topology models.Topology
 }
 
-func NewRoom(name string, log *zap.Logger, metrics *metrics.Metrics) *Room {
-	return &Room{
+func NewRoom(
+	name string,
+	log *zap.Logger,
+	metrics *metrics.Metrics,
+	opts RoomOptions,
+	deadLetters *DeadLetters,
+	inbox MessageStore,
+	bus bus.Bus,
+) *Room {
+	r := &Room{
 		name:        name,
 		userInfos:   make(map[string]*userInfo),
+		banned:      make(map[string]struct{}),
 		mux:         &sync.RWMutex{},
 		log:         log,
-		sendLimiter: rate.NewLimiter(rate.Limit(maxMsgRPS), 2*maxMsgRPS),
 		metrics:     metrics,
+		opts:        opts,
+		deadLetters: deadLetters,
+		inbox:       inbox,
+		bus:         bus,
+
+		lastEntityID:       &atomic.Uint64{},
+		connectionFailures: make(map[models.FailureStage]int),
+		negotiations:       newNegotiations(),
 	}
+
+	if opts.SDPLint {
+		r.sdpLinter = newSDPLinter(opts.SDPCandidateTimeout)
+	}
+	if opts.EventHistoryCapacity > 0 {
+		r.events = newEventLog(opts.EventHistoryCapacity)
+	}
+	if opts.DispatchQueueSize > 0 {
+		r.dispatcher = newDispatcher(opts.DispatchQueueSize, r.deliverDispatched)
+	}
+
+	return r
 }
 
 func (r *Room) publish(entity models.ChannelEntity) {
+	r.publishFiltered(entity, nil)
+}
+
+// publishFiltered sends entity to every user except the sender, for whom accept returns true. Nil accept matches all.
+// It never blocks: full queues are handled by the overflow policy and slow consumers are disconnected after the fan-out
+func (r *Room) publishFiltered(entity models.ChannelEntity, accept func(*userInfo) bool) {
 	r.log.Info("gonna send to message to users", zap.Int("users number", len(r.userInfos)-1))
 
+	entity.ID = r.lastEntityID.Add(1)
+	r.logEvent(entity, "")
+	r.metrics.EventsPublished.WithLabelValues(r.name, string(entity.ActionType)).Inc()
+
+	slow := make([]*userInfo, 0)
 	for userID, info := range r.userInfos {
-		if userID != entity.UserID {
-			info.entities <- entity
+		if userID == entity.UserID || (accept != nil && !accept(info)) {
+			continue
+		}
+
+		if !r.offer(info, entity) {
+			slow = append(slow, info)
 		}
 	}
+
+	r.disconnect(slow)
 }
 
-func (r *Room) AddUser(userID string) error {
+// offer enqueues entity without waiting. When the queue is full the overflow policy is applied,
+// false means the user has to be disconnected as slow consumer
+func (r *Room) offer(info *userInfo, entity models.ChannelEntity) bool {
+	if info.entities.push(entity) {
+		info.history.record(entity)
+		r.observeOccupancy(info)
+		return true
+	}
+
+	policy := r.opts.OverflowPolicy
+	if policy == "" {
+		policy = OverflowDropNewest
+	}
+	r.metrics.DroppedEntities.WithLabelValues(r.name, string(policy)).Inc()
+
+	switch policy {
+	case OverflowDisconnect:
+		return false
+	case OverflowDropOldest:
+		// subscriber may drain the queue meanwhile, then there is nothing to drop
+		if oldest, ok := info.entities.popOldest(); ok {
+			r.deadLetters.Record(r.name, info.id, oldest, "dropped for newer entity")
+		}
+
+		if info.entities.push(entity) {
+			info.history.record(entity)
+			r.observeOccupancy(info)
+			return true
+		}
+	}
+
+	r.log.Warn("entity is not published to user", zap.String("user", info.id), zap.Error(ErrDestBusy))
+	r.deadLetters.Record(r.name, info.id, entity, ErrDestBusy.Error())
+
+	return true
+}
+
+// observeOccupancy records how full the user queue is, queues filling up precede drops and slow consumer disconnects
+func (r *Room) observeOccupancy(info *userInfo) {
+	r.metrics.QueueOccupancy.WithLabelValues(r.name).Observe(float64(info.entities.Len()) / float64(info.entities.Cap()))
+}
+
+// disconnect removes slow consumers. Removal publishes user left entities, which may disconnect others first,
+// so users that are gone already are skipped. Must be called under write lock
+func (r *Room) disconnect(slow []*userInfo) {
+	for _, info := range slow {
+		if r.userInfos[info.id] != info {
+			continue
+		}
+
+		r.log.Warn("slow consumer disconnected", zap.String("user", info.id), zap.Int("queued", info.entities.Len()))
+		r.removeUser(info.id, reasonSlowConsumer)
+	}
+}
+
+// enqueue puts entity into user queue waiting no longer than configured delivery timeout.
+// Low priority entities and entities of rooms with a dispatcher do not wait at all and are dropped
+// if the queue is full
+func (r *Room) enqueue(ctx context.Context, info *userInfo, entity models.ChannelEntity) error {
+	if entity.Priority == models.PriorityLow || r.dispatcher != nil {
+		if !info.entities.push(entity) {
+			return ErrDestBusy
+		}
+
+		info.history.record(entity)
+		r.observeOccupancy(info)
+		return nil
+	}
+
+	if r.opts.DeliveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.opts.DeliveryTimeout)
+		defer cancel()
+	}
+
+	err := info.entities.pushWait(ctx, entity)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrDestBusy
+	}
+	if err != nil {
+		return err
+	}
+
+	info.history.record(entity)
+	r.observeOccupancy(info)
+
+	return nil
+}
+
+// AddUser adds user to the room. Unless joining silently, other members are notified
+func (r *Room) AddUser(userID string, opts JoinOptions) error {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
@@ -68,22 +356,124 @@ func (r *Room) AddUser(userID string) error {
 		return ErrUserAlreadyInRoom
 	}
 
-	r.publish(models.ChannelEntity{
-		Time:       time.Now(),
-		ActionType: models.UserJoined,
-		UserID:     userID,
-		Data:       nil,
-	})
+	if _, ok := r.banned[userID]; ok {
+		return ErrUserBanned
+	}
+
+	if _, ok := r.invited[userID]; r.invited != nil && !ok {
+		return ErrUserNotInvited
+	}
+
+	if r.capacity > 0 && !opts.Silent && r.members() >= r.capacity {
+		return ErrRoomFull
+	}
+
+	var answers map[string]any
+	if r.entryForm != nil && !opts.Silent {
+		var err error
+		answers, err = r.checkEntryAnswers(opts.Answers)
+		if err != nil {
+			return err
+		}
+	}
+
+	topology := opts.Topology
+	if topology == "" {
+		topology = models.TopologyMesh
+	}
+
+	if !opts.Silent {
+		r.publish(models.ChannelEntity{
+			Time:       time.Now(),
+			ActionType: models.UserJoined,
+			UserID:     userID,
+			Data:       nil,
+		})
+	}
 
 	r.userInfos[userID] = &userInfo{
-		entities:       make(chan models.ChannelEntity, 100),
+		id:             userID,
+		entities:       newEntityQueue(r.opts.QueueSize),
+		history:        newEntityHistory(r.opts.QueueSize),
 		lastActionTime: time.Now(),
 		joinTime:       time.Now(),
+		client:         opts.Client,
+		silent:         opts.Silent,
+		captions:       opts.Captions,
+		variantLabel:   opts.VariantLabel,
+		presence:       models.PresenceOnline,
+		sendLimiter:    rate.NewLimiter(rate.Limit(r.opts.UserMessageRate), r.opts.UserMessageBurst),
+		limiterStats:   &limiterStats{},
+		sessions:       map[string]struct{}{opts.Client.Session: {}},
+		answers:        answers,
+		moderator:      userID == r.owner,
+		topology:       topology,
 	}
+	r.metrics.RoomMembers.WithLabelValues(r.name).Set(float64(r.members()))
 
 	return nil
 }
 
+// members counts users the capacity applies to, silent service accounts are not counted. Must be called under lock
+func (r *Room) members() int {
+	members := 0
+	for _, info := range r.userInfos {
+		if !info.silent {
+			members++
+		}
+	}
+
+	return members
+}
+
+// AttachSession joins another login of the member to the room, e.g. the same user on the second device.
+// Other members see no change, the user is in the room until its last session leaves
+func (r *Room) AttachSession(userID, session string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	// the member handed over by another instance may join again instead of resuming its stream
+	if _, ok := info.sessions[session]; ok && !info.adopted.Load() {
+		return ErrUserAlreadyInRoom
+	}
+
+	info.adopted.Store(false)
+	info.sessions[session] = struct{}{}
+	info.lastActionTime = time.Now()
+
+	return nil
+}
+
+// LeaveSession detaches the login from the room and removes the user once no session of it is left.
+// Reports whether the user left the room
+func (r *Room) LeaveSession(userID, session string) (bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return false, ErrUserNotInRoom
+	}
+
+	if _, ok := info.sessions[session]; !ok {
+		return false, ErrUserNotInRoom
+	}
+
+	delete(info.sessions, session)
+	if len(info.sessions) > 0 {
+		return false, nil
+	}
+
+	r.removeUser(userID, "user left")
+
+	return true, nil
+}
+
 func (r *Room) RemoveUser(userID string) error {
 	r.mux.Lock()
 	defer r.mux.Unlock()
@@ -92,35 +482,225 @@ func (r *Room) RemoveUser(userID string) error {
 		return ErrUserNotInRoom
 	}
 
+	r.removeUser(userID, "user left")
+
+	return nil
+}
+
+// removeUser closes user queue moving undelivered entities to dead letters and notifies others. Must be called under lock
+func (r *Room) removeUser(userID, reason string) {
 	info := r.userInfos[userID]
 	delete(r.userInfos, userID)
-	close(info.entities)
+	r.metrics.RoomMembers.WithLabelValues(r.name).Set(float64(r.members()))
+
+	// the adopted member that never came here is left behind quietly, it is in the room on another instance
+	if info.adopted.Load() {
+		info.entities.closeQueue(false)
+		return
+	}
+
+	// evicted users are expected to reconnect, so messages left in their queues wait for them in the inbox
+	evicted := reason == "user evicted"
+	if !evicted {
+		r.dropMissed(userID)
+	}
+	r.closeQueue(userID, info, reason, evicted)
+
+	if r.sdpLinter != nil {
+		r.sdpLinter.forget(userID)
+	}
+	r.negotiations.forget(userID)
+
+	if info.silent {
+		return
+	}
 
 	r.publish(models.ChannelEntity{
 		Time:       time.Now(),
 		ActionType: models.UserLeft,
-		UserID:     userID,
+		UserID:     info.id,
 		Data:       nil,
 	})
+}
 
-	return nil
+func (r *Room) closeQueue(userID string, info *userInfo, reason string, keepMissed bool) {
+	for _, entity := range info.entities.closeQueue(true) {
+		if keepMissed && r.storeMissed(userID, entity) {
+			continue
+		}
+
+		r.deadLetters.Record(r.name, userID, entity, reason)
+	}
+}
+
+// Restrict makes the room private, only listed users may join it
+func (r *Room) Restrict(userIDs ...string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.invited = make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		r.invited[userID] = struct{}{}
+	}
+}
+
+// HistoryBytes is the size of entity data kept in histories of all users
+func (r *Room) HistoryBytes() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	total := 0
+	for _, info := range r.userInfos {
+		total += info.history.bytes()
+	}
+
+	return total
 }
 
-func (r *Room) GetUserEventsChan(userID string) (<-chan models.ChannelEntity, error) {
+// Reserve keeps the room alive while empty until the given time
+func (r *Room) Reserve(until time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.reservedUntil = until
+}
+
+// Abandoned reports whether the room is empty and not reserved, so it may be removed
+func (r *Room) Abandoned(now time.Time) bool {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
 
+	return len(r.userInfos) == 0 && now.After(r.reservedUntil)
+}
+
+// Protect requires the password with the given hash to join the room
+func (r *Room) Protect(passwordHash []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.passwordHash = passwordHash
+}
+
+// PasswordHash returns the hash of the room password, nil if the room is not protected
+func (r *Room) PasswordHash() []byte {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.passwordHash
+}
+
+// BanUser removes user from the room if present and forbids joining it again
+func (r *Room) BanUser(userID string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.banned[userID] = struct{}{}
+
+	if _, ok := r.userInfos[userID]; !ok {
+		return
+	}
+
+	r.removeUser(userID, "user banned")
+}
+
+// OpenStream returns the queue of the user's device for an event stream. Every opened stream must be closed
+// by CloseStream with the same session
+func (r *Room) OpenStream(userID, session string) (*QueueReader, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
 	info, ok := r.userInfos[userID]
 	if !ok {
 		return nil, ErrUserNotInRoom
 	}
 
 	info.lastActionTime = time.Now()
+	info.streams++
+	info.adopted.Store(false)
 
-	return info.entities, nil
+	return info.entities.open(session), nil
 }
 
-func (r *Room) GetUserEventsSlice(userID string) ([]models.ChannelEntity, error) {
+// CloseStream is called when subscriber went away without leaving. Once the last stream of the user is closed,
+// the user is made inactive at once: shown as away now, probed and evicted by the next clean.
+// Reports whether it was the last stream
+func (r *Room) CloseStream(userID, session string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return false
+	}
+
+	info.entities.release(session)
+
+	info.streams = max(info.streams-1, 0)
+	if info.streams > 0 {
+		return false
+	}
+
+	now := time.Now()
+	info.lastActionTime = now.Add(-r.opts.InactivityTimeout)
+	r.updatePresence(info, now)
+
+	return true
+}
+
+// PlanConnections orders members other than the joiner by join time, assigns each an offer delay growing by pacing
+// and tells them to expect an offer from the joiner. Silent and SFU members are not part of the mesh and are skipped,
+// SFU joiners get an empty plan
+func (r *Room) PlanConnections(joinerID string, pacing time.Duration) models.ConnectionPlan {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var peers []string
+	if joiner, ok := r.userInfos[joinerID]; ok && joiner.topology == models.TopologyMesh {
+		peers = r.meshPeers(joinerID)
+	}
+
+	plan := models.ConnectionPlan{Peers: make([]models.PlannedPeer, 0, len(peers))}
+	slow := make([]*userInfo, 0)
+	for i, userID := range peers {
+		delay := time.Duration(i) * pacing
+
+		plan.Peers = append(plan.Peers, models.PlannedPeer{
+			UserID:       userID,
+			OfferDelayMs: delay.Milliseconds(),
+		})
+
+		info := r.userInfos[userID]
+		accepted := r.offer(info, models.ChannelEntity{
+			ID:         r.lastEntityID.Add(1),
+			Time:       time.Now(),
+			ActionType: models.ExpectOffer,
+			UserID:     joinerID,
+			Data:       r.compact(map[string]any{"offerDelayMs": delay.Milliseconds()}),
+		})
+		if !accepted {
+			slow = append(slow, info)
+		}
+	}
+
+	// disconnected peers stay in the plan, the joiner learns they left from the user left entities
+	r.disconnect(slow)
+
+	return plan
+}
+
+// MarkDelivered records that entities were written to the user's subscriber
+func (r *Room) MarkDelivered(userID string, entities []models.ChannelEntity) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if info, ok := r.userInfos[userID]; ok {
+		info.history.markDelivered(entities)
+	}
+}
+
+// Replay returns entities already written to the user's previous subscription after the one with afterID.
+// Only entities still kept in the user's history can be replayed
+func (r *Room) Replay(userID string, afterID uint64) ([]models.ChannelEntity, error) {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
 
@@ -129,29 +709,86 @@ func (r *Room) GetUserEventsSlice(userID string) ([]models.ChannelEntity, error)
 		return nil, ErrUserNotInRoom
 	}
 
-	userCh := info.entities
+	return info.history.deliveredAfter(afterID), nil
+}
+
+// UserState describes membership of the user including entities that were enqueued but not delivered yet
+func (r *Room) UserState(userID string) (UserRoomState, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return UserRoomState{}, ErrUserNotInRoom
+	}
+
+	state := UserRoomState{
+		Room:                        r.name,
+		JoinTime:                    info.joinTime,
+		SecondsSinceLastInteraction: time.Since(info.lastActionTime).Seconds(),
+		Queued:                      info.entities.Len(),
+		QueueCapacity:               info.entities.Cap(),
+		Silent:                      info.silent,
+		Captions:                    info.captions,
+		Client:                      info.client,
+		Pending:                     info.history.pending(),
+	}
+	if !info.probeTime.IsZero() {
+		state.ProbedAt = &info.probeTime
+	}
 
-	entities := make([]models.ChannelEntity, 0, 2*len(userCh))
-	for len(userCh) > 0 {
-		entity, ok := <-userCh
-		if !ok {
-			break
-		}
+	return state, nil
+}
+
+// TouchUser updates user last action time, so the user is not considered inactive
+func (r *Room) TouchUser(userID string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
 
-		entities = append(entities, entity)
+	if info, ok := r.userInfos[userID]; ok {
+		info.lastActionTime = time.Now()
+		r.updatePresence(info, info.lastActionTime)
 	}
+}
+
+func (r *Room) GetUserEventsSlice(userID string) ([]models.ChannelEntity, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return nil, ErrUserNotInRoom
+	}
+
+	entities := info.entities.Take()
+	entities = r.takeMissed(userID, entities)
+	SortByPriority(entities)
 
 	info.lastActionTime = time.Now()
+	info.adopted.Store(false)
+	info.history.markDelivered(entities)
 
 	return entities, nil
 }
 
-func (r *Room) SendToUser(ctx context.Context, srcUserID, destUserID string, data map[string]any) error {
-	err := r.sendLimiter.Wait(ctx)
-	if err != nil {
-		r.log.Warn("send limiter cancelled", zap.String("reason", err.Error()))
-		return err
-	}
+// SendOptions tunes delivery of a single message
+type SendOptions struct {
+	// EchoToSender makes sender receive a copy of the message too
+	EchoToSender bool
+	// Priority overrides the priority of the message type
+	Priority models.Priority
+	// MessageID makes the room send delivered receipt to the sender
+	MessageID string
+	// ActionType of typed signals, message when empty
+	ActionType models.ActionType
+}
+
+// SendToUser delivers message to destination user
+func (r *Room) SendToUser(
+	ctx context.Context, srcUserID, destUserID string, data map[string]any, opts SendOptions,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "Room.SendToUser", tracing.Room(r.name), attribute.String("destination", destUserID))
+	defer func() { tracing.End(span, err) }()
 
 	r.mux.RLock()
 	defer r.mux.RUnlock()
@@ -161,28 +798,249 @@ func (r *Room) SendToUser(ctx context.Context, srcUserID, destUserID string, dat
 		return ErrUserNotInRoom
 	}
 
+	msg, err := r.prepareSend(destUserID, data, opts)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("message type", msg.entity.MessageType))
+
+	if msg.limited {
+		err = r.allowSend(srcUserID, srcInfo, 1)
+		if err != nil {
+			return err
+		}
+	}
+
 	srcInfo.lastActionTime = time.Now()
 
-	destInfo, ok := r.userInfos[destUserID]
+	return r.send(ctx, srcInfo, msg)
+}
+
+// outgoing is a message of a member that passed room policy, ready to be delivered
+type outgoing struct {
+	destUserID string
+	data       map[string]any
+	opts       SendOptions
+	// entity gets its ID on delivery
+	entity models.ChannelEntity
+	// limited messages are charged to the send rate limit of the sender
+	limited bool
+}
+
+// prepareSend checks message against room policy and resolves its type. Must be called under lock
+func (r *Room) prepareSend(destUserID string, data map[string]any, opts SendOptions) (outgoing, error) {
+	encoded, err := compactData(data)
+	if err != nil {
+		return outgoing{}, err
+	}
+
+	err = r.checkPolicy(data, encoded)
+	if err != nil {
+		return outgoing{}, err
+	}
+
+	if _, ok := r.userInfos[destUserID]; !ok && r.bus == nil {
+		return outgoing{}, ErrUserNotInRoom
+	}
+
+	messageTypeName := r.messageType(data)
+	messageType := r.opts.MessageTypes.Resolve(messageTypeName)
+
+	entity := models.ChannelEntity{
+		ActionType:  opts.ActionType,
+		Data:        encoded,
+		MessageType: messageTypeName,
+		Priority:    opts.Priority,
+		MessageID:   opts.MessageID,
+	}
+	if entity.ActionType == "" {
+		entity.ActionType = models.Message
+	}
+	if entity.Priority == "" {
+		entity.Priority = messageType.Priority
+	}
+
+	return outgoing{
+		destUserID: destUserID,
+		data:       data,
+		opts:       opts,
+		entity:     entity,
+		limited:    messageType.Rate != msgtype.RateExempt,
+	}, nil
+}
+
+// send hands prepared message to the dispatcher of the room, if it has one, otherwise delivers it right away.
+// Dispatched messages are accepted before they are delivered, their failures reach the sender as receipts.
+// Must be called under lock
+func (r *Room) send(ctx context.Context, srcInfo *userInfo, msg outgoing) error {
+	if r.dispatcher != nil {
+		return r.dispatch(ctx, srcInfo, msg)
+	}
+
+	return r.deliver(ctx, srcInfo, msg)
+}
+
+// deliver queues prepared message to its destination, or forwards it to the instance of a destination
+// not in this room. Must be called under lock
+func (r *Room) deliver(ctx context.Context, srcInfo *userInfo, msg outgoing) error {
+	entity := msg.entity
+	entity.ID = r.lastEntityID.Add(1)
+	entity.Time = time.Now()
+	entity.UserID = srcInfo.id
+
+	// destination may have left since the message was prepared
+	destInfo, ok := r.userInfos[msg.destUserID]
+	if !ok && r.bus == nil {
+		return ErrUserNotInRoom
+	}
+	if destInfo == nil {
+		return r.forward(ctx, srcInfo, msg.destUserID, entity, msg.opts)
+	}
+
+	if destInfo.adopted.Load() {
+		r.forwardCopy(ctx, destInfo.id, entity)
+	}
+
+	undoNegotiation, err := r.negotiations.apply(srcInfo.id, destInfo.id, entity.ActionType)
+	if err != nil {
+		return err
+	}
+
+	// message that does not fit into the queue waits in the inbox, delivered receipt is sent only for queued ones
+	queued := true
+	err = r.enqueue(ctx, destInfo, entity)
+	if errors.Is(err, ErrDestBusy) && r.storeMissed(destInfo.id, entity) {
+		queued, err = false, nil
+	}
+	if err != nil {
+		undoNegotiation()
+		r.deadLetters.Record(r.name, msg.destUserID, entity, err.Error())
+		return err
+	}
+
+	if msg.opts.MessageID != "" && queued {
+		r.sendReceipt(ctx, srcInfo, destInfo, models.Delivered, msg.opts.MessageID)
+	}
+
+	r.logEvent(entity, destInfo.id)
+	r.recordChat(entity, destInfo.id, msg.data)
+	r.lintSDP(srcInfo, destInfo, entity.MessageType, msg.data)
+
+	if msg.opts.EchoToSender && srcInfo.id != destInfo.id {
+		entity.DestinationUserID = destInfo.id
+
+		err = r.enqueue(ctx, srcInfo, entity)
+		if err != nil {
+			r.log.Warn("message is not echoed to sender", zap.String("user", srcInfo.id), zap.Error(err))
+		}
+	}
+
+	r.metrics.PeerMessages.WithLabelValues(r.name, r.opts.MessageTypes.Label(entity.MessageType)).Inc()
+
+	if entity.MessageType == models.MessageTypeAnswer {
+		r.metrics.WebRTCConnectionCreationTime.
+			WithLabelValues(r.name, srcInfo.variantLabel).
+			Observe(time.Since(srcInfo.joinTime).Seconds())
+	}
+
+	return nil
+}
+
+// Ack tells the sender that reader has read the message with messageID
+func (r *Room) Ack(ctx context.Context, readerID, senderID, messageID string) error {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	readerInfo, ok := r.userInfos[readerID]
 	if !ok {
 		return ErrUserNotInRoom
 	}
 
-	destInfo.entities <- models.ChannelEntity{
+	senderInfo, ok := r.userInfos[senderID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	readerInfo.lastActionTime = time.Now()
+
+	r.sendReceipt(ctx, senderInfo, readerInfo, models.Read, messageID)
+
+	return nil
+}
+
+// sendReceipt enqueues receipt about the message of sender to its recipient. Receipts are best effort,
+// failing to enqueue one must not fail the message itself
+func (r *Room) sendReceipt(
+	ctx context.Context, senderInfo, recipientInfo *userInfo, actionType models.ActionType, messageID string,
+) {
+	receipt := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
 		Time:       time.Now(),
-		ActionType: models.Message,
-		UserID:     srcUserID,
-		Data:       data,
+		ActionType: actionType,
+		UserID:     recipientInfo.id,
+		MessageID:  messageID,
+	}
+
+	err := r.enqueue(ctx, senderInfo, receipt)
+	if err != nil {
+		r.log.Warn("receipt is not sent",
+			zap.String("user", senderInfo.id), zap.String("actionType", string(actionType)), zap.Error(err),
+		)
 	}
+}
+
+// RateLimitError rejects message of the user who exceeded the send rate
+type RateLimitError struct {
+	// RetryAfter is the time until the next message is allowed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
 
-	if data["messageType"] == "answer" {
-		r.metrics.WebRTCConnectionCreationTime.WithLabelValues(r.name).Observe(time.Since(srcInfo.joinTime).Seconds())
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// allowSend takes n tokens from the sender's bucket, one per message. Messages above the limit are rejected
+// instead of waiting, so the client learns when to retry. Sustained rejections of the same user are logged
+func (r *Room) allowSend(srcUserID string, info *userInfo, n int) error {
+	now := time.Now()
+	reservation := info.sendLimiter.ReserveN(now, n)
+	if !reservation.OK() {
+		return ErrBatchOverBurst
+	}
+	delay := reservation.DelayFrom(now)
+
+	outcome := limiterOutcomeAllowed
+	if delay > 0 {
+		reservation.CancelAt(now)
+		outcome = limiterOutcomeRejected
+	}
+
+	r.metrics.RateLimiterRequests.WithLabelValues(r.name, outcome).Add(float64(n))
+
+	saturatedFor, warn := info.limiterStats.observe(outcome, time.Now())
+	if warn {
+		stats := info.limiterStats.snapshot()
+		r.log.Warn("user keeps exceeding send rate limit",
+			zap.String("userID", srcUserID),
+			zap.Duration("saturatedFor", saturatedFor),
+			zap.Uint64("allowed", stats.Allowed),
+			zap.Uint64("rejected", stats.Rejected),
+		)
+	}
+
+	if outcome == limiterOutcomeRejected {
+		return &RateLimitError{RetryAfter: delay}
 	}
 
 	return nil
 }
 
-func (r *Room) RemoveDisconnected() {
+// RemoveDisconnected evicts users with overflown queues and users who ignored the probe, returns the number of evicted
+func (r *Room) RemoveDisconnected() int {
 	r.log.Info("clearing room")
 
 	r.mux.Lock()
@@ -190,25 +1048,93 @@ func (r *Room) RemoveDisconnected() {
 
 	toDelete := make([]string, 0)
 	for userID, info := range r.userInfos {
-		if len(info.entities) > msgCountThreshold || time.Since(info.lastActionTime) > maxInactivityDuration {
+		if info.entities.Len() > r.opts.MaxQueuedEntities || r.probeInactive(userID, info) {
 			toDelete = append(toDelete, userID)
 		}
 	}
 
 	for _, userID := range toDelete {
-		info := r.userInfos[userID]
-		delete(r.userInfos, userID)
-		close(info.entities)
+		r.removeUser(userID, "user evicted")
+	}
 
-		r.publish(models.ChannelEntity{
-			Time:       time.Now(),
-			ActionType: models.UserLeft,
-			UserID:     userID,
-			Data:       nil,
-		})
+	// users who stopped sending heartbeats are shown as away long before eviction
+	now := time.Now()
+	for _, info := range r.userInfos {
+		r.updatePresence(info, now)
 	}
 
 	r.log.Info("cleared room", zap.Int("cleared number", len(toDelete)), zap.Any("deleted", toDelete))
+
+	return len(toDelete)
+}
+
+// probeInactive reports whether inactive user ignored the probe for the whole grace period.
+// Inactive users that were not probed yet receive a probe entity first
+func (r *Room) probeInactive(userID string, info *userInfo) bool {
+	if time.Since(info.lastActionTime) <= r.opts.InactivityTimeout {
+		info.probeTime = time.Time{}
+		return false
+	}
+
+	if info.probeTime.IsZero() {
+		info.probeTime = time.Now()
+
+		probe := models.ChannelEntity{
+			ID:         r.lastEntityID.Add(1),
+			Time:       info.probeTime,
+			ActionType: models.Probe,
+		}
+
+		if info.entities.push(probe) {
+			info.history.record(probe)
+		}
+
+		r.log.Debug("inactive user probed", zap.String("user", userID))
+
+		return false
+	}
+
+	return time.Since(info.probeTime) > r.opts.ProbeGracePeriod
+}
+
+// Members returns up to limit user IDs following after in lexicographical order and total number of users
+func (r *Room) Members(after string, limit int) (members []string, total int) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	all := make([]string, 0, len(r.userInfos))
+	for userID := range r.userInfos {
+		if userID > after {
+			all = append(all, userID)
+		}
+	}
+
+	sort.Strings(all)
+	if len(all) > limit {
+		all = all[:limit]
+	}
+
+	return all, len(r.userInfos)
+}
+
+func (r *Room) HasUser(userID string) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	_, ok := r.userInfos[userID]
+	return ok
+}
+
+func (r *Room) UserCount() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return len(r.userInfos)
+}
+
+// LastEntityID is the ID of the latest entity created in the room
+func (r *Room) LastEntityID() uint64 {
+	return r.lastEntityID.Load()
 }
 
 func (r *Room) IsEmpty() bool {
@@ -224,18 +1150,216 @@ func (r *Room) GetState() []UserInfo {
 		infos = append(infos, UserInfo{
 			UserID:                      userID,
 			SecondsSinceLastInteraction: time.Since(user.lastActionTime).Seconds(),
+			Client:                      user.client,
+			RateLimit:                   user.rateLimitStats(),
+			EntryAnswers:                user.answers,
+			Moderator:                   user.moderator,
 		})
 	}
 
 	return infos
 }
 
-func (r *Room) Dispose() {
+// Broadcast publishes entity on behalf of the sender to every other user in the room
+func (r *Room) Broadcast(senderID string, actionType models.ActionType, data map[string]any) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
+	r.publish(models.ChannelEntity{
+		Time:        time.Now(),
+		ActionType:  actionType,
+		UserID:      senderID,
+		Data:        r.compact(data),
+		MessageType: r.messageType(data),
+	})
+}
+
+// RecordConnectionFailure counts failed peer connection reported by a member of the room
+func (r *Room) RecordConnectionFailure(stage models.FailureStage) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.connectionFailures[stage]++
+	r.metrics.WebRTCConnectionFailures.WithLabelValues(r.name, string(stage)).Inc()
+}
+
+func (r *Room) ConnectionFailures() map[models.FailureStage]int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	out := make(map[models.FailureStage]int, len(r.connectionFailures))
+	for stage, count := range r.connectionFailures {
+		out[stage] = count
+	}
+
+	return out
+}
+
+// SetPolicy replaces room policy. Disabling chat history drops the indexed messages
+func (r *Room) SetPolicy(policy models.RoomPolicy) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.policy = policy
+
+	switch {
+	case policy.ChatHistory && r.chatHistory == nil:
+		r.chatHistory = newChatHistory(r.opts.ChatHistoryCapacity)
+	case !policy.ChatHistory:
+		r.chatHistory = nil
+	}
+}
+
+func (r *Room) Policy() models.RoomPolicy {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.policy
+}
+
+// E2EERequired reports whether members must encrypt messages, by the room policy or for the whole tenant
+func (r *Room) E2EERequired() bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.e2eeRequired()
+}
+
+// e2eeRequired must be called under lock
+func (r *Room) e2eeRequired() bool {
+	return r.policy.E2EERequired || r.opts.E2EERequired
+}
+
+// checkPolicy validates message against room policy. Must be called under lock
+func (r *Room) checkPolicy(data map[string]any, encoded json.RawMessage) error {
+	if len(r.policy.AllowedMessageTypes) > 0 {
+		messageType, _ := data["messageType"].(string)
+		if !slices.Contains(r.policy.AllowedMessageTypes, messageType) {
+			return fmt.Errorf("%w: message type %q is not allowed", ErrPolicyViolation, messageType)
+		}
+	}
+
+	if r.policy.MaxDataSize > 0 {
+		if len(encoded) > r.policy.MaxDataSize {
+			return fmt.Errorf("%w: message size %d exceeds %d bytes", ErrPolicyViolation, len(encoded), r.policy.MaxDataSize)
+		}
+	}
+
+	if r.e2eeRequired() {
+		messageType := r.messageType(data)
+		encrypted, _ := data[models.EncryptedField].(bool)
+		if !encrypted && !r.opts.MessageTypes.Resolve(messageType).Plaintext {
+			return fmt.Errorf("%w: message of type %q must be end-to-end encrypted", ErrPolicyViolation, messageType)
+		}
+	}
+
+	return nil
+}
+
+func (r *Room) SetCaptionsEnabled(enabled bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.captionsEnabled = enabled
+}
+
+func (r *Room) SetLocale(locale models.Locale) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.locale = locale
+}
+
+func (r *Room) Locale() models.Locale {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.locale
+}
+
+// PublishCaption delivers caption segment to users who opted in to captions
+func (r *Room) PublishCaption(senderID string, data map[string]any) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.captionsEnabled {
+		return ErrCaptionsDisabled
+	}
+
+	encoded, err := compactData(data)
+	if err != nil {
+		return err
+	}
+
+	r.publishFiltered(models.ChannelEntity{
+		Time:       time.Now(),
+		ActionType: models.Caption,
+		UserID:     senderID,
+		Data:       encoded,
+	}, func(info *userInfo) bool {
+		return info.captions
+	})
+
+	return nil
+}
+
+// Dispose publishes the farewell entity (e.g. room deleted or reconnect) to every user and closes their queues.
+// Entities left in the queues are not dead-lettered, subscribers flush them before their streams end
+func (r *Room) Dispose(actionType models.ActionType, data map[string]any) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.publish(models.ChannelEntity{
+		Time:       time.Now(),
+		ActionType: actionType,
+		Data:       r.compact(data),
+	})
+
 	for userID, info := range r.userInfos {
-		close(info.entities)
+		info.entities.closeQueue(false)
 		delete(r.userInfos, userID)
 	}
 }
+
+// DisposeEach is Dispose with farewell data of its own for every session, e.g. reconnect carrying the resume token
+// of the session. Users polling without a stream get the farewell of their only session, or of "" if they have several
+func (r *Room) DisposeEach(actionType models.ActionType, data func(userID, session string) map[string]any) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.disposeEach(actionType, data)
+}
+
+// disposeEach must be called under write lock
+func (r *Room) disposeEach(actionType models.ActionType, data func(userID, session string) map[string]any) {
+	entity := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
+		Time:       time.Now(),
+		ActionType: actionType,
+	}
+	r.logEvent(entity, "")
+	r.metrics.EventsPublished.WithLabelValues(r.name, string(actionType)).Inc()
+
+	for userID, info := range r.userInfos {
+		pollingSession := ""
+		if len(info.sessions) == 1 {
+			for session := range info.sessions {
+				pollingSession = session
+			}
+		}
+
+		info.entities.closeWithFarewells(func(session string) models.ChannelEntity {
+			farewell := entity
+			farewell.Data = r.compact(data(userID, session))
+			return farewell
+		}, pollingSession)
+		delete(r.userInfos, userID)
+	}
+}
+
+// SortByPriority orders batch of entities by priority keeping original order within the same priority
+func SortByPriority(entities []models.ChannelEntity) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Priority.Rank() > entities[j].Priority.Rank()
+	})
+}
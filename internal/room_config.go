@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRoomConfigNotFound  = errors.New("room config not found")
+	ErrRoomConfigsDisabled = errors.New("room config store is not configured")
+	ErrRoomFull            = errors.New("room is full")
+)
+
+// roomConfigTimeout bounds lookups of room configs made on behalf of callers without context
+const roomConfigTimeout = 2 * time.Second
+
+// RoomConfig defines a pre-created room. The room is brought back from its config whenever it is not in memory,
+// e.g. after restart or after the cleaner removed it empty
+type RoomConfig struct {
+	Name string `json:"name"`
+	// Capacity limits the number of members, 0 means no limit. Service accounts are not counted
+	Capacity int `json:"capacity"`
+	// PasswordHash is the bcrypt hash of the room password, nil for rooms without password
+	PasswordHash []byte `json:"-"`
+	// Owner becomes a moderator of the room on join
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RoomConfigRepository persists configs of pre-created rooms. Implementations must be safe for concurrent use
+type RoomConfigRepository interface {
+	// Get returns config of the room or ErrRoomConfigNotFound
+	Get(ctx context.Context, name string) (RoomConfig, error)
+	// Save creates or replaces config of the room. CreatedAt of the replaced config is kept, the saved one is returned
+	Save(ctx context.Context, cfg RoomConfig) (RoomConfig, error)
+	// Delete removes config of the room or returns ErrRoomConfigNotFound
+	Delete(ctx context.Context, name string) error
+}
+
+// applyConfig protects the room, limits its members and names its owner
+func (r *Room) applyConfig(cfg RoomConfig) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.passwordHash = cfg.PasswordHash
+	r.capacity = cfg.Capacity
+	r.owner = cfg.Owner
+}
+
+// ClaimOwner makes the user the owner of the room unless it already has one, e.g. named by its config.
+// The user creating the room by joining it claims it, so the room can be managed and deleted by someone
+func (r *Room) ClaimOwner(userID string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.owner == "" {
+		r.owner = userID
+	}
+}
+
+// findConfig looks up config of the room that is not in memory. ok is false for rooms without config
+func (repo *RoomRepository) findConfig(ctx context.Context, roomName string) (cfg RoomConfig, ok bool, err error) {
+	if repo.configs == nil {
+		return RoomConfig{}, false, nil
+	}
+
+	cfg, err = repo.configs.Get(ctx, roomName)
+	if errors.Is(err, ErrRoomConfigNotFound) {
+		return RoomConfig{}, false, nil
+	}
+	if err != nil {
+		return RoomConfig{}, false, fmt.Errorf("load config of room %q: %w", roomName, err)
+	}
+
+	return cfg, true, nil
+}
+
+// loadConfigured brings back the pre-created room from its config, ErrRoomNotExist is returned for other rooms
+func (repo *RoomRepository) loadConfigured(roomName string) (*Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), roomConfigTimeout)
+	defer cancel()
+
+	cfg, ok, err := repo.findConfig(ctx, roomName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRoomNotExist
+	}
+
+	repo.mut.Lock()
+	defer repo.mut.Unlock()
+
+	// the room may have been created while its config was loaded
+	if room, ok := repo.rooms[roomName]; ok {
+		return room, nil
+	}
+
+	room := repo.newRoom(roomName)
+	room.applyConfig(cfg)
+	repo.rooms[roomName] = room
+
+	return room, nil
+}
+
+// RoomConfig returns config of the pre-created room
+func (repo *RoomRepository) RoomConfig(ctx context.Context, roomName string) (RoomConfig, error) {
+	if repo.configs == nil {
+		return RoomConfig{}, ErrRoomConfigsDisabled
+	}
+
+	return repo.configs.Get(ctx, roomName)
+}
+
+// SaveRoomConfig persists config of the room and applies it to the room if it is in memory already
+func (repo *RoomRepository) SaveRoomConfig(ctx context.Context, cfg RoomConfig) (RoomConfig, error) {
+	if repo.configs == nil {
+		return RoomConfig{}, ErrRoomConfigsDisabled
+	}
+
+	cfg, err := repo.configs.Save(ctx, cfg)
+	if err != nil {
+		return RoomConfig{}, err
+	}
+
+	if room, err := repo.getLoaded(cfg.Name); err == nil {
+		room.applyConfig(cfg)
+	}
+
+	return cfg, nil
+}
+
+// DeleteRoomConfig forgets config of the room. The room in memory is left as is, it is not brought back
+// once removed
+func (repo *RoomRepository) DeleteRoomConfig(ctx context.Context, roomName string) error {
+	if repo.configs == nil {
+		return ErrRoomConfigsDisabled
+	}
+
+	return repo.configs.Delete(ctx, roomName)
+}
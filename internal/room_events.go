@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrNotModerator = errors.New("only moderators and the owner of the room may do it")
+
+const (
+	// reasonUserKicked is the dead letter reason of entities the kicked user did not take
+	reasonUserKicked = "user kicked"
+	// reasonExpired is told to members of the room closing on its expiry
+	reasonExpired = "room expired"
+)
+
+// AnnounceCreated tells the user that its join has created the room. Like other advisories it is not worth
+// waiting for, so it is dropped when the queue is full
+func (r *Room) AnnounceCreated(userID string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return
+	}
+
+	created := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
+		Time:       time.Now(),
+		ActionType: models.RoomCreated,
+		UserID:     userID,
+		Data:       r.compact(map[string]any{"roomName": r.name}),
+	}
+	if !info.entities.push(created) {
+		r.deadLetters.Record(r.name, userID, created, ErrDestBusy.Error())
+		return
+	}
+
+	info.history.record(created)
+}
+
+// AnnounceClosing warns members that the room is going to be deleted at closesAt
+func (r *Room) AnnounceClosing(reason string, closesAt time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.announceClosing(reason, closesAt)
+}
+
+// announceClosing must be called under lock
+func (r *Room) announceClosing(reason string, closesAt time.Time) {
+	r.publish(models.ChannelEntity{
+		Time:       time.Now(),
+		ActionType: models.RoomClosing,
+		Data:       r.compact(map[string]any{"reason": reason, "closesAt": closesAt}),
+		Priority:   models.PriorityHigh,
+	})
+}
+
+// KickUser removes the user telling others who was kicked and why. The kicked user gets the reason as the last
+// entity of its stream, entities it has not taken yet are dead-lettered
+func (r *Room) KickUser(userID, reason string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+
+	data := r.compact(map[string]any{"reason": reason})
+	if !info.silent {
+		r.publish(models.ChannelEntity{
+			Time:       time.Now(),
+			ActionType: models.UserKicked,
+			UserID:     userID,
+			Data:       data,
+		})
+	}
+
+	farewell := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
+		Time:       time.Now(),
+		ActionType: models.UserKicked,
+		UserID:     userID,
+		Data:       data,
+	}
+	for _, entity := range info.entities.closeWithFarewell(farewell) {
+		r.deadLetters.Record(r.name, userID, entity, reasonUserKicked)
+	}
+
+	// the queue is closed already, so removal only forgets the user and tells others it has left
+	r.removeUser(userID, reasonUserKicked)
+
+	return nil
+}
+
+// GrantModerator makes the member a moderator of the room. Everyone including the member is told about it,
+// granting it twice publishes nothing
+func (r *Room) GrantModerator(userID string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return ErrUserNotInRoom
+	}
+	if info.moderator {
+		return nil
+	}
+
+	info.moderator = true
+	r.publish(models.ChannelEntity{
+		Time:       time.Now(),
+		ActionType: models.ModeratorGranted,
+		Data:       r.compact(map[string]any{"userID": userID}),
+	})
+
+	return nil
+}
+
+// CanManage reports whether the user may manage the room: the owner always may, other users only while
+// they are moderators in the room
+func (r *Room) CanManage(userID string) bool {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.owner != "" && userID == r.owner {
+		return true
+	}
+
+	info, ok := r.userInfos[userID]
+	return ok && info.moderator
+}
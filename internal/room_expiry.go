@@ -0,0 +1,57 @@
+package internal
+
+import "time"
+
+// ExpiringRoom is a room whose closing has just been announced
+type ExpiringRoom struct {
+	Name     string
+	Room     *Room
+	ClosesAt time.Time
+}
+
+// Expire schedules closing of the room at the given time, zero time keeps the room until it is abandoned
+func (r *Room) Expire(at time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.expiresAt = at
+	r.closingAnnounced = false
+}
+
+// ExpiresAt returns when the room is closed, zero if it has no expiry
+func (r *Room) ExpiresAt() time.Time {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.expiresAt
+}
+
+// announceExpiry warns members once that the room expires, if it does before the given time
+func (r *Room) announceExpiry(before time.Time) (closesAt time.Time, ok bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.expiresAt.IsZero() || r.closingAnnounced || r.expiresAt.After(before) {
+		return time.Time{}, false
+	}
+	r.closingAnnounced = true
+	r.announceClosing(reasonExpired, r.expiresAt)
+
+	return r.expiresAt, true
+}
+
+// AnnounceExpiring warns members of rooms expiring before the given time that they are going to be closed.
+// Every room is announced once, the caller closes the returned rooms when they expire
+func (repo *RoomRepository) AnnounceExpiring(before time.Time) []ExpiringRoom {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	var expiring []ExpiringRoom
+	for roomName, room := range repo.rooms {
+		if closesAt, ok := room.announceExpiry(before); ok {
+			expiring = append(expiring, ExpiringRoom{Name: roomName, Room: room, ClosesAt: closesAt})
+		}
+	}
+
+	return expiring
+}
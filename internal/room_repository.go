@@ -1,12 +1,20 @@
 package internal
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
+	"peer-messenger/internal/bus"
 	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/tracing"
 )
 
 var (
@@ -19,33 +27,71 @@ type RoomRepository struct {
 	mut     *sync.RWMutex
 	log     *zap.Logger
 	metrics *metrics.Metrics
+	opts    RoomOptions
+	// deadLetters is nil when dead-letter capture is disabled
+	deadLetters *DeadLetters
+	// inbox is nil when missed messages are not kept
+	inbox MessageStore
+	// bus is nil on a single instance
+	bus bus.Bus
+	// configs is nil when rooms are not pre-created
+	configs RoomConfigRepository
 }
 
-func NewRoomRepository(log *zap.Logger, metrics *metrics.Metrics) *RoomRepository {
+func NewRoomRepository(
+	log *zap.Logger,
+	metrics *metrics.Metrics,
+	opts RoomOptions,
+	deadLetters *DeadLetters,
+	inbox MessageStore,
+	bus bus.Bus,
+	configs RoomConfigRepository,
+) *RoomRepository {
 	return &RoomRepository{
 		rooms:   make(map[string]*Room),
 		mut:     &sync.RWMutex{},
 		log:     log,
 		metrics: metrics,
+		opts:    opts,
+
+		deadLetters: deadLetters,
+		inbox:       inbox,
+		bus:         bus,
+		configs:     configs,
 	}
 }
 
+// CleanResult describes a single Clean pass
+type CleanResult struct {
+	Rooms        int `json:"rooms"`
+	EvictedUsers int `json:"evictedUsers"`
+	RemovedRooms int `json:"removedRooms"`
+}
+
 // Clean is a blocking call that makes each room drop disconnected users then removes all empty rooms
-func (repo *RoomRepository) Clean() {
+func (repo *RoomRepository) Clean(ctx context.Context) CleanResult {
+	_, span := tracing.Start(ctx, "RoomRepository.Clean")
+	defer span.End()
+
 	repo.mut.Lock()
 	defer repo.mut.Unlock()
 
+	result := CleanResult{Rooms: len(repo.rooms)}
+
+	now := time.Now()
 	toRemove := make([]string, 0)
 	for roomID, room := range repo.rooms {
-		room.RemoveDisconnected()
+		result.EvictedUsers += room.RemoveDisconnected()
 
-		if room.IsEmpty() {
+		if room.Abandoned(now) {
 			toRemove = append(toRemove, roomID)
 		}
 	}
 
 	for _, roomID := range toRemove {
 		delete(repo.rooms, roomID)
+		repo.metrics.DeleteRoom(roomID)
+		repo.dropInbox(roomID)
 	}
 
 	if len(toRemove) > 0 {
@@ -55,9 +101,28 @@ func (repo *RoomRepository) Clean() {
 			zap.Any("removed", toRemove),
 		)
 	}
+
+	result.RemovedRooms = len(toRemove)
+	span.SetAttributes(
+		attribute.Int("rooms", result.Rooms),
+		attribute.Int("evicted users", result.EvictedUsers),
+		attribute.Int("removed rooms", result.RemovedRooms),
+	)
+
+	return result
 }
 
+// Get returns the room in memory, pre-created rooms that are not are brought back from their configs
 func (repo *RoomRepository) Get(roomName string) (*Room, error) {
+	room, err := repo.getLoaded(roomName)
+	if errors.Is(err, ErrRoomNotExist) {
+		return repo.loadConfigured(roomName)
+	}
+
+	return room, err
+}
+
+func (repo *RoomRepository) getLoaded(roomName string) (*Room, error) {
 	repo.mut.RLock()
 	defer repo.mut.RUnlock()
 
@@ -77,7 +142,16 @@ func (repo *RoomRepository) Exist(roomName string) bool {
 	return ok
 }
 
-func (repo *RoomRepository) AddRoom(roomName string) (*Room, error) {
+func (repo *RoomRepository) AddRoom(ctx context.Context, roomName string) (_ *Room, err error) {
+	ctx, span := tracing.Start(ctx, "RoomRepository.AddRoom", tracing.Room(roomName))
+	defer func() { tracing.End(span, err) }()
+
+	// pre-created room is created as configured
+	cfg, configured, err := repo.findConfig(ctx, roomName)
+	if err != nil {
+		return nil, err
+	}
+
 	repo.mut.Lock()
 	defer repo.mut.Unlock()
 
@@ -85,14 +159,25 @@ func (repo *RoomRepository) AddRoom(roomName string) (*Room, error) {
 		return nil, ErrRoomAlreadyExist
 	}
 
-	roomLog := repo.log.With(zap.String("room name", roomName))
-	room := NewRoom(roomName, roomLog, repo.metrics)
+	room := repo.newRoom(roomName)
+	if configured {
+		room.applyConfig(cfg)
+	}
 	repo.rooms[roomName] = room
 
 	return room, nil
 }
 
-func (repo *RoomRepository) RemoveRoom(roomName string) {
+func (repo *RoomRepository) newRoom(roomName string) *Room {
+	roomLog := repo.log.With(zap.String("room name", roomName))
+	return NewRoom(roomName, roomLog, repo.metrics, repo.opts, repo.deadLetters, repo.inbox, repo.bus)
+}
+
+// RemoveRoom deletes the room telling its users why it was deleted
+func (repo *RoomRepository) RemoveRoom(ctx context.Context, roomName, reason string) {
+	_, span := tracing.Start(ctx, "RoomRepository.RemoveRoom", tracing.Room(roomName))
+	defer span.End()
+
 	repo.mut.Lock()
 	defer repo.mut.Unlock()
 
@@ -101,19 +186,183 @@ func (repo *RoomRepository) RemoveRoom(roomName string) {
 		return
 	}
 
-	room.Dispose()
-	delete(repo.rooms, roomName)
+	repo.removeRoom(room, reason)
+}
+
+// RemoveRoomInstance deletes the room unless it has been replaced meanwhile, e.g. deleted and created again
+// by a join while its delayed removal was pending. Reports whether the room was removed
+func (repo *RoomRepository) RemoveRoomInstance(ctx context.Context, room *Room, reason string) bool {
+	_, span := tracing.Start(ctx, "RoomRepository.RemoveRoomInstance", tracing.Room(room.name))
+	defer span.End()
+
+	repo.mut.Lock()
+	defer repo.mut.Unlock()
+
+	if repo.rooms[room.name] != room {
+		return false
+	}
+
+	repo.removeRoom(room, reason)
+
+	return true
+}
+
+// removeRoom must be called under write lock
+func (repo *RoomRepository) removeRoom(room *Room, reason string) {
+	room.Dispose(models.RoomDeleted, map[string]any{"reason": reason})
+	delete(repo.rooms, room.name)
+	repo.metrics.DeleteRoom(room.name)
+	repo.dropInbox(room.name)
+}
+
+// dropInbox forgets missed messages of the removed room. Drained rooms keep them,
+// a shared store replays them after users reconnect to another instance
+func (repo *RoomRepository) dropInbox(roomName string) {
+	if repo.inbox == nil {
+		return
+	}
+
+	err := repo.inbox.Drop(roomName, "")
+	if err != nil {
+		repo.log.Error("failed to drop missed messages of room", zap.String("room", roomName), zap.Error(err))
+	}
+}
+
+// RemoveUser removes the user from every room it is in and returns names of these rooms
+func (repo *RoomRepository) RemoveUser(ctx context.Context, userID string) []string {
+	_, span := tracing.Start(ctx, "RoomRepository.RemoveUser", tracing.User(userID))
+	defer span.End()
+
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	left := make([]string, 0)
+	for roomName, room := range repo.rooms {
+		if room.RemoveUser(userID) == nil {
+			left = append(left, roomName)
+		}
+	}
+
+	sort.Strings(left)
+
+	return left
+}
+
+// LeaveSession detaches the session of the user from every room and returns names of the rooms
+// the user left with it
+func (repo *RoomRepository) LeaveSession(ctx context.Context, userID, session string) []string {
+	_, span := tracing.Start(ctx, "RoomRepository.LeaveSession", tracing.User(userID))
+	defer span.End()
+
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	left := make([]string, 0)
+	for roomName, room := range repo.rooms {
+		if ok, _ := room.LeaveSession(userID, session); ok {
+			left = append(left, roomName)
+		}
+	}
+
+	sort.Strings(left)
+
+	return left
+}
+
+// Drain asks all users to reconnect and removes all rooms. Used on instance shutdown. Farewell data of every
+// session is built by farewell, e.g. with the resume token of the session.
+// With the bus every room is handed over to other instances before users are told to reconnect, so its members,
+// settings and queued entities are there when users resume their streams. Rooms that fail to be handed over
+// are only disposed, their users have to join again
+func (repo *RoomRepository) Drain(
+	ctx context.Context, reason string, farewell func(roomName, userID, session string) map[string]any,
+) {
+	repo.mut.Lock()
+	defer repo.mut.Unlock()
+
+	for roomName, room := range repo.rooms {
+		data := func(userID, session string) map[string]any {
+			return farewell(roomName, userID, session)
+		}
+
+		if repo.bus == nil {
+			room.DisposeEach(models.Reconnect, data)
+		} else {
+			err := room.HandOffEach(models.Reconnect, data, func(handoff bus.Handoff) error {
+				return repo.bus.HandOff(ctx, handoff)
+			})
+			if err != nil {
+				repo.log.Error("room is not handed over", zap.String("room", roomName), zap.Error(err))
+			}
+		}
+		delete(repo.rooms, roomName)
+		repo.metrics.DeleteRoom(roomName)
+	}
+
+	repo.log.Info("all rooms drained", zap.String("reason", reason))
+}
+
+func (repo *RoomRepository) DeadLetters(roomName, recipientID string) []DeadLetter {
+	return repo.deadLetters.List(roomName, recipientID)
 }
 
 type RoomInfo struct {
-	Name       string
-	TotalUsers int
-	UsersInfo  []UserInfo
+	Name       string     `json:"name"`
+	TotalUsers int        `json:"totalUsers"`
+	UsersInfo  []UserInfo `json:"usersInfo"`
+	// ConnectionFailures counts client-reported failed peer connections by failure stage
+	ConnectionFailures map[models.FailureStage]int `json:"connectionFailures"`
+	PasswordProtected  bool                        `json:"passwordProtected"`
+	Locale             models.Locale               `json:"locale"`
+	EntryForm          *models.EntryForm           `json:"entryForm,omitempty"`
+	// ExpiresAt is when the room is closed even if it is not empty, nil for rooms without expiry
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
 
 type UserInfo struct {
-	UserID                      string
-	SecondsSinceLastInteraction float64
+	UserID                      string            `json:"userID"`
+	SecondsSinceLastInteraction float64           `json:"secondsSinceLastInteraction"`
+	Client                      models.ClientInfo `json:"client"`
+	// RateLimit shows how the send rate limit affected messages of the user
+	RateLimit LimiterStats `json:"rateLimit"`
+	// EntryAnswers are the answers to the entry form of the room given on join
+	EntryAnswers map[string]any `json:"entryAnswers,omitempty"`
+	Moderator    bool           `json:"moderator,omitempty"`
+}
+
+// UserRoomState is the view of one user's membership used to debug delivery problems
+type UserRoomState struct {
+	Room                        string            `json:"room"`
+	JoinTime                    time.Time         `json:"joinTime"`
+	SecondsSinceLastInteraction float64           `json:"secondsSinceLastInteraction"`
+	ProbedAt                    *time.Time        `json:"probedAt,omitempty"`
+	Queued                      int               `json:"queued"`
+	QueueCapacity               int               `json:"queueCapacity"`
+	Silent                      bool              `json:"silent"`
+	Captions                    bool              `json:"captions"`
+	Client                      models.ClientInfo `json:"client"`
+	// Pending are recently enqueued entities not yet written to a subscriber, oldest first
+	Pending []models.ChannelEntity `json:"pending"`
+}
+
+// UserState returns state of the user in every room it is in ordered by room name
+func (repo *RoomRepository) UserState(userID string) []UserRoomState {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	states := make([]UserRoomState, 0)
+	for _, room := range repo.rooms {
+		state, err := room.UserState(userID)
+		if err == nil {
+			states = append(states, state)
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Room < states[j].Room
+	})
+
+	return states
 }
 
 func (repo *RoomRepository) GetState() []RoomInfo {
@@ -125,11 +374,143 @@ func (repo *RoomRepository) GetState() []RoomInfo {
 		usersInfo := room.GetState()
 
 		roomsInfo = append(roomsInfo, RoomInfo{
-			Name:       roomID,
-			TotalUsers: len(usersInfo),
-			UsersInfo:  usersInfo,
+			Name:               roomID,
+			TotalUsers:         len(usersInfo),
+			UsersInfo:          usersInfo,
+			ConnectionFailures: room.ConnectionFailures(),
+			PasswordProtected:  room.PasswordHash() != nil,
+			Locale:             room.Locale(),
+			EntryForm:          room.EntryForm(),
+			ExpiresAt:          expiresAt(room),
 		})
 	}
 
 	return roomsInfo
 }
+
+// RoomsFilter selects a page of rooms. Zero Limit means no limit
+type RoomsFilter struct {
+	// After skips rooms with names less than or equal to it
+	After      string
+	Limit      int
+	NamePrefix string
+	MinUsers   int
+}
+
+// ListState returns states of rooms matching the filter ordered by name and total number of matching rooms
+func (repo *RoomRepository) ListState(filter RoomsFilter) ([]RoomInfo, int) {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	names := make([]string, 0, len(repo.rooms))
+	for name, room := range repo.rooms {
+		if strings.HasPrefix(name, filter.NamePrefix) && room.UserCount() >= filter.MinUsers {
+			names = append(names, name)
+		}
+	}
+
+	total := len(names)
+
+	sort.Strings(names)
+	start := sort.SearchStrings(names, filter.After)
+	if start < len(names) && names[start] == filter.After {
+		start++
+	}
+	names = names[start:]
+	if filter.Limit > 0 && len(names) > filter.Limit {
+		names = names[:filter.Limit]
+	}
+
+	roomsInfo := make([]RoomInfo, 0, len(names))
+	for _, name := range names {
+		room := repo.rooms[name]
+		usersInfo := room.GetState()
+
+		roomsInfo = append(roomsInfo, RoomInfo{
+			Name:               name,
+			TotalUsers:         len(usersInfo),
+			UsersInfo:          usersInfo,
+			ConnectionFailures: room.ConnectionFailures(),
+			PasswordProtected:  room.PasswordHash() != nil,
+			Locale:             room.Locale(),
+			EntryForm:          room.EntryForm(),
+			ExpiresAt:          expiresAt(room),
+		})
+	}
+
+	return roomsInfo, total
+}
+
+// Announce broadcasts entity of the service to members of all rooms
+func (repo *RoomRepository) Announce(actionType models.ActionType, data map[string]any) {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	for _, room := range repo.rooms {
+		room.Broadcast("", actionType, data)
+	}
+}
+
+// FlushPointers publishes coalesced pointer positions of all rooms
+func (repo *RoomRepository) FlushPointers() {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	for _, room := range repo.rooms {
+		room.FlushPointers()
+	}
+}
+
+// Summary returns number of rooms and number of users in all rooms
+func (repo *RoomRepository) Summary() (rooms, users int) {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	for _, room := range repo.rooms {
+		users += room.UserCount()
+	}
+
+	return len(repo.rooms), users
+}
+
+// HistoryBytes is the size of entity data kept in histories of all rooms
+func (repo *RoomRepository) HistoryBytes() int {
+	repo.mut.RLock()
+	defer repo.mut.RUnlock()
+
+	total := 0
+	for _, room := range repo.rooms {
+		total += room.HistoryBytes()
+	}
+
+	return total
+}
+
+func (repo *RoomRepository) GetRoomState(roomName string) (RoomInfo, error) {
+	room, err := repo.Get(roomName)
+	if err != nil {
+		return RoomInfo{}, err
+	}
+
+	usersInfo := room.GetState()
+
+	return RoomInfo{
+		Name:               roomName,
+		TotalUsers:         len(usersInfo),
+		UsersInfo:          usersInfo,
+		ConnectionFailures: room.ConnectionFailures(),
+		PasswordProtected:  room.PasswordHash() != nil,
+		Locale:             room.Locale(),
+		EntryForm:          room.EntryForm(),
+		ExpiresAt:          expiresAt(room),
+	}, nil
+}
+
+func expiresAt(room *Room) *time.Time {
+	at := room.ExpiresAt()
+	if at.IsZero() {
+		return nil
+	}
+
+	return &at
+}
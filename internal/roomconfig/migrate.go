@@ -0,0 +1,112 @@
+package roomconfig
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrations are applied in the order of their numeric prefix, each once. Applied files must never be edited,
+// schema changes go into new files
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the advisory lock key serializing migrations of instances starting at once
+const migrationLock = 0x726f6f6d636667
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Migrate brings the schema up to date. Every migration runs in its own transaction with its version recorded
+func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	pending, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS room_config_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+
+	for _, m := range pending {
+		err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+			return apply(ctx, tx, m)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func apply(ctx context.Context, tx pgx.Tx, m migration) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLock)
+	if err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM room_config_migrations WHERE version = $1)", m.version,
+	).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, m.sql)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO room_config_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+
+	return err
+}
+
+// loadMigrations reads embedded migrations sorted by version. Files are named <version>_<description>.sql
+func loadMigrations() ([]migration, error) {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make([]migration, 0, len(names))
+	for _, path := range names {
+		name := strings.TrimPrefix(path, "migrations/")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no numeric version prefix", name)
+		}
+
+		raw, err := migrations.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded = append(loaded, migration{version: version, name: name, sql: string(raw)})
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].version < loaded[j].version
+	})
+
+	return loaded, nil
+}
@@ -0,0 +1,7 @@
+CREATE TABLE room_configs (
+    name          TEXT PRIMARY KEY,
+    capacity      INTEGER NOT NULL DEFAULT 0 CHECK (capacity >= 0),
+    password_hash BYTEA,
+    owner         TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,75 @@
+// Package roomconfig keeps configs of pre-created rooms in Postgres, so the rooms survive restarts
+package roomconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"peer-messenger/internal"
+)
+
+// Postgres is internal.RoomConfigRepository backed by room_configs table
+type Postgres struct {
+	pool *pgxpool.Pool
+}
+
+// OpenPostgres connects to the database at dsn and migrates its schema
+func OpenPostgres(ctx context.Context, dsn string) (*Postgres, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("connect to room config store: %w", err)
+	}
+
+	err = Migrate(ctx, pool)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("migrate room config store: %w", err)
+	}
+
+	return &Postgres{pool: pool}, nil
+}
+
+func (p *Postgres) Get(ctx context.Context, name string) (internal.RoomConfig, error) {
+	var cfg internal.RoomConfig
+	err := p.pool.QueryRow(ctx,
+		"SELECT name, capacity, password_hash, owner, created_at FROM room_configs WHERE name = $1", name,
+	).Scan(&cfg.Name, &cfg.Capacity, &cfg.PasswordHash, &cfg.Owner, &cfg.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return internal.RoomConfig{}, internal.ErrRoomConfigNotFound
+	}
+
+	return cfg, err
+}
+
+func (p *Postgres) Save(ctx context.Context, cfg internal.RoomConfig) (internal.RoomConfig, error) {
+	err := p.pool.QueryRow(ctx, `
+		INSERT INTO room_configs (name, capacity, password_hash, owner) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE
+			SET capacity = EXCLUDED.capacity, password_hash = EXCLUDED.password_hash, owner = EXCLUDED.owner
+		RETURNING created_at`,
+		cfg.Name, cfg.Capacity, cfg.PasswordHash, cfg.Owner,
+	).Scan(&cfg.CreatedAt)
+
+	return cfg, err
+}
+
+func (p *Postgres) Delete(ctx context.Context, name string) error {
+	tag, err := p.pool.Exec(ctx, "DELETE FROM room_configs WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return internal.ErrRoomConfigNotFound
+	}
+
+	return nil
+}
+
+// Close waits for queries in flight and closes connections
+func (p *Postgres) Close() {
+	p.pool.Close()
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/sdplint"
+)
+
+// sdpPair is the direction of signaling from one member to another
+type sdpPair struct {
+	from, to string
+}
+
+// sdpLinter remembers offers until they are answered to compare codecs of the pair, and waits for trickled
+// candidates after descriptions without embedded ones
+type sdpLinter struct {
+	timeout time.Duration
+	offers  map[sdpPair]sdplint.Description
+	waiting map[sdpPair]*time.Timer
+	mux     *sync.Mutex
+}
+
+func newSDPLinter(timeout time.Duration) *sdpLinter {
+	return &sdpLinter{
+		timeout: timeout,
+		offers:  make(map[sdpPair]sdplint.Description),
+		waiting: make(map[sdpPair]*time.Timer),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// observe lints signaling message of the pair and returns findings at once. Missing candidates are reported later
+// through onTimeout unless a candidate message of the pair comes first
+func (l *sdpLinter) observe(
+	pair sdpPair, messageType string, data map[string]any, onTimeout func(sdplint.Finding),
+) []sdplint.Finding {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if messageType == models.MessageTypeCandidate {
+		l.stopWaiting(pair)
+		return nil
+	}
+
+	if messageType != models.MessageTypeOffer && messageType != models.MessageTypeAnswer {
+		return nil
+	}
+
+	sdp, _ := data["sdp"].(string)
+	description := sdplint.Parse(sdp)
+	findings := sdplint.Lint(description)
+
+	if messageType == models.MessageTypeOffer {
+		l.offers[pair] = description
+	} else if offer, ok := l.offers[sdpPair{from: pair.to, to: pair.from}]; ok {
+		delete(l.offers, sdpPair{from: pair.to, to: pair.from})
+		findings = append(findings, sdplint.CompareCodecs(offer, description)...)
+	}
+
+	l.stopWaiting(pair)
+	if !description.HasCandidates() {
+		var timer *time.Timer
+		timer = time.AfterFunc(l.timeout, func() {
+			l.mux.Lock()
+			expired := l.waiting[pair] == timer
+			if expired {
+				delete(l.waiting, pair)
+			}
+			l.mux.Unlock()
+
+			if expired {
+				onTimeout(sdplint.Finding{
+					Check:  sdplint.CheckNoCandidates,
+					Detail: "no candidates sent within " + l.timeout.String() + " after " + messageType,
+				})
+			}
+		})
+		l.waiting[pair] = timer
+	}
+
+	return findings
+}
+
+// forget drops state of pairs with the user who left the room
+func (l *sdpLinter) forget(userID string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for pair := range l.offers {
+		if pair.from == userID || pair.to == userID {
+			delete(l.offers, pair)
+		}
+	}
+
+	for pair := range l.waiting {
+		if pair.from == userID || pair.to == userID {
+			l.stopWaiting(pair)
+		}
+	}
+}
+
+func (l *sdpLinter) stopWaiting(pair sdpPair) {
+	if timer, ok := l.waiting[pair]; ok {
+		timer.Stop()
+		delete(l.waiting, pair)
+	}
+}
+
+// lintSDP sends advisory warnings about signaling message of the pair to its sender. Must be called under read lock
+func (r *Room) lintSDP(srcInfo, destInfo *userInfo, messageType string, data map[string]any) {
+	if r.sdpLinter == nil {
+		return
+	}
+
+	pair := sdpPair{from: srcInfo.id, to: destInfo.id}
+	findings := r.sdpLinter.observe(pair, messageType, data, func(finding sdplint.Finding) {
+		r.mux.RLock()
+		defer r.mux.RUnlock()
+
+		if info, ok := r.userInfos[pair.from]; ok {
+			r.sendSDPWarning(info, pair.to, finding)
+		}
+	})
+
+	for _, finding := range findings {
+		r.sendSDPWarning(srcInfo, destInfo.id, finding)
+	}
+}
+
+// sendSDPWarning is advisory, so it goes with low priority and is dropped when the queue is full
+func (r *Room) sendSDPWarning(info *userInfo, peerUserID string, finding sdplint.Finding) {
+	r.metrics.SDPLintWarnings.WithLabelValues(r.name, string(finding.Check)).Inc()
+
+	warning := models.ChannelEntity{
+		ID:         r.lastEntityID.Add(1),
+		Time:       time.Now(),
+		ActionType: models.SDPWarning,
+		UserID:     info.id,
+		Data: r.compact(map[string]any{
+			"check":      finding.Check,
+			"detail":     finding.Detail,
+			"peerUserID": peerUserID,
+		}),
+		Priority: models.PriorityLow,
+	}
+
+	err := r.enqueue(context.Background(), info, warning)
+	if err != nil {
+		r.log.Warn("sdp warning is not sent", zap.String("user", info.id), zap.Error(err))
+	}
+}
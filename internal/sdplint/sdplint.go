@@ -0,0 +1,174 @@
+// Package sdplint finds common misconfigurations in session descriptions relayed between peers.
+// Parsing is tolerant: malformed lines are skipped, the goal is advice, not validation
+package sdplint
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Check string
+
+const (
+	CheckMissingICEUfrag    Check = "missing_ice_ufrag"
+	CheckMissingICEPwd      Check = "missing_ice_pwd"
+	CheckMissingFingerprint Check = "missing_fingerprint"
+	CheckNoCandidates       Check = "no_candidates"
+	CheckCodecMismatch      Check = "codec_mismatch"
+)
+
+// Finding is a single detected problem
+type Finding struct {
+	Check  Check  `json:"check"`
+	Detail string `json:"detail"`
+}
+
+// helperCodecs are not media codecs by themselves and never make a pair compatible
+var helperCodecs = []string{"rtx", "red", "ulpfec", "flexfec-03", "telephone-event", "cn"}
+
+// Media is an accepted media section of the description
+type Media struct {
+	Kind string
+	// Codecs are lowercase codec names from rtpmap attributes
+	Codecs       []string
+	hasUfrag     bool
+	hasPwd       bool
+	hasFinger    bool
+	hasCandidate bool
+}
+
+// Description is the part of session description the checks need
+type Description struct {
+	Media []Media
+
+	sessionUfrag  bool
+	sessionPwd    bool
+	sessionFinger bool
+}
+
+// HasCandidates reports whether any ICE candidate is embedded, otherwise candidates are expected to trickle
+func (d Description) HasCandidates() bool {
+	return slices.ContainsFunc(d.Media, func(m Media) bool { return m.hasCandidate })
+}
+
+func Parse(sdp string) Description {
+	var (
+		d       Description
+		current *Media
+	)
+
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+
+		if media, ok := strings.CutPrefix(line, "m="); ok {
+			current = nil
+
+			fields := strings.Fields(media)
+			// port 0 rejects the section
+			if len(fields) < 2 || fields[1] == "0" {
+				continue
+			}
+
+			d.Media = append(d.Media, Media{Kind: fields[0]})
+			current = &d.Media[len(d.Media)-1]
+
+			continue
+		}
+
+		attr, ok := strings.CutPrefix(line, "a=")
+		if !ok {
+			continue
+		}
+
+		name, value, _ := strings.Cut(attr, ":")
+		switch name {
+		case "ice-ufrag":
+			if current == nil {
+				d.sessionUfrag = true
+			} else {
+				current.hasUfrag = true
+			}
+		case "ice-pwd":
+			if current == nil {
+				d.sessionPwd = true
+			} else {
+				current.hasPwd = true
+			}
+		case "fingerprint":
+			if current == nil {
+				d.sessionFinger = true
+			} else {
+				current.hasFinger = true
+			}
+		case "candidate":
+			if current != nil {
+				current.hasCandidate = true
+			}
+		case "rtpmap":
+			if current == nil {
+				continue
+			}
+
+			// a=rtpmap:111 opus/48000/2
+			_, encoding, ok := strings.Cut(value, " ")
+			if !ok {
+				continue
+			}
+
+			codec, _, _ := strings.Cut(encoding, "/")
+			current.Codecs = append(current.Codecs, strings.ToLower(codec))
+		}
+	}
+
+	return d
+}
+
+// Lint checks a single description: ICE credentials and DTLS fingerprint must be set for every accepted section
+func Lint(d Description) []Finding {
+	var findings []Finding
+	for _, m := range d.Media {
+		if !m.hasUfrag && !d.sessionUfrag {
+			findings = append(findings, Finding{CheckMissingICEUfrag, fmt.Sprintf("%s section has no ice-ufrag", m.Kind)})
+		}
+		if !m.hasPwd && !d.sessionPwd {
+			findings = append(findings, Finding{CheckMissingICEPwd, fmt.Sprintf("%s section has no ice-pwd", m.Kind)})
+		}
+		if !m.hasFinger && !d.sessionFinger {
+			findings = append(findings, Finding{CheckMissingFingerprint, fmt.Sprintf("%s section has no fingerprint", m.Kind)})
+		}
+	}
+
+	return findings
+}
+
+// CompareCodecs checks that answer picked codecs from the offer and each media kind kept a common codec
+func CompareCodecs(offer, answer Description) []Finding {
+	var findings []Finding
+	for _, answered := range answer.Media {
+		offeredIdx := slices.IndexFunc(offer.Media, func(m Media) bool { return m.Kind == answered.Kind })
+		if offeredIdx < 0 || len(answered.Codecs) == 0 {
+			continue
+		}
+		offered := offer.Media[offeredIdx]
+
+		common := false
+		for _, codec := range answered.Codecs {
+			if !slices.Contains(offered.Codecs, codec) {
+				findings = append(findings, Finding{
+					CheckCodecMismatch, fmt.Sprintf("answer %s codec %s was not offered", answered.Kind, codec),
+				})
+				continue
+			}
+			if !slices.Contains(helperCodecs, codec) {
+				common = true
+			}
+		}
+
+		if !common {
+			findings = append(findings, Finding{CheckCodecMismatch, fmt.Sprintf("no common %s codec", answered.Kind)})
+		}
+	}
+
+	return findings
+}
@@ -0,0 +1,176 @@
+// Package search indexes chat messages for full text search. MemoryIndex is the built-in implementation,
+// Index interface allows replacing it with a search engine like Bleve
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// DefaultLimit is the number of results returned when query does not set one
+const DefaultLimit = 20
+
+type Document struct {
+	ID          uint64    `json:"id"`
+	Time        time.Time `json:"time"`
+	AuthorID    string    `json:"authorID"`
+	RecipientID string    `json:"recipientID"`
+	Text        string    `json:"text"`
+}
+
+type Query struct {
+	// Text matches documents containing all of its words, case insensitive. Empty text matches any document
+	Text     string
+	AuthorID string
+	// ParticipantID limits results to documents authored by or sent to the user
+	ParticipantID string
+	// From and To bound document time inclusively, zero values leave the range open
+	From, To time.Time
+	Limit    int
+}
+
+type Index interface {
+	Add(doc Document) error
+	Remove(id uint64) error
+	// Search returns matching documents from newest to oldest
+	Search(q Query) ([]Document, error)
+}
+
+// MemoryIndex is an inverted index from lowercase words to documents containing them
+type MemoryIndex struct {
+	docs     map[uint64]Document
+	postings map[string]map[uint64]struct{}
+	mux      *sync.RWMutex
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		docs:     make(map[uint64]Document),
+		postings: make(map[string]map[uint64]struct{}),
+		mux:      &sync.RWMutex{},
+	}
+}
+
+func (idx *MemoryIndex) Add(doc Document) error {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.docs[doc.ID] = doc
+	for _, word := range words(doc.Text) {
+		ids, ok := idx.postings[word]
+		if !ok {
+			ids = make(map[uint64]struct{})
+			idx.postings[word] = ids
+		}
+		ids[doc.ID] = struct{}{}
+	}
+
+	return nil
+}
+
+func (idx *MemoryIndex) Remove(id uint64) error {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	doc, ok := idx.docs[id]
+	if !ok {
+		return nil
+	}
+
+	delete(idx.docs, id)
+	for _, word := range words(doc.Text) {
+		delete(idx.postings[word], id)
+		if len(idx.postings[word]) == 0 {
+			delete(idx.postings, word)
+		}
+	}
+
+	return nil
+}
+
+func (idx *MemoryIndex) Search(q Query) ([]Document, error) {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	candidates := idx.docs
+	if queryWords := words(q.Text); len(queryWords) > 0 {
+		candidates = make(map[uint64]Document)
+
+		// the rarest word gives the shortest list to check the others against
+		sort.Slice(queryWords, func(i, j int) bool {
+			return len(idx.postings[queryWords[i]]) < len(idx.postings[queryWords[j]])
+		})
+
+		for id := range idx.postings[queryWords[0]] {
+			if idx.containsAll(id, queryWords[1:]) {
+				candidates[id] = idx.docs[id]
+			}
+		}
+	}
+
+	found := make([]Document, 0)
+	for _, doc := range candidates {
+		if matches(doc, q) {
+			found = append(found, doc)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID > found[j].ID
+	})
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	return found[:min(limit, len(found))], nil
+}
+
+func (idx *MemoryIndex) containsAll(id uint64, words []string) bool {
+	for _, word := range words {
+		if _, ok := idx.postings[word][id]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matches(doc Document, q Query) bool {
+	if q.AuthorID != "" && doc.AuthorID != q.AuthorID {
+		return false
+	}
+	if q.ParticipantID != "" && doc.AuthorID != q.ParticipantID && doc.RecipientID != q.ParticipantID {
+		return false
+	}
+	if !q.From.IsZero() && doc.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && doc.Time.After(q.To) {
+		return false
+	}
+
+	return true
+}
+
+// words splits text into unique lowercase words of letters and digits
+func words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]struct{}, len(fields))
+	out := fields[:0]
+	for _, field := range fields {
+		if _, ok := seen[field]; !ok {
+			seen[field] = struct{}{}
+			out = append(out, field)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"peer-messenger/internal/tracing"
+)
+
+// BatchMessage is one message of a batch sent by a member
+type BatchMessage struct {
+	DestUserID string
+	Data       map[string]any
+	Opts       SendOptions
+}
+
+// SendBatch delivers messages of the member in order, e.g. a burst of ICE candidates. The batch is checked
+// as a whole first: a message violating room policy or sent to a non-member rejects the batch, rate limited
+// messages are charged together and over the limit reject it too. Delivery errors, like busy destinations,
+// are returned per message, nil for delivered ones. In rooms with a dispatcher messages are accepted
+// for delivery instead, a full dispatch queue is the only error
+func (r *Room) SendBatch(ctx context.Context, srcUserID string, batch []BatchMessage) (_ []error, err error) {
+	ctx, span := tracing.Start(ctx, "Room.SendBatch", tracing.Room(r.name), attribute.Int("messages", len(batch)))
+	defer func() { tracing.End(span, err) }()
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	srcInfo, ok := r.userInfos[srcUserID]
+	if !ok {
+		return nil, ErrUserNotInRoom
+	}
+
+	msgs := make([]outgoing, 0, len(batch))
+	limited := 0
+	for i, item := range batch {
+		msg, err := r.prepareSend(item.DestUserID, item.Data, item.Opts)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		if msg.limited {
+			limited++
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if limited > 0 {
+		err = r.allowSend(srcUserID, srcInfo, limited)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	srcInfo.lastActionTime = time.Now()
+
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = r.send(ctx, srcInfo, msg)
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+)
+
+// RoomsPage is a page of rooms state. NextCursor is empty on the last page
+type RoomsPage struct {
+	Rooms      []internal.RoomInfo `json:"rooms"`
+	Total      int                 `json:"total"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+// ListRooms lists rooms state page by page ordered by room name
+func (s *PeerMessenger) ListRooms(_ context.Context, req models.RoomsRequest) (RoomsPage, error) {
+	after, err := base64.RawURLEncoding.DecodeString(req.Cursor)
+	if err != nil {
+		return RoomsPage{}, ErrInvalidCursor
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultRoomsPageSize
+	}
+
+	rooms, total := s.roomRepo.ListState(internal.RoomsFilter{
+		After:      string(after),
+		Limit:      limit,
+		NamePrefix: req.Prefix,
+		MinUsers:   req.MinUsers,
+	})
+
+	page := RoomsPage{
+		Rooms: rooms,
+		Total: total,
+	}
+	if len(rooms) == limit {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(rooms[len(rooms)-1].Name))
+	}
+
+	return page, nil
+}
+
+// RoomsSnapshot returns state of all rooms at once. Meant for support bundles, not for regular polling
+func (s *PeerMessenger) RoomsSnapshot(_ context.Context) []internal.RoomInfo {
+	return s.roomRepo.GetState()
+}
+
+func (s *PeerMessenger) GetRoom(_ context.Context, roomName string) (internal.RoomInfo, error) {
+	return s.roomRepo.GetRoomState(roomName)
+}
+
+// DeleteRoom deletes the room at once. With grace members are warned with room closing entity first,
+// the returned time is when the room is going to be deleted
+func (s *PeerMessenger) DeleteRoom(ctx context.Context, roomName string, req models.DeleteRoomRequest) (time.Time, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "deleted by admin"
+	}
+
+	if req.Grace == 0 {
+		s.roomRepo.RemoveRoom(ctx, roomName, reason)
+		s.roomRemoved(roomName)
+		return time.Now(), nil
+	}
+
+	closesAt := time.Now().Add(req.Grace)
+	room.AnnounceClosing(reason, closesAt)
+	s.logger.Info("audit: room closing", zap.String("room", roomName), zap.Time("closes at", closesAt))
+
+	time.AfterFunc(req.Grace, func() {
+		if s.roomRepo.RemoveRoomInstance(context.Background(), room, reason) {
+			s.roomRemoved(roomName)
+		}
+	})
+
+	return closesAt, nil
+}
+
+func (s *PeerMessenger) roomRemoved(roomName string) {
+	s.adminEvents.Publish(AdminEventRoomRemoved, roomName, "")
+	s.observeRoom(roomName)
+}
+
+// KickUser removes the user from the room, the user and other members are told the reason
+func (s *PeerMessenger) KickUser(_ context.Context, roomName, userID string, req models.KickRequest) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "kicked by admin"
+	}
+
+	err = room.KickUser(userID, reason)
+	if err != nil {
+		return err
+	}
+
+	s.adminEvents.Publish(AdminEventUserKicked, roomName, userID)
+	s.observeRoom(roomName)
+
+	return nil
+}
+
+// GrantModerator makes the member a moderator of the room and tells everyone in the room about it
+func (s *PeerMessenger) GrantModerator(_ context.Context, roomName, userID string) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	err = room.GrantModerator(userID)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("audit: moderator granted", zap.String("room", roomName), zap.String("user", userID))
+
+	return nil
+}
+
+// Notice publishes server notice to the room, or to all rooms of the instance when no room is given
+func (s *PeerMessenger) Notice(_ context.Context, req models.NoticeRequest) error {
+	level := req.Level
+	if level == "" {
+		level = "info"
+	}
+	data := map[string]any{"text": req.Text, "level": level}
+
+	if req.ChannelName == "" {
+		s.roomRepo.Announce(models.ServerNotice, data)
+		return nil
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	room.Broadcast("", models.ServerNotice, data)
+
+	return nil
+}
+
+func (s *PeerMessenger) BanUser(_ context.Context, roomName, userID string) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	room.BanUser(userID)
+	s.adminEvents.Publish(AdminEventUserBanned, roomName, userID)
+	s.observeRoom(roomName)
+
+	return nil
+}
+
+func (s *PeerMessenger) SetCaptionsEnabled(_ context.Context, roomName string, enabled bool) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	room.SetCaptionsEnabled(enabled)
+
+	return nil
+}
+
+// SetRoomLocale sets language and time zone used for texts and times the room is notified with
+func (s *PeerMessenger) SetRoomLocale(_ context.Context, roomName string, locale models.Locale) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	room.SetLocale(locale)
+
+	return nil
+}
+
+// PutRoomConfig pre-creates the room, the room keeps the config across restarts until it is deleted
+func (s *PeerMessenger) PutRoomConfig(
+	ctx context.Context, roomName string, req models.RoomConfigRequest,
+) (internal.RoomConfig, error) {
+	cfg := internal.RoomConfig{
+		Name:     roomName,
+		Capacity: req.Capacity,
+		Owner:    req.Owner,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return internal.RoomConfig{}, err
+		}
+		cfg.PasswordHash = hash
+	}
+
+	cfg, err := s.roomRepo.SaveRoomConfig(ctx, cfg)
+	if err != nil {
+		return internal.RoomConfig{}, err
+	}
+
+	s.logger.Info("audit: room config saved",
+		zap.String("room", roomName), zap.Int("capacity", cfg.Capacity), zap.String("owner", cfg.Owner),
+		zap.Bool("password", cfg.PasswordHash != nil),
+	)
+
+	return cfg, nil
+}
+
+func (s *PeerMessenger) GetRoomConfig(ctx context.Context, roomName string) (internal.RoomConfig, error) {
+	return s.roomRepo.RoomConfig(ctx, roomName)
+}
+
+// DeleteRoomConfig forgets the pre-created room. The room itself stays until it is deleted or becomes empty
+func (s *PeerMessenger) DeleteRoomConfig(ctx context.Context, roomName string) error {
+	err := s.roomRepo.DeleteRoomConfig(ctx, roomName)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("audit: room config deleted", zap.String("room", roomName))
+
+	return nil
+}
+
+// SetRoomEntryForm sets the questions members answer when joining the room, empty form removes them
+func (s *PeerMessenger) SetRoomEntryForm(_ context.Context, roomName string, form models.EntryForm) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	room.SetEntryForm(&form)
+	s.logger.Info("audit: room entry form set", zap.String("room", roomName), zap.Int("fields", len(form.Fields)))
+
+	return nil
+}
+
+func (s *PeerMessenger) SetRoomPolicy(_ context.Context, roomName string, policy models.RoomPolicy) error {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return err
+	}
+
+	room.SetPolicy(policy)
+
+	return nil
+}
+
+func (s *PeerMessenger) GetRoomPolicy(_ context.Context, roomName string) (models.RoomPolicy, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return models.RoomPolicy{}, err
+	}
+
+	return room.Policy(), nil
+}
+
+// InspectUser shows the user's memberships and pending entities the way the user would see them.
+// It is read-only and every call is audited, since it exposes user's messages to the operator
+func (s *PeerMessenger) InspectUser(_ context.Context, operatorIP, userID string) []internal.UserRoomState {
+	states := s.roomRepo.UserState(userID)
+
+	s.logger.Info(
+		"audit: admin inspected user",
+		zap.String("user", userID),
+		zap.String("operator ip", operatorIP),
+		zap.Int("rooms", len(states)),
+	)
+	s.adminEvents.Publish(AdminEventUserInspected, "", userID)
+
+	return states
+}
+
+// DeadLetters lists undeliverable entities, optionally filtered by room and recipient
+func (s *PeerMessenger) DeadLetters(_ context.Context, roomName, recipientID string) []internal.DeadLetter {
+	return s.roomRepo.DeadLetters(roomName, recipientID)
+}
+
+func (s *PeerMessenger) SubscribeAdminEvents(_ context.Context) (<-chan AdminEvent, func()) {
+	return s.adminEvents.Subscribe()
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+const adminEventsBufferSize = 100
+
+type AdminEventType string
+
+const (
+	AdminEventUserJoined    AdminEventType = "user joined"
+	AdminEventUserLeft      AdminEventType = "user left"
+	AdminEventUserKicked    AdminEventType = "user kicked"
+	AdminEventUserBanned    AdminEventType = "user banned"
+	AdminEventRoomRemoved   AdminEventType = "room removed"
+	AdminEventUserInspected AdminEventType = "user inspected"
+)
+
+type AdminEvent struct {
+	Time   time.Time      `json:"time"`
+	Type   AdminEventType `json:"type"`
+	Room   string         `json:"room"`
+	UserID string         `json:"userID,omitempty"`
+}
+
+// AdminEvents fans out admin events to subscribers. Slow subscribers lose events instead of blocking publishers
+type AdminEvents struct {
+	subs map[chan AdminEvent]struct{}
+	mux  *sync.RWMutex
+}
+
+func NewAdminEvents() *AdminEvents {
+	return &AdminEvents{
+		subs: make(map[chan AdminEvent]struct{}),
+		mux:  &sync.RWMutex{},
+	}
+}
+
+func (e *AdminEvents) Publish(eventType AdminEventType, room, userID string) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	event := AdminEvent{
+		Time:   time.Now(),
+		Type:   eventType,
+		Room:   room,
+		UserID: userID,
+	}
+
+	for sub := range e.subs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns events channel and the function that must be called to stop receiving events
+func (e *AdminEvents) Subscribe() (<-chan AdminEvent, func()) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	sub := make(chan AdminEvent, adminEventsBufferSize)
+	e.subs[sub] = struct{}{}
+
+	unsubscribe := func() {
+		e.mux.Lock()
+		defer e.mux.Unlock()
+
+		if _, ok := e.subs[sub]; ok {
+			delete(e.subs, sub)
+			close(sub)
+		}
+	}
+
+	return sub, unsubscribe
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+)
+
+// AudioOnlyRule recommends the room to switch to audio only when the mean packet loss reported by its members
+// stays at or above DegradeAt for Sustain, and back to video when it stays at or below RecoverAt for Sustain
+type AudioOnlyRule struct {
+	DegradeAt float64
+	RecoverAt float64
+	Sustain   time.Duration
+}
+
+// audioOnly evaluates AudioOnlyRule on every stats report. Reports older than Sustain are not counted
+type audioOnly struct {
+	rule  AudioOnlyRule
+	rooms map[string]*roomLoss
+	mux   *sync.Mutex
+}
+
+type roomLoss struct {
+	reports  map[string]lossReport
+	degraded bool
+	// since is when the mean loss started to call for the opposite of the current state, zero otherwise
+	since time.Time
+}
+
+type lossReport struct {
+	loss float64
+	at   time.Time
+}
+
+func newAudioOnly(rule AudioOnlyRule) *audioOnly {
+	return &audioOnly{
+		rule:  rule,
+		rooms: make(map[string]*roomLoss),
+		mux:   &sync.Mutex{},
+	}
+}
+
+// observe records the report and returns mean loss of the room, the current recommendation and whether it has changed
+func (a *audioOnly) observe(
+	roomName, userID string, loss float64, now time.Time,
+) (mean float64, degraded, changed bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	room, ok := a.rooms[roomName]
+	if !ok {
+		room = &roomLoss{reports: make(map[string]lossReport)}
+		a.rooms[roomName] = room
+	}
+	room.reports[userID] = lossReport{loss: loss, at: now}
+
+	for reporter, report := range room.reports {
+		if now.Sub(report.at) > a.rule.Sustain {
+			delete(room.reports, reporter)
+			continue
+		}
+		mean += report.loss
+	}
+	mean /= float64(len(room.reports))
+
+	opposite := mean <= a.rule.RecoverAt
+	if !room.degraded {
+		opposite = mean >= a.rule.DegradeAt
+	}
+
+	switch {
+	case !opposite:
+		room.since = time.Time{}
+	case room.since.IsZero():
+		room.since = now
+	}
+
+	if opposite && now.Sub(room.since) >= a.rule.Sustain {
+		room.degraded = !room.degraded
+		room.since = time.Time{}
+		changed = true
+	}
+
+	return mean, room.degraded, changed
+}
+
+// prune forgets rooms for which alive returns false
+func (a *audioOnly) prune(alive func(roomName string) bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for roomName := range a.rooms {
+		if !alive(roomName) {
+			delete(a.rooms, roomName)
+		}
+	}
+}
+
+// ReportNetworkStats accepts packet loss measured by a room member. When audio only rule is enabled,
+// sustained loss across the room makes every member receive the DegradeToAudio recommendation
+func (s *PeerMessenger) ReportNetworkStats(_ context.Context, userID string, req models.NetworkStatsRequest) error {
+	err := s.statsLimits.admit(userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	if !room.HasUser(userID) {
+		return internal.ErrUserNotInRoom
+	}
+
+	s.metrics.PacketLoss.WithLabelValues(req.ChannelName).Observe(req.PacketLoss)
+
+	if s.audioOnly == nil {
+		return nil
+	}
+
+	mean, audioOnly, changed := s.audioOnly.observe(req.ChannelName, userID, req.PacketLoss, time.Now())
+	if !changed {
+		return nil
+	}
+
+	s.logger.Info("audio only recommendation changed",
+		zap.String("room", req.ChannelName), zap.Bool("audioOnly", audioOnly), zap.Float64("packetLoss", mean),
+	)
+
+	room.Broadcast("", models.DegradeToAudio, map[string]any{
+		"audioOnly":  audioOnly,
+		"packetLoss": mean,
+	})
+
+	return nil
+}
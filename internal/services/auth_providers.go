@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/users"
+)
+
+var (
+	ErrUnknownProvider    = errors.New("authentication provider is unknown")
+	ErrInvalidLoginState  = errors.New("login state is unknown or expired, start the login again")
+	ErrIdentityConflict   = errors.New("user ID is taken by a user of another identity provider")
+	ErrTooManyLoginsBegun = errors.New("too many logins are in progress, retry later")
+)
+
+const (
+	// pendingLoginTTL is how long users have to log in at the identity provider
+	pendingLoginTTL = 10 * time.Minute
+	// maxPendingLogins bounds memory held by logins that are begun and never completed
+	maxPendingLogins = 10000
+)
+
+// pendingLogin is a login redirected to the identity provider, waiting for the callback
+type pendingLogin struct {
+	provider  string
+	verifier  string
+	nonce     string
+	expiresAt time.Time
+}
+
+// pendingLogins keeps begun logins by their state parameter, each state completes at most one login
+type pendingLogins struct {
+	byState map[string]pendingLogin
+	mux     *sync.Mutex
+}
+
+func newPendingLogins() *pendingLogins {
+	return &pendingLogins{
+		byState: make(map[string]pendingLogin),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// begin remembers a new login and returns its state
+func (pl *pendingLogins) begin(login pendingLogin) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+
+	if len(pl.byState) >= maxPendingLogins {
+		return "", ErrTooManyLoginsBegun
+	}
+	pl.byState[state] = login
+
+	return state, nil
+}
+
+// take forgets the login of the state and returns it, if it is not expired
+func (pl *pendingLogins) take(state string, now time.Time) (pendingLogin, bool) {
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+
+	login, ok := pl.byState[state]
+	if !ok {
+		return pendingLogin{}, false
+	}
+	delete(pl.byState, state)
+
+	return login, !now.After(login.expiresAt)
+}
+
+// prune forgets expired logins
+func (pl *pendingLogins) prune(now time.Time) {
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+
+	for state, login := range pl.byState {
+		if now.After(login.expiresAt) {
+			delete(pl.byState, state)
+		}
+	}
+}
+
+// randomString returns 32 random bytes encoded as URL safe base64, long enough for state, nonce
+// and PKCE verifier
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// AuthProviders lists providers users may log in with, the local password provider first
+func (s *PeerMessenger) AuthProviders() models.AuthProvidersResponse {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return models.AuthProvidersResponse{Providers: append([]string{authn.LocalProvider}, names...)}
+}
+
+// BeginLogin starts login with the identity provider and returns the URL the user is redirected to
+func (s *PeerMessenger) BeginLogin(ctx context.Context, providerName string) (string, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+
+	verifier, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := s.pendingLogins.begin(pendingLogin{
+		provider:  providerName,
+		verifier:  verifier,
+		nonce:     nonce,
+		expiresAt: time.Now().Add(pendingLoginTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	return provider.AuthCodeURL(ctx, state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+}
+
+// CompleteLogin handles the callback of the identity provider: the code is exchanged for the identity
+// of the user, who is created on the first login, and a session is started like after password login
+func (s *PeerMessenger) CompleteLogin(
+	ctx context.Context, client models.ClientInfo, providerName, state, code string,
+) (models.LoginResponse, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return models.LoginResponse{}, ErrUnknownProvider
+	}
+
+	login, ok := s.pendingLogins.take(state, time.Now())
+	if !ok || login.provider != providerName {
+		return models.LoginResponse{}, ErrInvalidLoginState
+	}
+
+	identity, err := provider.Exchange(ctx, code, login.verifier, login.nonce)
+	if err != nil {
+		s.logger.Warn("login with identity provider failed",
+			zap.String("provider", providerName), zap.String("ip", client.IP), zap.Error(err),
+		)
+		return models.LoginResponse{}, err
+	}
+
+	err = s.linkIdentity(ctx, identity)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	return s.startSession(identity, client.UserAgent, client)
+}
+
+// linkIdentity maps the external identity to its user, creating the user on the first login. Users
+// registered with a password or by another provider are never taken over
+func (s *PeerMessenger) linkIdentity(ctx context.Context, identity authn.Identity) error {
+	if isServiceAccount(identity.UserID) {
+		return ErrReservedUserID
+	}
+
+	user, err := s.users.Get(ctx, identity.UserID)
+	if errors.Is(err, users.ErrUserNotFound) {
+		user = users.User{
+			ID:        identity.UserID,
+			CreatedAt: time.Now(),
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+		}
+		err = s.users.Create(ctx, user)
+		if err == nil {
+			s.logger.Info("audit: user registered",
+				zap.String("user", identity.UserID), zap.String("provider", identity.Provider),
+			)
+			return nil
+		}
+		if errors.Is(err, users.ErrUserExists) {
+			// created by a concurrent login
+			user, err = s.users.Get(ctx, identity.UserID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Provider != identity.Provider || user.Subject != identity.Subject {
+		return ErrIdentityConflict
+	}
+
+	return nil
+}
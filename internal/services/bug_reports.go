@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+)
+
+const (
+	// bugReportRate and bugReportBurst limit how often a single user may report bugs
+	bugReportRate  = rate.Limit(1.0 / 60)
+	bugReportBurst = 3
+	// bugReportSignatureKey separates signatures of reports from subscriptionIDs signed with the same secret
+	bugReportSignatureKey = "bug-report"
+)
+
+var (
+	ErrBugReportsThrottled = errors.New("bugs are reported too often")
+	ErrBugReportNotExist   = errors.New("bug report does not exist")
+)
+
+// BugReport joins the view of the room reported by a user with the server-side state at the same moment
+type BugReport struct {
+	ID          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	UserID      string            `json:"userID"`
+	Room        string            `json:"room"`
+	Client      models.ClientInfo `json:"client"`
+	Description string            `json:"description"`
+	ClientView  BugReportClient   `json:"clientView"`
+	ServerView  BugReportServer   `json:"serverView"`
+}
+
+type BugReportClient struct {
+	PendingBuffer int      `json:"pendingBuffer"`
+	LastEventID   uint64   `json:"lastEventID"`
+	Members       []string `json:"members"`
+}
+
+type BugReportServer struct {
+	LastEntityID uint64                 `json:"lastEntityID"`
+	Membership   internal.UserRoomState `json:"membership"`
+	Room         internal.RoomInfo      `json:"room"`
+}
+
+// SignedBugReport is the report with HMAC of its JSON, so a report exported to a ticket can be checked for edits
+type SignedBugReport struct {
+	Report    BugReport `json:"report"`
+	Signature string    `json:"signature"`
+}
+
+type bugReporter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// bugReports keeps the latest reports and limits how often each user reports
+type bugReports struct {
+	byID      map[string]SignedBugReport
+	order     []string
+	capacity  int
+	reporters map[string]*bugReporter
+	mux       *sync.Mutex
+}
+
+func newBugReports(capacity int) *bugReports {
+	return &bugReports{
+		byID:      make(map[string]SignedBugReport),
+		capacity:  capacity,
+		reporters: make(map[string]*bugReporter),
+		mux:       &sync.Mutex{},
+	}
+}
+
+func (b *bugReports) admit(userID string, now time.Time) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	reporter, ok := b.reporters[userID]
+	if !ok {
+		reporter = &bugReporter{limiter: rate.NewLimiter(bugReportRate, bugReportBurst)}
+		b.reporters[userID] = reporter
+	}
+	reporter.lastSeen = now
+
+	if !reporter.limiter.AllowN(now, 1) {
+		return ErrBugReportsThrottled
+	}
+
+	return nil
+}
+
+// put stores the report evicting the oldest one when the store is full
+func (b *bugReports) put(report SignedBugReport) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if len(b.order) >= b.capacity {
+		delete(b.byID, b.order[0])
+		b.order = b.order[1:]
+	}
+
+	b.byID[report.Report.ID] = report
+	b.order = append(b.order, report.Report.ID)
+}
+
+func (b *bugReports) get(id string) (SignedBugReport, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	report, ok := b.byID[id]
+	return report, ok
+}
+
+// prune forgets reporters whose bucket is full again
+func (b *bugReports) prune(now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	idle := time.Duration(float64(bugReportBurst) / float64(bugReportRate) * float64(time.Second))
+	for userID, reporter := range b.reporters {
+		if now.Sub(reporter.lastSeen) >= idle {
+			delete(b.reporters, userID)
+		}
+	}
+}
+
+// ReportBug stores the view of the room reported by its member together with the server-side state
+func (s *PeerMessenger) ReportBug(
+	_ context.Context, userID string, client models.ClientInfo, req models.BugReportRequest,
+) (models.BugReportResponse, error) {
+	now := time.Now()
+
+	err := s.bugReports.admit(userID, now)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	membership, err := room.UserState(userID)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	roomState, err := s.roomRepo.GetRoomState(req.ChannelName)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	id := make([]byte, 12)
+	_, err = rand.Read(id)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	report := BugReport{
+		ID:          base64.RawURLEncoding.EncodeToString(id),
+		Time:        now,
+		UserID:      userID,
+		Room:        req.ChannelName,
+		Client:      client,
+		Description: req.Description,
+		ClientView: BugReportClient{
+			PendingBuffer: req.PendingBuffer,
+			LastEventID:   req.LastEventID,
+			Members:       req.Members,
+		},
+		ServerView: BugReportServer{
+			LastEntityID: room.LastEntityID(),
+			Membership:   membership,
+			Room:         roomState,
+		},
+	}
+
+	signature, err := s.signBugReport(report)
+	if err != nil {
+		return models.BugReportResponse{}, err
+	}
+
+	s.bugReports.put(SignedBugReport{Report: report, Signature: signature})
+
+	s.logger.Info("bug reported",
+		zap.String("report", report.ID), zap.String("room", report.Room), zap.String("user", userID),
+	)
+
+	return models.BugReportResponse{ReportID: report.ID}, nil
+}
+
+func (s *PeerMessenger) BugReport(_ context.Context, id string) (SignedBugReport, error) {
+	report, ok := s.bugReports.get(id)
+	if !ok {
+		return SignedBugReport{}, ErrBugReportNotExist
+	}
+
+	return report, nil
+}
+
+// VerifyBugReport tells whether the report was issued by this service and was not edited since
+func (s *PeerMessenger) VerifyBugReport(_ context.Context, report SignedBugReport) bool {
+	signature, err := s.signBugReport(report.Report)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(report.Signature))
+}
+
+func (s *PeerMessenger) signBugReport(report BugReport) (string, error) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, s.opts.SubscriptionSecret)
+	mac.Write([]byte(bugReportSignatureKey))
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
+
+	"peer-messenger/internal/models"
+)
+
+const (
+	// clientLogBatchRate and clientLogBatchBurst limit how often a single user may send batches
+	clientLogBatchRate  = rate.Limit(1)
+	clientLogBatchBurst = 5
+	// clientLogQuotaWindow is the period ClientLogQuota entries per user are counted over
+	clientLogQuotaWindow = time.Hour
+)
+
+var (
+	ErrClientLogsThrottled = errors.New("client logs are sent too often")
+	ErrClientLogsQuota     = errors.New("client log quota is exhausted, try again later")
+)
+
+type clientLogQuota struct {
+	limiter     *rate.Limiter
+	windowStart time.Time
+	used        int
+}
+
+// clientLogs admits client log batches within per-user rate and quota and writes them to their own logger
+type clientLogs struct {
+	logger *zap.Logger
+	quota  int
+	users  map[string]*clientLogQuota
+	mux    *sync.Mutex
+}
+
+func newClientLogs(logger *zap.Logger, quota int) *clientLogs {
+	return &clientLogs{
+		logger: logger,
+		quota:  quota,
+		users:  make(map[string]*clientLogQuota),
+		mux:    &sync.Mutex{},
+	}
+}
+
+// admit charges entries to the user's quota. Batch that does not fit into the quota is rejected as a whole
+func (l *clientLogs) admit(userID string, entries int, now time.Time) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	quota, ok := l.users[userID]
+	if !ok {
+		quota = &clientLogQuota{
+			limiter:     rate.NewLimiter(clientLogBatchRate, clientLogBatchBurst),
+			windowStart: now,
+		}
+		l.users[userID] = quota
+	}
+
+	if now.Sub(quota.windowStart) >= clientLogQuotaWindow {
+		quota.windowStart = now
+		quota.used = 0
+	}
+
+	if quota.used+entries > l.quota {
+		return ErrClientLogsQuota
+	}
+
+	if !quota.limiter.AllowN(now, 1) {
+		return ErrClientLogsThrottled
+	}
+
+	quota.used += entries
+
+	return nil
+}
+
+// prune forgets users whose quota window is over, they start from scratch on the next batch
+func (l *clientLogs) prune(now time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for userID, quota := range l.users {
+		if now.Sub(quota.windowStart) >= clientLogQuotaWindow {
+			delete(l.users, userID)
+		}
+	}
+}
+
+// CollectClientLogs writes a batch of client logs to the client log sink, correlated with the user, room and session
+func (s *PeerMessenger) CollectClientLogs(
+	ctx context.Context, userID string, client models.ClientInfo, req models.ClientLogsRequest,
+) error {
+	err := s.clientLogs.admit(userID, len(req.Entries), time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range req.Entries {
+		level, err := zapcore.ParseLevel(entry.Level)
+		if err != nil {
+			return err
+		}
+
+		channelName := entry.ChannelName
+		if channelName == "" {
+			channelName = req.ChannelName
+		}
+
+		ce := s.clientLogs.logger.Check(level, entry.Message)
+		if ce == nil {
+			continue
+		}
+
+		ce.Write(
+			zap.String("userID", userID),
+			zap.String("room", channelName),
+			zap.String("sessionID", req.SessionID),
+			zap.String("clientIP", client.IP),
+			zap.String("userAgent", client.UserAgent),
+			zap.Time("clientTime", entry.Time),
+			zap.Any("fields", entry.Fields),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+)
+
+// Subscription is a live stream of entities of one user in one room
+type Subscription struct {
+	Room   string
+	UserID string
+	// Events is the queue of the user's device, streams wait on Ready and write what Take returns until it is closed
+	Events *internal.QueueReader
+	// Replay holds entities the previous connection may have missed, they must be written before Events
+	Replay []models.ChannelEntity
+	// ResumeToken lets the next connection resume the stream once
+	ResumeToken string
+
+	// session is the login the stream belongs to, empty for tokens without session
+	session string
+	room    *internal.Room
+	service *PeerMessenger
+}
+
+// MarkActive records activity of the subscriber, e.g. after successful write to a live connection
+func (sub *Subscription) MarkActive() {
+	sub.room.TouchUser(sub.UserID)
+}
+
+// Delivered records that entities were written to the subscriber
+func (sub *Subscription) Delivered(entities ...models.ChannelEntity) {
+	sub.MarkActive()
+	sub.room.MarkDelivered(sub.UserID, entities)
+	sub.service.logDeliveries(sub.Room, sub.UserID, entities)
+}
+
+// Serve counts the stream in active streams and goroutines of the transport until the returned function is called
+func (sub *Subscription) Serve(transport string) (done func()) {
+	streams := sub.service.metrics.ActiveStreams.WithLabelValues(transport)
+	streams.Inc()
+	untrack := sub.service.metrics.TrackGoroutine(transport + " stream")
+
+	return func() {
+		streams.Dec()
+		untrack()
+	}
+}
+
+// Cancel closes the stream that is not going to be served, e.g. rejected by the transport after it was opened
+func (sub *Subscription) Cancel() {
+	sub.room.CloseStream(sub.UserID, sub.session)
+}
+
+// Disconnected is called by transports when the subscriber went away without leaving, e.g. closed browser tab.
+// The user is made inactive once the last stream is gone, or leaves the room with RemoveOnDisconnect
+func (sub *Subscription) Disconnected() {
+	if !sub.room.CloseStream(sub.UserID, sub.session) || !sub.service.opts.RemoveOnDisconnect {
+		return
+	}
+
+	err := sub.service.LeaveChannel(
+		context.Background(), sub.UserID, sub.session, models.ChannelRequest{ChannelName: sub.Room},
+	)
+	if err != nil && !errors.Is(err, internal.ErrUserNotInRoom) {
+		sub.service.logger.Warn("disconnected user is not removed",
+			zap.String("room", sub.Room), zap.String("user", sub.UserID), zap.Error(err),
+		)
+		return
+	}
+
+	sub.service.logger.Info("audit: disconnected user left room", zap.String("room", sub.Room), zap.String("user", sub.UserID))
+}
+
+// logDeliveries logs sampled part of delivered entities as server-side delivery evidence. Payloads are never logged
+func (s *PeerMessenger) logDeliveries(roomName, userID string, entities []models.ChannelEntity) {
+	if s.opts.DeliveryLogSampleRate <= 0 {
+		return
+	}
+
+	for _, entity := range entities {
+		if rand.Float64() >= s.opts.DeliveryLogSampleRate {
+			continue
+		}
+
+		s.deliveryLogger.Info(
+			"entity delivered",
+			zap.Uint64("entity id", entity.ID),
+			zap.String("room", roomName),
+			zap.String("user", entity.UserID),
+			zap.String("dest", userID),
+			zap.String("action type", string(entity.ActionType)),
+			zap.Duration("latency", time.Since(entity.Time)),
+		)
+	}
+}
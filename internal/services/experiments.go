@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrExperimentNotExist = errors.New("experiment does not exist")
+
+// experiments holds operator defined rollouts. Assignment is deterministic: the same user always gets the same variant
+type experiments struct {
+	byName map[string]models.Experiment
+	mux    *sync.RWMutex
+}
+
+func newExperiments() *experiments {
+	return &experiments{
+		byName: make(map[string]models.Experiment),
+		mux:    &sync.RWMutex{},
+	}
+}
+
+// assign returns variants of all experiments active in the room. Users outside of rollout get no variant
+func (e *experiments) assign(roomName, userID string) map[string]string {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	assigned := make(map[string]string)
+	for name, experiment := range e.byName {
+		if len(experiment.Rooms) > 0 && !slices.Contains(experiment.Rooms, roomName) {
+			continue
+		}
+
+		bucket := bucketOf(name, userID)
+		for _, variant := range experiment.Variants {
+			if bucket < variant.Percent {
+				assigned[name] = variant.Name
+				break
+			}
+
+			bucket -= variant.Percent
+		}
+	}
+
+	return assigned
+}
+
+// bucketOf maps user to [0, 100) independently for every experiment
+func bucketOf(experiment, userID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(experiment + ":" + userID))
+
+	return int(h.Sum32() % 100)
+}
+
+// variantLabel is the stable metrics label for a set of assigned variants
+func variantLabel(assigned map[string]string) string {
+	if len(assigned) == 0 {
+		return "none"
+	}
+
+	pairs := make([]string, 0, len(assigned))
+	for experiment, variant := range assigned {
+		pairs = append(pairs, experiment+"="+variant)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (s *PeerMessenger) PutExperiment(_ context.Context, experiment models.Experiment) error {
+	total := 0
+	for _, variant := range experiment.Variants {
+		total += variant.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("variants of experiment %q cover %d%% of users, at most 100%% allowed", experiment.Name, total)
+	}
+
+	s.experiments.mux.Lock()
+	defer s.experiments.mux.Unlock()
+
+	s.experiments.byName[experiment.Name] = experiment
+
+	return nil
+}
+
+func (s *PeerMessenger) DeleteExperiment(_ context.Context, name string) error {
+	s.experiments.mux.Lock()
+	defer s.experiments.mux.Unlock()
+
+	if _, ok := s.experiments.byName[name]; !ok {
+		return ErrExperimentNotExist
+	}
+
+	delete(s.experiments.byName, name)
+
+	return nil
+}
+
+func (s *PeerMessenger) ListExperiments(_ context.Context) []models.Experiment {
+	s.experiments.mux.RLock()
+	defer s.experiments.mux.RUnlock()
+
+	out := make([]models.Experiment, 0, len(s.experiments.byName))
+	for _, experiment := range s.experiments.byName {
+		out = append(out, experiment)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/search"
+)
+
+const defaultHistoryPageSize = 100
+
+// History pages entities of the room visible to the member: everything published to the room and peer messages
+// the member sent or received. Late joiners rebuild room state from it
+func (s *PeerMessenger) History(_ context.Context, userID string, req models.HistoryRequest) (models.HistoryResponse, error) {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return models.HistoryResponse{}, err
+	}
+
+	var afterID uint64
+	if req.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(req.Cursor)
+		if err != nil {
+			return models.HistoryResponse{}, ErrInvalidCursor
+		}
+
+		afterID, err = strconv.ParseUint(string(raw), 10, 64)
+		if err != nil {
+			return models.HistoryResponse{}, ErrInvalidCursor
+		}
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultHistoryPageSize
+	}
+
+	entities, more, err := room.History(userID, req.Since, afterID, limit)
+	if err != nil {
+		return models.HistoryResponse{}, err
+	}
+
+	resp := models.HistoryResponse{Entities: entities}
+	if more {
+		lastID := entities[len(entities)-1].ID
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(lastID, 10)))
+	}
+
+	return resp, nil
+}
+
+// SearchHistory finds chat messages of the room sent or received by the user
+func (s *PeerMessenger) SearchHistory(
+	_ context.Context, userID string, req models.HistorySearchRequest,
+) ([]search.Document, error) {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !room.HasUser(userID) {
+		return nil, internal.ErrUserNotInRoom
+	}
+
+	query := historyQuery(req)
+	query.ParticipantID = userID
+
+	return room.SearchHistory(query)
+}
+
+// SearchRoomHistory finds chat messages of all members of the room for support staff. Every call is audited
+func (s *PeerMessenger) SearchRoomHistory(
+	_ context.Context, operatorIP string, req models.HistorySearchRequest,
+) ([]search.Document, error) {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info(
+		"audit: admin searched room history",
+		zap.String("room", req.ChannelName),
+		zap.String("query", req.Query),
+		zap.String("author", req.AuthorID),
+		zap.String("operator ip", operatorIP),
+	)
+
+	return room.SearchHistory(historyQuery(req))
+}
+
+func historyQuery(req models.HistorySearchRequest) search.Query {
+	return search.Query{
+		Text:     req.Query,
+		AuthorID: req.AuthorID,
+		From:     req.From,
+		To:       req.To,
+		Limit:    req.Limit,
+	}
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"time"
+)
+
+// localTime formats t as RFC 3339 in the IANA time zone. Empty string is returned for empty or unknown zone,
+// zone names are validated on input, so unknown one means the tz database of the host has no such zone
+func localTime(t time.Time, timezone string) string {
+	if timezone == "" {
+		return ""
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return ""
+	}
+
+	return t.In(loc).Format(time.RFC3339)
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+)
+
+// matchWaitTimeout bounds how long a user waits in the pool before the request gives up
+const matchWaitTimeout = 30 * time.Second
+
+var (
+	ErrAlreadyMatching = errors.New("user is already waiting for a match")
+	ErrMatchTimeout    = errors.New("no match found, try again")
+)
+
+type matchTicket struct {
+	userID string
+	tags   []string
+	region string
+	// room receives the name of the private room once the ticket is paired
+	room chan string
+}
+
+// compatible reports whether both tickets can be paired: regions must be equal when both are set
+// and tags must intersect when both have any
+func (t *matchTicket) compatible(other *matchTicket) bool {
+	if t.region != "" && other.region != "" && t.region != other.region {
+		return false
+	}
+
+	if len(t.tags) == 0 || len(other.tags) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(t.tags, func(tag string) bool {
+		return slices.Contains(other.tags, tag)
+	})
+}
+
+// matchmaker is the pool of users waiting for a random peer, in order of arrival
+type matchmaker struct {
+	waiting []*matchTicket
+	mux     *sync.Mutex
+}
+
+func newMatchmaker() *matchmaker {
+	return &matchmaker{
+		mux: &sync.Mutex{},
+	}
+}
+
+// pair returns the oldest compatible waiting ticket removing it from the pool,
+// otherwise ticket is put into the pool and nil is returned
+func (m *matchmaker) pair(ticket *matchTicket) (*matchTicket, error) {
+	for _, waiting := range m.waiting {
+		if waiting.userID == ticket.userID {
+			return nil, ErrAlreadyMatching
+		}
+	}
+
+	for i, waiting := range m.waiting {
+		if waiting.compatible(ticket) {
+			m.waiting = slices.Delete(m.waiting, i, i+1)
+			return waiting, nil
+		}
+	}
+
+	m.waiting = append(m.waiting, ticket)
+
+	return nil, nil
+}
+
+// withdraw removes ticket from the pool, false means it was already paired
+func (m *matchmaker) withdraw(ticket *matchTicket) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	i := slices.Index(m.waiting, ticket)
+	if i < 0 {
+		return false
+	}
+
+	m.waiting = slices.Delete(m.waiting, i, i+1)
+
+	return true
+}
+
+// FindMatch puts user into matchmaking pool and waits until another user with compatible criteria shows up.
+// Both are joined into a new private room that nobody else may join
+func (s *PeerMessenger) FindMatch(
+	ctx context.Context, userID string, client models.ClientInfo, req models.MatchRequest,
+) (models.MatchResponse, error) {
+	ticket := &matchTicket{
+		userID: userID,
+		tags:   req.Tags,
+		region: req.Region,
+		room:   make(chan string, 1),
+	}
+
+	s.matchmaker.mux.Lock()
+	peer, err := s.matchmaker.pair(ticket)
+	if err != nil {
+		s.matchmaker.mux.Unlock()
+		return models.MatchResponse{}, err
+	}
+
+	var roomName string
+	if peer != nil {
+		roomName, err = s.createMatchRoom(ctx, userID, peer.userID)
+		if err == nil {
+			peer.room <- roomName
+		}
+	}
+	s.matchmaker.mux.Unlock()
+
+	if err != nil {
+		return models.MatchResponse{}, err
+	}
+
+	if peer == nil {
+		roomName, err = s.waitMatch(ctx, ticket)
+		if err != nil {
+			return models.MatchResponse{}, err
+		}
+	}
+
+	resp, err := s.JoinChannel(ctx, userID, client, models.JoinChannelRequest{ChannelName: roomName})
+	if err != nil {
+		return models.MatchResponse{}, err
+	}
+
+	return models.MatchResponse{
+		ChannelName:         roomName,
+		JoinChannelResponse: resp,
+	}, nil
+}
+
+func (s *PeerMessenger) waitMatch(ctx context.Context, ticket *matchTicket) (string, error) {
+	timer := time.NewTimer(matchWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case roomName := <-ticket.room:
+		return roomName, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	// ticket may have been paired right before withdrawal, the room is already waiting then
+	if !s.matchmaker.withdraw(ticket) {
+		return <-ticket.room, nil
+	}
+
+	return "", ErrMatchTimeout
+}
+
+// createMatchRoom creates a room with a random name only the pair may join
+func (s *PeerMessenger) createMatchRoom(ctx context.Context, userIDs ...string) (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	roomName := "match-" + hex.EncodeToString(raw)
+
+	room, err := s.roomRepo.AddRoom(ctx, roomName)
+	if err != nil {
+		return "", err
+	}
+
+	room.Restrict(userIDs...)
+
+	s.logger.Info("users matched", zap.String("room", roomName), zap.Strings("users", userIDs))
+
+	return roomName, nil
+}
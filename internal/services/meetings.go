@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/webhook"
+)
+
+// meetingCheckInterval is how often schedule is checked for meetings to prepare
+const meetingCheckInterval = 10 * time.Second
+
+var ErrMeetingNotExist = errors.New("meeting does not exist")
+
+// MeetingReady is the webhook payload sent when the room of a meeting is created, so the application can
+// notify the roster, e.g. with push notifications
+type MeetingReady struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Room     string    `json:"room"`
+	StartsAt time.Time `json:"startsAt"`
+	Roster   []string  `json:"roster"`
+	// LocalStartsAt is StartsAt in the meeting time zone, empty when not set
+	LocalStartsAt string `json:"localStartsAt,omitempty"`
+	Language      string `json:"language,omitempty"`
+}
+
+// meetings is the schedule of rooms created ahead of their start, so the first joiner does not race others
+// creating the room and every member finds the policy already applied
+type meetings struct {
+	byName map[string]models.Meeting
+	mux    *sync.Mutex
+	// sender is nil when meeting webhooks are disabled
+	sender *webhook.Sender
+}
+
+func newMeetings(sender *webhook.Sender) *meetings {
+	return &meetings{
+		byName: make(map[string]models.Meeting),
+		mux:    &sync.Mutex{},
+		sender: sender,
+	}
+}
+
+// PutMeeting schedules meeting or replaces the one with the same name. Room of a meeting starting within
+// the warm up period is prepared by the next schedule check
+func (s *PeerMessenger) PutMeeting(_ context.Context, meeting models.Meeting) error {
+	s.meetings.mux.Lock()
+	defer s.meetings.mux.Unlock()
+
+	s.meetings.byName[meeting.Name] = meeting
+
+	return nil
+}
+
+// DeleteMeeting unschedules meeting. Room already created stays until it is empty after the reservation ends
+func (s *PeerMessenger) DeleteMeeting(_ context.Context, name string) error {
+	s.meetings.mux.Lock()
+	defer s.meetings.mux.Unlock()
+
+	if _, ok := s.meetings.byName[name]; !ok {
+		return ErrMeetingNotExist
+	}
+
+	delete(s.meetings.byName, name)
+
+	return nil
+}
+
+func (s *PeerMessenger) ListMeetings(_ context.Context) []models.Meeting {
+	s.meetings.mux.Lock()
+	defer s.meetings.mux.Unlock()
+
+	out := make([]models.Meeting, 0, len(s.meetings.byName))
+	for _, meeting := range s.meetings.byName {
+		out = append(out, meeting)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartsAt.Before(out[j].StartsAt) })
+
+	return out
+}
+
+// RunMeetings prepares rooms of meetings starting within MeetingWarmUp and forgets meetings whose
+// reservation is over, until ctx is cancelled
+func (s *PeerMessenger) RunMeetings(ctx context.Context) {
+	if s.meetings.sender != nil {
+		go s.meetings.sender.Run(ctx)
+	}
+
+	ticker := time.NewTicker(meetingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.prepareMeetings(ctx, now)
+		}
+	}
+}
+
+func (s *PeerMessenger) prepareMeetings(ctx context.Context, now time.Time) {
+	s.meetings.mux.Lock()
+	defer s.meetings.mux.Unlock()
+
+	for name, meeting := range s.meetings.byName {
+		reservedUntil := meeting.StartsAt.Add(s.opts.MeetingGrace)
+		switch {
+		case now.After(reservedUntil):
+			delete(s.meetings.byName, name)
+		case meeting.ReadyAt == nil && now.After(meeting.StartsAt.Add(-s.opts.MeetingWarmUp)):
+			err := s.prepareMeeting(ctx, meeting, reservedUntil)
+			if err != nil {
+				s.logger.Error("meeting room is not prepared", zap.String("room", name), zap.Error(err))
+				continue
+			}
+
+			meeting.ReadyAt = &now
+			s.meetings.byName[name] = meeting
+		}
+	}
+}
+
+// prepareMeeting creates the room of the meeting or takes over the existing one and notifies the application
+func (s *PeerMessenger) prepareMeeting(ctx context.Context, meeting models.Meeting, reservedUntil time.Time) error {
+	room, err := s.roomRepo.AddRoom(ctx, meeting.Name)
+	if errors.Is(err, internal.ErrRoomAlreadyExist) {
+		room, err = s.roomRepo.Get(meeting.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	room.SetPolicy(meeting.Policy)
+	room.SetLocale(meeting.Locale)
+	room.SetEntryForm(meeting.EntryForm)
+	room.Restrict(meeting.Roster...)
+	room.Reserve(reservedUntil)
+	if meeting.EndsAt != nil {
+		room.Expire(*meeting.EndsAt)
+	}
+
+	s.logger.Info("meeting room prepared",
+		zap.String("room", meeting.Name), zap.Time("starts at", meeting.StartsAt), zap.Int("roster", len(meeting.Roster)),
+	)
+
+	if s.meetings.sender != nil {
+		s.meetings.sender.Send(MeetingReady{
+			Time:          time.Now(),
+			Type:          "meeting ready",
+			Room:          meeting.Name,
+			StartsAt:      meeting.StartsAt,
+			Roster:        meeting.Roster,
+			LocalStartsAt: localTime(meeting.StartsAt, meeting.Locale.Timezone),
+			Language:      meeting.Locale.Language,
+		})
+	}
+
+	return nil
+}
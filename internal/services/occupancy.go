@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/webhook"
+)
+
+type OccupancyEventType string
+
+const (
+	OccupancyReached OccupancyEventType = "occupancy reached"
+	OccupancyDropped OccupancyEventType = "occupancy dropped"
+)
+
+// OccupancyEvent is the webhook payload sent when room size crosses a threshold
+type OccupancyEvent struct {
+	Time      time.Time          `json:"time"`
+	Type      OccupancyEventType `json:"type"`
+	Room      string             `json:"room"`
+	Threshold int                `json:"threshold"`
+	Users     int                `json:"users"`
+	// LocalTime is Time in the room time zone and Language is the room language, both empty when not set
+	LocalTime string `json:"localTime,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+// occupancy tracks which thresholds each room has reached. Threshold N is reached at N users and dropped
+// only below N-hysteresis, so a room hovering around N does not flap
+type occupancy struct {
+	// thresholds are sorted in ascending order
+	thresholds []int
+	hysteresis int
+	sender     *webhook.Sender
+	// levels is the number of thresholds reached by each room
+	levels map[string]int
+	mux    *sync.Mutex
+}
+
+func newOccupancy(thresholds []int, hysteresis int, sender *webhook.Sender) *occupancy {
+	return &occupancy{
+		thresholds: thresholds,
+		hysteresis: hysteresis,
+		sender:     sender,
+		levels:     make(map[string]int),
+		mux:        &sync.Mutex{},
+	}
+}
+
+// observe compares room size with thresholds and notifies about crossed ones. Nil occupancy is a no-op
+func (o *occupancy) observe(room string, users int, locale models.Locale) {
+	if o == nil {
+		return
+	}
+
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	level := o.levels[room]
+	for level < len(o.thresholds) && users >= o.thresholds[level] {
+		o.notify(OccupancyReached, room, o.thresholds[level], users, locale)
+		level++
+	}
+	for level > 0 && users < o.thresholds[level-1]-o.hysteresis {
+		level--
+		o.notify(OccupancyDropped, room, o.thresholds[level], users, locale)
+	}
+
+	if level == 0 {
+		delete(o.levels, room)
+	} else {
+		o.levels[room] = level
+	}
+}
+
+func (o *occupancy) notify(eventType OccupancyEventType, room string, threshold, users int, locale models.Locale) {
+	now := time.Now()
+	o.sender.Send(OccupancyEvent{
+		Time:      now,
+		Type:      eventType,
+		Room:      room,
+		Threshold: threshold,
+		Users:     users,
+		LocalTime: localTime(now, locale.Timezone),
+		Language:  locale.Language,
+	})
+}
+
+// rooms returns rooms that reached at least one threshold
+func (o *occupancy) rooms() []string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	rooms := make([]string, 0, len(o.levels))
+	for room := range o.levels {
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+// observeRoom reports current size of the room to occupancy tracker, removed rooms count as empty
+func (s *PeerMessenger) observeRoom(roomName string) {
+	if s.occupancy == nil {
+		return
+	}
+
+	users := 0
+	var locale models.Locale
+	if room, err := s.roomRepo.Get(roomName); err == nil {
+		users = room.UserCount()
+		locale = room.Locale()
+	}
+
+	s.occupancy.observe(roomName, users, locale)
+}
+
+// observeAllRooms catches size changes made outside of requests, e.g. eviction of disconnected users
+func (s *PeerMessenger) observeAllRooms() {
+	if s.occupancy == nil {
+		return
+	}
+
+	for _, room := range s.occupancy.rooms() {
+		s.observeRoom(room)
+	}
+}
+
+// RunOccupancyWebhooks delivers occupancy notifications until ctx is cancelled. Returns at once when disabled
+func (s *PeerMessenger) RunOccupancyWebhooks(ctx context.Context) {
+	if s.occupancy == nil {
+		return
+	}
+
+	s.occupancy.sender.Run(ctx)
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrOverloaded = errors.New("instance is overloaded")
+
+// OverloadedError rejects new joins while the instance sheds load. Clients retry on one of AlternateURLs
+type OverloadedError struct {
+	AlternateURLs []string
+	RetryAfter    int
+}
+
+func (e *OverloadedError) Error() string {
+	if len(e.AlternateURLs) == 0 {
+		return ErrOverloaded.Error()
+	}
+
+	return ErrOverloaded.Error() + ", retry on " + strings.Join(e.AlternateURLs, ", ")
+}
+
+func (e *OverloadedError) Unwrap() error {
+	return ErrOverloaded
+}
+
+// LoadShedding is the state of load shedding. Instance sheds load when it is turned on by admin
+// or when the number of users reaches OverloadMaxUsers
+type LoadShedding struct {
+	Shedding  bool `json:"shedding"`
+	Manual    bool `json:"manual"`
+	Automatic bool `json:"automatic"`
+	Users     int  `json:"users"`
+	MaxUsers  int  `json:"maxUsers"`
+	// AlternateURLs are base URLs of other instances clients are sent to
+	AlternateURLs []string `json:"alternateURLs"`
+}
+
+type loadShedding struct {
+	manual    bool
+	automatic bool
+	users     int
+	mux       *sync.Mutex
+}
+
+func newLoadShedding() *loadShedding {
+	return &loadShedding{mux: &sync.Mutex{}}
+}
+
+func (l *loadShedding) active() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.manual || l.automatic
+}
+
+// update applies change and tells whether shedding has just started
+func (l *loadShedding) update(change func(l *loadShedding)) (started bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	before := l.manual || l.automatic
+	change(l)
+
+	return !before && (l.manual || l.automatic)
+}
+
+// checkLoad turns automatic shedding on while users of all rooms reach OverloadMaxUsers
+func (s *PeerMessenger) checkLoad(users int) {
+	if s.opts.OverloadMaxUsers <= 0 {
+		return
+	}
+
+	overloaded := users >= s.opts.OverloadMaxUsers
+	started := s.shedding.update(func(l *loadShedding) {
+		if l.automatic != overloaded {
+			s.logger.Warn("load shedding changed", zap.Bool("overloaded", overloaded), zap.Int("users", users))
+		}
+
+		l.automatic = overloaded
+		l.users = users
+	})
+	if started {
+		s.announceOverload()
+	}
+}
+
+// SetLoadShedding turns manual load shedding on or off, automatic shedding goes on regardless
+func (s *PeerMessenger) SetLoadShedding(ctx context.Context, enabled bool) LoadShedding {
+	started := s.shedding.update(func(l *loadShedding) {
+		l.manual = enabled
+	})
+	if started {
+		s.announceOverload()
+	}
+
+	s.logger.Info("audit: manual load shedding set", zap.Bool("enabled", enabled))
+
+	return s.LoadShedding(ctx)
+}
+
+func (s *PeerMessenger) LoadShedding(_ context.Context) LoadShedding {
+	s.shedding.mux.Lock()
+	defer s.shedding.mux.Unlock()
+
+	return LoadShedding{
+		Shedding:      s.shedding.manual || s.shedding.automatic,
+		Manual:        s.shedding.manual,
+		Automatic:     s.shedding.automatic,
+		Users:         s.shedding.users,
+		MaxUsers:      s.opts.OverloadMaxUsers,
+		AlternateURLs: s.opts.AlternateURLs,
+	}
+}
+
+// admitJoin rejects joins while the instance sheds load
+func (s *PeerMessenger) admitJoin() error {
+	if !s.shedding.active() {
+		return nil
+	}
+
+	return &OverloadedError{AlternateURLs: s.opts.AlternateURLs, RetryAfter: int(s.opts.OverloadRetryAfter.Seconds())}
+}
+
+// announceOverload tells members of all rooms that they may move to another instance
+func (s *PeerMessenger) announceOverload() {
+	s.roomRepo.Announce(models.Migrate, map[string]any{
+		"alternateURLs":     s.opts.AlternateURLs,
+		"retryAfterSeconds": int(s.opts.OverloadRetryAfter.Seconds()),
+	})
+}
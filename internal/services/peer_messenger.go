@@ -0,0 +1,975 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"peer-messenger/internal"
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/bus"
+	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/replay"
+	"peer-messenger/internal/subscription"
+	"peer-messenger/internal/tracing"
+	"peer-messenger/internal/users"
+	"peer-messenger/internal/webhook"
+)
+
+var (
+	ErrUserNotExist          = errors.New("user does not exist")
+	ErrUserAlreadyExist      = errors.New("user already exists")
+	ErrInvalidCredentials    = authn.ErrInvalidCredentials
+	ErrInvalidToken          = errors.New("token is invalid")
+	ErrInvalidSubscriptionID = errors.New("subscriptionID is invalid")
+	ErrInvalidCursor         = errors.New("cursor is invalid")
+	ErrLegacySubscriptionID  = errors.New("legacy subscriptionID format is no longer supported, join the channel again")
+	ErrWrongRoomPassword     = errors.New("room password is wrong")
+	ErrExpiryInPast          = errors.New("room expiry is in the past")
+	ErrInvalidResumeToken    = errors.New("resume token is invalid")
+	ErrResumeTokenExpired    = errors.New("resume token is expired, subscribe with subscriptionID")
+	ErrTokenReplayed         = errors.New("token was already used")
+)
+
+const (
+	defaultMembersPageSize = 100
+	defaultRoomsPageSize   = 100
+	// livenessChecksPerWindow bounds how late after the liveness window lapsed members are removed
+	livenessChecksPerWindow = 4
+)
+
+// Options configures PeerMessenger service
+type Options struct {
+	Room internal.RoomOptions
+	// OfferPacing is the delay between consecutive offers in connection plans
+	OfferPacing time.Duration
+	// PointerInterval is the period of publishing coalesced pointer positions
+	PointerInterval time.Duration
+	// RemoveOnDisconnect makes users leave the room once their last event stream is disconnected
+	RemoveOnDisconnect bool
+	// TokenSalt is appended to user ID in tokens issued before sessions, empty rejects such tokens
+	TokenSalt string
+	// LegacyTokensUntil is the end of the window when tokens without session are accepted, zero rejects them
+	LegacyTokensUntil time.Time
+	// SessionTTL is how long a login session is valid
+	SessionTTL time.Duration
+	// SubscriptionSecret is the HMAC key used to sign subscriptionIDs
+	SubscriptionSecret []byte
+	// LegacySubscriptionIDsUntil is the end of the window when unsigned "room__user" subscriptionIDs are accepted,
+	// zero rejects them
+	LegacySubscriptionIDsUntil time.Time
+	// ResumeTokenTTL is how long single-use resume tokens are valid
+	ResumeTokenTTL time.Duration
+	// ReplayGuard remembers used single-use tokens, nil uses in-memory guard of ReplayCapacity tokens
+	ReplayGuard    replay.Guard
+	ReplayCapacity int
+	// DeadLetterCapacity is the number of undeliverable entities kept for inspection, 0 disables capture
+	DeadLetterCapacity int
+	// InboxCapacity is the number of missed peer messages kept per user when MessageStore is nil, 0 disables the inbox
+	InboxCapacity int
+	// MessageStore keeps peer messages that did not fit into recipient queues, nil uses in-memory store
+	MessageStore internal.MessageStore
+	// RoomConfigs keeps configs of pre-created rooms across restarts, nil disables pre-created rooms
+	RoomConfigs internal.RoomConfigRepository
+	// Region served by this instance
+	Region string
+	// RegionURLs maps other regions to base URLs of their instances
+	RegionURLs map[string]string
+	// DeliveryLogSampleRate is the share of delivered entities logged by delivery logger, 0 disables it
+	DeliveryLogSampleRate float64
+	// LogRoomsSummary enables periodic logging of rooms and users count
+	LogRoomsSummary bool
+	// OccupancyWebhookURL receives notifications when room size crosses OccupancyThresholds, empty disables them
+	OccupancyWebhookURL string
+	OccupancyThresholds []int
+	// OccupancyHysteresis is how many users below a threshold the room must drop to be reported as dropped
+	OccupancyHysteresis int
+	// AudioOnly recommends rooms with sustained packet loss to drop video, zero DegradeAt disables it
+	AudioOnly AudioOnlyRule
+	// ClientLogger receives logs reported by clients, nil writes them to the service logger
+	ClientLogger *zap.Logger
+	// Bus passes peer messages to users connected to other instances, nil on a single instance
+	Bus bus.Bus
+	// OverloadMaxUsers is the number of users in all rooms at which new joins are rejected, 0 disables it
+	OverloadMaxUsers int
+	// OverloadRetryAfter is how long rejected clients wait before retrying this instance
+	OverloadRetryAfter time.Duration
+	// AlternateURLs are base URLs of other instances rejected clients may join instead
+	AlternateURLs []string
+	// BugReportCapacity is the number of the latest bug reports kept
+	BugReportCapacity int
+	// ClientLogQuota is the number of client log entries a user may send per hour
+	ClientLogQuota int
+	Quotas         Quotas
+	// MeetingWarmUp is how long before the start rooms of scheduled meetings are created
+	MeetingWarmUp time.Duration
+	// MeetingGrace keeps the empty room of a meeting after its start for late joiners
+	MeetingGrace time.Duration
+	// MeetingWebhookURL is notified when room of a meeting is ready, empty disables notifications
+	MeetingWebhookURL string
+	// RoomExpiryGrace is how long before expiry members of the room are warned it is closing
+	RoomExpiryGrace time.Duration
+	// AuthProviders are identity providers users may log in with besides passwords, names must be unique
+	AuthProviders []authn.RedirectProvider
+}
+
+// PeerMessenger holds transport-agnostic business logic. Transports (gin handlers for now)
+// are expected to decode and validate requests, call these methods and encode the results.
+type PeerMessenger struct {
+	logger         *zap.Logger
+	deliveryLogger *zap.Logger
+	salt           []byte
+	users          users.Store
+	roomRepo       *internal.RoomRepository
+	subscriptions  *subscription.Codec
+	replays        replay.Guard
+	metrics        *metrics.Metrics
+	adminEvents    *AdminEvents
+	opts           Options
+
+	local           *authn.Local
+	providers       map[string]authn.RedirectProvider
+	pendingLogins   *pendingLogins
+	serviceAccounts *serviceAccounts
+	sessions        *sessions
+	experiments     *experiments
+	matchmaker      *matchmaker
+	clientLogs      *clientLogs
+	statsLimits     *statsLimits
+	bugReports      *bugReports
+	shedding        *loadShedding
+	messagesToday   *dailyCounter
+	meetings        *meetings
+	// occupancy is nil when occupancy webhooks are disabled
+	occupancy *occupancy
+	// audioOnly is nil when audio only recommendations are disabled
+	audioOnly *audioOnly
+}
+
+func NewPeerMessenger(logger *zap.Logger, metrics *metrics.Metrics, userStore users.Store, opts Options) *PeerMessenger {
+	salt := []byte(opts.TokenSalt)
+
+	var deadLetters *internal.DeadLetters
+	if opts.DeadLetterCapacity > 0 {
+		deadLetters = internal.NewDeadLetters(opts.DeadLetterCapacity)
+	}
+
+	inbox := opts.MessageStore
+	if inbox == nil && opts.InboxCapacity > 0 {
+		inbox = internal.NewMemoryMessageStore(opts.InboxCapacity)
+	}
+
+	replays := opts.ReplayGuard
+	if replays == nil {
+		replays = replay.NewMemory(opts.ReplayCapacity)
+	}
+
+	out := &PeerMessenger{
+		logger:         logger,
+		deliveryLogger: logger.Named("delivery"),
+		salt:           salt,
+		users:          userStore,
+		roomRepo: internal.NewRoomRepository(
+			logger, metrics, opts.Room, deadLetters, inbox, opts.Bus, opts.RoomConfigs,
+		),
+		subscriptions: subscription.NewCodec(opts.SubscriptionSecret),
+		replays:       replays,
+		metrics:       metrics,
+		adminEvents:   NewAdminEvents(),
+		opts:          opts,
+
+		local:           authn.NewLocal(userStore),
+		providers:       make(map[string]authn.RedirectProvider, len(opts.AuthProviders)),
+		pendingLogins:   newPendingLogins(),
+		serviceAccounts: newServiceAccounts(),
+		sessions:        newSessions(),
+		experiments:     newExperiments(),
+		matchmaker:      newMatchmaker(),
+		statsLimits:     newStatsLimits(),
+		bugReports:      newBugReports(opts.BugReportCapacity),
+		shedding:        newLoadShedding(),
+		messagesToday:   newDailyCounter(),
+	}
+
+	for _, provider := range opts.AuthProviders {
+		out.providers[provider.Name()] = provider
+	}
+
+	clientLogger := opts.ClientLogger
+	if clientLogger == nil {
+		clientLogger = logger.Named("client")
+	}
+	out.clientLogs = newClientLogs(clientLogger, opts.ClientLogQuota)
+
+	if opts.OccupancyWebhookURL != "" && len(opts.OccupancyThresholds) > 0 {
+		thresholds := slices.Clone(opts.OccupancyThresholds)
+		slices.Sort(thresholds)
+
+		sender := webhook.NewSender(opts.OccupancyWebhookURL, logger.Named("webhook"))
+		out.occupancy = newOccupancy(thresholds, opts.OccupancyHysteresis, sender)
+	}
+
+	if opts.AudioOnly.DegradeAt > 0 {
+		out.audioOnly = newAudioOnly(opts.AudioOnly)
+	}
+
+	var meetingSender *webhook.Sender
+	if opts.MeetingWebhookURL != "" {
+		meetingSender = webhook.NewSender(opts.MeetingWebhookURL, logger.Named("meetings"))
+	}
+	out.meetings = newMeetings(meetingSender)
+
+	return out
+}
+
+// Clean drops disconnected users and empty rooms and prunes expired state of the service, it is the pass
+// of the janitor
+func (s *PeerMessenger) Clean(ctx context.Context) internal.CleanResult {
+	started := time.Now()
+	result := s.roomRepo.Clean(ctx)
+	s.closeExpiredRooms(started)
+	s.clientLogs.prune(started)
+	s.statsLimits.prune(started)
+	s.bugReports.prune(started)
+	s.sessions.prune(started)
+	s.pendingLogins.prune(started)
+	s.sweepMetrics()
+	s.observeAllRooms()
+	if s.audioOnly != nil {
+		s.audioOnly.prune(s.roomRepo.Exist)
+	}
+
+	rooms, users := s.roomRepo.Summary()
+	s.checkLoad(users)
+	if s.opts.LogRoomsSummary {
+		s.logger.Info("rooms summary", zap.Int("rooms", rooms), zap.Int("users", users))
+	}
+
+	return result
+}
+
+func (s *PeerMessenger) Register(ctx context.Context, req models.RegisterRequest) error {
+	if isServiceAccount(req.UserID) {
+		return ErrReservedUserID
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = s.users.Create(ctx, users.User{
+		ID:           req.UserID,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+		Language:     req.Locale.Language,
+		Timezone:     req.Locale.Timezone,
+	})
+	if errors.Is(err, users.ErrUserExists) {
+		return ErrUserAlreadyExist
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("audit: user registered", zap.String("user", req.UserID))
+
+	return nil
+}
+
+// sweepMetrics drops room labeled series of rooms that no longer exist
+func (s *PeerMessenger) sweepMetrics() {
+	swept, err := s.metrics.SweepRooms(s.roomRepo.Exist)
+	if err != nil {
+		s.logger.Error("failed to sweep room metrics", zap.Error(err))
+		return
+	}
+
+	if swept > 0 {
+		s.logger.Debug("swept metrics of removed rooms", zap.Int("rooms", swept))
+	}
+}
+
+func (s *PeerMessenger) JoinChannel(
+	ctx context.Context, userID string, client models.ClientInfo, req models.JoinChannelRequest,
+) (_ models.JoinChannelResponse, err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.JoinChannel", tracing.Room(req.ChannelName), tracing.User(userID))
+	defer func() { tracing.End(span, err) }()
+
+	err = s.admitJoin()
+	if err != nil {
+		return models.JoinChannelResponse{}, err
+	}
+
+	err = s.checkRegion(req.Region)
+	if err != nil {
+		return models.JoinChannelResponse{}, err
+	}
+
+	var (
+		roomName = req.ChannelName
+		room     *internal.Room
+		created  bool
+	)
+	// pre-created rooms not in memory are brought back from their configs, so they are looked up first
+	room, err = s.roomRepo.Get(roomName)
+	if errors.Is(err, internal.ErrRoomNotExist) {
+		room, err = s.createRoom(ctx, userID, roomName, req)
+		created = err == nil
+	} else if err == nil {
+		err = s.checkRoomPassword(room, userID, req.Password)
+	}
+	if err != nil {
+		return models.JoinChannelResponse{}, err
+	}
+
+	variants := s.experiments.assign(roomName, userID)
+
+	// service accounts join silently, other members are not notified
+	err = room.AddUser(userID, internal.JoinOptions{
+		Client:       client,
+		Silent:       isServiceAccount(userID),
+		Captions:     req.Captions,
+		VariantLabel: variantLabel(variants),
+		Answers:      req.Answers,
+		Topology:     req.Topology,
+	})
+	// the same user joining from another device gets its own stream in the room
+	device := errors.Is(err, internal.ErrUserAlreadyInRoom)
+	if device {
+		err = room.AttachSession(userID, client.Session)
+	}
+	if err != nil {
+		return models.JoinChannelResponse{}, err
+	}
+
+	s.logger.Info(
+		"audit: user joined room",
+		zap.String("room", roomName),
+		zap.String("user", userID),
+		zap.String("session", client.Session),
+		zap.Bool("another device", device),
+		zap.String("ip", client.IP),
+		zap.String("user agent", client.UserAgent),
+	)
+
+	if !device {
+		if len(req.Answers) > 0 && room.EntryForm() != nil {
+			s.logger.Info("audit: entry form answered",
+				zap.String("room", roomName), zap.String("user", userID), zap.Any("answers", req.Answers),
+			)
+		}
+
+		if created {
+			room.AnnounceCreated(userID)
+		}
+
+		s.adminEvents.Publish(AdminEventUserJoined, roomName, userID)
+		s.observeRoom(roomName)
+	}
+
+	sub := subscriber{room: roomName, userID: userID, session: client.Session}
+	resumeToken, err := s.issueResumeToken(sub)
+	if err != nil {
+		return models.JoinChannelResponse{}, err
+	}
+
+	resp := models.JoinChannelResponse{
+		SubscriptionID: s.subscriptions.Encode(roomName, userID, client.Session),
+		ResumeToken:    resumeToken,
+		MemberCount:    room.UserCount(),
+		Experiments:    variants,
+		MissedMessages: room.MissedCount(userID),
+		E2EERequired:   room.E2EERequired(),
+	}
+	if expiresAt := room.ExpiresAt(); !expiresAt.IsZero() {
+		resp.RoomExpiresAt = &expiresAt
+	}
+	if req.ConnectionPlan {
+		plan := room.PlanConnections(userID, s.opts.OfferPacing)
+		resp.ConnectionPlan = &plan
+	}
+
+	return resp, nil
+}
+
+// createRoom creates the room of the join owned by the joining user, protected by password if it is not empty
+// and expiring if asked to. Password is hashed before the room is created to keep the window when the room
+// is joinable without it short
+func (s *PeerMessenger) createRoom(
+	ctx context.Context, userID, roomName string, req models.JoinChannelRequest,
+) (*internal.Room, error) {
+	expiresAt, err := roomExpiry(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var hash []byte
+	if req.Password != "" {
+		hash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	room, err := s.roomRepo.AddRoom(ctx, roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	room.ClaimOwner(userID)
+	if hash != nil {
+		room.Protect(hash)
+	}
+	if !expiresAt.IsZero() {
+		room.Expire(expiresAt)
+	}
+
+	return room, nil
+}
+
+// checkRoomPassword lets user into protected room only with the right password. Service accounts are trusted
+func (s *PeerMessenger) checkRoomPassword(room *internal.Room, userID, password string) error {
+	hash := room.PasswordHash()
+	if hash == nil || isServiceAccount(userID) {
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		return ErrWrongRoomPassword
+	}
+
+	return nil
+}
+
+// Heartbeat keeps the user online in the room or marks it away
+func (s *PeerMessenger) Heartbeat(_ context.Context, userID string, req models.PresenceRequest) error {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	return room.Heartbeat(userID, req.Status)
+}
+
+// Beat records liveness heartbeat of the member, see RunLivenessSweep
+func (s *PeerMessenger) Beat(_ context.Context, userID, roomName string) (models.LivenessResponse, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return models.LivenessResponse{}, err
+	}
+
+	err = room.Beat(userID)
+	if err != nil {
+		return models.LivenessResponse{}, err
+	}
+
+	return models.LivenessResponse{WindowMs: s.opts.Room.LivenessWindow.Milliseconds()}, nil
+}
+
+// RunLivenessSweep removes members who stopped sending liveness heartbeats until ctx is cancelled.
+// It checks several times per window, so they are gone soon after the window ends
+func (s *PeerMessenger) RunLivenessSweep(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Room.LivenessWindow / livenessChecksPerWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, lapsed := range s.roomRepo.RemoveLapsed(now) {
+				s.logger.Info("audit: lapsed user left room", zap.String("room", lapsed.Room), zap.String("user", lapsed.UserID))
+				s.adminEvents.Publish(AdminEventUserLeft, lapsed.Room, lapsed.UserID)
+				s.observeRoom(lapsed.Room)
+			}
+		}
+	}
+}
+
+// SetTopology records how the member connects to others and returns which peer connections it opens
+func (s *PeerMessenger) SetTopology(
+	_ context.Context, userID, roomName string, req models.TopologyRequest,
+) (models.TopologyHints, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return models.TopologyHints{}, err
+	}
+
+	return room.SetTopology(userID, req.Topology)
+}
+
+// TopologyHints returns which peer connections the member opens in the room
+func (s *PeerMessenger) TopologyHints(_ context.Context, userID, roomName string) (models.TopologyHints, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return models.TopologyHints{}, err
+	}
+
+	return room.TopologyHints(userID)
+}
+
+// Presence returns status of every member of the room, only members may see it
+func (s *PeerMessenger) Presence(_ context.Context, userID, roomName string) ([]models.MemberPresence, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !room.HasUser(userID) {
+		return nil, internal.ErrUserNotInRoom
+	}
+
+	return room.Presence(), nil
+}
+
+// EntryForm returns the questions to answer when joining the room, asked before joining,
+// so membership is not required. Rooms without a form return no fields
+func (s *PeerMessenger) EntryForm(_ context.Context, roomName string) (models.EntryForm, error) {
+	room, err := s.roomRepo.Get(roomName)
+	if err != nil {
+		return models.EntryForm{}, err
+	}
+
+	form := room.EntryForm()
+	if form == nil {
+		return models.EntryForm{Fields: []models.EntryField{}}, nil
+	}
+
+	return *form, nil
+}
+
+// Members lists room members page by page. Only members of the room may list it
+func (s *PeerMessenger) Members(_ context.Context, userID string, req models.MembersRequest) (models.MembersResponse, error) {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return models.MembersResponse{}, err
+	}
+
+	if !room.HasUser(userID) {
+		return models.MembersResponse{}, internal.ErrUserNotInRoom
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(req.Cursor)
+	if err != nil {
+		return models.MembersResponse{}, ErrInvalidCursor
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultMembersPageSize
+	}
+
+	members, total := room.Members(string(after), limit)
+
+	resp := models.MembersResponse{
+		Members: members,
+		Total:   total,
+	}
+	if len(members) == limit {
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(members[len(members)-1]))
+	}
+
+	return resp, nil
+}
+
+// LeaveChannel detaches the session from the room, the user leaves it with its last session
+func (s *PeerMessenger) LeaveChannel(_ context.Context, userID, sessionID string, req models.ChannelRequest) error {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	left, err := room.LeaveSession(userID, sessionID)
+	if err != nil || !left {
+		return err
+	}
+
+	s.logger.Info("audit: user left room", zap.String("room", req.ChannelName), zap.String("user", userID))
+	s.adminEvents.Publish(AdminEventUserLeft, req.ChannelName, userID)
+	s.observeRoom(req.ChannelName)
+
+	return nil
+}
+
+// LeaveAll removes user from every room closing all its subscriptions and returns names of the rooms left
+func (s *PeerMessenger) LeaveAll(ctx context.Context, userID string) []string {
+	rooms := s.roomRepo.RemoveUser(ctx, userID)
+	s.logger.Info("audit: user left all rooms", zap.String("user", userID), zap.Strings("rooms", rooms))
+	for _, roomName := range rooms {
+		s.adminEvents.Publish(AdminEventUserLeft, roomName, userID)
+		s.observeRoom(roomName)
+	}
+
+	return rooms
+}
+
+// Logout ends the session of the request, the device leaves its rooms. Tokens without session can't be revoked,
+// so for them logout only makes sure no memberships linger until inactivity cleanup
+func (s *PeerMessenger) Logout(ctx context.Context, userID, sessionID string) []string {
+	if sessionID != "" {
+		err := s.sessions.revoke(userID, sessionID)
+		if err != nil {
+			s.logger.Warn("session is not revoked", zap.String("user", userID), zap.Error(err))
+		}
+
+		rooms := s.leaveSession(ctx, userID, sessionID)
+		s.logger.Info("audit: user logged out",
+			zap.String("user", userID), zap.String("session", sessionID), zap.Strings("rooms", rooms),
+		)
+
+		return rooms
+	}
+
+	rooms := s.LeaveAll(ctx, userID)
+
+	s.logger.Info("audit: user logged out", zap.String("user", userID), zap.Strings("rooms", rooms))
+
+	return rooms
+}
+
+// Subscribe returns the stream of events for the subscription. Events channel is closed when user leaves the room.
+// Non-zero lastEventID is the last entity received by the previous connection, entities after it are put into Replay
+// followed by messages from the inbox that did not fit into the queue
+func (s *PeerMessenger) Subscribe(
+	ctx context.Context, subscriptionID string, lastEventID uint64,
+) (_ *Subscription, err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.Subscribe")
+	defer func() { tracing.End(span, err) }()
+
+	sub, err := s.parseSubscriptionID(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.subscribe(ctx, sub, lastEventID)
+}
+
+// Resume is Subscribe authorized by single-use resume token instead of subscriptionID
+func (s *PeerMessenger) Resume(ctx context.Context, resumeToken string, lastEventID uint64) (_ *Subscription, err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.Resume")
+	defer func() { tracing.End(span, err) }()
+
+	sub, err := s.claimResumeToken(ctx, resumeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.subscribe(ctx, sub, lastEventID)
+}
+
+func (s *PeerMessenger) subscribe(ctx context.Context, sub subscriber, lastEventID uint64) (_ *Subscription, err error) {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.Room(sub.room), tracing.User(sub.userID))
+
+	roomKey, userID := sub.room, sub.userID
+	room, err := s.roomRepo.Get(roomKey)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := room.OpenStream(userID, sub.session)
+	if err != nil {
+		return nil, err
+	}
+	// reader of the device must not outlive the failed subscription, it would keep receiving entities
+	defer func() {
+		if err != nil {
+			room.CloseStream(userID, sub.session)
+		}
+	}()
+
+	var replay []models.ChannelEntity
+	if lastEventID > 0 {
+		replay, err = room.Replay(userID, lastEventID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	missed, err := room.TakeMissed(userID)
+	if err != nil {
+		return nil, err
+	}
+	replay = append(replay, missed...)
+
+	resumeToken, err := s.issueResumeToken(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscription{
+		Room:        roomKey,
+		UserID:      userID,
+		Events:      events,
+		Replay:      replay,
+		ResumeToken: resumeToken,
+		session:     sub.session,
+		room:        room,
+		service:     s,
+	}, nil
+}
+
+func (s *PeerMessenger) CollectMessages(_ context.Context, subscriptionID string) ([]models.ChannelEntity, error) {
+	sub, err := s.parseSubscriptionID(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.roomRepo.Get(sub.room)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := room.GetUserEventsSlice(sub.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logDeliveries(sub.room, sub.userID, entities)
+
+	return entities, nil
+}
+
+func (s *PeerMessenger) SendToPeer(ctx context.Context, userID string, req models.SendToPeerRequest) (err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.SendToPeer", tracing.Room(req.ChannelName), tracing.User(userID))
+	defer func() { tracing.End(span, err) }()
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	err = room.SendToUser(ctx, userID, req.DestinationUserID, req.Message, internal.SendOptions{
+		EchoToSender: req.EchoToSender,
+		Priority:     req.Priority,
+		MessageID:    req.MessageID,
+	})
+	outcome := "sent"
+	if err != nil {
+		outcome = "rejected"
+	}
+	s.metrics.SendToPeerDuration.WithLabelValues(outcome).Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		return err
+	}
+
+	s.messagesToday.inc(time.Now())
+
+	return nil
+}
+
+// SendBatch delivers messages of the batch in order and returns delivery errors per message, nil for delivered
+// ones and ones accepted by the room dispatcher. Rejected batches deliver nothing
+func (s *PeerMessenger) SendBatch(ctx context.Context, userID string, req models.SendBatchRequest) (_ []error, err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.SendBatch", tracing.Room(req.ChannelName), tracing.User(userID))
+	defer func() { tracing.End(span, err) }()
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]internal.BatchMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		batch = append(batch, internal.BatchMessage{
+			DestUserID: msg.DestinationUserID,
+			Data:       msg.Message,
+			Opts: internal.SendOptions{
+				EchoToSender: msg.EchoToSender,
+				Priority:     msg.Priority,
+				MessageID:    msg.MessageID,
+			},
+		})
+	}
+
+	startTime := time.Now()
+	errs, err := room.SendBatch(ctx, userID, batch)
+	outcome := "sent"
+	if err != nil {
+		outcome = "rejected"
+	}
+	s.metrics.SendToPeerDuration.WithLabelValues(outcome).Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, err := range errs {
+		if err == nil {
+			s.messagesToday.inc(now)
+		}
+	}
+
+	return errs, nil
+}
+
+// Signal relays typed signal checked against the negotiation state of the pair
+func (s *PeerMessenger) Signal(ctx context.Context, userID string, req models.SignalRequest) (err error) {
+	ctx, span := tracing.Start(ctx, "PeerMessenger.Signal",
+		tracing.Room(req.ChannelName), tracing.User(userID), attribute.String("type", string(req.Type)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	err = room.Signal(ctx, userID, req)
+	if err != nil {
+		return err
+	}
+
+	s.messagesToday.inc(time.Now())
+
+	return nil
+}
+
+// ReceiveForwarded delivers message sent on another instance. Messages for users not connected to this instance
+// are skipped, the instance that has them delivers them
+func (s *PeerMessenger) ReceiveForwarded(msg bus.Message) {
+	room, err := s.roomRepo.Get(msg.Room)
+	if err == nil {
+		err = room.DeliverForwarded(context.Background(), msg)
+	}
+	if err != nil && !errors.Is(err, internal.ErrRoomNotExist) && !errors.Is(err, internal.ErrUserNotInRoom) {
+		s.logger.Warn("forwarded message is not delivered",
+			zap.String("room", msg.Room), zap.String("user", msg.UserID), zap.Error(err),
+		)
+	}
+}
+
+// AdoptRoom takes over the room handed over by the instance shutting down, its members resume their streams here
+func (s *PeerMessenger) AdoptRoom(handoff bus.Handoff) {
+	s.roomRepo.Adopt(handoff)
+	s.observeRoom(handoff.Room)
+
+	s.logger.Info("room adopted from another instance",
+		zap.String("room", handoff.Room), zap.Int("members", len(handoff.Members)),
+	)
+}
+
+// AckMessage sends read receipt for the message to its sender
+func (s *PeerMessenger) AckMessage(ctx context.Context, userID string, req models.AckRequest) error {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	return room.Ack(ctx, userID, req.SenderUserID, req.MessageID)
+}
+
+// RemoveRoom deletes the room on behalf of its owner or moderator, members are told the room is deleted.
+// Like joining, deleting the protected room requires its password, unless the caller joined with it
+func (s *PeerMessenger) RemoveRoom(ctx context.Context, userID string, req models.RemoveRoomRequest) error {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	if !room.HasUser(userID) {
+		err = s.checkRoomPassword(room, userID, req.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !room.CanManage(userID) {
+		return internal.ErrNotModerator
+	}
+
+	s.roomRepo.RemoveRoom(ctx, req.ChannelName, "deleted by user")
+	s.adminEvents.Publish(AdminEventRoomRemoved, req.ChannelName, "")
+	s.observeRoom(req.ChannelName)
+
+	s.logger.Info("audit: room deleted", zap.String("room", req.ChannelName), zap.String("user", userID))
+
+	return nil
+}
+
+// Shutdown hands rooms over to other instances, if there are any, then tells all subscribers to reconnect
+// and closes their subscriptions. Farewell of every session carries a fresh resume token, so pollers and streams
+// with a stale token can resume on the instance they reconnect to
+func (s *PeerMessenger) Shutdown(ctx context.Context) {
+	const reason = "shutdown"
+
+	s.roomRepo.Drain(ctx, reason, func(roomName, userID, session string) map[string]any {
+		data := map[string]any{"reason": reason}
+
+		resumeToken, err := s.issueResumeToken(subscriber{room: roomName, userID: userID, session: session})
+		if err != nil {
+			s.logger.Warn("resume token is not issued on shutdown",
+				zap.String("room", roomName), zap.String("user", userID), zap.Error(err),
+			)
+			return data
+		}
+		data["resumeToken"] = resumeToken
+
+		return data
+	})
+}
+
+// ReportConnectionState accepts peer connection state reported by a room member and accounts failures
+func (s *PeerMessenger) ReportConnectionState(_ context.Context, userID string, req models.ConnectionStateRequest) error {
+	err := s.statsLimits.admit(userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	if !room.HasUser(userID) {
+		return internal.ErrUserNotInRoom
+	}
+
+	if req.State != models.ConnectionFailed {
+		return nil
+	}
+
+	room.RecordConnectionFailure(req.FailureStage)
+
+	s.logger.Info(
+		"peer connection failed",
+		zap.String("room", req.ChannelName),
+		zap.String("user", userID),
+		zap.String("peer", req.PeerUserID),
+		zap.String("stage", string(req.FailureStage)),
+	)
+
+	return nil
+}
+
+// CollectResolution records stream resolution of a room member in the room histogram. Reports are limited
+// per user and accepted from members only, so a misbehaving client can't flood the room distribution
+func (s *PeerMessenger) CollectResolution(_ context.Context, userID string, req models.ResolutionRequest) error {
+	err := s.statsLimits.admit(userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	room, err := s.roomRepo.Get(req.RoomName)
+	if err != nil {
+		return err
+	}
+
+	if !room.HasUser(userID) {
+		return internal.ErrUserNotInRoom
+	}
+
+	s.metrics.StreamResolution.WithLabelValues(req.RoomName).Observe(float64(req.Height))
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// MovePointer records the shared pointer position of a room member, see RunPointerFlush
+func (s *PeerMessenger) MovePointer(_ context.Context, userID string, req models.PointerRequest) error {
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	return room.MovePointer(userID, req)
+}
+
+// RunPointerFlush publishes coalesced pointer positions every PointerInterval until ctx is cancelled
+func (s *PeerMessenger) RunPointerFlush(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.PointerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.roomRepo.FlushPointers()
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnknownRegion = errors.New("region is unknown")
+
+// RegionRedirectError tells the transport to redirect client to the instance serving the requested region
+type RegionRedirectError struct {
+	Region string
+	URL    string
+}
+
+func (e *RegionRedirectError) Error() string {
+	return fmt.Sprintf("room is pinned to region %q served by %s", e.Region, e.URL)
+}
+
+// checkRegion allows operations on rooms of the local region only. Empty region means any
+func (s *PeerMessenger) checkRegion(region string) error {
+	if region == "" || region == s.opts.Region {
+		return nil
+	}
+
+	url, ok := s.opts.RegionURLs[region]
+	if !ok {
+		return ErrUnknownRegion
+	}
+
+	return &RegionRedirectError{Region: region, URL: url}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/models"
+)
+
+const reasonRoomExpired = "room expired"
+
+// roomExpiry returns when the room created by the join expires, zero if it does not
+func roomExpiry(req models.JoinChannelRequest, now time.Time) (time.Time, error) {
+	switch {
+	case req.TTLSeconds > 0:
+		return now.Add(time.Duration(req.TTLSeconds) * time.Second), nil
+	case req.ExpiresAt != nil:
+		if !req.ExpiresAt.After(now) {
+			return time.Time{}, ErrExpiryInPast
+		}
+		return *req.ExpiresAt, nil
+	default:
+		return time.Time{}, nil
+	}
+}
+
+// closeExpiredRooms warns members of rooms expiring within RoomExpiryGrace and closes the rooms on expiry.
+// Rooms found after their expiry, when cleanup ran late, are closed at once
+func (s *PeerMessenger) closeExpiredRooms(now time.Time) {
+	for _, expiring := range s.roomRepo.AnnounceExpiring(now.Add(s.opts.RoomExpiryGrace)) {
+		room, roomName := expiring.Room, expiring.Name
+		s.logger.Info("audit: room closing",
+			zap.String("room", roomName), zap.Time("closes at", expiring.ClosesAt), zap.String("reason", reasonRoomExpired),
+		)
+
+		time.AfterFunc(expiring.ClosesAt.Sub(now), func() {
+			if s.roomRepo.RemoveRoomInstance(context.Background(), room, reasonRoomExpired) {
+				s.roomRemoved(roomName)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// serviceAccountPrefix marks IDs of service accounts, regular users can't take such IDs
+const serviceAccountPrefix = "svc:"
+
+var (
+	ErrReservedUserID     = errors.New("user ID is reserved for service accounts")
+	ErrNotServiceAccount  = errors.New("operation is allowed only for service accounts")
+	ErrServiceAccountName = errors.New("service account already exists")
+)
+
+// serviceAccounts keeps bot identities authenticated by random tokens
+type serviceAccounts struct {
+	byToken map[string]string
+	ids     map[string]struct{}
+	mux     *sync.RWMutex
+}
+
+func newServiceAccounts() *serviceAccounts {
+	return &serviceAccounts{
+		byToken: make(map[string]string),
+		ids:     make(map[string]struct{}),
+		mux:     &sync.RWMutex{},
+	}
+}
+
+func (a *serviceAccounts) create(name string) (id, token string, err error) {
+	raw := make([]byte, 32)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	id = serviceAccountPrefix + name
+	token = hex.EncodeToString(raw)
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if _, ok := a.ids[id]; ok {
+		return "", "", ErrServiceAccountName
+	}
+
+	a.ids[id] = struct{}{}
+	a.byToken[token] = id
+
+	return id, token, nil
+}
+
+func (a *serviceAccounts) byTokenID(token string) (string, bool) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	id, ok := a.byToken[token]
+	return id, ok
+}
+
+func isServiceAccount(userID string) bool {
+	return strings.HasPrefix(userID, serviceAccountPrefix)
+}
+
+// CreateServiceAccount registers a bot identity. The returned token is shown only once
+func (s *PeerMessenger) CreateServiceAccount(
+	_ context.Context, req models.ServiceAccountRequest,
+) (models.ServiceAccountResponse, error) {
+	id, token, err := s.serviceAccounts.create(req.Name)
+	if err != nil {
+		return models.ServiceAccountResponse{}, err
+	}
+
+	return models.ServiceAccountResponse{UserID: id, Token: token}, nil
+}
+
+// Broadcast sends control message from service account to every member of the room. Membership is not required
+func (s *PeerMessenger) Broadcast(_ context.Context, userID string, req models.BroadcastRequest) error {
+	if !isServiceAccount(userID) {
+		return ErrNotServiceAccount
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	room.Broadcast(userID, models.Control, req.Message)
+	s.messagesToday.inc(time.Now())
+
+	return nil
+}
+
+// PublishCaption relays transcription segment from service account to room members who opted in to captions
+func (s *PeerMessenger) PublishCaption(_ context.Context, userID string, req models.CaptionRequest) error {
+	if !isServiceAccount(userID) {
+		return ErrNotServiceAccount
+	}
+
+	room, err := s.roomRepo.Get(req.ChannelName)
+	if err != nil {
+		return err
+	}
+
+	return room.PublishCaption(userID, map[string]any{
+		"speakerID": req.SpeakerID,
+		"sequence":  req.Sequence,
+		"text":      req.Text,
+		"final":     req.Final,
+		"language":  req.Language,
+	})
+}
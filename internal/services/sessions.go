@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/authn"
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/users"
+)
+
+var (
+	ErrSessionNotExist = errors.New("session does not exist")
+	ErrLegacyToken     = errors.New("token without session is no longer accepted, log in again")
+)
+
+// session is a login of the user. The token authenticates requests, the ID is public and names the session
+// in the list of the user's devices
+type session struct {
+	models.Session
+	userID string
+	token  string
+}
+
+// sessions keeps logins in memory, so users log in again after restart
+type sessions struct {
+	byToken map[string]*session
+	byID    map[string]*session
+	mux     *sync.RWMutex
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		byToken: make(map[string]*session),
+		byID:    make(map[string]*session),
+		mux:     &sync.RWMutex{},
+	}
+}
+
+func (ss *sessions) create(userID, device, ip string, ttl time.Duration) (*session, error) {
+	raw := make([]byte, 40)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	created := &session{
+		Session: models.Session{
+			ID:        hex.EncodeToString(raw[:8]),
+			Device:    device,
+			IP:        ip,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		},
+		userID: userID,
+		token:  hex.EncodeToString(raw[8:]),
+	}
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	ss.byToken[created.token] = created
+	ss.byID[created.ID] = created
+
+	return created, nil
+}
+
+// byTokenID returns the live session authenticated by token
+func (ss *sessions) byTokenID(token string, now time.Time) (*session, bool) {
+	ss.mux.RLock()
+	defer ss.mux.RUnlock()
+
+	found, ok := ss.byToken[token]
+	if !ok || now.After(found.ExpiresAt) {
+		return nil, false
+	}
+
+	return found, true
+}
+
+// list returns live sessions of the user, the newest first
+func (ss *sessions) list(userID string, now time.Time) []models.Session {
+	ss.mux.RLock()
+	defer ss.mux.RUnlock()
+
+	out := make([]models.Session, 0)
+	for _, found := range ss.byID {
+		if found.userID == userID && !now.After(found.ExpiresAt) {
+			out = append(out, found.Session)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+
+	return out
+}
+
+// revoke ends the session of the user. Sessions of other users are reported as not existing
+func (ss *sessions) revoke(userID, id string) error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	found, ok := ss.byID[id]
+	if !ok || found.userID != userID {
+		return ErrSessionNotExist
+	}
+
+	delete(ss.byID, id)
+	delete(ss.byToken, found.token)
+
+	return nil
+}
+
+// prune forgets expired sessions
+func (ss *sessions) prune(now time.Time) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	for id, found := range ss.byID {
+		if now.After(found.ExpiresAt) {
+			delete(ss.byID, id)
+			delete(ss.byToken, found.token)
+		}
+	}
+}
+
+// Login checks credentials and starts a session on the device. Every login gets its own session,
+// so the same user on two devices receives events on both
+func (s *PeerMessenger) Login(
+	ctx context.Context, client models.ClientInfo, req models.LoginRequest,
+) (models.LoginResponse, error) {
+	if isServiceAccount(req.UserID) {
+		return models.LoginResponse{}, ErrReservedUserID
+	}
+
+	identity, err := s.local.Authenticate(ctx, req.UserID, req.Password)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	device := req.Device
+	if device == "" {
+		device = client.UserAgent
+	}
+
+	return s.startSession(identity, device, client)
+}
+
+// startSession logs in the user authenticated by a provider
+func (s *PeerMessenger) startSession(
+	identity authn.Identity, device string, client models.ClientInfo,
+) (models.LoginResponse, error) {
+	created, err := s.sessions.create(identity.UserID, device, client.IP, s.opts.SessionTTL)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	s.logger.Info("audit: user logged in",
+		zap.String("user", identity.UserID), zap.String("provider", identity.Provider),
+		zap.String("session", created.ID), zap.String("ip", client.IP),
+	)
+
+	return models.LoginResponse{Token: created.token, SessionID: created.ID, ExpiresAt: created.ExpiresAt}, nil
+}
+
+// Authenticate extracts user ID from the token and checks that such user is registered
+func (s *PeerMessenger) Authenticate(token string) (string, error) {
+	userID, _, err := s.AuthenticateSession(token)
+	return userID, err
+}
+
+// AuthenticateSession resolves token to the user and its session. Service accounts and tokens issued
+// before sessions have no session, the latter are accepted until LegacyTokensUntil
+func (s *PeerMessenger) AuthenticateSession(token string) (userID, sessionID string, err error) {
+	if id, ok := s.serviceAccounts.byTokenID(token); ok {
+		return id, "", nil
+	}
+
+	if found, ok := s.sessions.byTokenID(token, time.Now()); ok {
+		return found.userID, found.ID, nil
+	}
+
+	// tokens issued before sessions are forgeable by design, they are recognized only while salt is configured
+	if len(s.salt) == 0 {
+		return "", "", ErrInvalidToken
+	}
+
+	userID, ok := strings.CutSuffix(token, string(s.salt))
+	if !ok || userID == "" {
+		return "", "", ErrInvalidToken
+	}
+
+	if s.opts.LegacyTokensUntil.IsZero() || time.Now().After(s.opts.LegacyTokensUntil) {
+		return "", "", ErrLegacyToken
+	}
+
+	_, err = s.users.Get(context.Background(), userID)
+	if errors.Is(err, users.ErrUserNotFound) {
+		return "", "", ErrUserNotExist
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return userID, "", nil
+}
+
+// Sessions lists live logins of the user, current marks the one of the request
+func (s *PeerMessenger) Sessions(_ context.Context, userID, current string) []models.Session {
+	list := s.sessions.list(userID, time.Now())
+	for i := range list {
+		list[i].Current = list[i].ID == current
+	}
+
+	return list
+}
+
+// RevokeSession logs the user out on the device of the session. The device leaves its rooms,
+// the user stays in rooms joined from other devices
+func (s *PeerMessenger) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	err := s.sessions.revoke(userID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	rooms := s.leaveSession(ctx, userID, sessionID)
+
+	s.logger.Info("audit: session revoked",
+		zap.String("user", userID), zap.String("session", sessionID), zap.Strings("rooms left", rooms),
+	)
+
+	return nil
+}
+
+// leaveSession detaches the session from every room and returns the rooms the user left entirely
+func (s *PeerMessenger) leaveSession(ctx context.Context, userID, sessionID string) []string {
+	rooms := s.roomRepo.LeaveSession(ctx, userID, sessionID)
+	for _, roomName := range rooms {
+		s.adminEvents.Publish(AdminEventUserLeft, roomName, userID)
+		s.observeRoom(roomName)
+	}
+
+	return rooms
+}
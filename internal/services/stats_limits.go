@@ -0,0 +1,67 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// statsReportRate and statsReportBurst limit how often a single session may report resolution,
+	// network stats and connection states together. Clients report every few seconds, bursts come on reconnects
+	statsReportRate  = rate.Limit(2)
+	statsReportBurst = 10
+	// statsIdleTimeout is after how long idle sessions are forgotten, by then their bucket is full anyway
+	statsIdleTimeout = time.Minute
+)
+
+var ErrStatsThrottled = errors.New("stats are reported too often")
+
+type statsSession struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// statsLimits bounds stats reported by each session, so a single client can't flood the metrics
+type statsLimits struct {
+	sessions map[string]*statsSession
+	mux      *sync.Mutex
+}
+
+func newStatsLimits() *statsLimits {
+	return &statsLimits{
+		sessions: make(map[string]*statsSession),
+		mux:      &sync.Mutex{},
+	}
+}
+
+func (l *statsLimits) admit(userID string, now time.Time) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	session, ok := l.sessions[userID]
+	if !ok {
+		session = &statsSession{limiter: rate.NewLimiter(statsReportRate, statsReportBurst)}
+		l.sessions[userID] = session
+	}
+	session.lastSeen = now
+
+	if !session.limiter.AllowN(now, 1) {
+		return ErrStatsThrottled
+	}
+
+	return nil
+}
+
+func (l *statsLimits) prune(now time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for userID, session := range l.sessions {
+		if now.Sub(session.lastSeen) >= statsIdleTimeout {
+			delete(l.sessions, userID)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/replay"
+	"peer-messenger/internal/subscription"
+)
+
+// resumeTokenKind labels rejected replays of resume tokens
+const resumeTokenKind = "resume"
+
+// subscriber is the stream owner named by subscriptionID or resume token: the user's session in the room
+type subscriber struct {
+	room    string
+	userID  string
+	session string
+}
+
+func (s *PeerMessenger) parseSubscriptionID(subscriptionID string) (subscriber, error) {
+	roomKey, userID, session, err := s.subscriptions.Decode(subscriptionID)
+	if errors.Is(err, subscription.ErrLegacy) {
+		return s.parseLegacySubscriptionID(subscriptionID)
+	}
+	if err != nil {
+		return subscriber{}, ErrInvalidSubscriptionID
+	}
+
+	return subscriber{room: roomKey, userID: userID, session: session}, nil
+}
+
+// parseLegacySubscriptionID accepts unsigned "room__user" IDs until the configured end of the deprecation window.
+// Anyone can build them for another user, so they are rejected when no end is configured
+func (s *PeerMessenger) parseLegacySubscriptionID(subscriptionID string) (subscriber, error) {
+	until := s.opts.LegacySubscriptionIDsUntil
+	if until.IsZero() || time.Now().After(until) {
+		s.metrics.LegacySubscriptionIDs.WithLabelValues("rejected").Inc()
+		return subscriber{}, ErrLegacySubscriptionID
+	}
+
+	roomKey, userID, err := subscription.DecodeLegacy(subscriptionID)
+	if err != nil {
+		return subscriber{}, ErrInvalidSubscriptionID
+	}
+
+	s.metrics.LegacySubscriptionIDs.WithLabelValues("accepted").Inc()
+	s.logger.Warn("legacy subscriptionID used", zap.String("room", roomKey), zap.String("user", userID))
+
+	return subscriber{room: roomKey, userID: userID}, nil
+}
+
+// issueResumeToken signs single-use token resuming the stream of the subscriber within ResumeTokenTTL
+func (s *PeerMessenger) issueResumeToken(sub subscriber) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return s.subscriptions.EncodeResume(subscription.Resume{
+		RoomKey: sub.room,
+		UserID:  sub.userID,
+		Session: sub.session,
+		ID:      base64.RawURLEncoding.EncodeToString(id),
+		Expires: time.Now().Add(s.opts.ResumeTokenTTL),
+	}), nil
+}
+
+// claimResumeToken verifies resume token and marks it used, so the captured token can't open another stream
+func (s *PeerMessenger) claimResumeToken(ctx context.Context, token string) (subscriber, error) {
+	resume, err := s.subscriptions.DecodeResume(token)
+	if errors.Is(err, subscription.ErrExpired) {
+		return subscriber{}, ErrResumeTokenExpired
+	}
+	if err != nil {
+		return subscriber{}, ErrInvalidResumeToken
+	}
+
+	err = s.replays.Claim(ctx, resume.ID, resume.Expires)
+	if errors.Is(err, replay.ErrReplayed) {
+		s.metrics.ReplayedTokens.WithLabelValues(resumeTokenKind).Inc()
+		s.logger.Warn("resume token replayed", zap.String("room", resume.RoomKey), zap.String("user", resume.UserID))
+
+		return subscriber{}, ErrTokenReplayed
+	}
+	if err != nil {
+		return subscriber{}, err
+	}
+
+	return subscriber{room: resume.RoomKey, userID: resume.UserID, session: resume.Session}, nil
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Quotas are soft limits the usage is reported against. 0 means unlimited
+type Quotas struct {
+	Rooms           int
+	ConcurrentUsers int
+	MessagesPerDay  int
+	HistoryBytes    int
+}
+
+// UsageItem is the consumption of a single resource. Quota is omitted when the resource is unlimited
+type UsageItem struct {
+	Used  int `json:"used"`
+	Quota int `json:"quota,omitempty"`
+}
+
+// Usage is the current consumption of the instance against its quotas
+type Usage struct {
+	Rooms           UsageItem `json:"rooms"`
+	ConcurrentUsers UsageItem `json:"concurrentUsers"`
+	// MessagesToday counts peer messages and broadcasts since UTC midnight
+	MessagesToday UsageItem `json:"messagesToday"`
+	HistoryBytes  UsageItem `json:"historyBytes"`
+	Day           string    `json:"day"`
+}
+
+// dailyCounter counts events of the current UTC day
+type dailyCounter struct {
+	day   string
+	count int
+	mux   *sync.Mutex
+}
+
+func newDailyCounter() *dailyCounter {
+	return &dailyCounter{
+		mux: &sync.Mutex{},
+	}
+}
+
+func (d *dailyCounter) inc(now time.Time) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.rollover(now)
+	d.count++
+}
+
+func (d *dailyCounter) get(now time.Time) (string, int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.rollover(now)
+
+	return d.day, d.count
+}
+
+func (d *dailyCounter) rollover(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day != d.day {
+		d.day = day
+		d.count = 0
+	}
+}
+
+// TenantUsage reports consumption against soft quotas, so integrating applications can warn before limits bite
+func (s *PeerMessenger) TenantUsage(_ context.Context) Usage {
+	rooms, users := s.roomRepo.Summary()
+	day, messages := s.messagesToday.get(time.Now())
+
+	return Usage{
+		Rooms:           UsageItem{Used: rooms, Quota: s.opts.Quotas.Rooms},
+		ConcurrentUsers: UsageItem{Used: users, Quota: s.opts.Quotas.ConcurrentUsers},
+		MessagesToday:   UsageItem{Used: messages, Quota: s.opts.Quotas.MessagesPerDay},
+		HistoryBytes:    UsageItem{Used: s.roomRepo.HistoryBytes(), Quota: s.opts.Quotas.HistoryBytes},
+		Day:             day,
+	}
+}
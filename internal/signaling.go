@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"peer-messenger/internal/models"
+)
+
+var ErrSignalingState = errors.New("signal is not allowed in the current negotiation state")
+
+// negotiationPair is the unordered pair of members, a is the lesser id
+type negotiationPair struct {
+	a, b string
+}
+
+func newNegotiationPair(userA, userB string) negotiationPair {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+
+	return negotiationPair{a: userA, b: userB}
+}
+
+// negotiation is the offer/answer state of a pair. The pair is stable when offerer is empty
+type negotiation struct {
+	// offerer is the member whose offer waits for the answer
+	offerer string
+	// started is set by the first offer, candidates before it have no description to belong to
+	started bool
+}
+
+// negotiations tracks offer/answer exchange of typed signals between members of the room,
+// so glare and answers to nothing are rejected by the server instead of breaking peer connections
+type negotiations struct {
+	pairs map[negotiationPair]negotiation
+	mux   *sync.Mutex
+}
+
+func newNegotiations() *negotiations {
+	return &negotiations{
+		pairs: make(map[negotiationPair]negotiation),
+		mux:   &sync.Mutex{},
+	}
+}
+
+// apply moves negotiation of the pair by the signal from src to dest. Undo restores the previous state
+// when the signal is not delivered after all. Actions other than signals do not change the state
+func (n *negotiations) apply(src, dest string, action models.ActionType) (undo func(), err error) {
+	undo = func() {}
+	if !action.IsSignal() {
+		return undo, nil
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	pair := newNegotiationPair(src, dest)
+	previous := n.pairs[pair]
+	next := previous
+
+	switch action {
+	case models.Offer:
+		// the same side may replace its own pending offer, e.g. with ICE restart
+		if previous.offerer == dest {
+			return undo, fmt.Errorf("%w: offer of %s is pending, answer it or wait", ErrSignalingState, dest)
+		}
+		next = negotiation{offerer: src, started: true}
+	case models.Answer:
+		if previous.offerer != dest {
+			return undo, fmt.Errorf("%w: no pending offer from %s to answer", ErrSignalingState, dest)
+		}
+		next.offerer = ""
+	case models.ICECandidate:
+		if !previous.started {
+			return undo, fmt.Errorf("%w: candidate before the first offer", ErrSignalingState)
+		}
+	case models.Renegotiate:
+		if previous.offerer != "" {
+			return undo, fmt.Errorf("%w: offer of %s is pending", ErrSignalingState, previous.offerer)
+		}
+	}
+
+	n.pairs[pair] = next
+
+	return func() {
+		n.mux.Lock()
+		defer n.mux.Unlock()
+
+		if _, ok := n.pairs[pair]; ok {
+			n.pairs[pair] = previous
+		}
+	}, nil
+}
+
+// forget drops state of pairs with the user who left the room, a new session negotiates from scratch
+func (n *negotiations) forget(userID string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	for pair := range n.pairs {
+		if pair.a == userID || pair.b == userID {
+			delete(n.pairs, pair)
+		}
+	}
+}
+
+// Signal relays typed signal to the destination member. Payload is carried the same way as in peer messages,
+// so message type policy, rate limits and SDP linting apply to signals too.
+// Signals to members connected to other instances are not checked against the negotiation state
+func (r *Room) Signal(ctx context.Context, srcUserID string, req models.SignalRequest) error {
+	data := map[string]any{}
+	switch req.Type {
+	case models.Offer, models.Answer:
+		data["messageType"] = string(req.Type)
+		data["sdp"] = req.SDP
+	case models.ICECandidate:
+		data["messageType"] = models.MessageTypeCandidate
+		data["candidate"] = req.Candidate.Candidate
+		if req.Candidate.SDPMid != nil {
+			data["sdpMid"] = *req.Candidate.SDPMid
+		}
+		if req.Candidate.SDPMLineIndex != nil {
+			data["sdpMLineIndex"] = *req.Candidate.SDPMLineIndex
+		}
+	case models.Renegotiate:
+		data["messageType"] = models.MessageTypeRenegotiate
+	}
+	if req.ICERestart {
+		data["iceRestart"] = true
+	}
+	if req.Reason != "" {
+		data["reason"] = req.Reason
+	}
+
+	err := r.SendToUser(ctx, srcUserID, req.DestinationUserID, data, SendOptions{
+		ActionType: req.Type,
+		Priority:   models.PriorityHigh,
+		MessageID:  req.MessageID,
+	})
+
+	outcome := "relayed"
+	if err != nil {
+		outcome = "rejected"
+	}
+	r.metrics.SignalingMessages.WithLabelValues(r.name, string(req.Type), outcome).Inc()
+
+	return err
+}
@@ -0,0 +1,182 @@
+// Package subscription encodes and parses subscriptionIDs handed out to clients on channel join
+// and single-use tokens resuming the event stream
+package subscription
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signedPrefix = "v1."
+	resumePrefix = "r1."
+)
+
+var (
+	ErrInvalid = errors.New("subscriptionID is invalid")
+	ErrLegacy  = errors.New("subscriptionID has legacy format")
+	ErrExpired = errors.New("resume token is expired")
+)
+
+var (
+	encoding            = base64.RawURLEncoding
+	legacyKeysExtractor = regexp.MustCompile(`[^_]+`)
+)
+
+// Codec issues and verifies signed subscriptionIDs of form "v1.<room>.<user>.<mac>" with base64url encoded parts.
+// IDs issued to a login session carry it as "v1.<room>.<user>.<session>.<mac>"
+type Codec struct {
+	secret []byte
+}
+
+func NewCodec(secret []byte) *Codec {
+	return &Codec{secret: secret}
+}
+
+// Encode issues subscriptionID, session is left out when empty
+func (c *Codec) Encode(roomKey, userID, session string) string {
+	payload := encoding.EncodeToString([]byte(roomKey)) + "." + encoding.EncodeToString([]byte(userID))
+	if session != "" {
+		payload += "." + encoding.EncodeToString([]byte(session))
+	}
+
+	return signedPrefix + payload + "." + encoding.EncodeToString(c.mac(payload))
+}
+
+// Decode parses signed subscriptionID. IDs without signed prefix are reported with ErrLegacy
+func (c *Codec) Decode(subscriptionID string) (roomKey, userID, session string, err error) {
+	signed, ok := strings.CutPrefix(subscriptionID, signedPrefix)
+	if !ok {
+		return "", "", "", ErrLegacy
+	}
+
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", "", "", ErrInvalid
+	}
+
+	last := len(parts) - 1
+	mac, err := encoding.DecodeString(parts[last])
+	if err != nil || !hmac.Equal(mac, c.mac(strings.Join(parts[:last], "."))) {
+		return "", "", "", ErrInvalid
+	}
+
+	decoded := make([]string, last)
+	for i, part := range parts[:last] {
+		value, err := encoding.DecodeString(part)
+		if err != nil {
+			return "", "", "", ErrInvalid
+		}
+		decoded[i] = string(value)
+	}
+
+	if last == 3 {
+		session = decoded[2]
+	}
+
+	return decoded[0], decoded[1], session, nil
+}
+
+func (c *Codec) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+// Resume is the content of a single-use token resuming the event stream of the user
+type Resume struct {
+	RoomKey string
+	UserID  string
+	// Session is the login the stream belongs to, empty for tokens without session
+	Session string
+	// ID is unique per token, used tokens are remembered by it
+	ID      string
+	Expires time.Time
+}
+
+// EncodeResume issues token of form "r1.<room>.<user>.<id>.<expires>.<mac>", expires are unix seconds.
+// Session, if any, goes before the mac. ID must be base64url encoded
+func (c *Codec) EncodeResume(resume Resume) string {
+	payload := resumePrefix +
+		encoding.EncodeToString([]byte(resume.RoomKey)) + "." +
+		encoding.EncodeToString([]byte(resume.UserID)) + "." +
+		resume.ID + "." +
+		strconv.FormatInt(resume.Expires.Unix(), 10)
+	if resume.Session != "" {
+		payload += "." + encoding.EncodeToString([]byte(resume.Session))
+	}
+
+	return payload + "." + encoding.EncodeToString(c.mac(payload))
+}
+
+// DecodeResume verifies resume token. Tokens past their expiry are reported with ErrExpired
+func (c *Codec) DecodeResume(token string) (Resume, error) {
+	signed, ok := strings.CutPrefix(token, resumePrefix)
+	if !ok {
+		return Resume{}, ErrInvalid
+	}
+
+	parts := strings.Split(signed, ".")
+	if len(parts) != 5 && len(parts) != 6 {
+		return Resume{}, ErrInvalid
+	}
+
+	last := len(parts) - 1
+	mac, err := encoding.DecodeString(parts[last])
+	if err != nil || !hmac.Equal(mac, c.mac(resumePrefix+strings.Join(parts[:last], "."))) {
+		return Resume{}, ErrInvalid
+	}
+
+	var session []byte
+	if last == 5 {
+		session, err = encoding.DecodeString(parts[4])
+		if err != nil {
+			return Resume{}, ErrInvalid
+		}
+	}
+
+	room, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return Resume{}, ErrInvalid
+	}
+
+	user, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return Resume{}, ErrInvalid
+	}
+
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return Resume{}, ErrInvalid
+	}
+
+	resume := Resume{
+		RoomKey: string(room),
+		UserID:  string(user),
+		Session: string(session),
+		ID:      parts[2],
+		Expires: time.Unix(expires, 0),
+	}
+	if !time.Now().Before(resume.Expires) {
+		return Resume{}, ErrExpired
+	}
+
+	return resume, nil
+}
+
+// DecodeLegacy parses unsigned "room__user" subscriptionID
+func DecodeLegacy(subscriptionID string) (roomKey, userID string, err error) {
+	keys := legacyKeysExtractor.FindAllString(subscriptionID, 2)
+	if len(keys) < 2 {
+		return "", "", ErrInvalid
+	}
+
+	return keys[0], keys[1], nil
+}
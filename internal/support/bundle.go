@@ -0,0 +1,104 @@
+package support
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Redacted replaces secret values in config snapshots
+const Redacted = "[REDACTED]"
+
+// Bundle collects server diagnostics into a zip archive to attach to bug reports
+type Bundle struct {
+	logs     *LogRing
+	config   any
+	gatherer prometheus.Gatherer
+	state    func() any
+}
+
+// NewBundle creates bundle from its sources. config must already have secrets replaced with Redacted,
+// state is called on each bundle creation to dump current rooms
+func NewBundle(logs *LogRing, config any, gatherer prometheus.Gatherer, state func() any) *Bundle {
+	return &Bundle{
+		logs:     logs,
+		config:   config,
+		gatherer: gatherer,
+		state:    state,
+	}
+}
+
+func (b *Bundle) WriteZip(w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{name: "logs.jsonl", write: b.writeLogs},
+		{name: "config.json", write: b.writeConfig},
+		{name: "rooms.json", write: b.writeState},
+		{name: "goroutines.txt", write: writeGoroutines},
+		{name: "metrics.txt", write: b.writeMetrics},
+	}
+
+	for _, file := range files {
+		fw, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		err = file.write(fw)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", file.name, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+func (b *Bundle) writeLogs(w io.Writer) error {
+	_, err := b.logs.WriteTo(w)
+	return err
+}
+
+func (b *Bundle) writeConfig(w io.Writer) error {
+	return writeJSON(w, b.config)
+}
+
+func (b *Bundle) writeState(w io.Writer) error {
+	return writeJSON(w, b.state())
+}
+
+func (b *Bundle) writeMetrics(w io.Writer) error {
+	families, err := b.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		err = encoder.Encode(family)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeGoroutines(w io.Writer) error {
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
@@ -0,0 +1,62 @@
+package support
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// LogRing keeps last written log lines in memory. It implements zapcore.WriteSyncer
+type LogRing struct {
+	lines [][]byte
+	next  int
+	full  bool
+	mux   *sync.Mutex
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{
+		lines: make([][]byte, size),
+		mux:   &sync.Mutex{},
+	}
+}
+
+// Write stores p as one log line. zap writes every entry with a single call
+func (r *LogRing) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.lines[r.next] = bytes.Clone(p)
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	return len(p), nil
+}
+
+func (r *LogRing) Sync() error {
+	return nil
+}
+
+// WriteTo writes stored lines from the oldest to the newest
+func (r *LogRing) WriteTo(w io.Writer) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	ordered := r.lines[:r.next]
+	if r.full {
+		ordered = append(r.lines[r.next:len(r.lines):len(r.lines)], r.lines[:r.next]...)
+	}
+
+	var total int64
+	for _, line := range ordered {
+		n, err := w.Write(line)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
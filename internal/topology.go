@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"sort"
+	"time"
+
+	"peer-messenger/internal/models"
+)
+
+// SetTopology records how the user connects to others and returns its hints. Other members are told
+// when the topology has changed, so mesh peers open or drop connections to the user
+func (r *Room) SetTopology(userID string, topology models.Topology) (models.TopologyHints, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return models.TopologyHints{}, ErrUserNotInRoom
+	}
+
+	if info.topology != topology {
+		info.topology = topology
+		if !info.silent {
+			r.publish(models.ChannelEntity{
+				Time:       time.Now(),
+				ActionType: models.TopologyChanged,
+				UserID:     userID,
+				Data:       r.compact(map[string]any{"topology": topology}),
+			})
+		}
+	}
+
+	return r.topologyHints(info), nil
+}
+
+// TopologyHints returns which peer connections the user opens in the room
+func (r *Room) TopologyHints(userID string) (models.TopologyHints, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	info, ok := r.userInfos[userID]
+	if !ok {
+		return models.TopologyHints{}, ErrUserNotInRoom
+	}
+
+	return r.topologyHints(info), nil
+}
+
+// topologyHints splits mesh peers of the user by join order: the user answers those who joined earlier
+// and offers to those who joined later, which is also what connection plans tell joiners. Must be called under lock
+func (r *Room) topologyHints(info *userInfo) models.TopologyHints {
+	hints := models.TopologyHints{Topology: info.topology, OfferTo: []string{}, AnswerFrom: []string{}}
+	if info.topology != models.TopologyMesh || info.silent {
+		return hints
+	}
+
+	for _, peerID := range r.meshPeers(info.id) {
+		if joinedBefore(r.userInfos[peerID], info) {
+			hints.AnswerFrom = append(hints.AnswerFrom, peerID)
+		} else {
+			hints.OfferTo = append(hints.OfferTo, peerID)
+		}
+	}
+
+	return hints
+}
+
+// meshPeers returns mesh members other than the user ordered by join time. Must be called under lock
+func (r *Room) meshPeers(userID string) []string {
+	peers := make([]string, 0, len(r.userInfos))
+	for peerID, info := range r.userInfos {
+		if peerID != userID && !info.silent && info.topology == models.TopologyMesh {
+			peers = append(peers, peerID)
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return joinedBefore(r.userInfos[peers[i]], r.userInfos[peers[j]])
+	})
+
+	return peers
+}
+
+// joinedBefore orders members by join time, members joined at the same time by user ID, so both sides
+// of a pair agree on the order
+func joinedBefore(a, b *userInfo) bool {
+	if !a.joinTime.Equal(b.joinTime) {
+		return a.joinTime.Before(b.joinTime)
+	}
+
+	return a.id < b.id
+}
@@ -0,0 +1,95 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps users in memory and rewrites the whole JSON file on every registration.
+// Fits small deployments, bigger ones should plug in a database backed Store
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// OpenFileStore loads users from the file at path. Missing file is treated as empty store
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = json.Unmarshal(raw, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		store.users[user.ID] = user
+	}
+
+	return store, nil
+}
+
+func (s *FileStore) Create(_ context.Context, user User) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.users[user.ID]; ok {
+		return ErrUserExists
+	}
+
+	s.users[user.ID] = user
+
+	err := s.save()
+	if err != nil {
+		delete(s.users, user.ID)
+		return err
+	}
+
+	return nil
+}
+
+// save writes all users to a temporary file and renames it over the store file. Must be called under lock
+func (s *FileStore) save() error {
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+
+	raw, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
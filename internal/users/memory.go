@@ -0,0 +1,44 @@
+package users
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps users in memory, they are lost on restart
+type MemoryStore struct {
+	users map[string]User
+	mux   *sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users: make(map[string]User),
+		mux:   &sync.RWMutex{},
+	}
+}
+
+func (s *MemoryStore) Create(_ context.Context, user User) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.users[user.ID]; ok {
+		return ErrUserExists
+	}
+
+	s.users[user.ID] = user
+
+	return nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, id string) (User, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return user, nil
+}
@@ -0,0 +1,35 @@
+// Package users keeps registered users and their password hashes
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+type User struct {
+	ID string `json:"id"`
+	// PasswordHash is nil for users created by identity providers, they can't log in with a password
+	PasswordHash []byte    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// Provider and Subject identify the user at the identity provider the user was created by,
+	// both are empty for users registered with a password
+	Provider string `json:"provider,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	// Language and Timezone are optional user preferences, see models.Locale
+	Language string `json:"language,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Store persists registered users. Implementations must be safe for concurrent use
+type Store interface {
+	// Create adds the user, ErrUserExists is returned if user with the same ID is already registered
+	Create(ctx context.Context, user User) error
+	// Get returns the user by ID or ErrUserNotFound
+	Get(ctx context.Context, id string) (User, error)
+}
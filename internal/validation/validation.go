@@ -0,0 +1,205 @@
+// Package validation builds the validator shared by request DTOs and registers custom rules:
+//
+//	roomname     room name of 1-64 letters, digits, '-', '_' or '.', starting with a letter or digit
+//	messagetype  type known to the message type registry
+//	mapdepth=N   nesting of maps and arrays within JSON object is at most N, the object itself is 1
+//	mapsize=N    JSON object holds at most N keys and array items in total, nested ones included
+package validation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+
+	"peer-messenger/internal/models"
+	"peer-messenger/internal/msgtype"
+)
+
+var roomNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// New returns validator with custom rules registered. Field names in errors are taken from json or form tags.
+// Peer messages are checked against types registry
+func New(types *msgtype.Registry) *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(tagName)
+
+	mustRegister(validate, "roomname", func(fl validator.FieldLevel) bool {
+		return roomNameRegexp.MatchString(fl.Field().String())
+	})
+	mustRegister(validate, "messagetype", func(fl validator.FieldLevel) bool {
+		_, ok := types.Lookup(fl.Field().String())
+		return ok
+	})
+	mustRegister(validate, "mapdepth", func(fl validator.FieldLevel) bool {
+		return withinDepth(fl.Field().Interface(), intParam(fl))
+	})
+	mustRegister(validate, "mapsize", func(fl validator.FieldLevel) bool {
+		limit := intParam(fl)
+		return countItems(fl.Field().Interface(), limit) <= limit
+	})
+
+	validate.RegisterStructValidation(sendToPeerValidation(types), models.SendToPeerRequest{}, models.BatchMessage{})
+
+	return validate
+}
+
+// sendToPeerValidation checks the message against its type: type must be allowed by the registry,
+// fields required by the type must be set and optional binary payload must be base64 encoded.
+// Messages of batches are checked the same way
+func sendToPeerValidation(types *msgtype.Registry) validator.StructLevelFunc {
+	return func(sl validator.StructLevel) {
+		switch req := sl.Current().Interface().(type) {
+		case models.SendToPeerRequest:
+			validateMessage(sl, types, req.Message)
+		case models.BatchMessage:
+			validateMessage(sl, types, req.Message)
+		}
+	}
+}
+
+func validateMessage(sl validator.StructLevel, types *msgtype.Registry, message map[string]any) {
+	rawType, ok := message["messageType"]
+	if !ok {
+		return
+	}
+
+	messageType, ok := rawType.(string)
+	if !ok || !types.Allowed(messageType) {
+		sl.ReportError(rawType, "message.messageType", "Message", "messagetype", "")
+		return
+	}
+
+	for _, field := range types.Resolve(messageType).MissingFields(message) {
+		sl.ReportError(message[field], "message."+field, "Message", "required", "")
+	}
+
+	if payload, ok := message["payload"]; ok {
+		encoded, _ := payload.(string)
+		_, err := base64.StdEncoding.DecodeString(encoded)
+		if encoded == "" || err != nil {
+			sl.ReportError(payload, "message.payload", "Message", "base64", "")
+		}
+	}
+}
+
+func mustRegister(validate *validator.Validate, tag string, fn validator.Func) {
+	err := validate.RegisterValidation(tag, fn)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// intParam parses rule parameter, malformed parameter is a programming error like in builtin rules
+func intParam(fl validator.FieldLevel) int {
+	n, err := strconv.Atoi(fl.Param())
+	if err != nil {
+		panic("validation: bad parameter of " + fl.GetTag() + ": " + fl.Param())
+	}
+
+	return n
+}
+
+func tagName(field reflect.StructField) string {
+	for _, key := range []string{"json", "form"} {
+		name, _, _ := strings.Cut(field.Tag.Get(key), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+
+	return field.Name
+}
+
+// withinDepth reports whether nesting of v does not exceed limit. It stops descending once the limit is crossed
+func withinDepth(v any, limit int) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		if limit < 1 {
+			return false
+		}
+		for _, item := range v {
+			if !withinDepth(item, limit-1) {
+				return false
+			}
+		}
+	case []any:
+		if limit < 1 {
+			return false
+		}
+		for _, item := range v {
+			if !withinDepth(item, limit-1) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// countItems counts keys and array items of v, nested included. Counting stops as soon as limit is exceeded
+func countItems(v any, limit int) int {
+	count := 0
+	switch v := v.(type) {
+	case map[string]any:
+		for _, item := range v {
+			count++
+			if count > limit {
+				return count
+			}
+			count += countItems(item, limit-count)
+		}
+	case []any:
+		for _, item := range v {
+			count++
+			if count > limit {
+				return count
+			}
+			count += countItems(item, limit-count)
+		}
+	}
+
+	return count
+}
+
+// ruleType is reported for JSON values of the wrong type, its param is the expected Go type
+const ruleType = "type"
+
+// FieldError is a single failed rule of a request field
+type FieldError struct {
+	// Field is the path of the field in the request, e.g. "message.sdp"
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+// Fields lists failed rules of err, nil if err is not a validation error. JSON values of the wrong type,
+// which fail decoding before validation, are reported as the field failing the type rule
+func Fields(err error) []FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []FieldError{{Field: typeErr.Field, Rule: ruleType, Param: typeErr.Type.String()}}
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+
+	fields := make([]FieldError, 0, len(validationErrs))
+	for _, fe := range validationErrs {
+		// namespace starts with the struct type name which means nothing to clients
+		_, field, _ := strings.Cut(fe.Namespace(), ".")
+		fields = append(fields, FieldError{Field: field, Rule: fe.Tag(), Param: fe.Param()})
+	}
+
+	return fields
+}
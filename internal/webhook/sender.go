@@ -0,0 +1,83 @@
+// Package webhook delivers JSON notifications to an external HTTP endpoint in the background
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queueSize      = 100
+	requestTimeout = 5 * time.Second
+)
+
+// Sender posts payloads to the URL one by one. Send never blocks, payloads are dropped when the queue is full
+type Sender struct {
+	url    string
+	log    *zap.Logger
+	client *http.Client
+	queue  chan any
+}
+
+func NewSender(url string, log *zap.Logger) *Sender {
+	return &Sender{
+		url:    url,
+		log:    log,
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan any, queueSize),
+	}
+}
+
+func (s *Sender) Send(payload any) {
+	select {
+	case s.queue <- payload:
+	default:
+		s.log.Warn("webhook queue is full, notification dropped", zap.Any("payload", payload))
+	}
+}
+
+// Run delivers queued payloads until ctx is cancelled
+func (s *Sender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-s.queue:
+			err := s.post(ctx, payload)
+			if err != nil {
+				s.log.Error("failed to deliver webhook", zap.Error(err), zap.Any("payload", payload))
+			}
+		}
+	}
+}
+
+func (s *Sender) post(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
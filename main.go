@@ -1,109 +1,67 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"context"
 	"log"
-	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
+	// room and user time zones must resolve on images without system tz database
+	_ "time/tzdata"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
-	"peer-messenger/internal/handlers"
-	"peer-messenger/internal/metrics"
+	"peer-messenger/internal/config"
+	"peer-messenger/internal/di"
+	"peer-messenger/internal/support"
 )
 
+const logRingSize = 1000
+
 func main() {
-	logger, err := NewZap()
+	logRing := support.NewLogRing(logRingSize)
+
+	logger, logLevel, err := NewZap(logRing)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	validate := validator.New()
-
-	prom := metrics.New()
-
-	handler := handlers.NewPeerMessenger(logger, validate, prom)
-
-	engine := gin.New()
-
-	engine.Use(func(c *gin.Context) {
-		c.Next()
-		for _, err := range c.Errors {
-			logger.Error("got post process error", zap.Error(err))
-		}
-	})
-
-	corsConfig := cors.DefaultConfig()
-	corsConfig.AllowAllOrigins = true
-	corsConfig.AllowHeaders = append(corsConfig.AllowHeaders, "Authorization")
-	engine.Use(cors.New(corsConfig))
-
-	engine.Use(func(c *gin.Context) {
-		startTime := time.Now()
-
-		c.Next()
-
-		prom.RPS.WithLabelValues(c.Request.URL.Path).Inc()
-		prom.RequestDuration.WithLabelValues(c.Request.URL.Path).Observe(time.Since(startTime).Seconds())
-	})
-
-	engine.Use(func(c *gin.Context) {
-		reqBodyCopy := &bytes.Buffer{}
-		_, err = io.Copy(reqBodyCopy, c.Request.Body)
-		if err != nil {
-			logger.Error("can't copy request body", zap.Error(err))
-			c.Abort()
-			return
-		}
-
-		c.Request.Body = io.NopCloser(reqBodyCopy)
-		logger.Info("Request received", zap.String("path", c.Request.URL.Path), zap.String("body", reqBodyCopy.String()))
-
-		c.Next()
-		logger.Info("Request processed", zap.String("path", c.Request.URL.Path))
-	})
-
-	engine.GET("/ping", func(c *gin.Context) {
-		c.JSON(http.StatusOK, map[string]string{"info": "pong"})
-	})
-
-	engine.POST("/register", handler.Register)
-	engine.POST("/login", handler.Login)
-	engine.POST("/channel/join", handler.JoinChannel)
-	engine.POST("channel/leave", handler.LeaveChannel)
-	engine.GET("/channel/subscribe", handler.Subscribe)
-	engine.POST("/channel/collect", handler.CollectMessages)
-	engine.POST("/peer/send", handler.SendToPeer)
-	engine.DELETE("/room/delete", handler.RemoveRoom)
-	engine.POST("/metrics/resolution", handler.CollectResolution)
-
-	metricsEngine := gin.New()
-	metricsEngine.Any("/metrics", gin.WrapH(
-		promhttp.HandlerFor(prom.Reg, promhttp.HandlerOpts{Registry: prom.Reg})),
-	)
-	metricsEngine.Any("/", gin.WrapH(
-		promhttp.HandlerFor(prom.Reg, promhttp.HandlerOpts{Registry: prom.Reg})),
-	)
-	go func() {
-		err := metricsEngine.Run(":9090")
-		if err != nil {
-			logger.Error("ERROR FROM METRICS ENGINE")
-		}
-	}()
-
-	err = engine.Run(":8080")
+	// CONFIG_FILE points to optional YAML config, environment variables override it
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		logger.Fatal("cannot load config", zap.Error(err))
+	}
+
+	container, err := di.New(cfg, logger, logLevel, logRing)
+	if err != nil {
+		logger.Fatal("cannot build application", zap.Error(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err = container.Lifecycle.Start(ctx)
+	if err != nil {
+		logger.Fatal("cannot start application", zap.Error(err))
+	}
+
+	<-ctx.Done()
+
+	logger.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	err = container.Lifecycle.Stop(shutdownCtx)
 	if err != nil {
-		logger.Error("cannot start gin engine", zap.Error(err))
+		logger.Error("cannot gracefully shutdown", zap.Error(err))
 	}
 }
 
-func NewZap() (*zap.Logger, error) {
+// NewZap builds the logger and returns its level, which can be changed at runtime.
+// Log entries are duplicated to ring to be included in support bundles
+func NewZap(ring *support.LogRing) (*zap.Logger, zap.AtomicLevel, error) {
 	encoderConfig := zap.NewProductionEncoderConfig()
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
@@ -114,10 +72,13 @@ func NewZap() (*zap.Logger, error) {
 	level := zapcore.DebugLevel
 	logConfig.Level.SetLevel(level)
 
-	coreLogger, err := logConfig.Build()
+	coreLogger, err := logConfig.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		ringCore := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), ring, logConfig.Level)
+		return zapcore.NewTee(core, ringCore)
+	}))
 	if err != nil {
-		return nil, err
+		return nil, zap.AtomicLevel{}, err
 	}
 
-	return coreLogger, nil
+	return coreLogger, logConfig.Level, nil
 }
@@ -0,0 +1,69 @@
+// Package server runs the whole peer messenger in process: the API engine with every middleware and route,
+// and the background workers behind it. It lets tests and embedders serve it with httptest or their own
+// http.Server, without listening on the configured addresses
+package server
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"peer-messenger/internal/config"
+	"peer-messenger/internal/di"
+	"peer-messenger/internal/lifecycle"
+	"peer-messenger/internal/support"
+)
+
+// logRingSize is the number of log entries kept for support bundles
+const logRingSize = 1000
+
+// Config is the application configuration, see config.example.yaml for its keys
+type Config = config.Config
+
+// DefaultConfig returns the configuration the binary runs with when nothing overrides it
+func DefaultConfig() Config {
+	return config.Default()
+}
+
+// Server is the running application. Engine serves the public API, admin routes are there when admin token is set
+type Server struct {
+	*gin.Engine
+	lifecycle *lifecycle.Lifecycle
+}
+
+// New is NewWithLogger discarding logs
+func New(cfg Config) (*Server, error) {
+	return NewWithLogger(cfg, zap.NewNop())
+}
+
+// NewWithLogger wires the application and starts its background workers. Addresses of the api, metrics
+// and gRPC servers are ignored: the embedder serves Engine, metrics are served by it at /metrics.
+// Call Close to stop the workers and release files and connections
+func NewWithLogger(cfg Config, logger *zap.Logger) (*Server, error) {
+	cfg.HTTP.APIAddr = ""
+	cfg.HTTP.MetricsAddr = ""
+	cfg.HTTP.GRPCAddr = ""
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := di.New(cfg, logger, zap.NewAtomicLevel(), support.NewLogRing(logRingSize))
+	if err != nil {
+		return nil, err
+	}
+
+	err = container.Lifecycle.Start(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{Engine: container.Engine, lifecycle: container.Lifecycle}, nil
+}
+
+// Close closes subscriptions and stops background workers, requests served after it are not guaranteed to work
+func (s *Server) Close(ctx context.Context) error {
+	return s.lifecycle.Stop(ctx)
+}
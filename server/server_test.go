@@ -0,0 +1,421 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"peer-messenger/server"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the whole messenger with the default configuration, closed when the test ends
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv, err := server.New(server.DefaultConfig())
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Close(ctx)
+		if err != nil {
+			t.Errorf("close server: %v", err)
+		}
+	})
+
+	return ts
+}
+
+// call sends the JSON body with the token and decodes the JSON response into out, if given
+func call(t *testing.T, ts *httptest.Server, method, path, token string, body any, out any) *http.Response {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+
+	return resp
+}
+
+// login registers the user and returns the token of a new session
+func login(t *testing.T, ts *httptest.Server, userID string) string {
+	t.Helper()
+
+	credentials := map[string]string{"userID": userID, "password": "password-" + userID}
+
+	resp := call(t, ts, http.MethodPost, "/register", "", credentials, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register %s: status %d", userID, resp.StatusCode)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	resp = call(t, ts, http.MethodPost, "/login", "", credentials, &session)
+	if resp.StatusCode != http.StatusOK || session.Token == "" {
+		t.Fatalf("login %s: status %d, token %q", userID, resp.StatusCode, session.Token)
+	}
+
+	return session.Token
+}
+
+type joinResponse struct {
+	SubscriptionID string `json:"subscriptionID"`
+	ResumeToken    string `json:"resumeToken"`
+	MemberCount    int    `json:"memberCount"`
+}
+
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Fields  []struct {
+		Field string `json:"field"`
+		Rule  string `json:"rule"`
+		Param string `json:"param"`
+	} `json:"fields"`
+}
+
+// sseEvent is one event of the stream, data is joined from its data lines
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// readEvents parses the event stream into the channel until the body ends or ctx is done
+func readEvents(ctx context.Context, body *bufio.Scanner, events chan<- sseEvent) {
+	defer close(events)
+
+	var ev sseEvent
+	for body.Scan() {
+		line := body.Text()
+		if line == "" {
+			if ev.event != "" || ev.data != "" {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			ev = sseEvent{}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.event = value
+		case "data":
+			if ev.data != "" {
+				ev.data += "\n"
+			}
+			ev.data += value
+		}
+	}
+}
+
+func TestJoinBothRouteStyles(t *testing.T) {
+	ts := newTestServer(t)
+	alice := login(t, ts, "alice")
+	bob := login(t, ts, "bob")
+
+	var aliceJoin joinResponse
+	resp := call(t, ts, http.MethodPost, "/channels/room-1/join", alice, nil, &aliceJoin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("join via /channels/:name/join: status %d", resp.StatusCode)
+	}
+	if aliceJoin.SubscriptionID == "" || aliceJoin.ResumeToken == "" || aliceJoin.MemberCount != 1 {
+		t.Fatalf("join via /channels/:name/join: unexpected response %+v", aliceJoin)
+	}
+	if resp.Header.Get("Deprecation") != "" {
+		t.Errorf("/channels/:name/join is marked deprecated")
+	}
+
+	var bobJoin joinResponse
+	resp = call(t, ts, http.MethodPost, "/channel/join", bob, map[string]string{"channelName": "room-1"}, &bobJoin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("join via /channel/join: status %d", resp.StatusCode)
+	}
+	if bobJoin.SubscriptionID == "" || bobJoin.MemberCount != 2 {
+		t.Fatalf("join via /channel/join: unexpected response %+v", bobJoin)
+	}
+	if resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("/channel/join is not marked deprecated")
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, "/channels/{name}/join") {
+		t.Errorf("/channel/join links to %q instead of its successor", link)
+	}
+}
+
+func TestMessageDelivery(t *testing.T) {
+	ts := newTestServer(t)
+	alice := login(t, ts, "alice")
+	bob := login(t, ts, "bob")
+
+	var aliceJoin, bobJoin joinResponse
+	call(t, ts, http.MethodPost, "/channels/room-1/join", alice, nil, &aliceJoin)
+	call(t, ts, http.MethodPost, "/channels/room-1/join", bob, nil, &bobJoin)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		ts.URL+"/channels/room-1/events?subscriptionID="+bobJoin.SubscriptionID, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	stream, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer stream.Body.Close()
+
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe: status %d", stream.StatusCode)
+	}
+	if contentType := stream.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		t.Fatalf("subscribe: content type %q", contentType)
+	}
+
+	events := make(chan sseEvent)
+	go readEvents(ctx, bufio.NewScanner(stream.Body), events)
+
+	// the handshake comes first, so the message is sent after the stream is open
+	first := <-events
+	if first.event != "time" {
+		t.Fatalf("first event is %q, not the time handshake", first.event)
+	}
+
+	send := map[string]any{
+		"channelName":       "room-1",
+		"destinationUserID": "bob",
+		"message":           map[string]any{"text": "hello"},
+	}
+	resp := call(t, ts, http.MethodPost, "/peer/send", alice, send, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send to bob: status %d", resp.StatusCode)
+	}
+
+	for message := false; !message; {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended before the message")
+			}
+			if ev.event != "message" {
+				continue
+			}
+
+			var entity struct {
+				UserID string         `json:"userID"`
+				Data   map[string]any `json:"data"`
+			}
+			err = json.Unmarshal([]byte(ev.data), &entity)
+			if err != nil {
+				t.Fatalf("decode message event %q: %v", ev.data, err)
+			}
+			if entity.UserID == "alice" && entity.Data["text"] == "hello" {
+				message = true
+			}
+		case <-ctx.Done():
+			t.Fatalf("message event is not received")
+		}
+	}
+
+	send["destinationUserID"] = "alice"
+	send["message"] = map[string]any{"text": "hi"}
+	resp = call(t, ts, http.MethodPost, "/peer/send", bob, send, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("send to alice: status %d", resp.StatusCode)
+	}
+
+	// messages are delivered by the room dispatcher, so collect until the message is there
+	for {
+		var collected struct {
+			Entities []struct {
+				UserID string         `json:"userID"`
+				Data   map[string]any `json:"data"`
+			} `json:"entities"`
+		}
+		resp = call(t, ts, http.MethodPost, "/channel/collect?subscriptionID="+aliceJoin.SubscriptionID, alice, nil,
+			&collected)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("collect: status %d", resp.StatusCode)
+		}
+
+		for _, entity := range collected.Entities {
+			if entity.UserID == "bob" && entity.Data["text"] == "hi" {
+				return
+			}
+		}
+
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("message is not collected")
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newTestServer(t)
+	alice := login(t, ts, "alice")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   any
+		status int
+		code   string
+		field  string
+		rule   string
+	}{
+		{
+			name:   "short password",
+			method: http.MethodPost,
+			path:   "/register",
+			body:   map[string]string{"userID": "bob", "password": "short"},
+			status: http.StatusBadRequest,
+			code:   "INVALID_REQUEST",
+			field:  "password",
+			rule:   "min",
+		},
+		{
+			name:   "wrong password",
+			method: http.MethodPost,
+			path:   "/login",
+			body:   map[string]string{"userID": "alice", "password": "wrong-password"},
+			status: http.StatusUnauthorized,
+			code:   "INVALID_CREDENTIALS",
+		},
+		{
+			name:   "join without token",
+			method: http.MethodPost,
+			path:   "/channels/room-1/join",
+			status: http.StatusUnauthorized,
+			code:   "UNAUTHORIZED",
+		},
+		{
+			name:   "join without room name",
+			method: http.MethodPost,
+			path:   "/channel/join",
+			token:  alice,
+			body:   map[string]string{},
+			status: http.StatusBadRequest,
+			code:   "INVALID_REQUEST",
+			field:  "channelName",
+			rule:   "required",
+		},
+		{
+			name:   "collect without subscription",
+			method: http.MethodPost,
+			path:   "/channel/collect",
+			token:  alice,
+			status: http.StatusBadRequest,
+			code:   "INVALID_REQUEST",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body errorResponse
+			resp := call(t, ts, tt.method, tt.path, tt.token, tt.body, &body)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code %q, want %q", body.Code, tt.code)
+			}
+			if body.Message == "" {
+				t.Errorf("message is empty")
+			}
+
+			if tt.field == "" {
+				if len(body.Fields) != 0 {
+					t.Errorf("unexpected fields %+v", body.Fields)
+				}
+				return
+			}
+			if len(body.Fields) != 1 || body.Fields[0].Field != tt.field || body.Fields[0].Rule != tt.rule {
+				t.Errorf("fields %+v, want %s failing %s", body.Fields, tt.field, tt.rule)
+			}
+		})
+	}
+}
+
+func TestRemoveRoom(t *testing.T) {
+	ts := newTestServer(t)
+	alice := login(t, ts, "alice")
+	bob := login(t, ts, "bob")
+
+	call(t, ts, http.MethodPost, "/channels/room-1/join", alice, nil, nil)
+	call(t, ts, http.MethodPost, "/channels/room-1/join", bob, nil, nil)
+
+	var body errorResponse
+	resp := call(t, ts, http.MethodDelete, "/channels/room-1", bob, nil, &body)
+	if resp.StatusCode != http.StatusForbidden || body.Code != "NOT_MODERATOR" {
+		t.Fatalf("member deleting the room: status %d, code %q", resp.StatusCode, body.Code)
+	}
+
+	// the creator owns the room, the deprecated alias lets the owner delete it like the successor does
+	resp = call(t, ts, http.MethodDelete, "/room/delete", alice, map[string]string{"channelName": "room-1"}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("creator deleting the room via /room/delete: status %d", resp.StatusCode)
+	}
+
+	resp = call(t, ts, http.MethodDelete, "/channels/room-1", alice, nil, &body)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleting the deleted room: status %d, code %q", resp.StatusCode, body.Code)
+	}
+}